@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// AlertLimiter - Caps how often each rule is logged and alerted about, so a
+// rule matching on every chunk of a busy connection doesn't flood the log or
+// the Notifier. Every rule gets a token bucket holding Rate tokens that
+// refills over a minute; a match that finds it empty is only counted, and
+// the count is reported with the rule's next alert. Matches are still
+// recorded, and drop still blocks, whatever the limit. One AlertLimiter is
+// usually shared by all connections, it is safe for concurrent use.
+type AlertLimiter struct {
+	// Rate - How many alerts a rule may raise per minute
+	Rate int
+	// Clock - Defaults to the system clock
+	Clock Clock
+
+	mu    sync.Mutex
+	rules map[string]*alertBucket
+}
+
+// alertBucket - The tokens a rule has left, as of last, and the alerts held
+// back since it last had one
+type alertBucket struct {
+	tokens     float64
+	last       time.Time
+	suppressed uint64
+}
+
+// NewAlertLimiter - An AlertLimiter letting each rule raise rate alerts per
+// minute
+func NewAlertLimiter(rate int) *AlertLimiter {
+	return &AlertLimiter{Rate: rate}
+}
+
+// Allow - Take a token for rule, false when it has none left. When it does,
+// also the number of alerts suppressed since the rule's last one.
+func (l *AlertLimiter) Allow(rule string) (bool, uint64) {
+	clock := l.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	now := clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rules == nil {
+		l.rules = make(map[string]*alertBucket)
+	}
+	rate := float64(l.Rate)
+	b, ok := l.rules[rule]
+	if !ok {
+		b = &alertBucket{tokens: rate, last: now}
+		l.rules[rule] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += rate * elapsed.Minutes()
+		if b.tokens > rate {
+			b.tokens = rate
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		b.suppressed++
+		return false, 0
+	}
+	b.tokens--
+	suppressed := b.suppressed
+	b.suppressed = 0
+	return true, suppressed
+}
+
+// Suppressed - How many alerts of rule were held back since its last one
+func (l *AlertLimiter) Suppressed(rule string) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.rules[rule]; ok {
+		return b.suppressed
+	}
+	return 0
+}
+
+// allowAlert - Whether the proxy's AlertLimit lets match be alerted about,
+// and how many alerts of its rule were suppressed before it
+func (p *Proxy) allowAlert(match RuleMatch) (bool, uint64) {
+	if p.AlertLimit == nil {
+		return true, 0
+	}
+	return p.AlertLimit.Allow(match.Namespace + ":" + match.Rule)
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAlertLimit(t *testing.T) {
+	clock := newFakeClock()
+	limit := NewAlertLimiter(3)
+	limit.Clock = clock
+	alerts := make(recordingNotifier, 16)
+	var log bytes.Buffer
+	match := RuleMatch{Rule: "Flood", Namespace: "default", Tags: []string{"warn", "drop"}}
+
+	fire := func() *Proxy {
+		p := &Proxy{errsig: make(chan struct{}), Log: ColorLogger{Writer: &log}, Notifier: alerts, AlertLimit: limit}
+		p.handleMatch(match)
+		return p
+	}
+	for i := 0; i < 10; i++ {
+		if p := fire(); !p.stopping() || !strings.Contains(p.CloseReason(), "blocked") {
+			t.Fatalf("match %d: wanted the connection blocked whatever the alert limit, got %q", i, p.CloseReason())
+		}
+	}
+	if n := strings.Count(log.String(), "match found for rule Flood"); n != 3 {
+		t.Errorf("wanted 3 matches logged, got %d:\n%s", n, log.String())
+	}
+	if n := limit.Suppressed("default:Flood"); n != 7 {
+		t.Errorf("wanted 7 alerts suppressed, got %d", n)
+	}
+	for i := 0; i < 3; i++ {
+		if a := nextAlert(t, alerts); a.Suppressed != 0 {
+			t.Errorf("alert %d: wanted nothing suppressed yet, got %d", i, a.Suppressed)
+		}
+	}
+
+	// a third of a minute later the bucket has a token again
+	log.Reset()
+	clock.Advance(20 * time.Second)
+	fire()
+	if a := nextAlert(t, alerts); a.Suppressed != 7 {
+		t.Errorf("wanted the next alert to report 7 suppressed, got %d", a.Suppressed)
+	}
+	if !strings.Contains(log.String(), "7 alerts for rule Flood suppressed") {
+		t.Errorf("wanted the suppressed alerts summarised, got:\n%s", log.String())
+	}
+	if n := limit.Suppressed("default:Flood"); n != 0 {
+		t.Errorf("wanted the count reset once reported, got %d", n)
+	}
+	fire()
+	select {
+	case a := <-alerts:
+		t.Errorf("wanted the bucket empty again, got %+v", a)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// other rules have buckets of their own
+	other := match
+	other.Rule = "Other"
+	p := &Proxy{errsig: make(chan struct{}), Log: NullLogger{}, Notifier: alerts, AlertLimit: limit}
+	p.handleMatch(other)
+	if a := nextAlert(t, alerts); a.Rule != "Other" {
+		t.Errorf("wanted an alert for the other rule, got %+v", a)
+	}
+}
+
+func TestAlertLimiterConcurrent(t *testing.T) {
+	limit := NewAlertLimiter(5)
+	limit.Clock = newFakeClock()
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if ok, _ := limit.Allow("default:Flood"); ok {
+					atomic.AddInt32(&allowed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 5 || limit.Suppressed("default:Flood") != 795 {
+		t.Errorf("wanted 5 alerts allowed and 795 suppressed, got %d and %d", allowed, limit.Suppressed("default:Flood"))
+	}
+}
+
+func nextAlert(t *testing.T, alerts recordingNotifier) Alert {
+	t.Helper()
+	select {
+	case a := <-alerts:
+		return a
+	case <-time.After(2 * time.Second):
+		t.Fatal("notifier wasn't called")
+	}
+	return Alert{}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// benchConfig - An inspection setup to benchmark
+type benchConfig struct {
+	name  string
+	setup func(b *testing.B, p *Proxy)
+}
+
+// benchConfigs - The inspection setups benchmarked; yara_test.go adds yara
+// scanning in builds that have it
+var benchConfigs = []benchConfig{
+	{"passthrough", func(*testing.B, *Proxy) {}},
+	{"replacer", func(b *testing.B, p *Proxy) {
+		p.SetReplacers([]Replacer{&StringReplacer{"needle", "thread"}})
+	}},
+}
+
+// startPiped - Run a proxy between two in-memory pipes, returning the client
+// end, the remote end and a channel closed once the proxy stops
+func startPiped(b *testing.B, setup func(*testing.B, *Proxy)) (client, remote net.Conn, done chan struct{}) {
+	client, local := net.Pipe()
+	rconn, remote := net.Pipe()
+	p := NewConnected(local, rconn)
+	setup(b, p)
+	done = make(chan struct{})
+	go func() {
+		p.Start()
+		close(done)
+	}()
+	return client, remote, done
+}
+
+func BenchmarkThroughput(b *testing.B) {
+	chunk := make([]byte, 32*1024)
+	for _, cfg := range benchConfigs {
+		b.Run(cfg.name, func(b *testing.B) {
+			client, remote, done := startPiped(b, cfg.setup)
+			drained := make(chan struct{})
+			go func() {
+				io.Copy(ioutil.Discard, remote)
+				close(drained)
+			}()
+
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(chunk); err != nil {
+					b.Fatalf("write failed: %v", err)
+				}
+			}
+			b.StopTimer()
+			client.Close()
+			<-done
+			remote.Close()
+			<-drained
+		})
+	}
+}
+
+func BenchmarkRoundTrip(b *testing.B) {
+	msg := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	for _, cfg := range benchConfigs {
+		b.Run(cfg.name, func(b *testing.B) {
+			client, remote, done := startPiped(b, cfg.setup)
+			go io.Copy(remote, remote)
+
+			buf := make([]byte, len(msg))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(msg); err != nil {
+					b.Fatalf("write failed: %v", err)
+				}
+				if _, err := io.ReadFull(client, buf); err != nil {
+					b.Fatalf("read failed: %v", err)
+				}
+			}
+			b.StopTimer()
+			client.Close()
+			<-done
+			remote.Close()
+		})
+	}
+}
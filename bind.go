@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"net"
+	"time"
+)
+
+// defaultDialTimeout - How long connecting to the remote may take when
+// DialTimeout isn't set
+const defaultDialTimeout = 10 * time.Second
+
+// dialer - The dialer used for remote connections, applying BindDevice and
+// FWMark to the socket
+func (p *Proxy) dialer() *net.Dialer {
+	d := &net.Dialer{Timeout: p.dialTimeout()}
+	if p.BindDevice == "" && p.FWMark == 0 {
+		return d
+	}
+	control, err := bindControl(p.BindDevice, p.FWMark)
+	if err != nil {
+		p.Log.Warn("Ignoring bind device and fwmark: %s", err)
+		return d
+	}
+	d.Control = control
+	return d
+}
+
+func (p *Proxy) dialTimeout() time.Duration {
+	if p.DialTimeout <= 0 {
+		return defaultDialTimeout
+	}
+	return p.DialTimeout
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// bindControl - A net.Dialer Control function binding the socket to device
+// (SO_BINDTODEVICE) and setting its routing mark (SO_MARK), when given
+func bindControl(device string, mark int) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			if device != "" {
+				if err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device); err != nil {
+					serr = fmt.Errorf("failed to bind to device %s: %w", device, err)
+					return
+				}
+			}
+			if mark != 0 {
+				if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark); err != nil {
+					serr = fmt.Errorf("failed to set fwmark %d: %w", mark, err)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}, nil
+}
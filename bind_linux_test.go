@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestBindControl(t *testing.T) {
+	l := listenLocal(t)
+	defer l.Close()
+
+	p := New(nil, nil, nil)
+	p.BindDevice = "lo"
+	p.FWMark = 42
+	c, err := p.dialer().Dial("tcp", l.Addr().String())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting SO_BINDTODEVICE and SO_MARK needs CAP_NET_RAW and CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	var serr error
+	raw.Control(func(fd uintptr) {
+		mark, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+	})
+	if serr != nil {
+		t.Fatalf("failed to read SO_MARK: %v", serr)
+	}
+	if mark != 42 {
+		t.Errorf("wanted fwmark 42, got %d", mark)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// bindControl - Not supported on this platform
+func bindControl(device string, mark int) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, errors.New("binding to a device or fwmark is only supported on linux")
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import "fmt"
+
+// BlockAction - What happens to the client connection when a rule drops it
+type BlockAction string
+
+const (
+	// BlockClose - close the connection normally (the default)
+	BlockClose BlockAction = "close"
+	// BlockReset - reset the client connection, so it looks like the port
+	// is closed
+	BlockReset BlockAction = "reset"
+	// BlockRespond - send BlockResponse to the client, then close
+	BlockRespond BlockAction = "respond"
+)
+
+// ParseBlockAction - Validate a block action name, as given on the command
+// line
+func ParseBlockAction(s string) (BlockAction, error) {
+	switch a := BlockAction(s); a {
+	case "", BlockClose:
+		return BlockClose, nil
+	case BlockReset, BlockRespond:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown block action %q, expected close, reset or respond", s)
+}
+
+type setLingerer interface {
+	SetLinger(sec int) error
+}
+
+// block - Terminate the connection because of a rule match, as configured by
+// BlockAction
+func (p *Proxy) block(reason error) {
+	switch p.BlockAction {
+	case BlockReset:
+		if conn, ok := p.lconn.(setLingerer); ok {
+			if err := conn.SetLinger(0); err != nil {
+				p.Log.Warn("failed to set linger on client connection: %v", err)
+			}
+		}
+	case BlockRespond:
+		if len(p.BlockResponse) > 0 {
+			// the match may come from the upstream pipe, while the downstream
+			// one is writing to the client
+			p.clientWriteLock.Lock()
+			_, err := p.lconn.Write(p.BlockResponse)
+			p.clientWriteLock.Unlock()
+			if err != nil {
+				p.Log.Warn("failed to send block response: %v", err)
+			}
+		}
+	}
+	p.closeWith(fmt.Errorf("%w: %v", ErrRuleBlock, reason), "blocked: %v", reason)
+	p.err("dropping connection", reason)
+}
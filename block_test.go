@@ -0,0 +1,20 @@
+package proxy
+
+import "testing"
+
+func TestParseBlockAction(t *testing.T) {
+	for in, want := range map[string]BlockAction{
+		"":        BlockClose,
+		"close":   BlockClose,
+		"reset":   BlockReset,
+		"respond": BlockRespond,
+	} {
+		got, err := ParseBlockAction(in)
+		if err != nil || got != want {
+			t.Errorf("%q: wanted %s, got %s (%v)", in, want, got, err)
+		}
+	}
+	if _, err := ParseBlockAction("explode"); err == nil {
+		t.Errorf("unknown actions should be rejected")
+	}
+}
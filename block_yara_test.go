@@ -0,0 +1,78 @@
+//go:build !noyara
+// +build !noyara
+
+package proxy
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	yara "github.com/hillu/go-yara/v4"
+)
+
+var dropRule = `
+rule DropEvil: drop
+{
+    strings:
+        $a = "evil"
+
+    condition:
+        $a
+}
+`
+
+func startBlockingProxy(t *testing.T, action BlockAction, response []byte) net.Conn {
+	t.Helper()
+	echo := startEcho(t)
+	t.Cleanup(func() { echo.Close() })
+
+	rules, err := yara.Compile(dropRule, nil)
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.BlockAction = action
+		p.BlockResponse = response
+		if err := p.SetYaraRules(rules); err != nil {
+			t.Fatalf("failed to set rules: %v", err)
+		}
+	})
+	t.Cleanup(func() { client.Close() })
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Write([]byte("something evil")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	<-done
+	return client
+}
+
+func TestBlockClose(t *testing.T) {
+	client := startBlockingProxy(t, BlockClose, nil)
+	if _, err := client.Read(make([]byte, 16)); err != io.EOF {
+		t.Errorf("wanted a graceful close, got %v", err)
+	}
+}
+
+func TestBlockReset(t *testing.T) {
+	client := startBlockingProxy(t, BlockReset, nil)
+	if _, err := client.Read(make([]byte, 16)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("wanted connection reset, got %v", err)
+	}
+}
+
+func TestBlockRespond(t *testing.T) {
+	client := startBlockingProxy(t, BlockRespond, []byte("blocked\n"))
+	got, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(got) != "blocked\n" {
+		t.Errorf("wanted the block response, got %q", got)
+	}
+}
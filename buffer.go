@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBufferSize - Size of the read buffer each direction of a connection
+// uses when BufferSize is unset
+const DefaultBufferSize = 0xffff
+
+// bufferSize - Size of the read buffer for direction
+func (p *Proxy) bufferSize(direction Direction) int {
+	size := p.UpstreamBufferSize
+	if direction == Downstream {
+		size = p.DownstreamBufferSize
+	}
+	if size <= 0 {
+		size = p.BufferSize
+	}
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return size
+}
+
+// bufPool - Read buffers shared between connections, pooled by size. The
+// pools are sync.Pools, so buffers left idle after a burst of connections
+// are released by the garbage collector instead of being held onto.
+//
+// The contract: a buffer from get belongs to the caller alone until it is
+// handed back with put, exactly once, after which neither it nor any slice
+// of it may be used again. Anything that has to outlive the call that read
+// into it (taps, pending decoder data, ...) is copied out first.
+type bufPool struct {
+	pools sync.Map // int -> *sync.Pool
+}
+
+var buffers bufPool
+
+// poolBuffer - A buffer from bufPool. B may be resliced freely; put always
+// returns the whole buffer to the pool, whatever B was left as.
+type poolBuffer struct {
+	B    []byte
+	full []byte
+	// out - 1 while handed out, so a second put is caught
+	out int32
+}
+
+// get - A buffer of exactly size bytes
+func (bp *bufPool) get(size int) *poolBuffer {
+	pool, ok := bp.pools.Load(size)
+	if !ok {
+		pool, _ = bp.pools.LoadOrStore(size, &sync.Pool{
+			New: func() interface{} {
+				b := make([]byte, size)
+				return &poolBuffer{full: b}
+			},
+		})
+	}
+	b := pool.(*sync.Pool).Get().(*poolBuffer)
+	b.B = b.full
+	atomic.StoreInt32(&b.out, 1)
+	return b
+}
+
+// put - Return a buffer from get once nothing refers to it anymore. Putting
+// the same buffer twice would hand it to two connections at once, so that
+// panics instead.
+func (bp *bufPool) put(b *poolBuffer) {
+	if !atomic.CompareAndSwapInt32(&b.out, 1, 0) {
+		panic("proxy: buffer returned to the pool twice")
+	}
+	b.B = nil
+	if pool, ok := bp.pools.Load(len(b.full)); ok {
+		pool.(*sync.Pool).Put(b)
+	}
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBufPoolSizes(t *testing.T) {
+	var bp bufPool
+	small := bp.get(512)
+	if len(small.B) != 512 || cap(small.B) != 512 {
+		t.Errorf("wanted a 512 byte buffer, got len %d cap %d", len(small.B), cap(small.B))
+	}
+	small.B = small.B[5:10]
+	bp.put(small)
+
+	if b := bp.get(512); len(b.B) != 512 || cap(b.B) != 512 {
+		t.Errorf("pooled buffers should come back whole, got len %d cap %d", len(b.B), cap(b.B))
+	}
+	if b := bp.get(DefaultBufferSize); len(b.B) != DefaultBufferSize {
+		t.Errorf("wanted a %d byte buffer, got %d", DefaultBufferSize, len(b.B))
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	const size = 64
+	var mu sync.Mutex
+	largest := 0
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.BufferSize = size
+		p.Matcher = func(ctx MatchContext) {
+			mu.Lock()
+			if cap(ctx.Data) > largest {
+				largest = cap(ctx.Data)
+			}
+			mu.Unlock()
+		}
+	})
+
+	msg := bytes.Repeat([]byte("x"), size*10)
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Write(msg); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	client.Close()
+	<-done
+
+	if !bytes.Equal(got, msg) {
+		t.Errorf("data corrupted with a small buffer")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// the read buffers are the connection's only per-direction allocation
+	if largest > size {
+		t.Errorf("wanted buffers of at most %d bytes, got %d", size, largest)
+	}
+}
+
+func TestDirectionBufferSizes(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	const up, down = 32, 256
+	var mu sync.Mutex
+	largest := make(map[Direction]int)
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.BufferSize = 64
+		p.UpstreamBufferSize = up
+		p.DownstreamBufferSize = down
+		p.Matcher = func(ctx MatchContext) {
+			mu.Lock()
+			if cap(ctx.Data) > largest[ctx.Direction] {
+				largest[ctx.Direction] = cap(ctx.Data)
+			}
+			mu.Unlock()
+		}
+	})
+
+	msg := bytes.Repeat([]byte("x"), down*10)
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Write(msg); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	client.Close()
+	<-done
+
+	if !bytes.Equal(got, msg) {
+		t.Errorf("data corrupted with per direction buffers")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// both sizes come from the same pool without handing one out as the other
+	if largest[Upstream] != up || largest[Downstream] != down {
+		t.Errorf("wanted buffers of %d bytes upstream and %d downstream, got %d and %d", up, down, largest[Upstream], largest[Downstream])
+	}
+}
+
+func TestBufPoolDoublePut(t *testing.T) {
+	var bp bufPool
+	b := bp.get(64)
+	bp.put(b)
+	defer func() {
+		if recover() == nil {
+			t.Error("expected putting a buffer twice to panic")
+		}
+	}()
+	bp.put(b)
+}
+
+// TestBufferIsolation - Many connections at once through the shared pool,
+// each sending its own pattern. A buffer handed to two connections, or one
+// still used after it was returned, shows up as another connection's bytes
+// in the echo. Most useful under go test -race.
+func TestBufferIsolation(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	const conns, rounds, size = 32, 20, 256
+	var wg sync.WaitGroup
+	errs := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+			// small buffers so they are recycled often
+			p.BufferSize = 64
+		})
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() {
+				client.Close()
+				<-done
+			}()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			msg := bytes.Repeat([]byte{byte('A' + i%26), byte(i)}, size/2)
+			got := make([]byte, len(msg))
+			for r := 0; r < rounds; r++ {
+				if _, err := client.Write(msg); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := io.ReadFull(client, got); err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(got, msg) {
+					errs <- fmt.Errorf("connection %d round %d got another connection's data: %q", i, r, got)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
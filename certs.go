@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CertStore - Certificates loaded from a directory, picked by the server name
+// clients ask for (SNI). Each <name>.crt in the directory is paired with
+// <name>.key, and serves the host names listed in the certificate.
+type CertStore struct {
+	dir         string
+	defaultName string
+
+	mu     sync.RWMutex
+	byHost map[string]*tls.Certificate
+	def    *tls.Certificate
+
+	// ClientCAs, ClientAuth - When set, clients are asked for a certificate
+	// signed by one of these authorities, see LoadClientCAs
+	ClientCAs  *x509.CertPool
+	ClientAuth tls.ClientAuthType
+}
+
+// LoadCertDir - Load every certificate pair in dir. Clients that send no
+// server name, or one no certificate covers, get the pair named defaultName,
+// or the first pair by name when defaultName is empty.
+func LoadCertDir(dir, defaultName string) (*CertStore, error) {
+	s := &CertStore{dir: dir, defaultName: defaultName}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload - Re-read the directory. On failure the certificates loaded before
+// stay in use.
+func (s *CertStore) Reload() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.crt"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	byHost := make(map[string]*tls.Certificate)
+	var def, first *tls.Certificate
+	for _, certPath := range paths {
+		name := strings.TrimSuffix(filepath.Base(certPath), ".crt")
+		keyPath := filepath.Join(s.dir, name+".key")
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %s: %w", name, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate %s: %w", name, err)
+		}
+		cert.Leaf = leaf
+
+		hosts := leaf.DNSNames
+		if len(hosts) == 0 && leaf.Subject.CommonName != "" {
+			hosts = []string{leaf.Subject.CommonName}
+		}
+		for _, h := range hosts {
+			byHost[strings.ToLower(h)] = &cert
+		}
+		if first == nil {
+			first = &cert
+		}
+		if name == s.defaultName {
+			def = &cert
+		}
+	}
+	if first == nil {
+		return fmt.Errorf("no certificates found in %s", s.dir)
+	}
+	if def == nil {
+		if s.defaultName != "" {
+			return fmt.Errorf("default certificate %s not found in %s", s.defaultName, s.dir)
+		}
+		def = first
+	}
+
+	s.mu.Lock()
+	s.byHost, s.def = byHost, def
+	s.mu.Unlock()
+	return nil
+}
+
+// GetCertificate - Pick the certificate for a client, for tls.Config
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.byHost[name]; ok {
+		return cert, nil
+	}
+	// *.example.com covers a.example.com
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := s.byHost["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	if s.def == nil {
+		return nil, errors.New("no certificates loaded")
+	}
+	return s.def, nil
+}
+
+// TLSConfig - A server config serving the store's certificates
+func (s *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+		ClientCAs:      s.ClientCAs,
+		ClientAuth:     s.ClientAuth,
+	}
+}
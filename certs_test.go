@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertPair - Write a self-signed <name>.crt and <name>.key for hosts
+// into dir
+func writeCertPair(t *testing.T, dir, name string, hosts ...string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedCert - Handshake with the store as sni and return the certificate
+// it served
+func servedCert(t *testing.T, store *CertStore, sni string) *x509.Certificate {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go tls.Server(server, store.TLSConfig()).Handshake()
+
+	c := tls.Client(client, &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+	if err := c.Handshake(); err != nil {
+		t.Fatalf("handshake for %q failed: %v", sni, err)
+	}
+	return c.ConnectionState().PeerCertificates[0]
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	dir := t.TempDir()
+	writeCertPair(t, dir, "a", "a.example.com")
+	writeCertPair(t, dir, "b", "b.example.com", "*.b.example.com")
+
+	store, err := LoadCertDir(dir, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		sni, want string
+	}{
+		{"a.example.com", "a.example.com"},
+		{"A.Example.COM", "a.example.com"},
+		{"b.example.com", "b.example.com"},
+		{"www.b.example.com", "b.example.com"},
+		{"unknown.example.com", "b.example.com"},
+		{"", "b.example.com"},
+	}
+	for _, c := range cases {
+		if got := servedCert(t, store, c.sni).Subject.CommonName; got != c.want {
+			t.Errorf("server name %q: got certificate for %s, want %s", c.sni, got, c.want)
+		}
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	writeCertPair(t, dir, "a", "a.example.com")
+	store, err := LoadCertDir(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedCert(t, store, "c.example.com").Subject.CommonName; got != "a.example.com" {
+		t.Fatalf("expected the only certificate as default, got %s", got)
+	}
+
+	writeCertPair(t, dir, "c", "c.example.com")
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedCert(t, store, "c.example.com").Subject.CommonName; got != "c.example.com" {
+		t.Errorf("expected the added certificate after reload, got %s", got)
+	}
+
+	// a pair that fails to load keeps the previous certificates in place
+	if err := ioutil.WriteFile(filepath.Join(dir, "d.crt"), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(); err == nil {
+		t.Error("expected an error reloading an invalid pair")
+	}
+	if got := servedCert(t, store, "c.example.com").Subject.CommonName; got != "c.example.com" {
+		t.Errorf("expected previous certificates after failed reload, got %s", got)
+	}
+}
+
+func TestLoadCertDirErrors(t *testing.T) {
+	if _, err := LoadCertDir(t.TempDir(), ""); err == nil {
+		t.Error("expected an error for a directory without certificates")
+	}
+	dir := t.TempDir()
+	writeCertPair(t, dir, "a", "a.example.com")
+	if _, err := LoadCertDir(dir, "missing"); err == nil {
+		t.Error("expected an error for a missing default certificate")
+	}
+}
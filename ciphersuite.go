@@ -0,0 +1,11 @@
+//go:build go1.14
+// +build go1.14
+
+package proxy
+
+import "crypto/tls"
+
+// cipherSuiteName - Name of the cipher suite id, its hex value if unknown
+func cipherSuiteName(id uint16) string {
+	return tls.CipherSuiteName(id)
+}
@@ -0,0 +1,12 @@
+//go:build !go1.14
+// +build !go1.14
+
+package proxy
+
+import "fmt"
+
+// cipherSuiteName - Go 1.13 has no tls.CipherSuiteName, so the id's hex
+// value like tls.CipherSuiteName gives for unknown ones
+func cipherSuiteName(id uint16) string {
+	return fmt.Sprintf("0x%04X", id)
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// LoadClientCAs - Read the PEM certificates of the authorities that client
+// certificates must be signed by, for CertStore.ClientCAs
+func LoadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CAs: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// sendClientCert - Send ClientCertPrologue with the identity of the client's
+// verified TLS certificate to the remote. Clients without one, or that
+// aren't TLS, get nothing sent on their behalf.
+func (p *Proxy) sendClientCert() bool {
+	if p.ClientCertPrologue == "" {
+		return true
+	}
+	tc, ok := p.lconn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	if err := tc.Handshake(); err != nil {
+		p.Log.Warn("TLS handshake with client failed: %s", err)
+		p.closeWith(err, "client TLS handshake failed: %v", err)
+		return false
+	}
+	chains := tc.ConnectionState().VerifiedChains
+	if len(chains) == 0 {
+		p.Log.Debug("Client sent no verified certificate, no identity sent to the remote")
+		return true
+	}
+	prologue := expandClientCert(p.ClientCertPrologue, chains[0][0])
+	if _, err := p.rconn.Write([]byte(prologue)); err != nil {
+		p.Log.Warn("Failed to send client certificate prologue: %s", err)
+		p.closeWith(err, "write to remote failed: %v", err)
+		return false
+	}
+	p.Log.Debug("Sent the identity of client certificate %s to the remote", chains[0][0].Subject)
+	return true
+}
+
+// expandClientCert - Fill in the {subject}, {cn}, {issuer}, {san}, {serial}
+// and {sha256} placeholders of tmpl for cert. Line breaks in the values are
+// replaced, so a certificate can't add lines of its own to the prologue.
+func expandClientCert(tmpl string, cert *x509.Certificate) string {
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	sum := sha256.Sum256(cert.Raw)
+
+	clean := strings.NewReplacer("\r", " ", "\n", " ").Replace
+	return strings.NewReplacer(
+		"{subject}", clean(cert.Subject.String()),
+		"{cn}", clean(cert.Subject.CommonName),
+		"{issuer}", clean(cert.Issuer.String()),
+		"{san}", clean(strings.Join(sans, ",")),
+		"{serial}", cert.SerialNumber.String(),
+		"{sha256}", hex.EncodeToString(sum[:]),
+	).Replace(tmpl)
+}
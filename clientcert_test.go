@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientCertFor - A CA and a client certificate it signed for cn
+func clientCertFor(t *testing.T, cn, email string) (*x509.Certificate, tls.Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(42),
+		Subject:        pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		EmailAddresses: []string{email},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestLoadClientCAs(t *testing.T) {
+	ca, _ := clientCertFor(t, "alice", "alice@example.com")
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadClientCAs(path); err != nil {
+		t.Errorf("failed to load CA: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("not pem"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadClientCAs(path); err == nil {
+		t.Error("expected an error for a file without certificates")
+	}
+}
+
+func TestClientCertPrologue(t *testing.T) {
+	ca, clientCert := clientCertFor(t, "alice", "alice@example.com")
+	dir := t.TempDir()
+	writeCertPair(t, dir, "server", "proxy.test")
+	store, err := LoadCertDir(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.ClientCAs = x509.NewCertPool()
+	store.ClientCAs.AddCert(ca)
+	store.ClientAuth = tls.RequireAndVerifyClientCert
+
+	// the remote reports the first line it gets, then echoes
+	remote := listenLocal(t)
+	defer remote.Close()
+	lines := make(chan string, 1)
+	go func() {
+		c, err := remote.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		r := bufio.NewReader(c)
+		line, _ := r.ReadString('\n')
+		lines <- line
+		buf := make([]byte, 64)
+		n, _ := r.Read(buf)
+		c.Write(buf[:n])
+	}()
+
+	l := listenLocal(t)
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		p := NewFromConn(tls.Server(c, store.TLSConfig()), remote.Addr().(*net.TCPAddr))
+		p.ClientCertPrologue = "X-Client-Cert: {cn} <{san}> serial {serial}\r\n"
+		p.Start()
+	}()
+
+	client, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName:         "proxy.test",
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{clientCert},
+	})
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+	if got := echoRoundTrip(t, client, "hello"); got != "hello" {
+		t.Errorf("client should only see its own data echoed, got %q", got)
+	}
+
+	select {
+	case line := <-lines:
+		if want := "X-Client-Cert: alice <alice@example.com> serial 42\r\n"; line != want {
+			t.Errorf("wanted %q, got %q", want, line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("remote got nothing")
+	}
+}
+
+func TestExpandClientCert(t *testing.T) {
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(7),
+		Subject:      pkix.Name{CommonName: "evil\r\nX-Admin: 1"},
+		DNSNames:     []string{"a.example", "b.example"},
+	}
+	got := expandClientCert("{cn}|{san}|{serial}", cert)
+	if strings.ContainsAny(got, "\r\n") {
+		t.Errorf("line breaks from the certificate should be removed, got %q", got)
+	}
+	if want := "evil  X-Admin: 1|a.example,b.example|7"; got != want {
+		t.Errorf("wanted %q, got %q", want, got)
+	}
+}
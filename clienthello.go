@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientHelloTimeout - How long admit waits for a ClientHello when
+// PeekTimeout isn't set, so a client that waits for the server to speak
+// first isn't held forever
+const clientHelloTimeout = 5 * time.Second
+
+// maxTLSRecord - The largest TLS record, header included
+const maxTLSRecord = 5 + 16<<10 + 2048
+
+// clientHello - The fields of a TLS ClientHello the policy and PeekServerName
+// look at
+type clientHello struct {
+	version    uint16
+	ciphers    []uint16
+	extensions []uint16
+	curves     []uint16
+	points     []uint8
+	serverName string
+}
+
+// parseClientHello - Parse the ClientHello at the start of peek. complete is
+// false when peek doesn't start with one or is cut off, in which case hello
+// holds what came before the cut.
+func parseClientHello(peek []byte) (hello clientHello, complete bool) {
+	// record header: handshake, version, length
+	if len(peek) < 5 || peek[0] != 0x16 {
+		return hello, false
+	}
+	b := peek[5:]
+	// handshake header: client hello, 3 byte length
+	if len(b) < 4 || b[0] != 0x01 {
+		return hello, false
+	}
+	n := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	b = b[4:]
+	whole := len(b) >= n
+	if whole {
+		// leave out whatever the client sent after it
+		b = b[:n]
+	}
+	// client version and random
+	if len(b) < 34 {
+		return hello, false
+	}
+	hello.version = binary.BigEndian.Uint16(b)
+	b = b[34:]
+	// session id, cipher suites, compression methods
+	for i, lenSize := range []int{1, 2, 1} {
+		if len(b) < lenSize {
+			return hello, false
+		}
+		n := int(b[0])
+		if lenSize == 2 {
+			n = int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < lenSize+n {
+			return hello, false
+		}
+		if i == 1 {
+			hello.ciphers = uint16s(b[lenSize : lenSize+n])
+		}
+		b = b[lenSize+n:]
+	}
+	if len(b) < 2 {
+		// no extensions at all
+		return hello, whole && len(b) == 0
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		typ, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			return hello, false
+		}
+		ext := b[4 : 4+n]
+		b = b[4+n:]
+		hello.extensions = append(hello.extensions, typ)
+		switch typ {
+		case 0:
+			hello.serverName = parseServerName(ext)
+		case 10:
+			// supported groups: length, then the groups
+			if len(ext) >= 2 {
+				hello.curves = uint16s(ext[2:])
+			}
+		case 11:
+			// point formats: length, then the formats
+			if len(ext) >= 1 {
+				hello.points = append([]uint8(nil), ext[1:]...)
+			}
+		}
+	}
+	return hello, whole && len(b) == 0
+}
+
+// parseServerName - The host name in a server name extension
+func parseServerName(ext []byte) string {
+	// server name list: length, then entries of type, length, name
+	if len(ext) < 2 {
+		return ""
+	}
+	ext = ext[2:]
+	for len(ext) >= 3 {
+		nameType, l := ext[0], int(binary.BigEndian.Uint16(ext[1:]))
+		if len(ext) < 3+l {
+			return ""
+		}
+		if nameType == 0 {
+			return string(ext[3 : 3+l])
+		}
+		ext = ext[3+l:]
+	}
+	return ""
+}
+
+func uint16s(b []byte) []uint16 {
+	var v []uint16
+	for ; len(b) >= 2; b = b[2:] {
+		v = append(v, binary.BigEndian.Uint16(b))
+	}
+	return v
+}
+
+// isGREASE - Whether v is one of the reserved values of RFC 8701, which
+// clients sprinkle in at random and JA3 leaves out
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ja3 - The JA3 fingerprint of the ClientHello, the MD5 of its version,
+// cipher suites, extensions, groups and point formats
+func (h *clientHello) ja3() string {
+	list := func(values []uint16) string {
+		var s []string
+		for _, v := range values {
+			if !isGREASE(v) {
+				s = append(s, strconv.Itoa(int(v)))
+			}
+		}
+		return strings.Join(s, "-")
+	}
+	points := make([]uint16, len(h.points))
+	for i, p := range h.points {
+		points[i] = uint16(p)
+	}
+	sum := md5.Sum([]byte(fmt.Sprintf("%d,%s,%s,%s,%s", h.version, list(h.ciphers), list(h.extensions), list(h.curves), list(points))))
+	return hex.EncodeToString(sum[:])
+}
+
+// PeekJA3 - The JA3 fingerprint of the TLS ClientHello peek starts with, as
+// PeekServerName. Empty unless peek holds all of the ClientHello.
+func PeekJA3(peek []byte) string {
+	hello, complete := parseClientHello(peek)
+	if !complete {
+		return ""
+	}
+	return hello.ja3()
+}
+
+// tlsRecordLen - How many bytes of peek make up its first TLS record, once
+// the header is known; the bytes already there when it isn't TLS
+func tlsRecordLen(peek []byte) int {
+	if len(peek) < 5 {
+		if len(peek) > 0 && peek[0] != 0x16 {
+			return len(peek)
+		}
+		return 5
+	}
+	if peek[0] != 0x16 {
+		return len(peek)
+	}
+	if n := 5 + int(binary.BigEndian.Uint16(peek[3:])); n <= maxTLSRecord {
+		return n
+	}
+	return len(peek)
+}
+
+// peekClientHello - Read the client's first TLS record into peeked, so the
+// Policy can look at its ClientHello. Stops early when the client sends
+// something else or nothing within PeekTimeout; the connection then goes on
+// without the TLS attributes.
+func (p *Proxy) peekClientHello() {
+	timeout := p.PeekTimeout
+	if timeout <= 0 {
+		timeout = clientHelloTimeout
+	}
+	if c, ok := p.lconn.(net.Conn); ok {
+		c.SetReadDeadline(time.Now().Add(timeout))
+		defer c.SetReadDeadline(time.Time{})
+	}
+	// later peeks get what was read here, rather than waiting for more
+	p.peekDone = true
+	buf := make([]byte, maxTLSRecord)
+	for len(p.peeked) < tlsRecordLen(p.peeked) {
+		n, err := p.lconn.Read(buf[:tlsRecordLen(p.peeked)-len(p.peeked)])
+		p.peeked = append(p.peeked, buf[:n]...)
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				p.Log.Debug("Failed to read the ClientHello: %s", err)
+			}
+			return
+		}
+	}
+}
+
+// tlsAttributes - Fill in the JA3 and SNI of attrs, from the ClientHello
+// peeked, or from the handshake when the client's TLS is terminated
+func (p *Proxy) tlsAttributes(attrs *ConnAttributes) error {
+	if tc, ok := p.lconn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return fmt.Errorf("client TLS handshake failed: %w", err)
+		}
+		attrs.SNI = tc.ConnectionState().ServerName
+		return nil
+	}
+	p.peekClientHello()
+	hello, complete := parseClientHello(p.peeked)
+	if complete {
+		attrs.JA3 = hello.ja3()
+	}
+	attrs.SNI = hello.serverName
+	return nil
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock - The time source for a proxy's timeouts and timestamps, so tests
+// can run time based features without sleeping
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker - A time.Ticker from a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer - A time.Timer from a Clock
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock - The wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+func (p *Proxy) clock() Clock {
+	if p.Clock == nil {
+		return realClock{}
+	}
+	return p.Clock
+}
+
+// idleChecks - How often per IdleTimeout the connection is checked for
+// activity, so it is closed at most a quarter of the timeout late
+const idleChecks = 4
+
+// touch - Note activity for IdleTimeout
+func (p *Proxy) touch() {
+	if p.IdleTimeout > 0 {
+		atomic.StoreInt64(&p.lastActive, p.clock().Now().UnixNano())
+	}
+}
+
+// idleFor - How long since either side last sent anything
+func (p *Proxy) idleFor() time.Duration {
+	return p.clock().Now().Sub(time.Unix(0, atomic.LoadInt64(&p.lastActive)))
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock - A Clock that only moves when advanced
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer
+}
+
+// fakeTimer - A timer or ticker of a fakeClock, ticking every period when
+// that is set
+type fakeTimer struct {
+	clock   *fakeClock
+	c       chan time.Time
+	next    time.Time
+	period  time.Duration
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) add(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), next: c.now.Add(d), period: period}
+	c.waiters = append(c.waiters, t)
+	return t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time { return c.add(d, 0).c }
+func (c *fakeClock) NewTicker(d time.Duration) Ticker       { return fakeTicker{c.add(d, d)} }
+func (c *fakeClock) NewTimer(d time.Duration) Timer         { return c.add(d, 0) }
+
+// Advance - Move the clock forward, firing the timers and tickers that
+// are due. Like time.Ticker, a ticker nobody reads from drops ticks.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, t := range c.waiters {
+		for !t.stopped && !t.next.After(c.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			if t.period == 0 {
+				t.stopped = true
+			} else {
+				t.next = t.next.Add(t.period)
+			}
+		}
+		if !t.stopped {
+			waiting = append(waiting, t)
+		}
+	}
+	c.waiters = waiting
+}
+
+// pending - How many timers and tickers are pending
+func (c *fakeClock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := !t.stopped
+	t.stopped = true
+	return active
+}
+
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() { t.fakeTimer.Stop() }
+
+func TestIdleTimeout(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	clock := newFakeClock()
+	var proxy *Proxy
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.Clock = clock
+		p.IdleTimeout = time.Minute
+		proxy = p
+	})
+	defer client.Close()
+	// the idle ticker is set up before any data is relayed
+	echoRoundTrip(t, client, "ping")
+	if clock.pending() != 1 {
+		t.Fatalf("expected the idle ticker to be running, got %d timers", clock.pending())
+	}
+
+	// activity restarts the timeout
+	clock.Advance(45 * time.Second)
+	echoRoundTrip(t, client, "ping")
+	clock.Advance(45 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("connection closed while it was active")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.Advance(30 * time.Second)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle connection wasn't closed")
+	}
+	if reason := proxy.CloseReason(); !strings.Contains(reason, "idle") {
+		t.Errorf("expected an idle close reason, got %q", reason)
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+// startCombined - Start the goroutine feeding CombinedMatcher
+func (p *Proxy) startCombined() {
+	if p.CombinedMatcher == nil {
+		return
+	}
+	size := p.TapBuffer
+	if size <= 0 {
+		size = defaultTapBuffer
+	}
+	p.combined = make(chan MatchContext, size)
+	p.combinedDone = make(chan struct{})
+	go func() {
+		defer close(p.combinedDone)
+		for ctx := range p.combined {
+			p.runCombined(ctx)
+		}
+	}()
+}
+
+// runCombined - Call CombinedMatcher for one chunk. A panic loses only that
+// chunk, the chunks after it are still delivered.
+func (p *Proxy) runCombined(ctx MatchContext) {
+	defer p.recoverPanic("combined matcher", false)
+	p.CombinedMatcher(ctx)
+}
+
+// sendCombined - Queue a copy of a chunk for CombinedMatcher, waiting for
+// room when it has fallen behind
+func (p *Proxy) sendCombined(ctx MatchContext) {
+	p.combinedLock.Lock()
+	defer p.combinedLock.Unlock()
+	if p.combined == nil || p.combinedClosed {
+		return
+	}
+	ctx.Data = append([]byte(nil), ctx.Data...)
+	p.combined <- ctx
+}
+
+// closeCombined - Stop feeding CombinedMatcher and wait until it has seen
+// every chunk queued
+func (p *Proxy) closeCombined() {
+	p.combinedLock.Lock()
+	if p.combined == nil || p.combinedClosed {
+		p.combinedLock.Unlock()
+		return
+	}
+	close(p.combined)
+	p.combinedClosed = true
+	p.combinedLock.Unlock()
+	<-p.combinedDone
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The handshake a CompressRemote proxy starts every connection with, and
+// the answer of an AcceptCompressed proxy at the other end. The leading zero
+// byte keeps it from being mistaken for the start of a text protocol.
+var (
+	compressHello = []byte("\x00tcp-proxy compress gzip\n")
+	compressAck   = []byte("\x00tcp-proxy compress ok\n")
+)
+
+// compressHandshakeTimeout - How long either end waits for the other's side
+// of the handshake
+const compressHandshakeTimeout = 2 * time.Second
+
+// defaultCompressProbe - How long an AcceptCompressed proxy waits for a
+// client to start the handshake before treating it as a plain client
+const defaultCompressProbe = 500 * time.Millisecond
+
+// compressedConn - A connection to another proxy whose data is gzip
+// compressed both ways. Every write is flushed so nothing is held back
+// waiting for more data.
+type compressedConn struct {
+	net.Conn
+	// wmu - guards zw, which the pipe writes to while Close may come from
+	// another goroutine
+	wmu sync.Mutex
+	zw  *gzip.Writer
+	r   io.Reader
+	zr  *gzip.Reader
+}
+
+func newCompressedConn(c net.Conn, r io.Reader) *compressedConn {
+	return &compressedConn{Conn: c, zw: gzip.NewWriter(c), r: r}
+}
+
+func (c *compressedConn) Read(b []byte) (int, error) {
+	if c.zr == nil {
+		zr, err := gzip.NewReader(c.r)
+		if err != nil {
+			return 0, fmt.Errorf("compressed stream: %w", err)
+		}
+		zr.Multistream(false)
+		c.zr = zr
+	}
+	return c.zr.Read(b)
+}
+
+func (c *compressedConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.zw.Write(b); err != nil {
+		return 0, err
+	}
+	if err := c.zw.Flush(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// CloseWrite - End the compressed stream, then the connection's sending side
+func (c *compressedConn) CloseWrite() error {
+	c.wmu.Lock()
+	err := c.zw.Close()
+	c.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Close - Close the connection, abandoning the compressed stream. It is
+// closed first so a Write blocked on it returns and gives up zw.
+func (c *compressedConn) Close() error {
+	err := c.Conn.Close()
+	c.wmu.Lock()
+	c.zw.Close()
+	c.wmu.Unlock()
+	return err
+}
+
+// compressRemote - Ask the remote, another proxy, to compress the connection
+// and wrap rconn once it agrees
+func (p *Proxy) compressRemote() error {
+	c, ok := p.rconn.(net.Conn)
+	if !ok {
+		return errors.New("remote connection can't be compressed")
+	}
+	c.SetDeadline(time.Now().Add(compressHandshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+	if _, err := c.Write(compressHello); err != nil {
+		return err
+	}
+	ack := make([]byte, len(compressAck))
+	if _, err := io.ReadFull(c, ack); err != nil {
+		return fmt.Errorf("no answer from the remote, is it a proxy accepting compression? %w", err)
+	}
+	if !bytes.Equal(ack, compressAck) {
+		return errors.New("remote answered with something else, is it a proxy accepting compression?")
+	}
+	p.rconn = newCompressedConn(c, c)
+	p.Log.Debug("Compressing data sent to the remote")
+	return nil
+}
+
+// acceptCompression - Check whether the client is a proxy starting the
+// compression handshake and if so answer and wrap lconn. For any other
+// client the bytes read while checking are kept in peeked, to be forwarded
+// ahead of the rest of its data.
+func (p *Proxy) acceptCompression() error {
+	c, ok := p.lconn.(net.Conn)
+	if !ok {
+		return nil
+	}
+	probe := p.CompressProbe
+	if probe <= 0 {
+		probe = defaultCompressProbe
+	}
+	c.SetReadDeadline(time.Now().Add(probe))
+	buf := make([]byte, len(compressHello))
+	n := 0
+	for n < len(buf) && bytes.Equal(buf[:n], compressHello[:n]) {
+		m, err := c.Read(buf[n:])
+		n += m
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			c.SetReadDeadline(time.Time{})
+			return err
+		}
+	}
+	c.SetReadDeadline(time.Time{})
+
+	if n < len(buf) || !bytes.Equal(buf, compressHello) {
+		p.peeked = append(p.peeked, buf[:n]...)
+		return nil
+	}
+	c.SetWriteDeadline(time.Now().Add(compressHandshakeTimeout))
+	_, err := c.Write(compressAck)
+	c.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	p.lconn = newCompressedConn(c, c)
+	p.Log.Debug("Client is a proxy compressing its data")
+	return nil
+}
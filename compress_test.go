@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// serveProxy - A listener proxying every connection to raddr, set up by setup
+func serveProxy(t *testing.T, raddr net.Addr, setup func(*Proxy)) net.Listener {
+	t.Helper()
+	l := listenLocal(t)
+	go Serve(l, func(c net.Conn) *Proxy {
+		p := NewFromConn(c, raddr.(*net.TCPAddr))
+		setup(p)
+		return p
+	})
+	return l
+}
+
+func TestCompressedProxies(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	// client -> near (compresses) -> sniffer -> far (decompresses) -> echo
+	far := serveProxy(t, echo.Addr(), func(p *Proxy) {
+		p.AcceptCompressed = true
+	})
+	defer far.Close()
+	var mu sync.Mutex
+	var wire []byte
+	sniffer := serveProxy(t, far.Addr(), func(p *Proxy) {
+		p.Matcher = func(ctx MatchContext) {
+			mu.Lock()
+			if ctx.Direction == Upstream {
+				wire = append(wire, ctx.Data...)
+			}
+			mu.Unlock()
+		}
+	})
+	defer sniffer.Close()
+	near := serveProxy(t, sniffer.Addr(), func(p *Proxy) {
+		p.CompressRemote = true
+		p.UpstreamReplacers = []Replacer{&StringReplacer{"secret", "public"}}
+	})
+	defer near.Close()
+
+	c, err := net.Dial("tcp", near.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, msg := range []string{"a secret " + strings.Repeat("message ", 50), "another secret"} {
+		want := strings.Replace(msg, "secret", "public", 1)
+		if got := echoRoundTrip(t, c, msg); got != want {
+			t.Errorf("expected %q through the compressed link, got %q", want, got)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !bytes.HasPrefix(wire, compressHello) {
+		t.Fatalf("expected the compression handshake on the wire, got %q", wire)
+	}
+	// short chunks may be sent as stored blocks, but the repetitive one
+	// shrinks
+	if bytes.Contains(wire, []byte("message message")) {
+		t.Errorf("expected compressed data between the proxies, got %q", wire)
+	}
+}
+
+func TestAcceptCompressedPlainClient(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	far := serveProxy(t, echo.Addr(), func(p *Proxy) {
+		p.AcceptCompressed = true
+	})
+	defer far.Close()
+
+	c, err := net.Dial("tcp", far.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := echoRoundTrip(t, c, "plain hello"); got != "plain hello" {
+		t.Errorf("expected a plain client to be proxied as usual, got %q", got)
+	}
+}
+
+func TestCompressRemoteNotAProxy(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.CompressRemote = true
+	})
+	defer client.Close()
+	// the echo sends the handshake back instead of answering it
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the connection to fail when the remote isn't a proxy")
+	}
+	<-done
+}
+
+func TestCompressedConnCloseWhileWriting(t *testing.T) {
+	local, remote := net.Pipe()
+	go io.Copy(ioutil.Discard, remote)
+	c := newCompressedConn(local, local)
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for {
+			if _, err := c.Write([]byte("data")); err != nil {
+				return
+			}
+		}
+	}()
+	c.Close()
+	<-written
+	remote.Close()
+}
@@ -0,0 +1,515 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"gopkg.in/yaml.v3"
+)
+
+// Replacer - Transforms a chunk of data flowing through the proxy. Returning
+// the input unchanged passes the chunk through; returning nil drops it, and
+// no replacers after it run.
+type Replacer interface {
+	Replace(in []byte) []byte
+	String() string
+}
+
+// ApplyReplacers - Run b through each replacer in order, as the proxy does
+// for the first chunk of a connection. Returns nil if a replacer dropped the
+// chunk. Every call starts afresh: an OnceReplacer replaces in each one, and
+// an EncodedReplacer doesn't carry a cut off character over to the next.
+// Replacers that fail, such as exec ones, pass b through unchanged.
+func ApplyReplacers(b []byte, replacers []Replacer) []byte {
+	var state replacerState
+	for _, r := range replacers {
+		if b = state.run(r, b, Upstream, NullLogger{}); b == nil {
+			return nil
+		}
+	}
+	return b
+}
+
+// replacerState - What running replacers carries from one chunk to the
+// next, see OnceReplacer and EncodedReplacer. A Proxy keeps one for the
+// connection.
+type replacerState struct {
+	// onceFired - the OnceReplacers that already changed a chunk
+	onceLock  sync.Mutex
+	onceFired map[*OnceReplacer]bool
+	// encodedRest - for each direction, the bytes the last chunk through an
+	// EncodedReplacer ended with that didn't make up a whole character
+	encodedLock sync.Mutex
+	encodedRest [2]map[*EncodedReplacer][]byte
+}
+
+// run - Replace b with r, logging to log why when a replacer that can fail
+// passes it through unchanged
+func (s *replacerState) run(r Replacer, b []byte, direction Direction, log Logger) []byte {
+	if once, ok := r.(*OnceReplacer); ok {
+		return s.replaceOnce(once, b, direction)
+	}
+	if enc, ok := r.(*EncodedReplacer); ok {
+		return s.replaceEncoded(enc, b, direction, false)
+	}
+	cr, ok := r.(checkedReplacer)
+	if !ok {
+		return r.Replace(b)
+	}
+	out, err := cr.TryReplace(b)
+	if err != nil {
+		log.Warn("Replacer %s failed, forwarding %d bytes unchanged: %v", r, len(b), err)
+		return b
+	}
+	return out
+}
+
+// notDropped - The bytes/regexp replace functions return nil when their
+// result is empty, which would read as dropping the chunk. A replacer that
+// removed everything passes on an empty chunk instead.
+func notDropped(out, in []byte) []byte {
+	if out == nil {
+		return in[:0]
+	}
+	return out
+}
+
+// lengthPreserver - Implemented by replacers that can tell whether their
+// output is always the same length as their input
+type lengthPreserver interface {
+	PreservesLength() bool
+}
+
+// ChangesLength - Whether r can change the length of the data it replaces.
+// Replacers that don't say otherwise are assumed to.
+func ChangesLength(r Replacer) bool {
+	lp, ok := r.(lengthPreserver)
+	return !ok || !lp.PreservesLength()
+}
+
+// ReplacerConfig - A single replacer entry as read from the yaml config file
+type ReplacerConfig struct {
+	ReplacerType string      `yaml:"type"`
+	Find         interface{} `yaml:"find"`
+	Replace      interface{} `yaml:"replace"`
+	// Once - apply the replacer only to its first match on each
+	// connection, see OnceReplacer
+	Once bool `yaml:"once"`
+	// Match - for strip replacers, whether find is a substring, regex or
+	// bytes. Defaults to bytes for a list and substring otherwise.
+	Match string `yaml:"match"`
+	// PrefixSize, ByteOrder - for prefixed replacers, see PrefixedReplacer
+	PrefixSize int    `yaml:"prefix_size"`
+	ByteOrder  string `yaml:"byte_order"`
+	// Encoding - for substring and regex replacers, the encoding the text
+	// is matched in, see EncodedReplacer and ParseTextEncoding
+	Encoding string `yaml:"encoding"`
+	// Command, Timeout, MaxOutput - for exec replacers, see ExecReplacer
+	Command   string        `yaml:"command"`
+	Timeout   time.Duration `yaml:"timeout"`
+	MaxOutput int           `yaml:"max_output"`
+}
+
+// StringReplacer - Replaces every occurrence of a substring. Matching is done
+// on the raw bytes, so data that isn't valid UTF-8 passes through untouched.
+type StringReplacer struct {
+	In  string
+	Out string
+}
+
+// Replace - replace all occurrences of In with Out
+func (r *StringReplacer) Replace(in []byte) []byte {
+	return notDropped(bytes.ReplaceAll(in, []byte(r.In), []byte(r.Out)), in)
+}
+
+// PreservesLength - true when In and Out are the same length
+func (r *StringReplacer) PreservesLength() bool {
+	return len(r.In) == len(r.Out)
+}
+
+func (r *StringReplacer) String() string {
+	return fmt.Sprintf("substring: %q -> %q", r.In, r.Out)
+}
+
+// RegexReplacer - Replaces every match of a regular expression. The
+// replacement may reference capture groups using $1 style expansion.
+type RegexReplacer struct {
+	In  *regexp.Regexp
+	Out []byte
+}
+
+// Replace - replace all matches of In with Out
+func (r *RegexReplacer) Replace(in []byte) []byte {
+	return notDropped(r.In.ReplaceAll(in, r.Out), in)
+}
+
+// PreservesLength - true when the expression only matches a literal of the
+// same length as Out, which doesn't expand any capture groups
+func (r *RegexReplacer) PreservesLength() bool {
+	literal, complete := r.In.LiteralPrefix()
+	return complete && len(literal) == len(r.Out) && !bytes.Contains(r.Out, []byte("$"))
+}
+
+func (r *RegexReplacer) String() string {
+	return fmt.Sprintf("regex: %q -> %q", r.In.String(), r.Out)
+}
+
+// BytesReplacer - Replaces every occurrence of a byte sequence
+type BytesReplacer struct {
+	In  []byte
+	Out []byte
+}
+
+// Replace - replace all occurrences of In with Out
+func (r *BytesReplacer) Replace(in []byte) []byte {
+	return notDropped(bytes.ReplaceAll(in, r.In, r.Out), in)
+}
+
+// PreservesLength - true when In and Out are the same length
+func (r *BytesReplacer) PreservesLength() bool {
+	return len(r.In) == len(r.Out)
+}
+
+func (r *BytesReplacer) String() string {
+	return fmt.Sprintf("bytes: %x -> %x", r.In, r.Out)
+}
+
+// StripReplacer - Removes every occurrence of a byte sequence, or every
+// match of Regex when that is set. The same as replacing with nothing, but
+// without having to spell out an empty replacement.
+type StripReplacer struct {
+	In    []byte
+	Regex *regexp.Regexp
+}
+
+// Replace - remove all occurrences of In, or matches of Regex
+func (r *StripReplacer) Replace(in []byte) []byte {
+	if r.Regex != nil {
+		return notDropped(r.Regex.ReplaceAll(in, nil), in)
+	}
+	return notDropped(bytes.ReplaceAll(in, r.In, nil), in)
+}
+
+func (r *StripReplacer) String() string {
+	if r.Regex != nil {
+		return fmt.Sprintf("strip regex: %q", r.Regex.String())
+	}
+	return fmt.Sprintf("strip: %q", r.In)
+}
+
+// parseStrip - Build a strip replacer, which only has something to find
+func (rc *ReplacerConfig) parseStrip() (Replacer, error) {
+	if rc.Replace != nil {
+		return nil, fmt.Errorf("strip replacer takes no replace value")
+	}
+	match := rc.Match
+	if match == "" {
+		match = "substring"
+		if _, ok := rc.Find.([]interface{}); ok {
+			match = "bytes"
+		}
+	}
+	switch match {
+	case "substring", "regex":
+		find, ok := rc.Find.(string)
+		if !ok || find == "" {
+			return nil, fmt.Errorf("strip %s find value must be a non-empty string", match)
+		}
+		if match == "substring" {
+			return &StripReplacer{In: []byte(find)}, nil
+		}
+		re, err := regexp.Compile(find)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", find, err)
+		}
+		return &StripReplacer{Regex: re}, nil
+	case "bytes":
+		find, err := parseByteSlice(rc.Find)
+		if err != nil {
+			return nil, fmt.Errorf("invalid find value: %w", err)
+		}
+		if len(find) == 0 {
+			return nil, fmt.Errorf("bytes find value must not be empty")
+		}
+		return &StripReplacer{In: find}, nil
+	default:
+		return nil, fmt.Errorf("unknown strip match %q, expected substring, regex or bytes", match)
+	}
+}
+
+// Parse - Build the Replacer described by this config entry
+func (rc *ReplacerConfig) Parse() (Replacer, error) {
+	r, err := rc.parse()
+	if err != nil || !rc.Once {
+		return r, err
+	}
+	return &OnceReplacer{r}, nil
+}
+
+func (rc *ReplacerConfig) parse() (Replacer, error) {
+	if rc.ReplacerType == "exec" {
+		command := strings.Fields(rc.Command)
+		if len(command) == 0 {
+			return nil, fmt.Errorf("exec replacer is missing a command")
+		}
+		if rc.Timeout < 0 || rc.MaxOutput < 0 {
+			return nil, fmt.Errorf("exec replacer timeout and max_output must not be negative")
+		}
+		return &ExecReplacer{Command: command, Timeout: rc.Timeout, MaxOutput: rc.MaxOutput}, nil
+	}
+	if rc.Find == nil {
+		return nil, fmt.Errorf("%s replacer is missing a find value", rc.ReplacerType)
+	}
+	if rc.Encoding != "" && rc.ReplacerType != "substring" && rc.ReplacerType != "regex" {
+		return nil, fmt.Errorf("encoding only applies to substring and regex replacers")
+	}
+
+	switch rc.ReplacerType {
+	case "strip":
+		return rc.parseStrip()
+	case "prefixed":
+		return rc.parsePrefixed()
+	case "substring":
+		find, ok := rc.Find.(string)
+		if !ok || find == "" {
+			return nil, fmt.Errorf("substring find value must be a non-empty string")
+		}
+		replace, err := parseString(rc.Replace)
+		if err != nil {
+			return nil, err
+		}
+		return rc.withEncoding(&StringReplacer{find, replace})
+	case "regex":
+		find, ok := rc.Find.(string)
+		if !ok || find == "" {
+			return nil, fmt.Errorf("regex find value must be a non-empty string")
+		}
+		re, err := regexp.Compile(find)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", find, err)
+		}
+		replace, err := parseString(rc.Replace)
+		if err != nil {
+			return nil, err
+		}
+		return rc.withEncoding(&RegexReplacer{re, []byte(replace)})
+	case "bytes":
+		find, err := parseByteSlice(rc.Find)
+		if err != nil {
+			return nil, fmt.Errorf("invalid find value: %w", err)
+		}
+		if len(find) == 0 {
+			return nil, fmt.Errorf("bytes find value must not be empty")
+		}
+		var replace []byte
+		if rc.Replace != nil {
+			replace, err = parseByteSlice(rc.Replace)
+			if err != nil {
+				return nil, fmt.Errorf("invalid replace value: %w", err)
+			}
+		}
+		return &BytesReplacer{find, replace}, nil
+	default:
+		return nil, fmt.Errorf("unknown replacer type %q", rc.ReplacerType)
+	}
+}
+
+func parseString(v interface{}) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("replace value must be a string, got %T", v)
+	}
+	return s, nil
+}
+
+// maxByteSlice - The longest list of bytes a config value may have, far
+// more than a chunk of data holds, so a longer one is surely a mistake
+const maxByteSlice = 1 << 20
+
+func parseByteSlice(v interface{}) ([]byte, error) {
+	elems, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of bytes, got %T", v)
+	}
+	if len(elems) > maxByteSlice {
+		return nil, fmt.Errorf("list of %d bytes is longer than the limit of %d", len(elems), maxByteSlice)
+	}
+	out := make([]byte, 0, len(elems))
+	for i, elem := range elems {
+		b, err := parseByte(elem)
+		if err != nil {
+			return nil, fmt.Errorf("element %d %w", i, err)
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+// parseByte - A byte from any of the numeric types the yaml decoder gives
+// for a number: int, or int64 and uint64 for values too large for it, and
+// float64 for ones written with a fraction or exponent, e.g. 1e2
+func parseByte(v interface{}) (byte, error) {
+	var n int64
+	switch v := v.(type) {
+	case int:
+		n = int64(v)
+	case int64:
+		n = v
+	case uint64:
+		if v > 0xff {
+			return 0, fmt.Errorf("(%d) is out of byte range", v)
+		}
+		n = int64(v)
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("(%v) is not a whole number", v)
+		}
+		if v < 0 || v > 0xff {
+			return 0, fmt.Errorf("(%v) is out of byte range", v)
+		}
+		n = int64(v)
+	default:
+		return 0, fmt.Errorf("is not an integer, got %T", v)
+	}
+	if n < 0 || n > 0xff {
+		return 0, fmt.Errorf("(%d) is out of byte range", n)
+	}
+	return byte(n), nil
+}
+
+// ReplacerSet - Replacers grouped by the direction of data they apply to
+type ReplacerSet struct {
+	// Both - applied to data flowing either way
+	Both       []Replacer
+	Upstream   []Replacer
+	Downstream []Replacer
+}
+
+// Len - Total number of replacers in the set
+func (rs ReplacerSet) Len() int {
+	return len(rs.Both) + len(rs.Upstream) + len(rs.Downstream)
+}
+
+// All - Every replacer in the set, shared ones first
+func (rs ReplacerSet) All() []Replacer {
+	var all []Replacer
+	all = append(all, rs.Both...)
+	all = append(all, rs.Upstream...)
+	return append(all, rs.Downstream...)
+}
+
+// LengthChanging - The replacers in the set that can change the length of
+// the data, see ChangesLength
+func (rs ReplacerSet) LengthChanging() []Replacer {
+	var changing []Replacer
+	for _, r := range rs.All() {
+		if ChangesLength(r) {
+			changing = append(changing, r)
+		}
+	}
+	return changing
+}
+
+// configSections - The keys allowed in the sectioned form of the config
+var configSections = []string{"both", "upstream", "downstream"}
+
+// readConfigData - Parse replacer config. The config is either a flat yaml
+// list of replacers applied in both directions, or a mapping with upstream,
+// downstream and both sections each holding such a list. Every valid entry
+// is returned, along with a multierror describing the invalid ones.
+func readConfigData(data []byte) (ReplacerSet, error) {
+	var set ReplacerSet
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return set, fmt.Errorf("failed to parse replacer config: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return set, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		var configs []ReplacerConfig
+		if err := root.Decode(&configs); err != nil {
+			return set, fmt.Errorf("failed to parse replacer config: %w", err)
+		}
+		var err error
+		set.Both, err = parseReplacers("", configs, nil)
+		return set, err
+	}
+
+	var sections map[string][]ReplacerConfig
+	if err := root.Decode(&sections); err != nil {
+		return set, fmt.Errorf("failed to parse replacer config: %w", err)
+	}
+	for name := range sections {
+		if !isConfigSection(name) {
+			return set, fmt.Errorf("unknown replacer config section %q", name)
+		}
+	}
+
+	var result error
+	set.Both, result = parseReplacers("both", sections["both"], result)
+	set.Upstream, result = parseReplacers("upstream", sections["upstream"], result)
+	set.Downstream, result = parseReplacers("downstream", sections["downstream"], result)
+	return set, result
+}
+
+func isConfigSection(name string) bool {
+	for _, s := range configSections {
+		if name == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReplacers - Parse a list of replacer configs, appending any failures
+// to result
+func parseReplacers(section string, configs []ReplacerConfig, result error) ([]Replacer, error) {
+	var replacers []Replacer
+	for i := range configs {
+		r, err := configs[i].Parse()
+		if err != nil {
+			result = multierror.Append(result, &ConfigError{Section: section, Index: i, Err: err})
+			continue
+		}
+		replacers = append(replacers, r)
+	}
+	return replacers, result
+}
+
+// LoadConfig - Parse replacer config data and replace the proxy's replacers
+// with it. If any entry is invalid the replacers are left as they were and
+// the error lists every invalid entry, so loading is safe to repeat.
+func (p *Proxy) LoadConfig(data []byte) error {
+	set, err := readConfigData(data)
+	if err != nil {
+		return err
+	}
+	p.SetReplacerSet(set)
+	for _, r := range set.All() {
+		p.Log.Debug("loaded replacer %s", r.String())
+	}
+	return nil
+}
+
+// ReadConfigFile - Read and parse a replacer config file without attaching
+// it to a proxy. Every valid entry is returned even when err is non-nil.
+func ReadConfigFile(filePath string) (ReplacerSet, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return ReplacerSet{}, fmt.Errorf("failed to read replacer config: %w", err)
+	}
+	return readConfigData(data)
+}
@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"bytes"
+	"regexp"
+	"strings"
 	"testing"
 
 	"gopkg.in/yaml.v3"
@@ -101,3 +103,330 @@ func TestReplaceByte(t *testing.T) {
 	}
 	t.Log(string(replaced))
 }
+
+func TestApplyReplacers(t *testing.T) {
+	set, err := readConfigData([]byte(configValid))
+	if err != nil {
+		t.Fatalf("failed to parse valid config: %v", err)
+	}
+	replacers := set.Both
+
+	in := []byte("foo abcd \x11\x22\x33\x44 foo")
+	want := []byte("bar 1337 \x55\x66\x77\x88 bar")
+	if got := ApplyReplacers(in, replacers); !bytes.Equal(got, want) {
+		t.Errorf("wanted %q, got %q", want, got)
+	}
+
+	var p Proxy
+	p.SetReplacers(replacers)
+	if got := p.Transform(in); !bytes.Equal(got, want) {
+		t.Errorf("Transform: wanted %q, got %q", want, got)
+	}
+
+	if got := ApplyReplacers(in, nil); !bytes.Equal(got, in) {
+		t.Errorf("no replacers should leave data unchanged, got %q", got)
+	}
+}
+
+func TestApplyReplacersLikeTransform(t *testing.T) {
+	set, err := readConfigData([]byte(`- type: substring
+  find: ping
+  replace: pong
+  encoding: utf-16le
+  once: true
+- type: substring
+  find: needle
+  replace: pin
+  encoding: utf-16le
+- type: substring
+  find: "p\0o\0n\0g\0"
+  replace: "P\0O\0N\0G\0"
+`))
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	replacers := append(set.Both, &ExecReplacer{Command: []string{"/nonexistent/filter"}})
+	in := encodeUTF16LE("ping ping needle")
+	want := encodeUTF16LE("PONG ping pin")
+
+	var p Proxy
+	p.Log = NullLogger{}
+	p.SetReplacers(replacers)
+	transformed := p.Transform(append([]byte(nil), in...))
+	applied := ApplyReplacers(append([]byte(nil), in...), replacers)
+	if !bytes.Equal(transformed, want) || !bytes.Equal(applied, transformed) {
+		t.Errorf("wanted %x from both, Transform gave %x and ApplyReplacers %x", want, transformed, applied)
+	}
+	// the once replacer fired for the proxy's connection, not for later calls
+	if got := ApplyReplacers(append([]byte(nil), in...), replacers); !bytes.Equal(got, want) {
+		t.Errorf("wanted every call to start afresh, got %x", got)
+	}
+}
+
+var configSectioned = `
+both:
+  - type: substring
+    find: "shared"
+    replace: "common"
+upstream:
+  - type: substring
+    find: "foo"
+    replace: "up"
+downstream:
+  - type: substring
+    find: "foo"
+    replace: "down"
+  - type: regex
+    find: "[0-9]+"
+    replace: "N"
+`
+
+func TestConfigSections(t *testing.T) {
+	set, err := readConfigData([]byte(configSectioned))
+	if err != nil {
+		t.Fatalf("failed to parse sectioned config: %v", err)
+	}
+	if len(set.Both) != 1 || len(set.Upstream) != 1 || len(set.Downstream) != 2 {
+		t.Fatalf("unexpected section sizes: %d both, %d upstream, %d downstream",
+			len(set.Both), len(set.Upstream), len(set.Downstream))
+	}
+
+	var p Proxy
+	p.SetReplacerSet(set)
+	in := []byte("shared foo 42")
+	if got := string(p.TransformDirection(in, Upstream)); got != "common up 42" {
+		t.Errorf("upstream: got %q", got)
+	}
+	if got := string(p.TransformDirection(in, Downstream)); got != "common down N" {
+		t.Errorf("downstream: got %q", got)
+	}
+
+	if _, err := readConfigData([]byte("sideways:\n  - type: substring\n    find: x\n")); err == nil {
+		t.Errorf("unknown sections should be rejected")
+	}
+
+	_, err = readConfigData([]byte("upstream:\n  - type: regex\n    replace: x\n"))
+	if err == nil || !strings.Contains(err.Error(), "upstream replacer 0") {
+		t.Errorf("errors should name the section and index, got %v", err)
+	}
+}
+
+func TestLoadConfigReplaces(t *testing.T) {
+	var p Proxy
+	p.Log = NullLogger{}
+	counts := func() [3]int {
+		return [3]int{len(p.Replacers), len(p.UpstreamReplacers), len(p.DownstreamReplacers)}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := p.LoadConfig([]byte(configValid)); err != nil {
+			t.Fatalf("failed to load flat config: %v", err)
+		}
+	}
+	if got := counts(); got != [3]int{3, 0, 0} {
+		t.Fatalf("loading twice should not duplicate replacers, got %v", got)
+	}
+
+	// a sectioned config replaces the flat one entirely
+	if err := p.LoadConfig([]byte(configSectioned)); err != nil {
+		t.Fatalf("failed to load sectioned config: %v", err)
+	}
+	if got := counts(); got != [3]int{1, 1, 2} {
+		t.Fatalf("unexpected replacer counts after reloading: %v", got)
+	}
+	// the shared replacers run ahead of the directional ones
+	if got := string(p.TransformDirection([]byte("foo shared 42"), Downstream)); got != "down common N" {
+		t.Errorf("got %q", got)
+	}
+
+	// an invalid config, even one with valid entries, changes nothing
+	err := p.LoadConfig([]byte(configValid + invalidConfigs[0]))
+	if err == nil {
+		t.Fatal("expected an error for the invalid entry")
+	}
+	if !strings.Contains(err.Error(), "replacer 3") {
+		t.Errorf("error should name the invalid entry, got %v", err)
+	}
+	if got := counts(); got != [3]int{1, 1, 2} {
+		t.Errorf("a failed load should keep the previous replacers, got %v", got)
+	}
+}
+
+func TestStringReplacerBinarySafe(t *testing.T) {
+	r := &StringReplacer{"héllo", "bye"}
+
+	// invalid UTF-8, a lone continuation byte and half of a multibyte rune
+	in := []byte("\xff\xfe\x80 h\xc3\xa9llo \xe2\x82")
+	want := []byte("\xff\xfe\x80 bye \xe2\x82")
+	if got := r.Replace(in); !bytes.Equal(got, want) {
+		t.Errorf("wanted %x, got %x", want, got)
+	}
+
+	noMatch := []byte{0x00, 0xc3, 0xff, 0x7f, 0xed, 0xa0, 0x80}
+	if got := r.Replace(noMatch); !bytes.Equal(got, noMatch) {
+		t.Errorf("non-matching bytes should pass through unchanged, got %x", got)
+	}
+}
+
+// dropReplacer - Drops every chunk containing its marker
+type dropReplacer struct{ marker string }
+
+func (r dropReplacer) Replace(in []byte) []byte {
+	if bytes.Contains(in, []byte(r.marker)) {
+		return nil
+	}
+	return in
+}
+
+func (r dropReplacer) String() string { return "drop " + r.marker }
+
+// countingReplacer - Counts the chunks it sees
+type countingReplacer struct{ n *int }
+
+func (r countingReplacer) Replace(in []byte) []byte {
+	*r.n++
+	return in
+}
+
+func (r countingReplacer) String() string { return "counter" }
+
+func TestReplacerDrop(t *testing.T) {
+	var seen int
+	replacers := []Replacer{dropReplacer{"secret"}, countingReplacer{&seen}}
+	if got := ApplyReplacers([]byte("a secret"), replacers); got != nil {
+		t.Errorf("chunk should be dropped, got %q", got)
+	}
+	if seen != 0 {
+		t.Errorf("replacers after a drop should not run")
+	}
+	if got := ApplyReplacers([]byte("public"), replacers); string(got) != "public" || seen != 1 {
+		t.Errorf("other chunks should pass through, got %q", got)
+	}
+}
+
+func TestBuiltinReplacersNeverDrop(t *testing.T) {
+	in := []byte("gone")
+	for _, r := range []Replacer{
+		&StringReplacer{"gone", ""},
+		&RegexReplacer{regexp.MustCompile("g.*"), nil},
+		&BytesReplacer{[]byte("gone"), nil},
+	} {
+		if got := r.Replace(in); got == nil || len(got) != 0 {
+			t.Errorf("%s: removing everything should give an empty chunk, not a drop, got %#v", r, got)
+		}
+	}
+}
+
+func TestChangesLength(t *testing.T) {
+	cases := []struct {
+		r    Replacer
+		want bool
+	}{
+		{&StringReplacer{In: "foo", Out: "bar"}, false},
+		{&StringReplacer{In: "foo", Out: "barbaz"}, true},
+		{&BytesReplacer{In: []byte{1, 2}, Out: []byte{3, 4}}, false},
+		{&BytesReplacer{In: []byte{1, 2}, Out: []byte{3}}, true},
+		{&RegexReplacer{In: regexp.MustCompile("foo"), Out: []byte("bar")}, false},
+		{&RegexReplacer{In: regexp.MustCompile("fo+"), Out: []byte("bar")}, true},
+		{&RegexReplacer{In: regexp.MustCompile("foo"), Out: []byte("$1x")}, true},
+		{dropReplacer{}, true},
+	}
+	for _, c := range cases {
+		if got := ChangesLength(c.r); got != c.want {
+			t.Errorf("%s: expected ChangesLength %v, got %v", c.r, c.want, got)
+		}
+	}
+}
+
+func TestStripReplacer(t *testing.T) {
+	var p Proxy
+	p.Log = NullLogger{}
+	config := `
+- type: strip
+  find: "X-Tracking: 1\r\n"
+- type: strip
+  match: regex
+  find: "session=[0-9]+;?"
+- type: strip
+  find: [0xde, 0xad]
+`
+	if err := p.LoadConfig([]byte(config)); err != nil {
+		t.Fatalf("failed to parse strip config: %v", err)
+	}
+	if len(p.Replacers) != 3 {
+		t.Fatalf("wanted 3 replacers, got %d", len(p.Replacers))
+	}
+	cases := []struct {
+		in, want string
+	}{
+		{"GET / HTTP/1.1\r\nX-Tracking: 1\r\nHost: a\r\nX-Tracking: 1\r\n", "GET / HTTP/1.1\r\nHost: a\r\n"},
+		{"Cookie: session=1234; lang=en", "Cookie:  lang=en"},
+		{"\x01\xde\xad\x02\xde\xad", "\x01\x02"},
+		{"untouched", "untouched"},
+	}
+	for i, c := range cases {
+		if got := p.Replacers[i%3].Replace([]byte(c.in)); string(got) != c.want {
+			t.Errorf("%s: wanted %q, got %q", p.Replacers[i%3], c.want, got)
+		}
+	}
+	if got := p.Replacers[2].Replace([]byte{0xde, 0xad}); got == nil || len(got) != 0 {
+		t.Errorf("stripping everything should give an empty chunk, got %#v", got)
+	}
+
+	for _, invalid := range []string{
+		"- type: strip\n  find: foo\n  replace: bar\n",
+		"- type: strip\n  match: regex\n  find: \"(\"\n",
+		"- type: strip\n  match: glob\n  find: foo\n",
+		"- type: strip\n  match: bytes\n  find: foo\n",
+		"- type: strip\n",
+	} {
+		if err := p.LoadConfig([]byte(invalid)); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestParseByteSliceNumbers(t *testing.T) {
+	for _, tc := range []struct {
+		find string
+		want []byte
+		err  string
+	}{
+		{find: "[0x00, 255, 0o17]", want: []byte{0x00, 0xff, 0x0f}},
+		{find: "[1.0, 2e1, 0x7f]", want: []byte{0x01, 0x14, 0x7f}},
+		{find: "[256]", err: "element 0 (256) is out of byte range"},
+		{find: "[1, -1]", err: "element 1 (-1) is out of byte range"},
+		{find: "[9223372036854775807]", err: "element 0 (9223372036854775807) is out of byte range"},
+		{find: "[18446744073709551615]", err: "element 0 (18446744073709551615) is out of byte range"},
+		{find: "[1e300]", err: "element 0 (1e+300) is out of byte range"},
+		{find: "[-.inf]", err: "element 0 (-Inf) is out of byte range"},
+		{find: "[1.5]", err: "element 0 (1.5) is not a whole number"},
+		{find: "[.nan]", err: "element 0 (NaN) is not a whole number"},
+		{find: "[a]", err: "element 0 is not an integer, got string"},
+	} {
+		var rc ReplacerConfig
+		if err := yaml.Unmarshal([]byte("type: bytes\nfind: "+tc.find), &rc); err != nil {
+			t.Fatalf("%s: %v", tc.find, err)
+		}
+		r, err := rc.Parse()
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: wanted an error containing %q, got %v", tc.find, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.find, err)
+		} else if got := r.(*BytesReplacer).In; !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: wanted %x, got %x", tc.find, tc.want, got)
+		}
+	}
+
+	long := make([]interface{}, maxByteSlice+1)
+	for i := range long {
+		long[i] = 0
+	}
+	if _, err := parseByteSlice(long); err == nil || !strings.Contains(err.Error(), "longer than the limit") {
+		t.Errorf("wanted a list of %d bytes rejected, got %v", len(long), err)
+	}
+}
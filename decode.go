@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// defaultMaxDecodeSize - How large a compressed stream may get, before or
+// after decompression, for the decoder to look inside it
+const defaultMaxDecodeSize = 1 << 20
+
+var errDecodeTooLarge = errors.New("decompressed data exceeds limit")
+
+// decoder - Finds gzip and zlib streams in one direction of a connection and
+// hands their decompressed content to the inspection. A stream split over
+// several reads is buffered until it is complete.
+type decoder struct {
+	max     int
+	pending []byte
+}
+
+func newDecoder(max int) *decoder {
+	if max <= 0 {
+		max = defaultMaxDecodeSize
+	}
+	return &decoder{max: max}
+}
+
+// feed - Process a chunk, returning the bytes to forward. Plain data is run
+// through inspect as is. For compressed streams inspect gets the decompressed
+// content; the stream is re-compressed if inspect changed it and forwarded
+// untouched otherwise. Returns nothing while a stream is incomplete.
+func (d *decoder) feed(b []byte, inspect func([]byte) []byte) []byte {
+	var out []byte
+	data := b
+	if len(d.pending) > 0 {
+		data = append(d.pending, b...)
+		d.pending = nil
+	}
+
+	for len(data) > 0 {
+		start, kind := findCompressed(data)
+		if start < 0 {
+			return append(out, inspect(data)...)
+		}
+		if start > 0 {
+			out = append(out, inspect(data[:start])...)
+			data = data[start:]
+		}
+
+		n, plain, err := decompress(kind, data, d.max)
+		switch {
+		case err == io.ErrUnexpectedEOF && len(data) <= d.max && (kind == compressGzip || len(data) > zlibHeaderLen):
+			// wait for the rest of the stream. A zlib header is only two
+			// bytes, common enough in plain data, so it is only taken for
+			// one once some deflate data after it inflated without error.
+			d.pending = append([]byte(nil), data...)
+			return out
+		case err != nil:
+			// not really compressed, or too big to look at: inspect it as
+			// plain data and keep looking past the header
+			skip := 2
+			if err == errDecodeTooLarge || (err == io.ErrUnexpectedEOF && len(data) > d.max) {
+				skip = len(data)
+			}
+			out = append(out, inspect(data[:skip])...)
+			data = data[skip:]
+			continue
+		}
+
+		inspected := inspect(append([]byte(nil), plain...))
+		switch {
+		case inspected == nil:
+			// dropped by a replacer
+		case bytes.Equal(inspected, plain):
+			out = append(out, data[:n]...)
+		default:
+			out = append(out, recompress(kind, data[:n], inspected)...)
+		}
+		data = data[n:]
+	}
+	return out
+}
+
+// flush - The bytes of a stream still incomplete once the connection ends,
+// to be forwarded as they are
+func (d *decoder) flush() []byte {
+	pending := d.pending
+	d.pending = nil
+	return pending
+}
+
+type compression int
+
+const (
+	compressGzip compression = iota
+	compressZlib
+)
+
+// zlibHeaderLen - The size of the CMF and FLG bytes starting a zlib stream
+const zlibHeaderLen = 2
+
+// findCompressed - Offset of the first gzip or zlib header in b, or -1
+func findCompressed(b []byte) (int, compression) {
+	for i := 0; i+1 < len(b); i++ {
+		if b[i] == 0x1f && b[i+1] == 0x8b && (i+2 >= len(b) || b[i+2] == 0x08) {
+			return i, compressGzip
+		}
+		if isZlibHeader(b[i], b[i+1]) {
+			return i, compressZlib
+		}
+	}
+	return -1, 0
+}
+
+// isZlibHeader - Whether cmf and flg start a zlib stream as RFC 1950 has
+// it: deflate with a 32K window, a valid FCHECK and no preset dictionary,
+// which the decoder couldn't supply
+func isZlibHeader(cmf, flg byte) bool {
+	return cmf == 0x78 && flg&0x20 == 0 && (uint16(cmf)<<8|uint16(flg))%31 == 0
+}
+
+// decompress - Decompress the stream at the start of b, returning how many
+// bytes of b it took up along with its content. io.ErrUnexpectedEOF means
+// the stream continues past the end of b.
+func decompress(kind compression, b []byte, max int) (int, []byte, error) {
+	r := bytes.NewReader(b)
+	var zr io.Reader
+	var err error
+	if kind == compressGzip {
+		var gr *gzip.Reader
+		gr, err = gzip.NewReader(r)
+		if err == nil {
+			gr.Multistream(false)
+			zr = gr
+		}
+	} else {
+		zr, err = zlib.NewReader(r)
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+
+	plain, err := ioutil.ReadAll(io.LimitReader(zr, int64(max)+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(plain) > max {
+		return 0, nil, errDecodeTooLarge
+	}
+	return len(b) - r.Len(), plain, nil
+}
+
+// recompress - Compress plain the same way as the original stream
+func recompress(kind compression, original, plain []byte) []byte {
+	var buf bytes.Buffer
+	if kind == compressGzip {
+		w := gzip.NewWriter(&buf)
+		if gr, err := gzip.NewReader(bytes.NewReader(original)); err == nil {
+			w.Header = gr.Header
+		}
+		w.Write(plain)
+		w.Close()
+	} else {
+		w := zlib.NewWriter(&buf)
+		w.Write(plain)
+		w.Close()
+	}
+	return buf.Bytes()
+}
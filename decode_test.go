@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.Bytes()
+}
+
+func gunzip(t *testing.T, b []byte) string {
+	t.Helper()
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("output is not gzip: %v", err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to decompress output: %v", err)
+	}
+	return string(out)
+}
+
+func replaceSecret(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte("secret"), []byte("public"))
+}
+
+func TestDecodeGzip(t *testing.T) {
+	d := newDecoder(0)
+	in := gzipped(t, "the secret is out")
+	out := d.feed(in, replaceSecret)
+	if got := gunzip(t, out); got != "the public is out" {
+		t.Errorf("wanted replaced plaintext, got %q", got)
+	}
+}
+
+func TestDecodeUnmodified(t *testing.T) {
+	d := newDecoder(0)
+	in := gzipped(t, "nothing to see here")
+	if out := d.feed(in, replaceSecret); !bytes.Equal(out, in) {
+		t.Errorf("unmodified stream should be forwarded as is")
+	}
+}
+
+func TestDecodeSplitStream(t *testing.T) {
+	d := newDecoder(0)
+	stream := gzipped(t, "a secret body")
+
+	out := d.feed([]byte("HTTP/1.1 200 OK secret\r\n\r\n"), replaceSecret)
+	for i := 0; i < len(stream); i += 7 {
+		end := i + 7
+		if end > len(stream) {
+			end = len(stream)
+		}
+		out = append(out, d.feed(stream[i:end], replaceSecret)...)
+	}
+	out = append(out, d.feed([]byte("trailing secret"), replaceSecret)...)
+
+	head := "HTTP/1.1 200 OK public\r\n\r\n"
+	if !bytes.HasPrefix(out, []byte(head)) {
+		t.Fatalf("plain data before the stream should be inspected, got %q", out)
+	}
+	if !bytes.HasSuffix(out, []byte("trailing public")) {
+		t.Fatalf("plain data after the stream should be inspected, got %q", out)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(out[len(head):]))
+	if err != nil {
+		t.Fatalf("output is not gzip: %v", err)
+	}
+	r.Multistream(false)
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to decompress output: %v", err)
+	}
+	if string(plain) != "a public body" {
+		t.Errorf("wanted replaced body, got %q", plain)
+	}
+}
+
+func TestDecodeZlib(t *testing.T) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write([]byte("zlib secret"))
+	w.Close()
+
+	out := newDecoder(0).feed(buf.Bytes(), replaceSecret)
+	r, err := zlib.NewReader(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("output is not zlib: %v", err)
+	}
+	plain, _ := ioutil.ReadAll(r)
+	if string(plain) != "zlib public" {
+		t.Errorf("wanted replaced plaintext, got %q", plain)
+	}
+}
+
+func TestDecodeLimit(t *testing.T) {
+	var seen [][]byte
+	record := func(b []byte) []byte {
+		seen = append(seen, append([]byte(nil), b...))
+		return b
+	}
+	const plain = "a secret longer than the decode limit"
+	in := gzipped(t, plain)
+
+	d := newDecoder(16)
+	if out := d.feed(in, record); !bytes.Equal(out, in) {
+		t.Errorf("stream over the limit should be forwarded as is")
+	}
+
+	// an incomplete stream isn't buffered past the limit either
+	d = newDecoder(8)
+	partial := in[:12]
+	if out := d.feed(partial, record); !bytes.Equal(out, partial) {
+		t.Errorf("incomplete stream over the limit should be flushed, got %x", out)
+	}
+
+	for _, b := range seen {
+		if string(b) == plain {
+			t.Errorf("stream over the limit should not be decompressed")
+		}
+	}
+}
+
+func TestDecodeCompressedProxy(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.DecodeCompressed = true
+		p.UpstreamReplacers = []Replacer{&StringReplacer{"secret", "public"}}
+	})
+
+	in := gzipped(t, "my secret payload")
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Write(in); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	// the re-compressed length isn't known up front, read until the stream
+	// decompresses
+	r, err := gzip.NewReader(client)
+	if err != nil {
+		t.Fatalf("echoed data is not gzip: %v", err)
+	}
+	r.Multistream(false)
+	got := make([]byte, len("my public payload"))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("failed to read echoed payload: %v", err)
+	}
+	client.Close()
+	<-done
+
+	if string(got) != "my public payload" {
+		t.Errorf("wanted replaced payload, got %q", got)
+	}
+}
+
+func TestDecodeZlibHeaderInPlainData(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"bad fcheck", "x\x02a secret", "x\x02a public"},
+		{"preset dictionary", "x\xbba secret", "x\xbba public"},
+		{"no deflate data yet", "a secret x\x9c", "a public x\x9c"},
+		{"corrupt deflate data", "x\x01a secret", "x\x01a public"},
+	} {
+		if out := newDecoder(0).feed([]byte(tc.in), replaceSecret); string(out) != tc.want {
+			t.Errorf("%s: wanted %q forwarded as plain data, got %q", tc.name, tc.want, out)
+		}
+	}
+}
+
+func TestDecodeFlushAtEOF(t *testing.T) {
+	sink, received := startSink(t)
+	defer sink.Close()
+	client, done := startProxy(t, sink.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.DecodeCompressed = true
+	})
+
+	// a stream cut short is held back waiting for the rest, until the
+	// client closes
+	in := gzipped(t, "a secret body")
+	in = in[:len(in)-4]
+	if _, err := client.Write(in); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	client.(*net.TCPConn).CloseWrite()
+	select {
+	case got := <-received:
+		if got != string(in) {
+			t.Errorf("wanted the incomplete stream forwarded as is, got %x", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("remote never got the stream")
+	}
+	client.Close()
+	<-done
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// dumpWidth - Bytes per line of a Dump
+const dumpWidth = 16
+
+// dump - Write a chunk forwarded in direction to Dump as a hexdump, offsets
+// counting from the start of that direction's stream
+func (p *Proxy) dump(direction Direction, b []byte) {
+	if p.Dump == nil || len(b) == 0 {
+		return
+	}
+	p.dumpLock.Lock()
+	defer p.dumpLock.Unlock()
+	offset := p.dumpOffsets[direction]
+	p.dumpOffsets[direction] += uint64(len(b))
+
+	arrow := ">>>"
+	if direction == Downstream {
+		arrow = "<<<"
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s %s %d bytes at offset %d\n", p.clock().Now().Format(time.RFC3339Nano), arrow, direction, len(b), offset)
+	writeHexDump(&buf, b, offset)
+	if _, err := p.Dump.Write(buf.Bytes()); err != nil && !p.dumpFailed {
+		p.dumpFailed = true
+		p.Log.Warn("Writing the dump failed: %v", err)
+	}
+}
+
+// writeHexDump - Format b like hexdump -C, the first line at offset
+func writeHexDump(buf *bytes.Buffer, b []byte, offset uint64) {
+	for len(b) > 0 {
+		line := b
+		if len(line) > dumpWidth {
+			line = line[:dumpWidth]
+		}
+		fmt.Fprintf(buf, "%08x ", offset)
+		for i := 0; i < dumpWidth; i++ {
+			if i%8 == 0 {
+				buf.WriteByte(' ')
+			}
+			if i < len(line) {
+				fmt.Fprintf(buf, "%02x ", line[i])
+			} else {
+				buf.WriteString("   ")
+			}
+		}
+		buf.WriteString(" |")
+		for _, c := range line {
+			if c < 32 || c > 126 {
+				c = '.'
+			}
+			buf.WriteByte(c)
+		}
+		buf.WriteString("|\n")
+		offset += uint64(len(line))
+		b = b[len(line):]
+	}
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	var dump bytes.Buffer
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.Dump = &dump
+	})
+	echoRoundTrip(t, client, "hello, world!\x00\x01abc")
+	echoRoundTrip(t, client, "more")
+	client.Close()
+	<-done
+
+	out := dump.String()
+	for _, want := range []string{
+		">>> upstream 18 bytes at offset 0\n",
+		"<<< downstream 18 bytes at offset 0\n",
+		"00000000  68 65 6c 6c 6f 2c 20 77  6f 72 6c 64 21 00 01 61  |hello, world!..a|\n",
+		"00000010  62 63                                             |bc|\n",
+		">>> upstream 4 bytes at offset 18\n",
+		"00000012  6d 6f 72 65                                       |more|\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("dump is missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+)
+
+// defaultEntropyWindow - Bytes entropy is measured over when Window is unset
+const defaultEntropyWindow = 4096
+
+// EntropyCheck - Flags a direction whose data looks encrypted or
+// compressed, e.g. to catch exfiltration over a plain text protocol. The
+// Shannon entropy of the last Window bytes is measured as data is read, and
+// once it is above Threshold the check matches like a yara rule named
+// HighEntropy in the entropy namespace, with Tags deciding what happens.
+// It matches at most once per connection and direction.
+type EntropyCheck struct {
+	// Threshold - Entropy in bits per byte, up to 8, above which a window
+	// counts as high entropy; 7.5 catches most encrypted and compressed
+	// data. Zero turns the check off.
+	Threshold float64
+	// Window - How many of the latest bytes the entropy is measured over,
+	// defaults to 4096. Nothing matches before that many were read.
+	Window int
+	// Tags - Handled like a yara rule's tags: log, warn and drop. Defaults
+	// to log.
+	Tags []string
+}
+
+// entropyMeter - The rolling byte counts of one direction's last Window
+// bytes
+type entropyMeter struct {
+	EntropyCheck
+	direction Direction
+	counts    [256]int
+	ring      []byte
+	next      int
+	filled    bool
+	matched   bool
+}
+
+func (p *Proxy) newEntropyMeter(direction Direction) *entropyMeter {
+	check := p.UpstreamEntropy
+	if direction == Downstream {
+		check = p.DownstreamEntropy
+	}
+	if p.passthrough || check.Threshold <= 0 {
+		return nil
+	}
+	if check.Window <= 0 {
+		check.Window = defaultEntropyWindow
+	}
+	return &entropyMeter{EntropyCheck: check, direction: direction, ring: make([]byte, check.Window)}
+}
+
+// feed - Add b to the window, returning the entropy of the window and
+// whether it newly went over the threshold
+func (m *entropyMeter) feed(b []byte) (float64, bool) {
+	if m.matched {
+		return 0, false
+	}
+	for _, c := range b {
+		if m.filled {
+			m.counts[m.ring[m.next]]--
+		}
+		m.counts[c]++
+		m.ring[m.next] = c
+		if m.next++; m.next == len(m.ring) {
+			m.next, m.filled = 0, true
+		}
+	}
+	if !m.filled {
+		return 0, false
+	}
+	e := m.entropy()
+	if e <= m.Threshold {
+		return e, false
+	}
+	m.matched = true
+	return e, true
+}
+
+// entropy - Shannon entropy of the window in bits per byte
+func (m *entropyMeter) entropy() float64 {
+	var e float64
+	n := float64(len(m.ring))
+	for _, c := range m.counts {
+		if c == 0 {
+			continue
+		}
+		f := float64(c) / n
+		e -= f * math.Log2(f)
+	}
+	return e
+}
+
+// checkEntropy - Feed a chunk to the meter and handle a match the way a
+// rule match is
+func (p *Proxy) checkEntropy(m *entropyMeter, b []byte) {
+	e, high := m.feed(b)
+	if !high {
+		return
+	}
+	tags := m.Tags
+	if len(tags) == 0 {
+		tags = []string{"log"}
+	}
+	p.Log.Debug("%s entropy is %.2f bits per byte over the last %d bytes", m.direction, e, m.Window)
+	p.handleMatch(RuleMatch{
+		Rule:      "HighEntropy",
+		Namespace: "entropy",
+		Tags:      tags,
+		Meta: map[string]interface{}{
+			"direction": m.direction.String(),
+			"entropy":   fmt.Sprintf("%.2f", e),
+			"window":    m.Window,
+		},
+	})
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEntropyMeter(t *testing.T) {
+	p := &Proxy{UpstreamEntropy: EntropyCheck{Threshold: 7.5, Window: 1024}}
+	m := p.newEntropyMeter(Upstream)
+
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 100))
+	if e, high := m.feed(text); high || e > 5 {
+		t.Errorf("text shouldn't count as high entropy, got %.2f", e)
+	}
+	random := make([]byte, 2048)
+	rand.Read(random)
+	// half a window of random data still leaves half of it text
+	if _, high := m.feed(random[:512]); high {
+		t.Errorf("the window isn't mostly random yet")
+	}
+	if e, high := m.feed(random[512:]); !high || e < 7.5 {
+		t.Errorf("random data should count as high entropy, got %.2f", e)
+	}
+	if _, high := m.feed(random); high {
+		t.Errorf("the check should only match once")
+	}
+
+	if (&Proxy{}).newEntropyMeter(Upstream) != nil {
+		t.Errorf("no meter should be made without a threshold")
+	}
+}
+
+func TestEntropyDrop(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	matches := make(chan RuleMatch, 1)
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.UpstreamEntropy = EntropyCheck{Threshold: 7.5, Window: 1024, Tags: []string{"drop"}}
+		p.OnRuleMatch = func(m RuleMatch) { matches <- m }
+	})
+	if got := echoRoundTrip(t, client, strings.Repeat("plain text ", 200)); !strings.HasPrefix(got, "plain text") {
+		t.Fatalf("low entropy data should be relayed, got %q", got)
+	}
+
+	random := make([]byte, 4096)
+	rand.Read(random)
+	client.Write(random)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, client); err != nil {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+	<-done
+
+	select {
+	case m := <-matches:
+		if m.Rule != "HighEntropy" || m.Namespace != "entropy" || m.Meta["direction"] != "upstream" {
+			t.Errorf("unexpected match %+v", m)
+		}
+	default:
+		t.Fatal("high entropy data wasn't matched")
+	}
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The categories of error a connection can end with, see Proxy.Err. Match
+// them with errors.Is; the errors themselves carry the details.
+var (
+	// ErrRemoteDial - The remote connection could not be opened, see
+	// DialError
+	ErrRemoteDial = errors.New("remote connection failed")
+	// ErrRuleBlock - A rule tagged drop matched and the connection was
+	// blocked
+	ErrRuleBlock = errors.New("blocked by rule")
+	// ErrIdleTimeout - Nothing was relayed for IdleTimeout
+	ErrIdleTimeout = errors.New("idle timeout reached")
+	// ErrMaxLifetime - The connection was open for MaxLifetime
+	ErrMaxLifetime = errors.New("max lifetime reached")
+	// ErrConfig - A replacer config entry is invalid, see ConfigError
+	ErrConfig = errors.New("invalid replacer config")
+)
+
+// DialError - Why the remote connection of a Proxy failed. Matches
+// ErrRemoteDial, and unwraps to the dial error so its cause, such as
+// ErrQueueFull or a syscall error, can be matched as well.
+type DialError struct {
+	Err error
+}
+
+func (e *DialError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Is - Match ErrRemoteDial
+func (e *DialError) Is(target error) bool {
+	return target == ErrRemoteDial
+}
+
+// ConfigError - An invalid entry of a replacer config, one of the items of
+// the error LoadConfig and ReadConfigFile return. Matches ErrConfig.
+type ConfigError struct {
+	// Section - "both", "upstream" or "downstream" for the sectioned form of
+	// the config, empty for a plain list
+	Section string
+	// Index - The position of the entry in its list, from 0
+	Index int
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Section != "" {
+		return fmt.Sprintf("%s replacer %d: %v", e.Section, e.Index, e.Err)
+	}
+	return fmt.Sprintf("replacer %d: %v", e.Index, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// Is - Match ErrConfig
+func (e *ConfigError) Is(target error) bool {
+	return target == ErrConfig
+}
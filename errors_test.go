@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunDialError(t *testing.T) {
+	// a port nothing listens on
+	closed := listenLocal(t)
+	raddr := closed.Addr().(*net.TCPAddr)
+	closed.Close()
+
+	local, client := net.Pipe()
+	defer client.Close()
+	err := NewFromConn(local, raddr).Run()
+	if !errors.Is(err, ErrRemoteDial) {
+		t.Fatalf("wanted ErrRemoteDial, got %v", err)
+	}
+	var dial *DialError
+	var op *net.OpError
+	if !errors.As(err, &dial) || !errors.As(err, &op) {
+		t.Errorf("wanted a DialError unwrapping to the refused dial, got %#v", err)
+	}
+}
+
+func TestErrCategories(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	for _, tc := range []struct {
+		name  string
+		setup func(*Proxy)
+		want  error
+	}{
+		{"rule block", func(p *Proxy) {
+			p.Matcher = func(MatchContext) {
+				p.handleMatch(RuleMatch{Rule: "Bad", Namespace: "default", Tags: []string{"drop"}})
+			}
+		}, ErrRuleBlock},
+		{"idle timeout", func(p *Proxy) { p.IdleTimeout = 50 * time.Millisecond }, ErrIdleTimeout},
+		{"max lifetime", func(p *Proxy) { p.MaxLifetime = 50 * time.Millisecond }, ErrMaxLifetime},
+	} {
+		var proxy *Proxy
+		client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+			proxy = p
+			tc.setup(p)
+		})
+		client.Write([]byte("hello"))
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: connection wasn't closed", tc.name)
+		}
+		client.Close()
+		if err := proxy.Err(); !errors.Is(err, tc.want) {
+			t.Errorf("%s: wanted %v, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestErrNormalClose(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	var proxy *Proxy
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) { proxy = p })
+	echoRoundTrip(t, client, "hello")
+	client.Close()
+	<-done
+	if err := proxy.Err(); err != nil {
+		t.Errorf("wanted no error once the client closed, got %v", err)
+	}
+}
+
+func TestConfigError(t *testing.T) {
+	_, err := readConfigData([]byte("upstream:\n  - type: substring\n    find: x\n  - type: sideways\n"))
+	if !errors.Is(err, ErrConfig) {
+		t.Fatalf("wanted ErrConfig, got %v", err)
+	}
+	var item *ConfigError
+	if !errors.As(err, &item) || item.Section != "upstream" || item.Index != 1 {
+		t.Fatalf("wanted a ConfigError for upstream entry 1, got %#v", err)
+	}
+	if !strings.HasPrefix(item.Error(), "upstream replacer 1: ") {
+		t.Errorf("unexpected message %q", item.Error())
+	}
+}
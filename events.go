@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// eventQueue - Events an EventSocket holds while writing before new ones
+// are dropped
+const eventQueue = 256
+
+// eventWriteTimeout - How long dialing the socket or writing an event may
+// take before the event is dropped
+const eventWriteTimeout = time.Second
+
+// eventRedial - How often an EventSocket tries to reconnect while the
+// socket is unavailable
+var eventRedial = time.Second
+
+// Event - One line written to an EventSocket. Sent, Received and Reason are
+// set for close events, Rule, Namespace and Tags for match events.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Event - open, close or match
+	Event     string   `json:"event"`
+	ID        uint64   `json:"id"`
+	UUID      string   `json:"uuid,omitempty"`
+	Client    string   `json:"client"`
+	Local     string   `json:"local"`
+	Remote    string   `json:"remote"`
+	Sent      uint64   `json:"sent,omitempty"`
+	Received  uint64   `json:"received,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+	Rule      string   `json:"rule,omitempty"`
+	Namespace string   `json:"namespace,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	// ConnTags - the connection's Tags, unlike Tags which are the rule's
+	ConnTags map[string]string `json:"conn_tags,omitempty"`
+}
+
+// EventSocket - Writes connection and match events as JSON lines to a Unix
+// socket for a local collector, from a goroutine of its own so the proxy
+// never waits on it. While the socket is unavailable, or the queue is full,
+// events are dropped and counted; the socket is redialed every second, so
+// a restarted collector starts getting events again. One EventSocket is
+// usually shared by all connections.
+type EventSocket struct {
+	network, path string
+	log           Logger
+	events        chan []byte
+	dropped       uint64
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// NewEventSocket - Start writing events to the Unix socket at path, with
+// network unix for a stream socket or unixgram for a datagram socket, one
+// event per datagram. Problems with the socket are logged to log.
+func NewEventSocket(network, path string, log Logger) *EventSocket {
+	if log == nil {
+		log = NullLogger{}
+	}
+	s := &EventSocket{
+		network: network,
+		path:    path,
+		log:     log,
+		events:  make(chan []byte, eventQueue),
+		done:    make(chan struct{}),
+	}
+	go s.run(eventRedial)
+	return s
+}
+
+// Emit - Queue e to be written, or drop it if the queue is full
+func (s *EventSocket) Emit(e Event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		atomic.AddUint64(&s.dropped, 1)
+		return
+	}
+	select {
+	case s.events <- append(b, '\n'):
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Dropped - Number of events that weren't written
+func (s *EventSocket) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close - Stop writing events and close the socket. Events still queued are
+// dropped.
+func (s *EventSocket) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *EventSocket) run(redial time.Duration) {
+	var conn net.Conn
+	var dialed time.Time
+	down := false
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		var b []byte
+		select {
+		case <-s.done:
+			return
+		case b = <-s.events:
+		}
+		if conn == nil && time.Since(dialed) >= redial {
+			dialed = time.Now()
+			c, err := net.DialTimeout(s.network, s.path, eventWriteTimeout)
+			switch {
+			case err != nil && !down:
+				s.log.Warn("Event socket %s unavailable, dropping events: %s", s.path, err)
+				down = true
+			case err == nil:
+				if down {
+					s.log.Info("Event socket %s reconnected, %d events dropped so far", s.path, s.Dropped())
+				}
+				conn, down = c, false
+			}
+		}
+		if conn == nil {
+			atomic.AddUint64(&s.dropped, 1)
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if _, err := conn.Write(b); err != nil {
+			atomic.AddUint64(&s.dropped, 1)
+			s.log.Warn("Writing to event socket %s failed, dropping events: %s", s.path, err)
+			conn.Close()
+			conn, down = nil, true
+		}
+	}
+}
+
+// event - An Event of the given kind describing this connection
+func (p *Proxy) event(kind string) Event {
+	return Event{
+		Time:     p.clock().Now(),
+		Event:    kind,
+		ID:       p.ID,
+		UUID:     p.UUID,
+		Client:   p.clientAddr(),
+		Local:    p.laddr.String(),
+		Remote:   p.remoteString(),
+		ConnTags: p.tags(),
+	}
+}
+
+func (p *Proxy) emitOpen() {
+	if p.Events != nil {
+		p.Events.Emit(p.event("open"))
+	}
+}
+
+func (p *Proxy) emitClose(stats Stats) {
+	if p.Events == nil {
+		return
+	}
+	e := p.event("close")
+	e.Sent, e.Received, e.Reason = stats.BytesSent, stats.BytesReceived, p.CloseReason()
+	p.Events.Emit(e)
+}
+
+func (p *Proxy) emitMatch(m RuleMatch) {
+	if p.Events == nil {
+		return
+	}
+	e := p.event("match")
+	e.Rule, e.Namespace, e.Tags = m.Rule, m.Namespace, m.Tags
+	p.Events.Emit(e)
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readEvents - Decode the events arriving on each connection to l, until
+// stop closes l and the connections, as a collector exiting would
+func readEvents(t *testing.T, l net.Listener) (events <-chan Event, stop func()) {
+	ch := make(chan Event, 16)
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+			go func() {
+				defer c.Close()
+				lines := bufio.NewScanner(c)
+				for lines.Scan() {
+					var e Event
+					if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+						t.Errorf("bad event %q: %v", lines.Text(), err)
+						return
+					}
+					ch <- e
+				}
+			}()
+		}
+	}()
+	return ch, func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+}
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event arrived")
+	}
+	return Event{}
+}
+
+func TestEventSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	events, stop := readEvents(t, l)
+	defer stop()
+
+	sock := NewEventSocket("unix", path, nil)
+	defer sock.Close()
+	echo := startEcho(t)
+	defer echo.Close()
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.ID = 7
+		p.Events = sock
+		p.UpstreamEntropy = EntropyCheck{Threshold: 3, Window: 16}
+	})
+	echoRoundTrip(t, client, "abcdefghijklmnop")
+	client.Close()
+	<-done
+
+	if e := nextEvent(t, events); e.Event != "open" || e.ID != 7 || e.Client == "" || e.Remote != echo.Addr().String() {
+		t.Errorf("unexpected open event %+v", e)
+	}
+	if e := nextEvent(t, events); e.Event != "match" || e.Rule != "HighEntropy" || e.Namespace != "entropy" {
+		t.Errorf("unexpected match event %+v", e)
+	}
+	if e := nextEvent(t, events); e.Event != "close" || e.Sent != 16 || e.Received != 16 || e.Reason == "" {
+		t.Errorf("unexpected close event %+v", e)
+	}
+	if n := sock.Dropped(); n != 0 {
+		t.Errorf("no events should have been dropped, got %d", n)
+	}
+}
+
+func TestEventSocketReconnect(t *testing.T) {
+	defer func(d time.Duration) { eventRedial = d }(eventRedial)
+	eventRedial = 10 * time.Millisecond
+
+	// the collector isn't running yet
+	path := filepath.Join(t.TempDir(), "events.sock")
+	sock := NewEventSocket("unix", path, nil)
+	defer sock.Close()
+	sock.Emit(Event{Event: "open", ID: 1})
+	deadline := time.Now().Add(2 * time.Second)
+	for sock.Dropped() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := sock.Dropped(); n != 1 {
+		t.Fatalf("wanted the event dropped while the socket is missing, got %d", n)
+	}
+
+	for restart := 0; restart < 2; restart++ {
+		os.Remove(path)
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		events, stop := readEvents(t, l)
+		// events are dropped until the socket is redialed
+		var got Event
+		deadline := time.Now().Add(2 * time.Second)
+		for got.ID == 0 && time.Now().Before(deadline) {
+			sock.Emit(Event{Event: "open", ID: 2})
+			select {
+			case got = <-events:
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+		if got.ID != 2 {
+			t.Fatalf("restart %d: no event arrived after the collector started", restart)
+		}
+		stop()
+	}
+}
+
+func TestEventSocketDatagrams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	pc, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer pc.Close()
+
+	sock := NewEventSocket("unixgram", path, nil)
+	defer sock.Close()
+	sock.Emit(Event{Event: "close", ID: 3, Reason: "client closed"})
+
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := pc.Read(buf)
+	if err != nil {
+		t.Fatalf("no datagram arrived: %v", err)
+	}
+	var e Event
+	if err := json.Unmarshal(buf[:n], &e); err != nil || e.ID != 3 || e.Reason != "client closed" {
+		t.Errorf("unexpected datagram %q: %v", buf[:n], err)
+	}
+}
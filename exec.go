@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultExecTimeout - How long a hook command may run when ExecTimeout is unset
+const defaultExecTimeout = 5 * time.Second
+
+// execEvent - Description of the connection passed to hook commands on stdin
+type execEvent struct {
+	Event    string `json:"event"`
+	ID       uint64 `json:"id"`
+	UUID     string `json:"uuid,omitempty"`
+	Client   string `json:"client"`
+	Local    string `json:"local"`
+	Remote   string `json:"remote"`
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+}
+
+func (p *Proxy) clientAddr() string {
+	if c, ok := p.lconn.(net.Conn); ok && c.RemoteAddr() != nil {
+		return c.RemoteAddr().String()
+	}
+	return ""
+}
+
+// runExecHook - Run a hook command for the given event. The command gets the
+// event, connection id, client, local and remote addresses and byte counts
+// appended as arguments, and the same details as JSON on stdin. Failures are
+// logged and otherwise ignored.
+func (p *Proxy) runExecHook(event string, argv []string) {
+	if len(argv) == 0 {
+		return
+	}
+
+	evt := execEvent{
+		Event:    event,
+		ID:       p.ID,
+		UUID:     p.UUID,
+		Client:   p.clientAddr(),
+		Local:    p.laddr.String(),
+		Remote:   p.remoteString(),
+		Sent:     atomic.LoadUint64(&p.sentBytes),
+		Received: atomic.LoadUint64(&p.receivedBytes),
+	}
+	stdin, err := json.Marshal(evt)
+	if err != nil {
+		p.Log.Warn("failed to encode %s hook event: %v", event, err)
+		return
+	}
+
+	timeout := p.ExecTimeout
+	if timeout <= 0 {
+		timeout = defaultExecTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	args := append(append([]string(nil), argv[1:]...),
+		evt.Event,
+		strconv.FormatUint(evt.ID, 10),
+		evt.Client,
+		evt.Local,
+		evt.Remote,
+		strconv.FormatUint(evt.Sent, 10),
+		strconv.FormatUint(evt.Received, 10),
+	)
+	cmd := exec.CommandContext(ctx, argv[0], args...)
+	cmd.Stdin = bytes.NewReader(append(stdin, '\n'))
+	out, err := cmd.CombinedOutput()
+	if output := strings.TrimSpace(string(out)); output != "" {
+		p.Log.Info("%s hook output: %s", event, output)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		p.Log.Warn("%s hook timed out after %s", event, timeout)
+	} else if err != nil {
+		p.Log.Warn("%s hook failed: %v", event, err)
+	}
+}
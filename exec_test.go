@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecHooks(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	echo := startEcho(t)
+	defer echo.Close()
+
+	dir := t.TempDir()
+	hook := func(name string) []string {
+		out := filepath.Join(dir, name)
+		return []string{"sh", "-c", `printf '%s\n' "$@" > "$0"; cat >> "$0"`, out}
+	}
+
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.ID = 7
+		p.OnConnectExec = hook("connect")
+		p.OnCloseExec = hook("close")
+	})
+	echoRoundTrip(t, client, "hello")
+	client.Close()
+	<-done
+
+	for _, tt := range []struct {
+		event    string
+		sent     string
+		received string
+	}{
+		{"connect", "0", "0"},
+		{"close", "5", "5"},
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, tt.event))
+		if err != nil {
+			t.Fatalf("%s hook did not run: %v", tt.event, err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 8 {
+			t.Fatalf("%s hook: wanted 7 args and a json line, got %q", tt.event, lines)
+		}
+		if lines[0] != tt.event || lines[1] != "7" || lines[4] != echo.Addr().String() ||
+			lines[5] != tt.sent || lines[6] != tt.received {
+			t.Errorf("%s hook got unexpected args %q", tt.event, lines[:7])
+		}
+		var evt execEvent
+		if err := json.Unmarshal([]byte(lines[7]), &evt); err != nil {
+			t.Fatalf("%s hook stdin is not json: %v", tt.event, err)
+		}
+		if evt.Event != tt.event || evt.ID != 7 || evt.Client != lines[2] {
+			t.Errorf("%s hook got unexpected stdin %+v", tt.event, evt)
+		}
+	}
+}
+
+func TestExecHookFailures(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not available")
+	}
+	echo := startEcho(t)
+	defer echo.Close()
+
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.OnConnectExec = []string{"sleep", "5"}
+		p.OnCloseExec = []string{"/does/not/exist"}
+		p.ExecTimeout = 50 * time.Millisecond
+	})
+	if got := echoRoundTrip(t, client, "still works"); got != "still works" {
+		t.Errorf("failing hooks should not affect the connection, got %q", got)
+	}
+	client.Close()
+	<-done
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultFilterTimeout - How long an ExecReplacer's command may take for
+	// one chunk when Timeout is unset
+	defaultFilterTimeout = time.Second
+	// defaultFilterOutput - How much output an ExecReplacer accepts for one
+	// chunk when MaxOutput is unset
+	defaultFilterOutput = 1 << 20
+)
+
+// checkedReplacer - Implemented by replacers that can fail, so the proxy
+// can log why a chunk was passed through unchanged
+type checkedReplacer interface {
+	TryReplace(in []byte) ([]byte, error)
+}
+
+// ExecReplacer - Pipes every chunk through an external command, e.g. a
+// prototype codec, and forwards what it writes to stdout instead. The
+// command is run once per chunk, with the chunk on stdin; since a filter
+// can't tell where one chunk's output ends in a stream, it isn't kept
+// running between chunks. When the command fails, times out or writes too
+// much the chunk is passed through unchanged.
+type ExecReplacer struct {
+	Command []string
+	// Timeout - How long the command may run for one chunk, defaults to a
+	// second
+	Timeout time.Duration
+	// MaxOutput - How many bytes the command may write for one chunk,
+	// defaults to 1MB
+	MaxOutput int
+}
+
+// limitedBuffer - Collects up to max bytes of output, dropping the rest.
+// The buffer isn't embedded so its ReadFrom can't bypass the limit.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); len(p) > room {
+		b.overflow = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// TryReplace - Run the command on in and return its output
+func (r *ExecReplacer) TryReplace(in []byte) ([]byte, error) {
+	if len(r.Command) == 0 {
+		return nil, errors.New("no command")
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultFilterTimeout
+	}
+	max := r.MaxOutput
+	if max <= 0 {
+		max = defaultFilterOutput
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, r.Command[0], r.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	stdout := &limitedBuffer{max: max}
+	stderr := &limitedBuffer{max: 512}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return nil, fmt.Errorf("timed out after %s", timeout)
+	case err != nil:
+		if msg := strings.TrimSpace(stderr.buf.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	case stdout.overflow:
+		return nil, fmt.Errorf("output larger than %d bytes", max)
+	}
+	return notDropped(stdout.buf.Bytes(), in), nil
+}
+
+// Replace - The command's output, or in unchanged when it failed
+func (r *ExecReplacer) Replace(in []byte) []byte {
+	out, err := r.TryReplace(in)
+	if err != nil {
+		return in
+	}
+	return out
+}
+
+func (r *ExecReplacer) String() string {
+	return fmt.Sprintf("exec: %q", strings.Join(r.Command, " "))
+}
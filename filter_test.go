@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func needCommands(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not available", name)
+		}
+	}
+}
+
+func TestExecReplacer(t *testing.T) {
+	needCommands(t, "tr")
+	r := &ExecReplacer{Command: []string{"tr", "a-z", "A-Z"}}
+	if got := r.Replace([]byte("hello, world")); string(got) != "HELLO, WORLD" {
+		t.Errorf("expected the filtered chunk, got %q", got)
+	}
+}
+
+func TestExecReplacerFailures(t *testing.T) {
+	needCommands(t, "sh", "sleep", "head")
+	in := []byte("unchanged")
+	for _, tc := range []struct {
+		name string
+		r    *ExecReplacer
+		want string
+	}{
+		{"crash", &ExecReplacer{Command: []string{"sh", "-c", "echo broken >&2; kill -9 $$"}}, "signal: killed"},
+		{"exit status", &ExecReplacer{Command: []string{"sh", "-c", "echo bad input >&2; exit 3"}}, "bad input"},
+		{"timeout", &ExecReplacer{Command: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond}, "timed out"},
+		{"output", &ExecReplacer{Command: []string{"head", "-c", "100", "/dev/zero"}, MaxOutput: 10}, "larger than 10 bytes"},
+		{"missing", &ExecReplacer{Command: []string{"/nonexistent/filter"}}, "no such file"},
+	} {
+		if _, err := tc.r.TryReplace(in); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.want, err)
+		}
+		if got := tc.r.Replace(in); !bytes.Equal(got, in) {
+			t.Errorf("%s: expected the chunk passed through, got %q", tc.name, got)
+		}
+	}
+}
+
+func TestExecReplacerEmptyOutput(t *testing.T) {
+	needCommands(t, "true")
+	got := (&ExecReplacer{Command: []string{"true"}}).Replace([]byte("gone"))
+	if got == nil || len(got) != 0 {
+		t.Errorf("expected an empty chunk rather than a dropped one, got %q", got)
+	}
+}
+
+func TestExecReplacerConfig(t *testing.T) {
+	set, err := readConfigData([]byte("- type: exec\n  command: tr a-z A-Z\n  timeout: 250ms\n  max_output: 4096\n"))
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	r, ok := set.Both[0].(*ExecReplacer)
+	if !ok || strings.Join(r.Command, " ") != "tr a-z A-Z" || r.Timeout != 250*time.Millisecond || r.MaxOutput != 4096 {
+		t.Fatalf("unexpected replacer %#v", set.Both[0])
+	}
+	if _, err := readConfigData([]byte("- type: exec\n")); err == nil {
+		t.Errorf("expected an error for an exec replacer without a command")
+	}
+}
+
+func TestExecReplacerLogsFailure(t *testing.T) {
+	needCommands(t, "sh")
+	echo := startEcho(t)
+	defer echo.Close()
+
+	var logs bytes.Buffer
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.Log = ColorLogger{Writer: &logs}
+		p.SetReplacers([]Replacer{&ExecReplacer{Command: []string{"sh", "-c", "exit 1"}}})
+	})
+	if got := echoRoundTrip(t, client, "plain"); got != "plain" {
+		t.Errorf("expected data to pass through the failing filter, got %q", got)
+	}
+	client.Close()
+	<-done
+	if !strings.Contains(logs.String(), "forwarding 5 bytes unchanged: exit status 1") {
+		t.Errorf("expected the failure to be logged, got %q", logs.String())
+	}
+}
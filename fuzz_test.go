@@ -0,0 +1,77 @@
+//go:build go1.18
+// +build go1.18
+
+package proxy
+
+import (
+	"regexp"
+	"testing"
+)
+
+// FuzzParseConfig - Replacer configs of any shape must fail with an error
+// rather than panic, and the replacers they do give must be safe to run
+func FuzzParseConfig(f *testing.F) {
+	f.Add([]byte(configValid))
+	for _, c := range invalidConfigs {
+		f.Add([]byte(c))
+	}
+	f.Add([]byte("upstream:\n- type: strip\n  find: [0x0d]\ndownstream:\n- type: regex\n  find: (a+)\n  replace: $1$1\n  once: true\n"))
+	f.Add([]byte("- type: prefixed\n  prefix_size: 2\n  byte_order: little\n  find: user\n  replace: [0x61, 0x64]\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// the valid entries are returned along with any error
+		set, _ := readConfigData(data)
+		for _, r := range set.All() {
+			if _, ok := r.(*ExecReplacer); ok {
+				// runs whatever command the input names
+				continue
+			}
+			checkReplace(t, r, data)
+		}
+	})
+}
+
+// FuzzReplace - Every builtin replacer built from find and replace must
+// handle any input, never drop a chunk, and keep to PreservesLength
+func FuzzReplace(f *testing.F) {
+	f.Add([]byte("foo"), []byte("bar"), []byte("a foo in food"))
+	f.Add([]byte("[a-f0-9]{4}"), []byte("1337"), []byte("deadbeef"))
+	f.Add([]byte("(x*)"), []byte("<$1>"), []byte("xxyxx"))
+	f.Add([]byte{0x00, 0xff}, []byte{}, []byte{0x00, 0xff, 0x00, 0xff})
+	f.Fuzz(func(t *testing.T, find, replace, in []byte) {
+		if len(find) == 0 {
+			return
+		}
+		replacers := []Replacer{
+			&StringReplacer{string(find), string(replace)},
+			&BytesReplacer{find, replace},
+			&StripReplacer{In: find},
+		}
+		for _, size := range []int{1, 2, 4} {
+			if len(find) < 1<<(8*uint(size)) && len(replace) < 1<<(8*uint(size)) {
+				replacers = append(replacers, &PrefixedReplacer{Size: size, In: find, Out: replace})
+			}
+		}
+		if re, err := regexp.Compile(string(find)); err == nil {
+			replacers = append(replacers, &RegexReplacer{re, replace}, &StripReplacer{Regex: re})
+		}
+		for _, name := range []string{"latin1", "utf-16le"} {
+			enc, _ := ParseTextEncoding(name)
+			replacers = append(replacers, &EncodedReplacer{&StringReplacer{string(find), string(replace)}, enc})
+		}
+		for _, r := range replacers {
+			checkReplace(t, r, in)
+			checkReplace(t, &OnceReplacer{r}, in)
+		}
+	})
+}
+
+func checkReplace(t *testing.T, r Replacer, in []byte) {
+	t.Helper()
+	out := r.Replace(append([]byte{}, in...))
+	if out == nil {
+		t.Fatalf("%s dropped the chunk", r)
+	}
+	if !ChangesLength(r) && len(out) != len(in) {
+		t.Fatalf("%s says it preserves length, but turned %d bytes into %d", r, len(in), len(out))
+	}
+}
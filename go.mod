@@ -3,11 +3,12 @@ module gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy
 go 1.13
 
 require (
-	github.com/fsnotify/fsnotify v1.6.0 // indirect
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/hashicorp/go-multierror v1.1.1
 	github.com/hillu/go-yara/v4 v4.2.3
 	github.com/mattn/go-colorable v0.1.4 // indirect
 	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b
-	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/text v0.3.8
 	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"sync"
+)
+
+// DataHashes - Hex encoded SHA-256 digests of what a connection with
+// HashData set relayed each way. Upstream and Downstream cover the data as
+// written to the remote and the client; UpstreamRead and DownstreamRead
+// cover it as read from the other side, and are only given when they
+// differ, i.e. replacers or other transforms changed the data. Prologues
+// aren't included.
+type DataHashes struct {
+	Upstream       string `json:"upstream"`
+	Downstream     string `json:"downstream"`
+	UpstreamRead   string `json:"upstream_read,omitempty"`
+	DownstreamRead string `json:"downstream_read,omitempty"`
+}
+
+// dataHash - The running digests of one direction
+type dataHash struct {
+	mu        sync.Mutex
+	read      hash.Hash
+	forwarded hash.Hash
+}
+
+func newDataHash() *dataHash {
+	return &dataHash{read: sha256.New(), forwarded: sha256.New()}
+}
+
+// add - Count b into one of the digests, read or forwarded; a nil
+// dataHash, without HashData, ignores it
+func (h *dataHash) add(forwarded bool, b []byte) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	if forwarded {
+		h.forwarded.Write(b)
+	} else {
+		h.read.Write(b)
+	}
+	h.mu.Unlock()
+}
+
+// sums - The digests of the data read and forwarded so far
+func (h *dataHash) sums() (read, forwarded string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return hex.EncodeToString(h.read.Sum(nil)), hex.EncodeToString(h.forwarded.Sum(nil))
+}
+
+// startHashes - Set up the digests for HashData, before the pipes start
+func (p *Proxy) startHashes() {
+	if p.HashData {
+		p.hashes = [2]*dataHash{newDataHash(), newDataHash()}
+	}
+}
+
+// Hashes - The digests of the data relayed so far, nil unless HashData is
+// set. Final once Start has returned.
+func (p *Proxy) Hashes() *DataHashes {
+	up, down := p.hashes[Upstream], p.hashes[Downstream]
+	if up == nil || down == nil {
+		return nil
+	}
+	var h DataHashes
+	var upRead, downRead string
+	upRead, h.Upstream = up.sums()
+	downRead, h.Downstream = down.sums()
+	if upRead != h.Upstream {
+		h.UpstreamRead = upRead
+	}
+	if downRead != h.Downstream {
+		h.DownstreamRead = downRead
+	}
+	return &h
+}
+
+// logHashes - Log the digests as the connection closes
+func (p *Proxy) logHashes() {
+	h := p.Hashes()
+	if h == nil {
+		return
+	}
+	p.logLifecycle(LifecycleClose, "SHA-256 of the data sent %s, received %s", h.Upstream, h.Downstream)
+	if h.UpstreamRead != "" || h.DownstreamRead != "" {
+		p.logLifecycle(LifecycleClose, "SHA-256 before transforms of the data sent %s, received %s", orSame(h.UpstreamRead, h.Upstream), orSame(h.DownstreamRead, h.Downstream))
+	}
+}
+
+// orSame - read, or forwarded when the data wasn't changed
+func orSame(read, forwarded string) string {
+	if read == "" {
+		return forwarded
+	}
+	return read
+}
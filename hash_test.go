@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestHashData(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	for _, tc := range []struct {
+		name     string
+		config   string
+		sent     string
+		want     string
+		upstream string
+	}{
+		{"faithful", "", "hello world", "hello world", ""},
+		{"replaced", "- type: substring\n  find: ping\n  replace: pong\n", "ping ping", "pong pong", "ping ping"},
+	} {
+		var proxy *Proxy
+		client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+			proxy = p
+			p.HashData = true
+			if tc.config != "" {
+				if err := p.LoadConfig([]byte(tc.config)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+		if got := echoRoundTrip(t, client, tc.sent); got != tc.want {
+			t.Fatalf("%s: wanted %q back, got %q", tc.name, tc.want, got)
+		}
+		client.Close()
+		<-done
+
+		h := proxy.Hashes()
+		if h == nil {
+			t.Fatalf("%s: wanted hashes with HashData set", tc.name)
+		}
+		// the remote echoes what it was sent, so both ways carry the
+		// forwarded data
+		if want := sha256Hex(tc.want); h.Upstream != want || h.Downstream != want {
+			t.Errorf("%s: wanted both directions hashed as %s, got %+v", tc.name, want, h)
+		}
+		var upRead string
+		if tc.upstream != "" {
+			upRead = sha256Hex(tc.upstream)
+		}
+		if h.UpstreamRead != upRead || h.DownstreamRead != "" {
+			t.Errorf("%s: wanted the digest before replacing only upstream and only when changed, got %+v", tc.name, h)
+		}
+		if s := proxy.Summary(); s.Hashes == nil || *s.Hashes != *h {
+			t.Errorf("%s: wanted the hashes in the summary, got %+v", tc.name, s.Hashes)
+		}
+	}
+}
+
+func TestHashDataOff(t *testing.T) {
+	var p Proxy
+	if h := p.Hashes(); h != nil {
+		t.Errorf("wanted no hashes without HashData, got %+v", h)
+	}
+}
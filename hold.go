@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// holds - The outstanding MatchContext.Hold calls of one direction. While
+// any is, the pipe neither forwards nor reads, so TCP flow control pushes
+// back on the sender.
+type holds struct {
+	mu    sync.Mutex
+	count int
+	// resumed - closed once count drops back to zero
+	resumed chan struct{}
+}
+
+// hold - Take a hold until the returned function is called or, when d is
+// positive, d passes
+func (h *holds) hold(clock Clock, d time.Duration) func() {
+	h.mu.Lock()
+	if h.count == 0 {
+		h.resumed = make(chan struct{})
+	}
+	h.count++
+	h.mu.Unlock()
+
+	released := make(chan struct{})
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			close(released)
+			h.mu.Lock()
+			if h.count--; h.count == 0 {
+				close(h.resumed)
+			}
+			h.mu.Unlock()
+		})
+	}
+	if d > 0 {
+		timer := clock.NewTimer(d)
+		go func() {
+			defer timer.Stop()
+			select {
+			case <-timer.C():
+				release()
+			case <-released:
+			}
+		}()
+	}
+	return release
+}
+
+// wait - Block while a hold is outstanding, false if the connection stopped
+// in the meantime. held says whether there was one.
+func (h *holds) wait(stop <-chan struct{}) (held, ok bool) {
+	h.mu.Lock()
+	held, resumed := h.count > 0, h.resumed
+	h.mu.Unlock()
+	if !held {
+		return false, true
+	}
+	select {
+	case <-resumed:
+		return true, true
+	case <-stop:
+		return true, false
+	}
+}
+
+// holdFunc - The MatchContext.Hold of a direction
+func (p *Proxy) holdFunc(direction Direction) func(time.Duration) func() {
+	return func(d time.Duration) func() {
+		return p.holds[direction].hold(p.clock(), d)
+	}
+}
+
+// waitHolds - Wait out the holds on a direction, logging how long they took
+func (p *Proxy) waitHolds(direction Direction) bool {
+	start := p.clock().Now()
+	held, ok := p.holds[direction].wait(p.errsig)
+	if held && ok {
+		p.Log.Debug("Resumed %s after holding it for %v", direction, p.clock().Now().Sub(start))
+		// start the idle time over, the sender had to wait
+		p.touch()
+	}
+	return ok
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// readWithin - Read from c, or "" if nothing arrives within d
+func readWithin(c net.Conn, d time.Duration) string {
+	c.SetReadDeadline(time.Now().Add(d))
+	buf := make([]byte, 1024)
+	n, _ := c.Read(buf)
+	return string(buf[:n])
+}
+
+func TestMatcherHold(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	resumes := make(chan func(), 1)
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.Matcher = func(ctx MatchContext) {
+			if ctx.Direction == Upstream && ctx.Offset == 0 {
+				resumes <- ctx.Hold(0)
+			}
+		}
+	})
+	defer func() {
+		client.Close()
+		<-done
+	}()
+
+	client.Write([]byte("held"))
+	resume := <-resumes
+	if got := readWithin(client, 100*time.Millisecond); got != "" {
+		t.Fatalf("wanted nothing forwarded while held, got %q", got)
+	}
+	resume()
+	if got := readWithin(client, 2*time.Second); got != "held" {
+		t.Fatalf("wanted the held chunk forwarded once resumed, got %q", got)
+	}
+	// resuming twice is harmless, and later chunks aren't held
+	resume()
+	if got := echoRoundTrip(t, client, "after"); got != "after" {
+		t.Errorf("wanted forwarding to carry on, got %q", got)
+	}
+}
+
+func TestMatcherHoldTimeout(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	clock := newFakeClock()
+	held := make(chan struct{}, 1)
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.Clock = clock
+		p.Matcher = func(ctx MatchContext) {
+			if ctx.Direction == Upstream && ctx.Offset == 0 {
+				ctx.Hold(time.Minute)
+				held <- struct{}{}
+			}
+		}
+	})
+	defer func() {
+		client.Close()
+		<-done
+	}()
+
+	client.Write([]byte("held"))
+	<-held
+	clock.Advance(30 * time.Second)
+	if got := readWithin(client, 100*time.Millisecond); got != "" {
+		t.Fatalf("wanted nothing forwarded before the hold ran out, got %q", got)
+	}
+	clock.Advance(30 * time.Second)
+	if got := readWithin(client, 2*time.Second); got != "held" {
+		t.Fatalf("wanted the chunk forwarded once the hold ran out, got %q", got)
+	}
+}
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+
+	proxy "gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy"
+)
+
+// runCheck - Validate the replacer config and yara rules without opening any
+// sockets, printing what was loaded. Any problem, including a single invalid
+// replacer, makes the check fail.
+func runCheck(w io.Writer, configPath, yaraPath string) int {
+	code := exitOK
+
+	if configPath != "" {
+		set, err := proxy.ReadConfigFile(configPath)
+		fmt.Fprintf(w, "replacer config %s: %d replacers\n", configPath, set.Len())
+		for _, section := range []struct {
+			name      string
+			replacers []proxy.Replacer
+		}{{"both", set.Both}, {"upstream", set.Upstream}, {"downstream", set.Downstream}} {
+			for _, r := range section.replacers {
+				fmt.Fprintf(w, "  %s %s\n", section.name, r.String())
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(w, "  error: %v\n", err)
+			code = exitConfig
+		}
+	}
+
+	if yaraPath != "" {
+		rules, warnings, err := proxy.CompileYaraRules(yaraPath)
+		for _, warning := range warnings {
+			fmt.Fprintf(w, "  warning: %s\n", warning)
+		}
+		if err != nil {
+			fmt.Fprintf(w, "yara rules %s: error: %v\n", yaraPath, err)
+			code = exitConfig
+		} else {
+			names := proxy.RuleNames(rules)
+			fmt.Fprintf(w, "yara rules %s: %d rules\n", yaraPath, len(names))
+			for _, name := range names {
+				fmt.Fprintf(w, "  %s\n", name)
+			}
+		}
+	}
+
+	if configPath == "" && yaraPath == "" {
+		fmt.Fprintln(w, "nothing to check, pass --config and/or --yara")
+		return exitUsage
+	}
+	if code == exitOK {
+		fmt.Fprintln(w, "ok")
+	}
+	return code
+}
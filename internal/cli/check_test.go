@@ -0,0 +1,57 @@
+//go:build !noyara
+// +build !noyara
+
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		return path
+	}
+
+	valid := write("valid.yml", "- type: substring\n  find: foo\n  replace: bar\n")
+	partial := write("partial.yml", "- type: substring\n  find: foo\n- type: regex\n  replace: x\n")
+	rules := write("rules.yar", "rule Foo\n{\n    strings:\n        $a = \"foo\"\n\n    condition:\n        $a\n}\n")
+	badRules := write("bad.yar", "rule {\n")
+
+	tests := []struct {
+		name       string
+		config     string
+		yara       string
+		code       int
+		wantOutput []string
+	}{
+		{"valid", valid, rules, exitOK, []string{"1 replacers", `substring: "foo" -> "bar"`, "1 rules", "Foo", "ok"}},
+		{"invalid replacer", partial, "", exitConfig, []string{"1 replacers", "replacer 1"}},
+		{"missing config", filepath.Join(dir, "missing.yml"), "", exitConfig, []string{"error"}},
+		{"bad rules", "", badRules, exitConfig, []string{"error"}},
+		{"nothing to check", "", "", exitUsage, nil},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if code := runCheck(&out, tt.config, tt.yara); code != tt.code {
+			t.Errorf("%s: wanted exit code %d, got %d\n%s", tt.name, tt.code, code, out.String())
+		}
+		for _, want := range tt.wantOutput {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("%s: output is missing %q:\n%s", tt.name, want, out.String())
+			}
+		}
+	}
+
+	if code := run([]string{"--check", "-f", valid}); code != exitOK {
+		t.Errorf("--check with a valid config should succeed, got %d", code)
+	}
+}
@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	proxy "gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy"
+)
+
+// healthCacheTTL - How long /readyz reuses the result of dialing the remote,
+// so frequent probes don't each open a connection to it
+const healthCacheTTL = 5 * time.Second
+
+// healthDialTimeout - How long /readyz waits for each remote to answer
+const healthDialTimeout = time.Second
+
+// health - Serves /healthz, which answers as long as the process runs, and
+// /readyz, which answers once the listener is open and a remote is
+// reachable, for --health-address
+type health struct {
+	network string
+	// remotes - the addresses /readyz dials, one answering is enough
+	remotes func() []string
+	dial    func(network, address string) (net.Conn, error)
+	now     func() time.Time
+
+	mu        sync.Mutex
+	listening bool
+	// mux - when set, ready while its upstream is connected instead
+	mux     *proxy.MuxClient
+	checked time.Time
+	lastErr error
+}
+
+func newHealth(network string, remotes func() []string) *health {
+	d := &net.Dialer{Timeout: healthDialTimeout}
+	return &health{network: network, remotes: remotes, dial: d.Dial, now: time.Now}
+}
+
+// setListening - The listener is open
+func (h *health) setListening() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listening = true
+}
+
+// setMux - Connections go over mux, which tells whether the remote is up
+func (h *health) setMux(mux *proxy.MuxClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.mux = mux
+}
+
+// ready - Why the proxy can't take connections yet, nil when it can
+func (h *health) ready() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.listening {
+		return errors.New("not listening yet")
+	}
+	if h.mux != nil {
+		if !h.mux.Connected() {
+			return errors.New("upstream connection is down")
+		}
+		return nil
+	}
+	now := h.now()
+	if h.checked.IsZero() || now.Sub(h.checked) >= healthCacheTTL {
+		h.lastErr = h.dialRemotes()
+		h.checked = now
+	}
+	return h.lastErr
+}
+
+// dialRemotes - Dial the remotes in turn until one answers
+func (h *health) dialRemotes() error {
+	remotes := h.remotes()
+	if len(remotes) == 0 {
+		return errors.New("no remotes")
+	}
+	var err error
+	for _, address := range remotes {
+		var conn net.Conn
+		if conn, err = h.dial(h.network, address); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	if len(remotes) > 1 {
+		return fmt.Errorf("none of %d remotes reachable, last: %w", len(remotes), err)
+	}
+	return fmt.Errorf("remote unreachable: %w", err)
+}
+
+func (h *health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+		fmt.Fprintln(w, "ok")
+	case "/readyz":
+		if err := h.ready(); err != nil {
+			http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveHealth - Listen on address and serve h until the listener is closed
+func serveHealth(address string, h *health, logger proxy.Logger) (net.Listener, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := http.Serve(l, h); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Warn("Health endpoint stopped: %s", err)
+		}
+	}()
+	return l, nil
+}
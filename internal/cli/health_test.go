@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func probe(h *health, path string) (int, string) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	// dials complete from the backlog, nothing needs to accept them
+	remote, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer remote.Close()
+
+	now := time.Unix(0, 0)
+	dials := 0
+	h := newHealth("tcp", func() []string { return []string{"127.0.0.1:1", remote.Addr().String()} })
+	h.now = func() time.Time { return now }
+	dial := h.dial
+	h.dial = func(network, address string) (net.Conn, error) {
+		dials++
+		return dial(network, address)
+	}
+
+	if code, _ := probe(h, "/healthz"); code != http.StatusOK {
+		t.Errorf("wanted /healthz to answer while starting, got %d", code)
+	}
+	if code, body := probe(h, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "not listening") {
+		t.Errorf("wanted not ready before listening, got %d %q", code, body)
+	}
+
+	h.setListening()
+	if code, body := probe(h, "/readyz"); code != http.StatusOK {
+		t.Errorf("wanted ready with one remote reachable, got %d %q", code, body)
+	}
+	if dials != 2 {
+		t.Errorf("wanted both remotes dialed in turn, got %d dials", dials)
+	}
+
+	// the result is reused until it is stale
+	remote.Close()
+	if code, _ := probe(h, "/readyz"); code != http.StatusOK || dials != 2 {
+		t.Errorf("wanted the cached result, got %d after %d dials", code, dials)
+	}
+	now = now.Add(healthCacheTTL)
+	if code, body := probe(h, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "none of 2 remotes reachable") {
+		t.Errorf("wanted not ready once no remote answers, got %d %q", code, body)
+	}
+	if code, _ := probe(h, "/healthz"); code != http.StatusOK {
+		t.Errorf("wanted /healthz to answer whatever the remotes do, got %d", code)
+	}
+	if code, _ := probe(h, "/other"); code != http.StatusNotFound {
+		t.Errorf("wanted 404 for other paths, got %d", code)
+	}
+}
+
+func TestHealthNoRemotes(t *testing.T) {
+	h := newHealth("tcp", func() []string { return nil })
+	h.dial = func(network, address string) (net.Conn, error) { return nil, errors.New("unexpected dial") }
+	h.setListening()
+	if code, body := probe(h, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "no remotes") {
+		t.Errorf("wanted not ready without remotes, got %d %q", code, body)
+	}
+}
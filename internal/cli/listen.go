@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	proxy "gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy"
+)
+
+// listenFDsStart - First file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+// systemdListener - The listening socket handed over by systemd socket
+// activation, or nil when the process wasn't socket activated
+func systemdListener() (*net.TCPListener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+
+	f := os.NewFile(listenFDsStart, "systemd-socket")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use socket passed by systemd: %w", err)
+	}
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("socket passed by systemd is not a TCP socket")
+	}
+	return tl, nil
+}
+
+// listenRetryInterval - How often a local address that is in use is tried
+// again with --listen-retry
+const listenRetryInterval = 250 * time.Millisecond
+
+// errAddrInUse - The local address is taken by another socket
+type errAddrInUse struct {
+	addr  *net.TCPAddr
+	owner string
+	err   error
+}
+
+func (e *errAddrInUse) Error() string {
+	msg := fmt.Sprintf("local address %s is already in use", e.addr)
+	if e.owner != "" {
+		msg += " by " + e.owner
+	}
+	return msg + "; stop it, pick another --local-address, or wait for it to be released with --listen-retry"
+}
+
+func (e *errAddrInUse) Unwrap() error { return e.err }
+
+// listenWithRetry - Open the local port. While another socket holds it, as
+// happens when restarting over an instance that is still shutting down,
+// keep trying for up to retry.
+func listenWithRetry(laddr *net.TCPAddr, retry time.Duration, logger proxy.Logger) (*net.TCPListener, error) {
+	deadline := time.Now().Add(retry)
+	logged := false
+	for {
+		l, err := net.ListenTCP("tcp", laddr)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+			return l, err
+		}
+		if !time.Now().Before(deadline) {
+			return nil, &errAddrInUse{addr: laddr, owner: portOwner(laddr.Port), err: err}
+		}
+		if !logged {
+			logger.Info("Local address %s is in use, retrying for up to %v", laddr, retry)
+			logged = true
+		}
+		time.Sleep(listenRetryInterval)
+	}
+}
+
+// listenAll - Open every one of the local addresses with listenWithRetry,
+// closing the ones already open when one fails
+func listenAll(laddrs []*net.TCPAddr, retry time.Duration, logger proxy.Logger) ([]*net.TCPListener, error) {
+	var listeners []*net.TCPListener
+	for _, laddr := range laddrs {
+		l, err := listenWithRetry(laddr, retry, logger)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// portAddrs - The addresses on the host of laddr with each of the ports
+func portAddrs(laddr *net.TCPAddr, ports []int) []*net.TCPAddr {
+	addrs := make([]*net.TCPAddr, len(ports))
+	for i, port := range ports {
+		addrs[i] = &net.TCPAddr{IP: laddr.IP, Port: port, Zone: laddr.Zone}
+	}
+	return addrs
+}
@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	proxy "gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy"
+)
+
+func TestListenAddrInUse(t *testing.T) {
+	busy, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer busy.Close()
+	laddr := busy.Addr().(*net.TCPAddr)
+
+	start := time.Now()
+	_, err = listenWithRetry(laddr, 300*time.Millisecond, proxy.NullLogger{})
+	inUse, ok := err.(*errAddrInUse)
+	if !ok {
+		t.Fatalf("expected an address in use error, got %v", err)
+	}
+	if time.Since(start) < 300*time.Millisecond {
+		t.Errorf("gave up before the retry period was over")
+	}
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("the error should wrap EADDRINUSE")
+	}
+	if !strings.Contains(inUse.Error(), laddr.String()) {
+		t.Errorf("the message should name the address, got %q", inUse)
+	}
+	// this process holds the port
+	if pid := fmt.Sprintf("(pid %d)", os.Getpid()); runtime.GOOS == "linux" && !strings.Contains(inUse.owner, pid) {
+		t.Errorf("expected the owner to be %s, got %q", pid, inUse.owner)
+	}
+}
+
+func TestListenRetryWaitsForRelease(t *testing.T) {
+	busy, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	laddr := busy.Addr().(*net.TCPAddr)
+	time.AfterFunc(300*time.Millisecond, func() { busy.Close() })
+
+	l, err := listenWithRetry(laddr, 5*time.Second, proxy.NullLogger{})
+	if err != nil {
+		t.Fatalf("expected to listen once the port was released, got %v", err)
+	}
+	l.Close()
+}
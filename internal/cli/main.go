@@ -0,0 +1,822 @@
+// Package cli - The tcp-proxy command line tool, shared by its builds with
+// and without QUIC
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
+	proxy "gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy"
+)
+
+// version - Logged at startup, see Main
+var version = "0.0.0-src"
+
+// Exit codes returned by the CLI, so scripts can tell failure modes apart
+const (
+	exitOK      = 0
+	exitUsage   = 2 // bad flags
+	exitResolve = 3 // local or remote address could not be resolved
+	exitListen  = 4 // local port could not be opened
+	exitConfig  = 5 // replacer config, policy or yara rules failed to load
+	exitRemote  = 6 // --preflight couldn't reach the remote
+	exitPrivs   = 7 // --user or --group couldn't be switched to
+	exitInUse   = 8 // local address is already in use
+)
+
+type options struct {
+	localAddr    string
+	listenRetry  time.Duration
+	healthAddr   string
+	remoteAddr   string
+	verbose      int
+	quietConns   bool
+	lifecycle    string
+	nagles       bool
+	hex          bool
+	help         bool
+	colors       bool
+	unwrapTLS    bool
+	quic         bool
+	yaraConfig   string
+	replacerFile string
+	strictConf   bool
+	timeFormat   string
+	logUTC       bool
+	onConnectCmd string
+	onCloseCmd   string
+	logMSS       bool
+	smallRead    int
+	blockAction  string
+	entropy      proxy.EntropyCheck
+	entropyTag   string
+	blockReply   string
+	check        bool
+	decompress   bool
+	websocket    bool
+	colorScheme  string
+	maxLifetime  time.Duration
+	idleTimeout  time.Duration
+	bindDevice   string
+	fwmark       int
+	shadowAddr   string
+	bufferSize   int
+	upBuffer     int
+	downBuffer   int
+	recvBuf      int
+	sendBuf      int
+	maxConns     int
+	maxPerClient int
+	preflight    bool
+	policyFile   string
+	linger       time.Duration
+	tlsInsecure  bool
+	tlsPins      []string
+	tlsALPN      []string
+	serverName   string
+	certDir      string
+	defaultCert  string
+	clientCA     string
+	certProlog   string
+	statsOutput  string
+	statsFile    string
+	hashData     bool
+	matchLog     string
+	eventSocket  string
+	tags         map[string]string
+	dumpDir      string
+	user         string
+	group        string
+	sampleRate   float64
+	sampleSeed   int64
+	remoteFile   string
+	portMap      string
+	clientProlog string
+	remoteProlog string
+	tunnel       string
+	mux          bool
+	muxWait      time.Duration
+	queueWait    time.Duration
+	queueSize    int
+	compress     bool
+	acceptComp   bool
+	maxScans     int
+	skipScans    bool
+	matchStrings int
+	matchData    int
+	notify       string
+	alertRate    int
+	sendProxy    string
+	network      string
+	connIDs      string
+	upSkip       proxy.Skip
+	downSkip     proxy.Skip
+}
+
+func newFlagSet(o *options) *pflag.FlagSet {
+	fs := pflag.NewFlagSet("tcp-proxy", pflag.ContinueOnError)
+	fs.StringVarP(&o.localAddr, "local-address", "l", ":9999", "local address")
+	fs.DurationVar(&o.listenRetry, "listen-retry", 0, "if the local address is in use, keep trying to listen on it for this long")
+	fs.StringVar(&o.healthAddr, "health-address", "", "serve /healthz (the process is up) and /readyz (listening, and a remote is reachable) over HTTP on this address, e.g. :8080")
+	fs.StringVarP(&o.remoteAddr, "remote-address", "r", "localhost:80", "remote address")
+	fs.StringVar(&o.tunnel, "tunnel", "", "convert transports instead of proxying: udp-to-tcp tunnels datagrams received on the local address over TCP to the remote, tcp-to-udp is the far end, sending them on to a UDP remote")
+	fs.BoolVar(&o.mux, "mux", false, "carry every connection over one persistent connection to the remote, a tcp-proxy running --tunnel mux-to-tcp, redialing it with jittered backoff when it drops")
+	fs.DurationVar(&o.muxWait, "mux-queue-timeout", 5*time.Second, "with --mux, how long new connections wait for the upstream while it is redialed before being refused")
+	fs.DurationVar(&o.queueWait, "queue-timeout", 0, "when the remote refuses a connection, e.g. while at capacity, keep the client waiting and redial for up to this long before giving up")
+	fs.IntVar(&o.queueSize, "queue-size", 64, "with --queue-timeout, how many connections may wait at once; the remote's refusal is passed on to the rest right away")
+	fs.StringVar(&o.network, "network", "tcp", "network remotes are resolved and dialed over: tcp picks IPv4 or IPv6 by what the remote resolves to and this host can reach, tcp4 and tcp6 force one")
+	fs.StringVar(&o.remoteFile, "remote-file", "", "file listing remote addresses, one per line, that connections are spread over; re-read when it changes")
+	fs.StringVar(&o.portMap, "port-map", "", "yaml file mapping local ports to remotes, e.g. 8080: backend-a:80; the proxy listens on every port in it, on the host of --local-address, and sends each port's connections to its remote")
+	fs.CountVarP(&o.verbose, "verbose", "v", "verbose logging")
+	fs.BoolVarP(&o.nagles, "nagles", "n", false, "disable nagles algorithm")
+	fs.BoolVarP(&o.hex, "hex", "x", false, "log the data relayed as hex instead of text")
+	fs.BoolVarP(&o.help, "help", "h", false, "show this help and exit")
+	fs.BoolVarP(&o.colors, "colors", "c", false, "output ansi colors")
+	fs.BoolVar(&o.quietConns, "quiet-connections", false, "don't log the Opened and Closed lines of each connection; warnings and the startup lines are still logged")
+	fs.StringVar(&o.lifecycle, "log-lifecycle", "open,timeout,close", "connection lifecycle events logged: a comma separated list of open, timeout (max lifetime or idle timeout reached) and close, or none")
+	fs.StringVar(&o.colorScheme, "color-scheme", "", "colors used per log level with --colors, e.g. warn=yellow+b,info=cyan")
+	fs.BoolVarP(&o.unwrapTLS, "unwrap-tls", "u", false, "remote connection with TLS exposed unencrypted locally")
+	fs.BoolVar(&o.quic, "quic", false, "with --unwrap-tls, connect to the remote over QUIC instead of TCP, relaying each connection over a QUIC stream (needs the tcp-proxy of the quic module)")
+	fs.BoolVar(&o.tlsInsecure, "tls-insecure-skip-verify", false, "with --unwrap-tls, accept any remote certificate")
+	fs.StringVar(&o.serverName, "tls-server-name", "", "with --unwrap-tls, the name sent to the remote and verified against its certificate, defaults to the host of --remote-address")
+	fs.StringSliceVar(&o.tlsALPN, "tls-alpn", nil, "with --unwrap-tls, offer these application protocols to the remote with ALPN, e.g. h2,http/1.1")
+	fs.StringSliceVar(&o.tlsPins, "tls-pin-sha256", nil, "with --unwrap-tls, require the remote certificate's public key to have this SHA-256 hash (hex or base64, repeatable)")
+	fs.StringVar(&o.certDir, "tls-cert-dir", "", "accept TLS locally, serving the <name>.crt/<name>.key pair in this directory that matches the client's server name")
+	fs.StringVar(&o.defaultCert, "tls-default-cert", "", "with --tls-cert-dir, name of the pair served when no certificate matches, defaults to the first by name")
+	fs.StringVarP(&o.yaraConfig, "yara", "y", "", "path to file containing yara rules for connection blocking")
+	fs.StringVarP(&o.replacerFile, "config", "f", "", "path to yaml file containing replacers")
+	fs.BoolVar(&o.strictConf, "strict-config", false, "exit at startup if any entry of the --config replacers is invalid, instead of warning about it and loading the valid ones")
+	fs.StringVar(&o.policyFile, "policy", "", "path to yaml file with rules deciding which connections are admitted")
+	fs.StringVar(&o.timeFormat, "log-time-format", "", "prefix log lines with a timestamp in this Go time layout (e.g. 2006-01-02T15:04:05Z07:00)")
+	fs.BoolVar(&o.logUTC, "log-utc", false, "log timestamps in UTC")
+	fs.StringVar(&o.clientCA, "tls-client-ca", "", "with --tls-cert-dir, require clients to present a certificate signed by a CA in this PEM file")
+	fs.StringVar(&o.certProlog, "client-cert-prologue-file", "", "file sent to the remote ahead of the client's data with {subject}, {cn}, {issuer}, {san}, {serial} and {sha256} of the client's verified certificate filled in")
+	fs.StringVar(&o.clientProlog, "client-prologue-file", "", "file whose contents are sent to each client on connect, before anything from the remote")
+	fs.StringVar(&o.remoteProlog, "remote-prologue-file", "", "file whose contents are sent to the remote after connecting, before anything from the client")
+	fs.StringVar(&o.onConnectCmd, "on-connect-cmd", "", "command run when a connection opens, given the connection details as arguments and JSON on stdin")
+	fs.StringVar(&o.onCloseCmd, "on-close-cmd", "", "command run when a connection closes, given the connection details as arguments and JSON on stdin")
+	fs.BoolVar(&o.logMSS, "log-mss", false, "log the TCP maximum segment size of each connection (linux only)")
+	fs.IntVar(&o.smallRead, "small-read-threshold", 0, "count reads smaller than this many bytes as fragmented")
+	fs.StringVar(&o.sendProxy, "send-proxy", "", "send a PROXY protocol header (v1 or v2) with the client's address to the remote and the --shadow backend before any data")
+	fs.StringVar(&o.notify, "notify", "", "alert on matches of yara rules tagged log or warn: bell, exec:<command> run with the rule and connection details, or webhook:<url> POSTed them as JSON")
+	fs.IntVar(&o.alertRate, "alert-rate", 0, "log and alert on each yara rule at most this many times a minute, counting the rest and reporting the count with its next alert; drop rules block regardless (0 for no limit)")
+	fs.StringVar(&o.blockAction, "block-action", "close", "how connections dropped by a yara rule are ended: close, reset or respond")
+	fs.Float64Var(&o.entropy.Threshold, "entropy-threshold", 0, "match client data whose entropy stays above this many bits per byte (up to 8, e.g. 7.5) over --entropy-window bytes, as encrypted or compressed data does")
+	fs.IntVar(&o.entropy.Window, "entropy-window", 4096, "bytes the entropy for --entropy-threshold is measured over")
+	fs.StringVar(&o.entropyTag, "entropy-action", "warn", "what an --entropy-threshold match does, like the yara tag of the same name: log, warn or drop")
+	fs.StringVar(&o.blockReply, "block-response", "", "data sent to the client before closing when --block-action is respond")
+	fs.StringVar(&o.bindDevice, "bind-device", "", "bind remote connections to this network device or VRF (linux only)")
+	fs.IntVar(&o.fwmark, "fwmark", 0, "set this routing mark on remote connections (linux only)")
+	fs.StringVar(&o.shadowAddr, "shadow", "", "also send client data to this backend and log where its responses differ from the remote's")
+	fs.DurationVar(&o.linger, "linger-after-eof", 0, "when one side closes, keep relaying the other for up to this long")
+	fs.DurationVar(&o.maxLifetime, "max-lifetime", 0, "close connections after they have been open this long, e.g. 1h")
+	fs.DurationVar(&o.idleTimeout, "idle-timeout", 0, "close connections once neither side has sent anything for this long, e.g. 5m")
+	fs.BoolVar(&o.decompress, "decompress", false, "inspect and rewrite the content of gzip and zlib streams instead of their compressed bytes")
+	fs.BoolVar(&o.compress, "compress", false, "gzip compress the connection to the remote, which must be another tcp-proxy running with --accept-compressed")
+	fs.BoolVar(&o.acceptComp, "accept-compressed", false, "let clients that are tcp-proxy instances running with --compress compress their connections")
+	fs.BoolVar(&o.websocket, "websocket", false, "after an HTTP upgrade to WebSocket, inspect and rewrite the payload of each frame instead of the masked frames")
+	fs.IntVar(&o.bufferSize, "buffer-size", proxy.DefaultBufferSize, "read buffer size per direction of each connection (env "+envBufferSize+")")
+	fs.IntVar(&o.upBuffer, "upstream-buffer-size", 0, "read buffer size for data from clients, defaults to --buffer-size")
+	fs.IntVar(&o.downBuffer, "downstream-buffer-size", 0, "read buffer size for data from the remote, defaults to --buffer-size")
+	fs.IntVar(&o.recvBuf, "recv-buf", 0, "socket receive buffer size (SO_RCVBUF) of both connections, 0 for the OS default")
+	fs.IntVar(&o.sendBuf, "send-buf", 0, "socket send buffer size (SO_SNDBUF) of both connections, 0 for the OS default")
+	fs.IntVar(&o.maxConns, "max-connections", 0, "refuse connections while this many are open, 0 for no limit (env "+envMaxConns+")")
+	fs.IntVar(&o.maxPerClient, "max-per-client", 0, "refuse connections from a client IP while this many from it are open, 0 for no limit")
+	fs.IntVar(&o.maxScans, "max-concurrent-scans", 0, "run at most this many yara scans at once across all connections, 0 for no limit")
+	fs.BoolVar(&o.skipScans, "skip-busy-scans", false, "with --max-concurrent-scans, forward data unscanned instead of waiting when the limit is reached")
+	fs.IntVar(&o.matchStrings, "max-match-strings", proxy.DefaultMaxMatchStrings, "string matches logged per yara rule match, the rest are only counted; 0 means the built-in limit, not none")
+	fs.IntVar(&o.matchData, "max-match-data", proxy.DefaultMaxMatchData, "bytes of data kept per string match of a yara rule; 0 means the built-in limit, not none")
+	fs.IntVar(&o.upSkip.Head, "skip-upstream-head", 0, "forward this many bytes at the start of each client stream without scanning or replacing them")
+	fs.IntVar(&o.upSkip.Tail, "skip-upstream-tail", 0, "forward this many bytes at the end of each client stream without scanning or replacing them, holding them back until the client sends more or closes")
+	fs.IntVar(&o.downSkip.Head, "skip-downstream-head", 0, "like --skip-upstream-head for the remote's stream")
+	fs.IntVar(&o.downSkip.Tail, "skip-downstream-tail", 0, "like --skip-upstream-tail for the remote's stream")
+	fs.BoolVar(&o.preflight, "preflight", false, "connect to the remote once at startup and exit if it is unreachable")
+	fs.Float64Var(&o.sampleRate, "sample-rate", 1, "inspect only this fraction of connections, picked at random, and relay the rest untouched")
+	fs.Int64Var(&o.sampleSeed, "sample-seed", 0, "seed for picking --sample-rate connections, for reproducible runs (default random)")
+	fs.StringVar(&o.connIDs, "conn-ids", "counter", "how connections are identified in logs, summaries and hooks: counter numbers them from 1, uuid also gives each a random UUID that is unique across restarts")
+	fs.StringVar(&o.statsOutput, "stats-output", "", "write a summary of each closed connection in this format (json)")
+	fs.BoolVar(&o.hashData, "hash", false, "keep SHA-256 digests of the data relayed each way, before and after replacers, logged when the connection closes and added to --stats-output summaries")
+	fs.StringVar(&o.statsFile, "stats-file", "", "file --stats-output summaries are appended to, defaults to stderr")
+	fs.StringVar(&o.dumpDir, "dump-dir", "", "write a hexdump of each connection's traffic in both directions to a file of its own in this directory")
+	fs.StringVar(&o.eventSocket, "event-socket", "", "send a JSON line for every connection opened and closed and every rule match to the collector listening on this Unix socket, or unixgram:PATH for a datagram socket")
+	fs.StringToStringVar(&o.tags, "tag", nil, "tag every connection with this key=value (repeatable), e.g. tenant=acme, shown in its log lines, summary, match records and events")
+	fs.StringVar(&o.matchLog, "match-log", "", "append a JSON record of every yara rule match, with the connection and matched strings, to this file")
+	fs.StringVar(&o.user, "user", "", "after opening the listener, e.g. on a privileged port as root, switch to this user (name or uid, linux only)")
+	fs.StringVar(&o.group, "group", "", "after opening the listener, switch to this group (name or gid, linux only), defaults to the primary group of --user")
+	fs.BoolVar(&o.check, "check", false, "validate the replacer config and yara rules, then exit")
+	fs.Usage = func() { printUsage(os.Stderr, fs) }
+	return fs
+}
+
+// printUsage - Write the usage message listing the flags of fs to w
+func printUsage(w io.Writer, fs *pflag.FlagSet) {
+	fmt.Fprintf(w, "Usage of %s:\n", os.Args[0])
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// Environment variables read for settings whose flag wasn't given, for
+// devices where changing the command line is awkward
+const (
+	envBufferSize = "TCP_PROXY_BUFFER_SIZE"
+	envMaxConns   = "TCP_PROXY_MAX_CONNECTIONS"
+)
+
+// envFallback - Set *v from the environment variable env when the flag
+// wasn't passed on the command line
+func envFallback(fs *pflag.FlagSet, flag, env string, v *int) error {
+	s, ok := os.LookupEnv(env)
+	if !ok || fs.Changed(flag) {
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid %s %q: expected a non-negative integer", env, s)
+	}
+	*v = n
+	return nil
+}
+
+// readPrologue - The contents of a prologue file, nil when none is given
+func readPrologue(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prologue: %w", err)
+	}
+	return data, nil
+}
+
+// sampleSeed - The --sample-seed if given, otherwise a different one each run
+func sampleSeed(fs *pflag.FlagSet, seed int64) int64 {
+	if fs.Changed("sample-seed") {
+		return seed
+	}
+	return time.Now().UnixNano()
+}
+
+// Main - Run the tool with args, logging v as its version, and exit with
+// its exit code
+func Main(v string, args []string) {
+	version = v
+	os.Exit(run(args))
+}
+
+// run - Parse args and run the proxy, returning the process exit code. Only
+// returns once the proxy has stopped or failed to start.
+func run(args []string) int {
+	var o options
+	fs := newFlagSet(&o)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if o.help {
+		printUsage(os.Stdout, fs)
+		return exitOK
+	}
+
+	if o.check {
+		return runCheck(os.Stdout, o.replacerFile, o.yaraConfig)
+	}
+
+	if err := envFallback(fs, "buffer-size", envBufferSize, &o.bufferSize); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := envFallback(fs, "max-connections", envMaxConns, &o.maxConns); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	blockAction, err := proxy.ParseBlockAction(o.blockAction)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	lifecycle, err := proxy.ParseLifecycleEvents(o.lifecycle)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --log-lifecycle: %v\n", err)
+		return exitUsage
+	}
+	quiet := proxy.AllLifecycleEvents &^ lifecycle
+	if o.quietConns {
+		quiet |= proxy.LifecycleOpen | proxy.LifecycleClose
+	}
+	if o.sampleRate <= 0 || o.sampleRate > 1 {
+		fmt.Fprintf(os.Stderr, "invalid --sample-rate %g, expected more than 0 and at most 1\n", o.sampleRate)
+		return exitUsage
+	}
+	var notifier proxy.Notifier
+	if o.notify != "" {
+		if notifier, err = proxy.ParseNotifier(o.notify); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+	sendProxy, err := proxy.ParseProxyProtocol(o.sendProxy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --send-proxy: %s\n", err)
+		return exitUsage
+	}
+	if o.network != "tcp" && o.network != "tcp4" && o.network != "tcp6" {
+		fmt.Fprintf(os.Stderr, "unknown --network %q, expected tcp, tcp4 or tcp6\n", o.network)
+		return exitUsage
+	}
+	if o.connIDs != "counter" && o.connIDs != "uuid" {
+		fmt.Fprintf(os.Stderr, "unknown --conn-ids %q, expected counter or uuid\n", o.connIDs)
+		return exitUsage
+	}
+	if o.entropy.Threshold < 0 || o.entropy.Threshold > 8 {
+		fmt.Fprintf(os.Stderr, "invalid --entropy-threshold %v, expected 0 to 8 bits per byte\n", o.entropy.Threshold)
+		return exitUsage
+	}
+	if o.entropyTag != "log" && o.entropyTag != "warn" && o.entropyTag != "drop" {
+		fmt.Fprintf(os.Stderr, "unknown --entropy-action %q, expected log, warn or drop\n", o.entropyTag)
+		return exitUsage
+	}
+	o.entropy.Tags = []string{o.entropyTag}
+	if o.muxWait < 0 {
+		fmt.Fprintf(os.Stderr, "invalid --mux-queue-timeout %v, expected 0 or more\n", o.muxWait)
+		return exitUsage
+	}
+	if o.queueWait < 0 {
+		fmt.Fprintf(os.Stderr, "invalid --queue-timeout %v, expected 0 or more\n", o.queueWait)
+		return exitUsage
+	}
+	if o.listenRetry < 0 {
+		fmt.Fprintf(os.Stderr, "invalid --listen-retry %v, expected 0 or more\n", o.listenRetry)
+		return exitUsage
+	}
+	if o.maxScans < 0 {
+		fmt.Fprintf(os.Stderr, "invalid --max-concurrent-scans %d, expected 0 or more\n", o.maxScans)
+		return exitUsage
+	}
+	for _, count := range []struct {
+		name string
+		n    int
+	}{
+		{"skip-upstream-head", o.upSkip.Head},
+		{"skip-upstream-tail", o.upSkip.Tail},
+		{"skip-downstream-head", o.downSkip.Head},
+		{"skip-downstream-tail", o.downSkip.Tail},
+		{"entropy-window", o.entropy.Window},
+		{"upstream-buffer-size", o.upBuffer},
+		{"downstream-buffer-size", o.downBuffer},
+		{"recv-buf", o.recvBuf},
+		{"send-buf", o.sendBuf},
+		{"max-match-strings", o.matchStrings},
+		{"max-match-data", o.matchData},
+		{"queue-size", o.queueSize},
+		{"alert-rate", o.alertRate},
+		{"max-per-client", o.maxPerClient},
+	} {
+		if count.n < 0 {
+			fmt.Fprintf(os.Stderr, "invalid --%s %d, expected 0 or more\n", count.name, count.n)
+			return exitUsage
+		}
+	}
+	if o.tunnel != "" && o.tunnel != tunnelUDPToTCP && o.tunnel != tunnelTCPToUDP && o.tunnel != tunnelMuxToTCP {
+		fmt.Fprintf(os.Stderr, "unknown --tunnel mode %q, expected %s, %s or %s\n", o.tunnel, tunnelUDPToTCP, tunnelTCPToUDP, tunnelMuxToTCP)
+		return exitUsage
+	}
+	if o.mux && (o.unwrapTLS || o.remoteFile != "" || o.tunnel != "") {
+		fmt.Fprintln(os.Stderr, "--mux can't be used with --unwrap-tls, --remote-file or --tunnel")
+		return exitUsage
+	}
+	if o.portMap != "" && (o.remoteFile != "" || o.mux || o.tunnel != "") {
+		fmt.Fprintln(os.Stderr, "--port-map can't be used with --remote-file, --mux or --tunnel")
+		return exitUsage
+	}
+	if o.mux && o.queueWait > 0 {
+		fmt.Fprintln(os.Stderr, "--queue-timeout can't be used with --mux, see --mux-queue-timeout")
+		return exitUsage
+	}
+	if o.statsOutput != "" && o.statsOutput != "json" {
+		fmt.Fprintf(os.Stderr, "unknown --stats-output format %q, expected json\n", o.statsOutput)
+		return exitUsage
+	}
+
+	for k := range o.tags {
+		if k == "" {
+			fmt.Fprintln(os.Stderr, "--tag needs a key, e.g. tenant=acme")
+			return exitUsage
+		}
+	}
+
+	var pins [][]byte
+	for _, s := range o.tlsPins {
+		pin, err := proxy.ParseSPKIPin(s)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		pins = append(pins, pin)
+	}
+	palette, err := proxy.ParsePalette(o.colorScheme)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	verbosity := &proxy.LogLevel{}
+	verbosity.Set(o.verbose)
+	logger := proxy.ColorLogger{
+		Verbosity:  verbosity,
+		Color:      o.colors,
+		Palette:    palette,
+		TimeFormat: o.timeFormat,
+		UTC:        o.logUTC,
+	}
+
+	if o.yaraConfig != "" && !proxy.YaraEnabled {
+		logger.Warn("yara disabled in this build, rebuild without the noyara tag to use --yara")
+		return exitConfig
+	}
+	if o.quic && !proxy.QUICEnabled() {
+		logger.Warn("QUIC disabled in this build, use the tcp-proxy of the quic module for --quic")
+		return exitConfig
+	}
+
+	if o.quic && !o.unwrapTLS {
+		fmt.Fprintln(os.Stderr, "--quic needs --unwrap-tls")
+		return exitUsage
+	}
+	if o.quic && o.preflight {
+		fmt.Fprintln(os.Stderr, "--preflight can't be used with --quic")
+		return exitUsage
+	}
+	if o.clientCA != "" && o.certDir == "" {
+		fmt.Fprintln(os.Stderr, "--tls-client-ca needs --tls-cert-dir")
+		return exitUsage
+	}
+	if o.tunnel != "" && (o.user != "" || o.group != "") {
+		fmt.Fprintln(os.Stderr, "--user and --group can't be used with --tunnel")
+		return exitUsage
+	}
+	if o.tunnel != "" && o.healthAddr != "" {
+		fmt.Fprintln(os.Stderr, "--health-address can't be used with --tunnel")
+		return exitUsage
+	}
+	if o.tunnel != "" {
+		return runTunnel(o.tunnel, o.localAddr, o.remoteAddr, logger)
+	}
+
+	remoteDesc := o.remoteAddr
+	if o.remoteFile != "" {
+		remoteDesc = "remotes in " + o.remoteFile
+	}
+	if o.portMap != "" {
+		remoteDesc = "the remotes by port in " + o.portMap
+	}
+	logger.Info("go-tcp-proxy (%s) proxying from %v to %v ", version, o.localAddr, remoteDesc)
+
+	creds, err := lookupCredentials(o.user, o.group)
+	if err != nil {
+		logger.Warn("Failed to look up the user to run as: %s", err)
+		return exitPrivs
+	}
+
+	laddr, err := net.ResolveTCPAddr("tcp", o.localAddr)
+	if err != nil {
+		logger.Warn("Failed to resolve local address: %s", err)
+		return exitResolve
+	}
+	raddr, err := proxy.ResolveRemote(o.network, o.remoteAddr)
+	if err != nil {
+		logger.Warn("Failed to resolve remote address: %s", err)
+		return exitResolve
+	}
+
+	var policy *proxy.Policy
+	if o.policyFile != "" {
+		policy, err = proxy.ReadPolicyFile(o.policyFile)
+		if err != nil {
+			logger.Warn("error loading policy: %v", err)
+			return exitConfig
+		}
+		if o.certDir != "" && policy.UsesJA3() {
+			// the handshake with the client happens in crypto/tls, which
+			// doesn't hand over the ClientHello as sent
+			logger.Warn("error loading policy: ja3 conditions can't match clients whose TLS --tls-cert-dir terminates")
+			return exitConfig
+		}
+	}
+
+	clientPrologue, err := readPrologue(o.clientProlog)
+	if err != nil {
+		logger.Warn("%v", err)
+		return exitConfig
+	}
+	remotePrologue, err := readPrologue(o.remoteProlog)
+	if err != nil {
+		logger.Warn("%v", err)
+		return exitConfig
+	}
+	certPrologue, err := readPrologue(o.certProlog)
+	if err != nil {
+		logger.Warn("%v", err)
+		return exitConfig
+	}
+
+	var remotes *proxy.RemoteFile
+	if o.remoteFile != "" {
+		remotes, err = proxy.OpenRemoteFile(o.remoteFile, logger)
+		if err != nil {
+			logger.Warn("error loading remote file: %v", err)
+			return exitConfig
+		}
+		defer remotes.Close()
+	}
+
+	var portMap proxy.PortMap
+	var ports map[int]portRemote
+	if o.portMap != "" {
+		if portMap, err = proxy.ReadPortMapFile(o.portMap); err != nil {
+			logger.Warn("error loading port map: %v", err)
+			return exitConfig
+		}
+		if fs.Changed("local-address") && laddr.Port != 0 {
+			if err := portMap.Check(laddr.Port); err != nil {
+				logger.Warn("error in port map: %v, the --local-address port must be one of its ports", err)
+				return exitConfig
+			}
+		}
+		ports = make(map[int]portRemote, len(portMap))
+		for port, remote := range portMap {
+			addr, err := proxy.ResolveRemote(o.network, remote)
+			if err != nil {
+				logger.Warn("Failed to resolve remote address for local port %d: %s", port, err)
+				return exitResolve
+			}
+			ports[port] = portRemote{addr: addr, serverName: remoteServerName(o.serverName, remote, false)}
+		}
+	}
+
+	var certs *proxy.CertStore
+	if o.certDir != "" {
+		certs, err = proxy.LoadCertDir(o.certDir, o.defaultCert)
+		if err != nil {
+			logger.Warn("error loading certificates: %v", err)
+			return exitConfig
+		}
+		if o.clientCA != "" {
+			if certs.ClientCAs, err = proxy.LoadClientCAs(o.clientCA); err != nil {
+				logger.Warn("error loading client CAs: %v", err)
+				return exitConfig
+			}
+			certs.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	var stats io.Writer
+	if o.statsOutput != "" {
+		stats = os.Stderr
+		if o.statsFile != "" {
+			f, err := os.OpenFile(o.statsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				logger.Warn("Failed to open stats file: %s", err)
+				return exitConfig
+			}
+			defer f.Close()
+			stats = f
+		}
+	}
+
+	var matchLog *proxy.MatchLog
+	if o.matchLog != "" {
+		matchLog, err = proxy.OpenMatchLog(o.matchLog)
+		if err != nil {
+			logger.Warn("Failed to open match log: %s", err)
+			return exitConfig
+		}
+		defer matchLog.Close()
+	}
+
+	var events *proxy.EventSocket
+	if o.eventSocket != "" {
+		network, path := "unix", o.eventSocket
+		if strings.HasPrefix(path, "unixgram:") {
+			network, path = "unixgram", strings.TrimPrefix(path, "unixgram:")
+		}
+		events = proxy.NewEventSocket(network, path, logger)
+		defer events.Close()
+	}
+
+	if o.dumpDir != "" {
+		if err := os.MkdirAll(o.dumpDir, 0700); err != nil {
+			logger.Warn("Failed to create dump directory: %s", err)
+			return exitConfig
+		}
+	}
+
+	s := &server{
+		Log:          logger,
+		laddr:        laddr,
+		raddr:        raddr,
+		configPath:   o.replacerFile,
+		strictConfig: o.strictConf,
+		yaraPath:     o.yaraConfig,
+		connLog:      logger,
+		quiet:        quiet,
+		nagles:       o.nagles,
+		hex:          o.hex,
+		unwrapTLS:    o.unwrapTLS,
+		quic:         o.quic,
+		onConnect:    strings.Fields(o.onConnectCmd),
+		onClose:      strings.Fields(o.onCloseCmd),
+		logMSS:       o.logMSS,
+		smallRead:    o.smallRead,
+		block:        blockAction,
+		entropy:      o.entropy,
+		notifier:     notifier,
+		blockReply:   []byte(o.blockReply),
+		decompress:   o.decompress,
+		websocket:    o.websocket,
+		compress:     o.compress,
+		acceptComp:   o.acceptComp,
+		maxLifetime:  o.maxLifetime,
+		idleTimeout:  o.idleTimeout,
+		bindDevice:   o.bindDevice,
+		fwmark:       o.fwmark,
+		shadowAddr:   o.shadowAddr,
+		bufferSize:   o.bufferSize,
+		upBuffer:     o.upBuffer,
+		downBuffer:   o.downBuffer,
+		recvBuf:      o.recvBuf,
+		sendBuf:      o.sendBuf,
+		matchStrings: o.matchStrings,
+		matchData:    o.matchData,
+		maxConns:     o.maxConns,
+		maxPerClient: o.maxPerClient,
+		policy:       policy,
+		network:      o.network,
+		sendProxy:    sendProxy,
+		uuids:        o.connIDs == "uuid",
+		tags:         o.tags,
+		linger:       o.linger,
+		tlsConfig:    proxy.RemoteTLSConfig(o.tlsInsecure, pins),
+		tlsALPN:      o.tlsALPN,
+		serverName:   remoteServerName(o.serverName, o.remoteAddr, remotes != nil),
+		certs:        certs,
+		remotes:      remotes,
+		ports:        ports,
+		clientProlog: clientPrologue,
+		remoteProlog: remotePrologue,
+		certProlog:   string(certPrologue),
+		sampleRate:   o.sampleRate,
+		sampleRand:   proxy.NewSampleRand(sampleSeed(fs, o.sampleSeed)),
+		stats:        stats,
+		hashData:     o.hashData,
+		matchLog:     matchLog,
+		events:       events,
+		dumpDir:      o.dumpDir,
+		upSkip:       o.upSkip,
+		downSkip:     o.downSkip,
+	}
+	if o.queueWait > 0 {
+		s.queue = proxy.NewDialQueue(o.queueSize, o.queueWait)
+	}
+	if o.alertRate > 0 {
+		s.alerts = proxy.NewAlertLimiter(o.alertRate)
+	}
+	if o.maxScans > 0 {
+		s.scanLimit = proxy.NewScanLimiter(o.maxScans, o.skipScans)
+	}
+	// an interrupt while a huge ruleset compiles gives up on it, so the
+	// deferred cleanup still runs
+	loading, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = s.reload(loading)
+	stop()
+	if err != nil {
+		return exitConfig
+	}
+
+	if o.preflight {
+		target := o.remoteAddr
+		if remotes != nil {
+			// the remotes in the file change over time, check the first one
+			if addrs := remotes.Addresses(); len(addrs) > 0 {
+				target = addrs[0]
+			}
+		}
+		targets := []string{target}
+		serverNames := map[string]string{target: s.serverName}
+		if portMap != nil {
+			// -r isn't used, every port's remote has to be up instead
+			targets = portMap.Remotes()
+			for port, remote := range portMap {
+				serverNames[remote] = ports[port].serverName
+			}
+		}
+		for _, target := range targets {
+			if err := preflight(o.network, target, o.unwrapTLS, serverNames[target], s.tlsConfig); err != nil {
+				logger.Warn("Preflight check failed, remote %s is unreachable: %s", target, err)
+				return exitRemote
+			}
+			logger.Info("Preflight check passed, remote %s is reachable", target)
+		}
+	}
+
+	var probes *health
+	if o.healthAddr != "" {
+		remotes := func() []string { return []string{o.remoteAddr} }
+		if s.remotes != nil {
+			remotes = s.remotes.Addresses
+		}
+		if portMap != nil {
+			remotes = portMap.Remotes
+		}
+		probes = newHealth(o.network, remotes)
+		l, err := serveHealth(o.healthAddr, probes, logger)
+		if err != nil {
+			logger.Warn("Failed to open health address: %s", err)
+			return exitListen
+		}
+		defer l.Close()
+		logger.Info("Serving /healthz and /readyz on %v", l.Addr())
+	}
+
+	listener, err := systemdListener()
+	if err != nil {
+		logger.Warn("%s", err)
+		return exitListen
+	}
+	var listeners []*net.TCPListener
+	if listener != nil {
+		logger.Info("Using socket passed by systemd on %v", listener.Addr())
+		s.laddr = listener.Addr().(*net.TCPAddr)
+		if portMap != nil {
+			if err := portMap.Check(s.laddr.Port); err != nil {
+				listener.Close()
+				logger.Warn("error in port map: %v, the socket passed by systemd must be on one of its ports", err)
+				return exitConfig
+			}
+		}
+		listeners = []*net.TCPListener{listener}
+	} else {
+		laddrs := []*net.TCPAddr{laddr}
+		if portMap != nil {
+			laddrs = portAddrs(laddr, portMap.Ports())
+		}
+		listeners, err = listenAll(laddrs, o.listenRetry, logger)
+		if inUse, ok := err.(*errAddrInUse); ok {
+			logger.Warn("Failed to open local port to listen: %s", inUse)
+			return exitInUse
+		}
+		if err != nil {
+			logger.Warn("Failed to open local port to listen: %s", err)
+			return exitListen
+		}
+	}
+	if probes != nil {
+		probes.setListening()
+	}
+	if o.user != "" || o.group != "" {
+		if err := dropPrivileges(creds); err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			logger.Warn("Failed to drop privileges: %s", err)
+			return exitPrivs
+		}
+		logger.Info("Running as uid %d gid %d", os.Getuid(), os.Getgid())
+	}
+
+	if o.mux {
+		s.mux = &proxy.MuxClient{Remote: o.remoteAddr, Log: logger, QueueTimeout: o.muxWait}
+		s.mux.Start()
+		defer s.mux.Close()
+		if probes != nil {
+			probes.setMux(s.mux)
+		}
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go s.handleReloads(sighup)
+
+	sigusr2 := make(chan os.Signal, 1)
+	notifyVerbosity(sigusr2)
+	go handleVerbosity(sigusr2, verbosity, logger)
+
+	sigusr1 := make(chan os.Signal, 1)
+	notifyStats(sigusr1)
+	go handleStats(sigusr1, s)
+
+	s.serve(listeners...)
+	return exitOK
+}
@@ -0,0 +1,144 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExitCodes(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer busy.Close()
+
+	missing := filepath.Join(t.TempDir(), "missing.yml")
+	portMap := filepath.Join(t.TempDir(), "ports.yml")
+	invalid := filepath.Join(t.TempDir(), "invalid.yml")
+	ja3Policy := filepath.Join(t.TempDir(), "policy.yml")
+	if err := ioutil.WriteFile(ja3Policy, []byte("rules:\n  - verdict: deny\n    ja3: [e7d705a3286e19ea42f587b344ee6865]\n"), 0644); err != nil {
+		t.Fatalf("failed to write policy: %v", err)
+	}
+	if err := ioutil.WriteFile(invalid, []byte("- type: substring\n  find: foo\n- type: bogus\n"), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	busyPort := busy.Addr().(*net.TCPAddr).Port
+	if err := ioutil.WriteFile(portMap, []byte(fmt.Sprintf("%d: 127.0.0.1:1\n", busyPort)), 0644); err != nil {
+		t.Fatalf("failed to write port map: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"help", []string{"--help"}, exitOK},
+		{"bad flag", []string{"--no-such-flag"}, exitUsage},
+		{"bad block action", []string{"--block-action", "explode"}, exitUsage},
+		{"bad stats format", []string{"--stats-output", "xml"}, exitUsage},
+		{"bad tls pin", []string{"--tls-pin-sha256", "abcd"}, exitUsage},
+		{"bad sample rate", []string{"--sample-rate", "1.5"}, exitUsage},
+		{"bad lifecycle event", []string{"--log-lifecycle", "open,opened"}, exitUsage},
+		{"negative scan limit", []string{"--max-concurrent-scans", "-1"}, exitUsage},
+		{"negative match strings", []string{"--max-match-strings", "-1"}, exitUsage},
+		{"negative skip", []string{"--skip-downstream-tail", "-4"}, exitUsage},
+		{"bad entropy threshold", []string{"--entropy-threshold", "9"}, exitUsage},
+		{"bad entropy action", []string{"--entropy-action", "explode"}, exitUsage},
+		{"negative socket buffer", []string{"--recv-buf", "-1"}, exitUsage},
+		{"bad notifier", []string{"--notify", "pager"}, exitUsage},
+		{"bad network", []string{"--network", "udp"}, exitUsage},
+		{"bad send proxy", []string{"--send-proxy", "v3"}, exitUsage},
+		{"bad conn ids", []string{"--conn-ids", "random"}, exitUsage},
+		{"bad tunnel mode", []string{"--tunnel", "sideways"}, exitUsage},
+		{"client ca without cert dir", []string{"--tls-client-ca", "ca.pem"}, exitUsage},
+		{"mux with unwrap tls", []string{"--mux", "-u"}, exitUsage},
+		{"negative mux queue timeout", []string{"--mux-queue-timeout", "-1s"}, exitUsage},
+		{"user with tunnel", []string{"--tunnel", "udp-to-tcp", "--user", "nobody"}, exitUsage},
+		{"tag without a key", []string{"--tag", "=acme"}, exitUsage},
+		{"health address with tunnel", []string{"--tunnel", "udp-to-tcp", "--health-address", ":0"}, exitUsage},
+		{"negative queue timeout", []string{"--queue-timeout", "-1s"}, exitUsage},
+		{"negative queue size", []string{"--queue-size", "-1"}, exitUsage},
+		{"negative alert rate", []string{"--alert-rate", "-1"}, exitUsage},
+		{"negative max per client", []string{"--max-per-client", "-1"}, exitUsage},
+		{"queue timeout with mux", []string{"--mux", "--queue-timeout", "1s"}, exitUsage},
+		{"unknown user", []string{"-l", "127.0.0.1:0", "-r", "127.0.0.1:1", "--user", "no-such-user-here"}, exitPrivs},
+		{"bad local address", []string{"-l", "127.0.0.1"}, exitResolve},
+		{"bad remote address", []string{"-l", "127.0.0.1:0", "-r", "localhost"}, exitResolve},
+		{"missing config", []string{"-l", "127.0.0.1:0", "-r", "127.0.0.1:1", "-f", missing}, exitConfig},
+		{"invalid config entry with strict config", []string{"-l", "127.0.0.1:0", "-r", "127.0.0.1:1", "-f", invalid, "--strict-config"}, exitConfig},
+		{"missing policy", []string{"-l", "127.0.0.1:0", "-r", "127.0.0.1:1", "--policy", missing}, exitConfig},
+		{"missing cert dir", []string{"-l", "127.0.0.1:0", "-r", "127.0.0.1:1", "--tls-cert-dir", missing}, exitConfig},
+		{"ja3 policy with cert dir", []string{"-l", "127.0.0.1:0", "-r", "127.0.0.1:1", "--policy", ja3Policy, "--tls-cert-dir", t.TempDir()}, exitConfig},
+		{"missing remote file", []string{"-l", "127.0.0.1:0", "-r", "127.0.0.1:1", "--remote-file", missing}, exitConfig},
+		{"missing port map", []string{"-l", "127.0.0.1:0", "--port-map", missing}, exitConfig},
+		{"unmapped local port", []string{"-l", fmt.Sprintf("127.0.0.1:%d", busyPort+1), "--port-map", portMap}, exitConfig},
+		{"port map with remote file", []string{"--port-map", portMap, "--remote-file", missing}, exitUsage},
+		{"mapped port in use", []string{"-l", "127.0.0.1:0", "--port-map", portMap}, exitInUse},
+		{"missing prologue", []string{"-l", "127.0.0.1:0", "-r", "127.0.0.1:1", "--client-prologue-file", missing}, exitConfig},
+		{"missing yara rules", []string{"-l", "127.0.0.1:0", "-r", "127.0.0.1:1", "-y", missing}, exitConfig},
+		{"negative listen retry", []string{"--listen-retry", "-1s"}, exitUsage},
+		{"port in use", []string{"-l", busy.Addr().String(), "-r", "127.0.0.1:1"}, exitInUse},
+	}
+	for _, tt := range tests {
+		if code := run(tt.args); code != tt.code {
+			t.Errorf("%s: wanted exit code %d, got %d", tt.name, tt.code, code)
+		}
+	}
+}
+
+func TestEnvFallback(t *testing.T) {
+	var o options
+	fs := newFlagSet(&o)
+	fs.Parse([]string{"--max-connections", "7"})
+
+	t.Setenv(envBufferSize, "4096")
+	t.Setenv(envMaxConns, "3")
+	if err := envFallback(fs, "buffer-size", envBufferSize, &o.bufferSize); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := envFallback(fs, "max-connections", envMaxConns, &o.maxConns); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if o.bufferSize != 4096 {
+		t.Errorf("buffer size should come from the environment, got %d", o.bufferSize)
+	}
+	if o.maxConns != 7 {
+		t.Errorf("the flag should win over the environment, got %d", o.maxConns)
+	}
+
+	t.Setenv(envBufferSize, "lots")
+	if err := envFallback(fs, "buffer-size", envBufferSize, &o.bufferSize); err == nil {
+		t.Errorf("expected an error for a non-numeric value")
+	}
+}
+
+func TestHelpFlag(t *testing.T) {
+	for _, args := range [][]string{{"-h"}, {"--help"}} {
+		var o options
+		fs := newFlagSet(&o)
+		if err := fs.Parse(args); err != nil {
+			t.Fatalf("%v: unexpected error: %v", args, err)
+		}
+		if !o.help || o.hex {
+			t.Errorf("%v should ask for help, not hex output", args)
+		}
+
+		var out bytes.Buffer
+		printUsage(&out, fs)
+		for _, want := range []string{"Usage of", "-h, --help", "show this help", "-x, --hex", "--local-address"} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("usage should mention %q, got:\n%s", want, out.String())
+			}
+		}
+	}
+
+	var o options
+	if err := newFlagSet(&o).Parse([]string{"-x"}); err != nil || !o.hex || o.help {
+		t.Errorf("-x should turn on hex output")
+	}
+}
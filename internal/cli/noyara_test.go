@@ -0,0 +1,23 @@
+//go:build noyara
+// +build noyara
+
+package cli
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestYaraDisabled(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "rules.yar")
+	if err := ioutil.WriteFile(rules, []byte("rule Foo\n{\n    condition:\n        true\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := run([]string{"-l", "127.0.0.1:0", "-r", "127.0.0.1:1", "-y", rules}); code != exitConfig {
+		t.Errorf("expected exit code %d with --yara in a noyara build, got %d", exitConfig, code)
+	}
+	if code := runCheck(ioutil.Discard, "", rules); code != exitConfig {
+		t.Errorf("expected --check of yara rules to fail in a noyara build, got %d", code)
+	}
+}
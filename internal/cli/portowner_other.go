@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package cli
+
+// portOwner - Not supported on this platform
+func portOwner(port int) string {
+	return ""
+}
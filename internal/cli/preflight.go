@@ -0,0 +1,36 @@
+package cli
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// preflightTimeout - How long the startup check waits for the remote
+const preflightTimeout = 5 * time.Second
+
+// preflight - Dial the remote once the way connections will, including the
+// TLS handshake when unwrapping TLS, to confirm it is reachable. serverName,
+// when set, is sent and verified instead of the host of remoteAddr.
+func preflight(network, remoteAddr string, unwrapTLS bool, serverName string, tlsConfig *tls.Config) error {
+	d := &net.Dialer{Timeout: preflightTimeout}
+	var conn net.Conn
+	var err error
+	if unwrapTLS {
+		if serverName != "" && (tlsConfig == nil || tlsConfig.ServerName == "") {
+			if tlsConfig == nil {
+				tlsConfig = &tls.Config{}
+			} else {
+				tlsConfig = tlsConfig.Clone()
+			}
+			tlsConfig.ServerName = serverName
+		}
+		conn, err = tls.DialWithDialer(d, network, remoteAddr, tlsConfig)
+	} else {
+		conn, err = d.Dial(network, remoteAddr)
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
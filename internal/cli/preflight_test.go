@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := l.Addr().String()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	if err := preflight("tcp", addr, false, "", nil); err != nil {
+		t.Errorf("reachable remote failed the preflight: %v", err)
+	}
+	// a plain TCP server fails the TLS handshake
+	if err := preflight("tcp", addr, true, "", nil); err == nil {
+		t.Errorf("TLS preflight should fail against a plain TCP remote")
+	}
+
+	l.Close()
+	if err := preflight("tcp", addr, false, "", nil); err == nil {
+		t.Errorf("unreachable remote passed the preflight")
+	}
+	if code := run([]string{"-l", "127.0.0.1:0", "-r", addr, "--preflight"}); code != exitRemote {
+		t.Errorf("wanted exit code %d for an unreachable remote, got %d", exitRemote, code)
+	}
+}
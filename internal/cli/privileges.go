@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// credentials - The user and group to switch to after listening, -1 for
+// ones that stay as they are
+type credentials struct {
+	uid, gid int
+}
+
+// lookupCredentials - Resolve --user and --group, each a name or a numeric
+// id. A user without a group switches to the user's primary group.
+func lookupCredentials(userName, groupName string) (credentials, error) {
+	creds := credentials{uid: -1, gid: -1}
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if _, ok := err.(user.UnknownUserError); ok {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return creds, fmt.Errorf("unknown user %q: %w", userName, err)
+		}
+		if creds.uid, err = strconv.Atoi(u.Uid); err != nil {
+			return creds, fmt.Errorf("user %q has non-numeric uid %s", userName, u.Uid)
+		}
+		if groupName == "" {
+			if creds.gid, err = strconv.Atoi(u.Gid); err != nil {
+				return creds, fmt.Errorf("user %q has non-numeric gid %s", userName, u.Gid)
+			}
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return creds, fmt.Errorf("unknown group %q: %w", groupName, err)
+		}
+		if creds.gid, err = strconv.Atoi(g.Gid); err != nil {
+			return creds, fmt.Errorf("group %q has non-numeric gid %s", groupName, g.Gid)
+		}
+	}
+	return creds, nil
+}
@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// dropPrivileges - Switch the whole process to creds, once the privileged
+// work of opening the listener is done. The group goes first, since
+// changing it needs the privileges that changing the user gives up, and
+// the supplementary groups of the starting user, e.g. root's, go with it.
+func dropPrivileges(creds credentials) error {
+	if creds.gid >= 0 {
+		if err := syscall.Setgroups([]int{creds.gid}); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+		if err := syscall.Setgid(creds.gid); err != nil {
+			return fmt.Errorf("setgid %d: %w", creds.gid, err)
+		}
+	}
+	if creds.uid >= 0 {
+		if err := syscall.Setuid(creds.uid); err != nil {
+			return fmt.Errorf("setuid %d: %w", creds.uid, err)
+		}
+		// make sure there is no way back
+		if err := syscall.Setuid(0); err == nil && creds.uid != 0 {
+			return fmt.Errorf("privileges could be regained after setuid %d", creds.uid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// privilegesHelperEnv - Set when the test binary is re-run to drop its
+// privileges, which can't be undone in the process running the other tests
+const privilegesHelperEnv = "TCP_PROXY_DROP_PRIVILEGES_HELPER"
+
+func TestDropPrivilegesHelper(t *testing.T) {
+	if os.Getenv(privilegesHelperEnv) == "" {
+		t.Skip("only run by TestDropPrivileges")
+	}
+	creds, err := lookupCredentials("nobody", "")
+	if err != nil {
+		fmt.Println("lookup failed:", err)
+		return
+	}
+	// port 80 needs root, or CAP_NET_BIND_SERVICE
+	l, err := net.Listen("tcp", "127.0.0.1:80")
+	if err != nil {
+		fmt.Println("listen failed:", err)
+		return
+	}
+	defer l.Close()
+	before := os.Geteuid()
+	if err := dropPrivileges(creds); err != nil {
+		fmt.Println("drop failed:", err)
+		return
+	}
+	fmt.Printf("euid %d -> %d egid %d\n", before, os.Geteuid(), os.Getegid())
+}
+
+func TestDropPrivileges(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("dropping privileges needs root")
+	}
+	creds, err := lookupCredentials("nobody", "")
+	if err != nil {
+		t.Skipf("no nobody user: %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivilegesHelper$", "-test.v")
+	cmd.Env = append(os.Environ(), privilegesHelperEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("helper failed: %v\n%s", err, out)
+	}
+	if strings.Contains(string(out), "listen failed") {
+		t.Skipf("port 80 isn't free: %s", out)
+	}
+	want := fmt.Sprintf("euid 0 -> %d egid %d", creds.uid, creds.gid)
+	if !strings.Contains(string(out), want) {
+		t.Errorf("wanted %q, got:\n%s", want, out)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package cli
+
+import "errors"
+
+// dropPrivileges - Not supported on this platform
+func dropPrivileges(creds credentials) error {
+	return errors.New("--user and --group are only supported on linux")
+}
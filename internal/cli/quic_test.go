@@ -0,0 +1,29 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"testing"
+
+	proxy "gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy"
+)
+
+func TestQUICDisabled(t *testing.T) {
+	if code := run([]string{"-l", "127.0.0.1:0", "-r", "127.0.0.1:1", "-u", "--quic"}); code != exitConfig {
+		t.Errorf("expected exit code %d with --quic and no QUIC dialer, got %d", exitConfig, code)
+	}
+}
+
+func TestQUICFlags(t *testing.T) {
+	proxy.RegisterQUIC(func(context.Context, string, *tls.Config) (io.ReadWriteCloser, error) {
+		return nil, proxy.ErrQUICDisabled
+	})
+	defer proxy.RegisterQUIC(nil)
+	if code := run([]string{"-l", "127.0.0.1:0", "-r", "127.0.0.1:1", "--quic"}); code != exitUsage {
+		t.Errorf("expected exit code %d for --quic without --unwrap-tls, got %d", exitUsage, code)
+	}
+	if code := run([]string{"-l", "127.0.0.1:0", "-r", "127.0.0.1:1", "-u", "--quic", "--preflight"}); code != exitUsage {
+		t.Errorf("expected exit code %d for --quic with --preflight, got %d", exitUsage, code)
+	}
+}
@@ -0,0 +1,534 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	proxy "gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy"
+)
+
+// server - Accepts local connections and hands each one to a new Proxy,
+// holding the configuration shared between all of them.
+type server struct {
+	Log proxy.Logger
+	// connLog - Template for the per-connection loggers
+	connLog proxy.ColorLogger
+	// quiet - the lifecycle events connections don't log
+	quiet proxy.LifecycleEvents
+
+	laddr, raddr *net.TCPAddr
+	configPath   string
+	// strictConfig - refuse a replacer config with invalid entries at
+	// startup instead of loading the valid ones
+	strictConfig bool
+	yaraPath     string
+	nagles       bool
+	hex          bool
+	unwrapTLS    bool
+	quic         bool
+	mux          *proxy.MuxClient
+	queue        *proxy.DialQueue
+	onConnect    []string
+	onClose      []string
+	logMSS       bool
+	smallRead    int
+	block        proxy.BlockAction
+	blockReply   []byte
+	entropy      proxy.EntropyCheck
+	notifier     proxy.Notifier
+	alerts       *proxy.AlertLimiter
+	decompress   bool
+	websocket    bool
+	compress     bool
+	acceptComp   bool
+	maxLifetime  time.Duration
+	idleTimeout  time.Duration
+	bindDevice   string
+	fwmark       int
+	shadowAddr   string
+	bufferSize   int
+	upBuffer     int
+	downBuffer   int
+	recvBuf      int
+	sendBuf      int
+	matchStrings int
+	matchData    int
+	maxConns     int
+	// maxPerClient - refuse connections from a client IP while this many
+	// from it are open, see --max-per-client
+	maxPerClient int
+	policy       *proxy.Policy
+	network      string
+	sendProxy    proxy.ProxyProtocol
+	scanLimit    *proxy.ScanLimiter
+	upSkip       proxy.Skip
+	downSkip     proxy.Skip
+	linger       time.Duration
+	tlsConfig    *tls.Config
+	tlsALPN      []string
+	// serverName - the name TLS remotes are verified as, see remoteServerName
+	serverName string
+	// certs - when set, local connections are TLS, served these certificates
+	certs      *proxy.CertStore
+	sampleRate float64
+	sampleRand func() float64
+	// remotes - when set, picks the remote of each connection instead of raddr
+	remotes *proxy.RemoteFile
+	// ports - when set, the remote for each listener's port, used instead
+	// of raddr, see --port-map
+	ports map[int]portRemote
+	// clientProlog, remoteProlog - sent ahead of the piped data
+	clientProlog []byte
+	remoteProlog []byte
+	// certProlog - sent with the identity of the client's certificate
+	certProlog string
+	// stats - where a JSON summary of each closed connection is written
+	stats     io.Writer
+	statsLock sync.Mutex
+	// hashData - digest what each connection relays, see --hash
+	hashData bool
+	// matchLog - where every rule match is recorded, see --match-log
+	matchLog *proxy.MatchLog
+	// events - where connection and match events are sent, see --event-socket
+	events *proxy.EventSocket
+	// dumpDir - when set, each connection's traffic is dumped to a file in it
+	dumpDir string
+
+	connid uint64
+	// uuids - give every connection a UUID as well, used in its log prefix
+	uuids bool
+	// tags - set on every connection, see --tag
+	tags map[string]string
+
+	// reloadMu - held for a whole reload, so reloads don't overlap.
+	// configLoaded, replacers and rules are only changed with it held as
+	// well as mu, so reload can read them without mu.
+	reloadMu     sync.Mutex
+	mu           sync.Mutex
+	configLoaded bool
+	replacers    proxy.ReplacerSet
+	rules        *proxy.YaraRules
+	conns        map[uint64]*proxy.Proxy
+	// perClient - the open connections of each client IP, for maxPerClient
+	perClient map[string]int
+	// started, accepted, sent, received - totals for the SIGUSR1 stats
+	// dump; sent and received count closed connections only
+	started  time.Time
+	accepted uint64
+	sent     uint64
+	received uint64
+}
+
+// portRemote - Where connections to one local port of a --port-map go
+type portRemote struct {
+	addr       *net.TCPAddr
+	serverName string
+}
+
+// serve - Accept connections on all the listeners until they are closed
+func (s *server) serve(listeners ...*net.TCPListener) {
+	s.mu.Lock()
+	s.started = time.Now()
+	s.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *net.TCPListener) {
+			defer wg.Done()
+			s.accept(l)
+		}(l)
+	}
+	wg.Wait()
+}
+
+func (s *server) accept(listener *net.TCPListener) {
+	laddr, raddr, serverName := s.laddr, s.raddr, s.serverName
+	if s.ports != nil {
+		laddr = listener.Addr().(*net.TCPAddr)
+		remote := s.ports[laddr.Port]
+		raddr, serverName = remote.addr, remote.serverName
+	}
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.Log.Warn("Failed to accept connection '%s'", err)
+			continue
+		}
+		if s.maxConns > 0 && s.openConns() >= s.maxConns {
+			s.Log.Warn("Refusing connection from %v, %d connections already open", conn.RemoteAddr(), s.maxConns)
+			conn.Close()
+			continue
+		}
+		client := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		if !s.admitClient(client) {
+			s.Log.Warn("Refusing connection from %v, %d connections from %s already open", conn.RemoteAddr(), s.maxPerClient, client)
+			conn.Close()
+			continue
+		}
+		s.mu.Lock()
+		s.connid++
+		id := s.connid
+		s.mu.Unlock()
+
+		var p *proxy.Proxy
+		if s.certs != nil {
+			p = proxy.NewFromConn(tls.Server(conn, s.certs.TLSConfig()), raddr)
+		} else {
+			p = proxy.New(conn, laddr, raddr)
+		}
+		p.Mux = s.mux
+		p.DialQueue = s.queue
+		if s.unwrapTLS {
+			if s.quiet&proxy.LifecycleOpen == 0 {
+				s.Log.Info("Unwrapping TLS")
+			}
+			p.UnwrapTLS = true
+			p.QUIC = s.quic
+			p.ServerName = serverName
+		}
+
+		connLog := s.connLog
+		connLog.Prefix = fmt.Sprintf("Connection #%03d ", id)
+		if s.uuids {
+			p.UUID = proxy.NewConnUUID()
+			connLog.Prefix = fmt.Sprintf("Connection %s ", p.UUID)
+		}
+		p.Log = connLog
+		p.QuietEvents = s.quiet
+		p.ID = id
+		for k, v := range s.tags {
+			p.SetTag(k, v)
+		}
+		p.Nagles = s.nagles
+		p.OutputHex = s.hex
+		p.OnConnectExec = s.onConnect
+		p.OnCloseExec = s.onClose
+		p.LogMSS = s.logMSS
+		p.SmallReadThreshold = s.smallRead
+		p.BlockAction = s.block
+		p.BlockResponse = s.blockReply
+		p.UpstreamEntropy = s.entropy
+		p.Notifier = s.notifier
+		p.AlertLimit = s.alerts
+		p.DecodeCompressed = s.decompress
+		p.DecodeWebSocket = s.websocket
+		p.CompressRemote = s.compress
+		p.AcceptCompressed = s.acceptComp
+		p.SampleRate = s.sampleRate
+		p.SampleRand = s.sampleRand
+		p.ClientPrologue = s.clientProlog
+		p.RemotePrologue = s.remoteProlog
+		p.ClientCertPrologue = s.certProlog
+		if s.remotes != nil {
+			p.Router = s.remotes.Route
+		}
+		p.MaxLifetime = s.maxLifetime
+		p.IdleTimeout = s.idleTimeout
+		p.BindDevice = s.bindDevice
+		p.FWMark = s.fwmark
+		p.ShadowAddr = s.shadowAddr
+		p.BufferSize = s.bufferSize
+		p.UpstreamBufferSize = s.upBuffer
+		p.DownstreamBufferSize = s.downBuffer
+		p.RecvBuf = s.recvBuf
+		p.SendBuf = s.sendBuf
+		p.MaxMatchStrings = s.matchStrings
+		p.MaxMatchData = s.matchData
+		p.Policy = s.policy
+		p.Network = s.network
+		p.SendProxy = s.sendProxy
+		p.ScanLimit = s.scanLimit
+		p.MatchLog = s.matchLog
+		p.Events = s.events
+		p.UpstreamSkip = s.upSkip
+		p.DownstreamSkip = s.downSkip
+		p.LingerAfterEOF = s.linger
+		p.HashData = s.hashData
+		p.TLSConfig = s.tlsConfig
+		p.TLSNextProtos = s.tlsALPN
+
+		s.mu.Lock()
+		p.SetReplacerSet(s.replacers)
+		if s.conns == nil {
+			s.conns = make(map[uint64]*proxy.Proxy)
+		}
+		s.conns[id] = p
+		s.accepted++
+		s.mu.Unlock()
+
+		go func() {
+			if dump := s.openDump(p); dump != nil {
+				p.Dump = dump
+				defer dump.Close()
+			}
+			p.Start()
+			stats := p.Stats()
+			s.mu.Lock()
+			// in one go, so a connection no longer listed is no longer counted
+			delete(s.conns, id)
+			s.releaseClient(client)
+			s.sent += stats.BytesSent
+			s.received += stats.BytesReceived
+			s.mu.Unlock()
+			s.writeSummary(p.Summary())
+		}()
+	}
+}
+
+// admitClient - Count a connection from the client IP, false when it has
+// maxPerClient open already
+func (s *server) admitClient(ip string) bool {
+	if s.maxPerClient <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.perClient[ip] >= s.maxPerClient {
+		return false
+	}
+	if s.perClient == nil {
+		s.perClient = make(map[string]int)
+	}
+	s.perClient[ip]++
+	return true
+}
+
+// releaseClient - Uncount a closed connection from the client IP, dropping
+// clients without open connections so the map doesn't grow with every IP
+// ever seen. Call with mu held.
+func (s *server) releaseClient(ip string) {
+	if s.maxPerClient <= 0 {
+		return
+	}
+	if s.perClient[ip]--; s.perClient[ip] <= 0 {
+		delete(s.perClient, ip)
+	}
+}
+
+// remoteServerName - The name TLS remotes are verified as: the one given
+// with --tls-server-name, or else the host of the remote address, which is
+// dialed by its resolved IP. Remotes from a remote file are verified by the
+// host each one is listed with.
+func remoteServerName(flag, remoteAddr string, remoteFile bool) string {
+	if flag != "" || remoteFile {
+		return flag
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil || net.ParseIP(host) != nil {
+		return ""
+	}
+	return host
+}
+
+// openDump - Create the --dump-dir file for a connection's hexdump, named
+// by when it opened and its ID. Nil without --dump-dir or if it couldn't be
+// created, which is logged.
+func (s *server) openDump(p *proxy.Proxy) *os.File {
+	if s.dumpDir == "" {
+		return nil
+	}
+	name := fmt.Sprintf("%03d", p.ID)
+	if p.UUID != "" {
+		name = p.UUID
+	}
+	path := filepath.Join(s.dumpDir, fmt.Sprintf("%s-%s.dump", time.Now().Format("20060102T150405"), name))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		p.Log.Warn("Failed to create dump file: %s", err)
+		return nil
+	}
+	return f
+}
+
+// writeSummary - Write a closed connection's summary as a JSON line, when
+// --stats-output is set
+func (s *server) writeSummary(summary proxy.Summary) {
+	if s.stats == nil {
+		return
+	}
+	line, err := json.Marshal(summary)
+	if err != nil {
+		s.Log.Warn("Failed to encode connection summary: %s", err)
+		return
+	}
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	s.stats.Write(append(line, '\n'))
+}
+
+func (s *server) openConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// reload - (Re)read the replacer config and yara rules. A file that fails to
+// load leaves the previously loaded configuration in place, and the failure
+// is returned. Invalid entries in an otherwise readable replacer config are
+// only logged. New settings are applied to new connections and swapped into
+// the ones already open. Compiling the yara rules is given up on once ctx
+// is done. The files are loaded without holding mu, so connections keep
+// being accepted and closed while a large ruleset compiles.
+func (s *server) reload(ctx context.Context) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	var result error
+	replacers, configLoaded := s.replacers, s.configLoaded
+	if s.configPath != "" {
+		r, err := proxy.ReadConfigFile(s.configPath)
+		var itemErrs *multierror.Error
+		switch {
+		case err == nil:
+			replacers = r
+			configLoaded = true
+		case s.configLoaded:
+			s.warnConfigErrors("error reloading replacer config, keeping previous config", err)
+		case errors.As(err, &itemErrs) && !s.strictConfig:
+			s.warnConfigErrors(fmt.Sprintf("skipping %d invalid replacer config entries, loading the %d valid ones", len(itemErrs.Errors), r.Len()), err)
+			replacers = r
+		case errors.As(err, &itemErrs):
+			s.warnConfigErrors("error loading replacer config, --strict-config refuses invalid entries", err)
+			result = err
+		default:
+			s.Log.Warn("error loading replacer config: %v", err)
+			result = err
+		}
+	}
+
+	rules := s.rules
+	if s.yaraPath != "" {
+		r, warnings, err := proxy.CompileYaraRulesContext(ctx, s.yaraPath)
+		for _, w := range warnings {
+			s.Log.Warn("yara compiler warning: %s", w)
+		}
+		if err != nil {
+			if s.rules != nil {
+				s.Log.Warn("error reloading yara config, keeping previous rules: %v", err)
+			} else {
+				s.Log.Warn("error loading yara config: %v", err)
+			}
+			result = err
+		} else {
+			rules = r
+		}
+	}
+
+	if s.certs != nil {
+		if err := s.certs.Reload(); err != nil {
+			s.Log.Warn("error reloading certificates, keeping previous certificates: %v", err)
+			result = err
+		}
+	}
+
+	if mode := s.lengthSensitiveMode(); mode != "" {
+		for _, r := range replacers.LengthChanging() {
+			s.Log.Warn("WARNING: replacer %s can change the length of the data, which %s can't account for; lengths in the data such as Content-Length headers or record lengths will no longer match", r.String(), mode)
+		}
+	}
+
+	s.Log.Info("Loaded %d replacers (previously %d), yara rules %s",
+		replacers.Len(), s.replacers.Len(), describeRulesChange(s.rules, rules))
+	for _, r := range replacers.All() {
+		s.Log.Debug("replacer: %s", r.String())
+	}
+	if rules != nil && rules != s.rules {
+		s.Log.Debug("yara rules: %s", strings.Join(proxy.RuleNames(rules), ", "))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rulesChanged := rules != s.rules
+	// the rules replaced aren't destroyed here: connections still scanning
+	// with them hold them through their scanner, and go-yara's finalizer
+	// frees them once the last of those is gone
+	s.configLoaded = configLoaded
+	s.replacers = replacers
+	s.rules = rules
+	proxy.SetActiveRules(rules)
+	for _, p := range s.conns {
+		p.SetReplacerSet(replacers)
+		if rulesChanged && rules != nil {
+			if err := p.SetYaraRules(rules); err != nil {
+				p.Log.Warn("error swapping yara rules: %v", err)
+			}
+		}
+	}
+	return result
+}
+
+// warnConfigErrors - Log msg, followed by each invalid replacer config
+// entry on a line of its own when err lists them
+func (s *server) warnConfigErrors(msg string, err error) {
+	var itemErrs *multierror.Error
+	if !errors.As(err, &itemErrs) {
+		s.Log.Warn("%s: %v", msg, err)
+		return
+	}
+	s.Log.Warn("%s:", msg)
+	for _, e := range itemErrs.Errors {
+		s.Log.Warn("  %v", e)
+	}
+}
+
+// lengthSensitiveMode - The flag of an active mode that forwards data whose
+// framing records lengths the replacers don't fix up, if any
+func (s *server) lengthSensitiveMode() string {
+	switch {
+	case s.unwrapTLS:
+		return "--unwrap-tls"
+	case s.certs != nil:
+		return "--tls-cert-dir"
+	case s.decompress:
+		return "--decompress"
+	}
+	return ""
+}
+
+func describeRulesChange(prev, cur *proxy.YaraRules) string {
+	switch {
+	case cur == nil:
+		return "not loaded"
+	case prev == cur:
+		return "unchanged"
+	case prev == nil:
+		return "loaded"
+	default:
+		return "reloaded"
+	}
+}
+
+// handleReloads - Reload the configuration every time a signal arrives
+func (s *server) handleReloads(sigs <-chan os.Signal) {
+	for sig := range sigs {
+		s.Log.Info("Received %s, reloading configuration", sig)
+		s.reload(context.Background())
+	}
+}
+
+// handleVerbosity - Step the log verbosity up every time a signal arrives,
+// wrapping back around to the default once the most verbose level is passed
+func handleVerbosity(sigs <-chan os.Signal, level *proxy.LogLevel, log proxy.Logger) {
+	for sig := range sigs {
+		next := level.Get() + 1
+		if next > proxy.MaxLevel {
+			next = 0
+		}
+		level.Set(next)
+		log.Info("Received %s, verbosity is now %d", sig, next)
+	}
+}
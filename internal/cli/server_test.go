@@ -0,0 +1,656 @@
+//go:build !windows
+// +build !windows
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	proxy "gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy"
+)
+
+// recordingLogger - collects every message so tests can wait for them
+type recordingLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *recordingLogger) add(f string, args ...interface{}) {
+	l.mu.Lock()
+	l.msgs = append(l.msgs, fmt.Sprintf(f, args...))
+	l.mu.Unlock()
+}
+
+func (l *recordingLogger) Trace(f string, args ...interface{}) { l.add(f, args...) }
+func (l *recordingLogger) Debug(f string, args ...interface{}) { l.add(f, args...) }
+func (l *recordingLogger) Info(f string, args ...interface{})  { l.add(f, args...) }
+func (l *recordingLogger) Warn(f string, args ...interface{})  { l.add(f, args...) }
+
+func (l *recordingLogger) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.msgs {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func startEchoServer(t *testing.T) *net.TCPListener {
+	t.Helper()
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					c.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func startServer(t *testing.T, s *server) *net.TCPListener {
+	t.Helper()
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s.laddr = l.Addr().(*net.TCPAddr)
+	go s.serve(l)
+	return l
+}
+
+func roundTrip(t *testing.T, addr net.Addr, msg string) string {
+	t.Helper()
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func writeConfig(t *testing.T, path, data string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+}
+
+func TestSighupReload(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	cfg := filepath.Join(t.TempDir(), "replacers.yml")
+	writeConfig(t, cfg, "- type: substring\n  find: foo\n  replace: bar\n")
+
+	log := &recordingLogger{}
+	s := &server{
+		Log:        log,
+		raddr:      echo.Addr().(*net.TCPAddr),
+		configPath: cfg,
+	}
+	s.reload(context.Background())
+	l := startServer(t, s)
+	defer l.Close()
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+	go s.handleReloads(sighup)
+
+	if got := roundTrip(t, l.Addr(), "foo"); got != "bar" {
+		t.Fatalf("initial config not applied: wanted bar, got %s", got)
+	}
+
+	writeConfig(t, cfg, "- type: substring\n  find: foo\n  replace: baz\n")
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	waitFor(t, "new replacers", func() bool {
+		return roundTrip(t, l.Addr(), "foo") == "baz"
+	})
+
+	writeConfig(t, cfg, "- type: substring\n  replace: nope\n")
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	waitFor(t, "failed reload", func() bool {
+		return log.contains("keeping previous config")
+	})
+	if got := roundTrip(t, l.Addr(), "foo"); got != "baz" {
+		t.Errorf("broken config should keep previous replacers: wanted baz, got %s", got)
+	}
+}
+
+func TestReloadDoesNotBlockConnections(t *testing.T) {
+	// reading a FIFO blocks until something writes it, like a slow load
+	cfg := filepath.Join(t.TempDir(), "replacers.yml")
+	if err := syscall.Mkfifo(cfg, 0600); err != nil {
+		t.Skipf("can't make a FIFO: %v", err)
+	}
+	s := &server{Log: &recordingLogger{}, configPath: cfg}
+	reloaded := make(chan error, 1)
+	go func() { reloaded <- s.reload(context.Background()) }()
+	// opening the writing end waits for the reload to start reading
+	f, err := os.OpenFile(cfg, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counted := make(chan int, 1)
+	go func() { counted <- s.openConns() }()
+	select {
+	case <-counted:
+	case <-time.After(2 * time.Second):
+		t.Error("the connection list was locked while the config loaded")
+	}
+
+	f.Write([]byte("- type: substring\n  find: foo\n  replace: bar\n"))
+	f.Close()
+	if err := <-reloaded; err != nil || s.replacers.Len() != 1 {
+		t.Errorf("wanted the replacer loaded, got %v with %d replacers", err, s.replacers.Len())
+	}
+}
+
+func TestStrictConfig(t *testing.T) {
+	cfg := filepath.Join(t.TempDir(), "replacers.yml")
+	writeConfig(t, cfg, "- type: substring\n  find: foo\n  replace: bar\n- type: substring\n  replace: nope\n- type: bogus\n  find: x\n")
+
+	for _, strict := range []bool{false, true} {
+		log := &recordingLogger{}
+		s := &server{Log: log, configPath: cfg, strictConfig: strict}
+		err := s.reload(context.Background())
+		if strict && (err == nil || s.replacers.Len() != 0) {
+			t.Errorf("strict: wanted the config refused, got %v with %d replacers", err, s.replacers.Len())
+		}
+		if !strict && (err != nil || s.replacers.Len() != 1) {
+			t.Errorf("lenient: wanted the valid replacer loaded, got %v with %d replacers", err, s.replacers.Len())
+		}
+		for _, entry := range []string{"replacer 1: ", "replacer 2: "} {
+			if !log.contains(entry) {
+				t.Errorf("strict %v: wanted %q reported on its own, got %q", strict, entry, log.msgs)
+			}
+		}
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	log := &recordingLogger{}
+	s := &server{
+		Log:      log,
+		raddr:    echo.Addr().(*net.TCPAddr),
+		maxConns: 1,
+	}
+	l := startServer(t, s)
+	defer l.Close()
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer first.Close()
+	waitFor(t, "first connection", func() bool { return s.openConns() == 1 })
+
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Errorf("connection over the limit should be closed")
+	}
+	if !log.contains("Refusing connection") {
+		t.Errorf("refused connection was not logged")
+	}
+
+	first.Close()
+	waitFor(t, "first connection to close", func() bool { return s.openConns() == 0 })
+	if got := roundTrip(t, l.Addr(), "again"); got != "again" {
+		t.Errorf("wanted a connection once below the limit, got %q", got)
+	}
+}
+
+func TestMaxPerClient(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	log := &recordingLogger{}
+	s := &server{
+		Log:          log,
+		raddr:        echo.Addr().(*net.TCPAddr),
+		maxPerClient: 2,
+	}
+	l := startServer(t, s)
+	defer l.Close()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial proxy: %v", err)
+		}
+		return c
+	}
+	echoes := func(c net.Conn, msg string) bool {
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, len(msg))
+		if _, err := c.Write([]byte(msg)); err != nil {
+			return false
+		}
+		_, err := io.ReadFull(c, buf)
+		return err == nil && string(buf) == msg
+	}
+
+	var open []net.Conn
+	for i := 0; i < 2; i++ {
+		c := dial()
+		defer c.Close()
+		if !echoes(c, "hi") {
+			t.Fatalf("connection %d under the cap wasn't relayed", i)
+		}
+		open = append(open, c)
+	}
+	excess := dial()
+	defer excess.Close()
+	excess.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := excess.Read(make([]byte, 1)); err == nil {
+		t.Errorf("connection over the cap should be closed")
+	}
+	if !log.contains("2 connections from 127.0.0.1 already open") {
+		t.Errorf("refused connection was not logged")
+	}
+	for i, c := range open {
+		if !echoes(c, "still") {
+			t.Errorf("connection %d should stay open while the excess one is refused", i)
+		}
+	}
+
+	open[0].Close()
+	waitFor(t, "a connection to close", func() bool { return s.openConns() == 1 })
+	again := dial()
+	defer again.Close()
+	if !echoes(again, "again") {
+		t.Errorf("wanted a connection once below the cap")
+	}
+
+	again.Close()
+	open[1].Close()
+	waitFor(t, "clients without connections to be evicted", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.perClient) == 0
+	})
+}
+
+func TestHandleVerbosity(t *testing.T) {
+	var buf bytes.Buffer
+	level := &proxy.LogLevel{}
+	logger := proxy.ColorLogger{Verbosity: level, Writer: &buf}
+
+	sigs := make(chan os.Signal)
+	go handleVerbosity(sigs, level, proxy.NullLogger{})
+	defer close(sigs)
+
+	for _, want := range []int{1, 2, 0} {
+		sigs <- syscall.SIGUSR2
+		waitFor(t, fmt.Sprintf("verbosity %d", want), func() bool { return level.Get() == want })
+	}
+
+	sigs <- syscall.SIGUSR2
+	waitFor(t, "verbosity 1", func() bool { return level.Get() == 1 })
+	logger.Debug("now visible")
+	if !strings.Contains(buf.String(), "now visible") {
+		t.Errorf("debug message should be logged after raising the verbosity")
+	}
+}
+
+func TestStatsOutput(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	var buf bytes.Buffer
+	s := &server{
+		Log:   &recordingLogger{},
+		raddr: echo.Addr().(*net.TCPAddr),
+		stats: &buf,
+	}
+	l := startServer(t, s)
+	defer l.Close()
+
+	if got := roundTrip(t, l.Addr(), "hello"); got != "hello" {
+		t.Fatalf("wanted echo, got %q", got)
+	}
+	summary := func() string {
+		s.statsLock.Lock()
+		defer s.statsLock.Unlock()
+		return buf.String()
+	}
+	waitFor(t, "connection summary", func() bool { return summary() != "" })
+
+	var got proxy.Summary
+	if err := json.Unmarshal([]byte(summary()), &got); err != nil {
+		t.Fatalf("summary is not JSON: %v", err)
+	}
+	if got.ID != 1 || got.Remote != echo.Addr().String() || got.Local != l.Addr().String() || got.Client == "" {
+		t.Errorf("unexpected connection details %+v", got)
+	}
+	if got.Sent != 5 || got.Received != 5 || got.Reason != "client closed" {
+		t.Errorf("unexpected summary %+v", got)
+	}
+	if !strings.HasSuffix(summary(), "}\n") {
+		t.Errorf("summary should be a single JSON line, got %q", summary())
+	}
+}
+
+func TestDumpDir(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	dir := t.TempDir()
+	s := &server{
+		Log:     &recordingLogger{},
+		raddr:   echo.Addr().(*net.TCPAddr),
+		dumpDir: dir,
+	}
+	l := startServer(t, s)
+	defer l.Close()
+
+	if got := roundTrip(t, l.Addr(), "dump me"); got != "dump me" {
+		t.Fatalf("wanted echo, got %q", got)
+	}
+	waitFor(t, "connection to close", func() bool { return s.openConns() == 0 })
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*-001.dump"))
+	if len(files) != 1 {
+		t.Fatalf("expected a dump file for connection 1, got %v", files)
+	}
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("failed to read dump: %v", err)
+	}
+	for _, want := range []string{">>> upstream 7 bytes", "<<< downstream 7 bytes", "|dump me|"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("dump is missing %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestUUIDConnectionIDs(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	var buf bytes.Buffer
+	log := &recordingLogger{}
+	s := &server{
+		Log:     log,
+		connLog: proxy.ColorLogger{Writer: ioutil.Discard},
+		raddr:   echo.Addr().(*net.TCPAddr),
+		stats:   &buf,
+		uuids:   true,
+	}
+	l := startServer(t, s)
+	defer l.Close()
+
+	roundTrip(t, l.Addr(), "one")
+	roundTrip(t, l.Addr(), "two")
+	summaries := func() []string {
+		s.statsLock.Lock()
+		defer s.statsLock.Unlock()
+		return strings.Split(strings.TrimSpace(buf.String()), "\n")
+	}
+	waitFor(t, "connection summaries", func() bool { return len(summaries()) == 2 })
+
+	uuids := make(map[string]bool)
+	for _, line := range summaries() {
+		var got proxy.Summary
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("summary is not JSON: %v", err)
+		}
+		if len(got.UUID) != 36 || strings.Count(got.UUID, "-") != 4 || got.ID == 0 {
+			t.Errorf("expected a UUID next to the counter, got %+v", got)
+		}
+		uuids[got.UUID] = true
+	}
+	if len(uuids) != 2 {
+		t.Errorf("expected two distinct UUIDs, got %v", uuids)
+	}
+}
+
+func TestLengthChangeWarning(t *testing.T) {
+	cfg := filepath.Join(t.TempDir(), "replacers.yml")
+	writeConfig(t, cfg, "- type: substring\n  find: foo\n  replace: foobar\n- type: substring\n  find: abc\n  replace: xyz\n")
+
+	for _, unwrap := range []bool{false, true} {
+		log := &recordingLogger{}
+		s := &server{Log: log, configPath: cfg, unwrapTLS: unwrap}
+		if err := s.reload(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := log.contains(`"foo" -> "foobar" can change the length`); got != unwrap {
+			t.Errorf("unwrap-tls %v: expected warning %v, got %v", unwrap, unwrap, got)
+		}
+		if log.contains(`"abc" -> "xyz" can change the length`) {
+			t.Errorf("unwrap-tls %v: warned about a replacer that keeps the length", unwrap)
+		}
+	}
+}
+
+// startNamedServer - A remote that answers every connection with its name
+func startNamedServer(t *testing.T, name string) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte(name))
+			c.Close()
+		}
+	}()
+	return l
+}
+
+func TestRemoteFileRouting(t *testing.T) {
+	a := startNamedServer(t, "a")
+	defer a.Close()
+	b := startNamedServer(t, "b")
+	defer b.Close()
+
+	path := filepath.Join(t.TempDir(), "remotes")
+	writeConfig(t, path, a.Addr().String()+"\n")
+	remotes, err := proxy.OpenRemoteFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remotes.Close()
+
+	s := &server{Log: &recordingLogger{}, remotes: remotes}
+	l := startServer(t, s)
+	defer l.Close()
+
+	if got := roundTrip(t, l.Addr(), "hi"); got != "a" {
+		t.Fatalf("expected the remote listed in the file, got %q", got)
+	}
+	// replace the file in one go, so no connection sees it empty
+	writeConfig(t, path+".new", b.Addr().String()+"\n")
+	if err := os.Rename(path+".new", path); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "routing to the edited remote", func() bool {
+		return roundTrip(t, l.Addr(), "hi") == "b"
+	})
+}
+
+func TestPortMap(t *testing.T) {
+	a := startNamedServer(t, "a")
+	defer a.Close()
+	b := startNamedServer(t, "b")
+	defer b.Close()
+
+	var listeners []*net.TCPListener
+	ports := make(map[int]portRemote)
+	for _, remote := range []net.Addr{a.Addr(), b.Addr()} {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer l.Close()
+		listeners = append(listeners, l)
+		ports[l.Addr().(*net.TCPAddr).Port] = portRemote{addr: remote.(*net.TCPAddr)}
+	}
+	s := &server{Log: &recordingLogger{}, ports: ports}
+	go s.serve(listeners...)
+
+	for i, want := range []string{"a", "b", "a"} {
+		l := listeners[i%2]
+		if got := roundTrip(t, l.Addr(), "hi"); got != want {
+			t.Errorf("connection %d to port %d: wanted remote %s, got %q", i, l.Addr().(*net.TCPAddr).Port, want, got)
+		}
+	}
+	waitFor(t, "the connections to close", func() bool { return s.openConns() == 0 })
+	if d := s.statsDump(); d.accepted != 3 {
+		t.Errorf("wanted connections on both ports counted, got %d", d.accepted)
+	}
+}
+
+func TestRemoteServerName(t *testing.T) {
+	for _, tc := range []struct {
+		flag, remote string
+		remoteFile   bool
+		want         string
+	}{
+		{"", "backend.example:443", false, "backend.example"},
+		{"", "10.0.0.1:443", false, ""},
+		{"lb.example", "10.0.0.1:443", false, "lb.example"},
+		{"", "backend.example:443", true, ""},
+	} {
+		if got := remoteServerName(tc.flag, tc.remote, tc.remoteFile); got != tc.want {
+			t.Errorf("remoteServerName(%q, %q, %v) = %q, want %q", tc.flag, tc.remote, tc.remoteFile, got, tc.want)
+		}
+	}
+}
+
+func TestMux(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	peer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer peer.Close()
+	go (&proxy.MuxServer{Remote: echo.Addr().String()}).Serve(peer)
+
+	mux := &proxy.MuxClient{Remote: peer.Addr().String(), QueueTimeout: 2 * time.Second}
+	mux.Start()
+	defer mux.Close()
+	s := &server{Log: &recordingLogger{}, mux: mux}
+	l := startServer(t, s)
+	defer l.Close()
+
+	for _, msg := range []string{"one", "two"} {
+		if got := roundTrip(t, l.Addr(), msg); got != msg {
+			t.Errorf("wanted %s over the mux, got %s", msg, got)
+		}
+	}
+}
+
+func TestStatsDump(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	s := &server{Log: &recordingLogger{}, raddr: echo.Addr().(*net.TCPAddr)}
+	l := startServer(t, s)
+	defer l.Close()
+
+	// one closed connection, one still open
+	if got := roundTrip(t, l.Addr(), "hello"); got != "hello" {
+		t.Fatalf("wanted echo, got %q", got)
+	}
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("abc"))
+	io.ReadFull(c, make([]byte, 3))
+	waitFor(t, "the first connection to close", func() bool { return s.openConns() == 1 })
+
+	var d statsDump
+	waitFor(t, "the byte counts", func() bool {
+		d = s.statsDump()
+		return d.sent == 8 && d.received == 8
+	})
+	if d.accepted != 2 || d.active != 1 {
+		t.Errorf("wanted 2 connections with 1 active, got %+v", d)
+	}
+
+	d.uptime = 90 * time.Second
+	d.rules = map[string]uint64{"default:Rare": 1, "default:Common": 7, "entropy:HighEntropy": 7}
+	var buf bytes.Buffer
+	d.write(&buf)
+	want := "uptime 1m30s\n" +
+		"connections 2 total, 1 active\n" +
+		"bytes 8 sent to remotes, 8 received from remotes\n" +
+		"top rule matches:\n" +
+		"  default:Common 7\n" +
+		"  entropy:HighEntropy 7\n" +
+		"  default:Rare 1\n"
+	if buf.String() != want {
+		t.Errorf("wanted\n%s\ngot\n%s", want, buf.String())
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package cli
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyVerbosity - Deliver the signals that step up the log verbosity to c
+func notifyVerbosity(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// notifyStats - Deliver the signals that dump the stats to c
+func notifyStats(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
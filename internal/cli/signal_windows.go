@@ -0,0 +1,9 @@
+package cli
+
+import "os"
+
+// notifyVerbosity - Windows has no SIGUSR2, the verbosity can't be changed
+func notifyVerbosity(c chan<- os.Signal) {}
+
+// notifyStats - Windows has no SIGUSR1, the stats can't be dumped
+func notifyStats(c chan<- os.Signal) {}
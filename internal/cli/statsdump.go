@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	proxy "gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy"
+)
+
+// topRules - How many of the most matched rules a stats dump lists
+const topRules = 10
+
+// statsDump - The totals written on SIGUSR1
+type statsDump struct {
+	uptime   time.Duration
+	accepted uint64
+	active   int
+	// sent, received - bytes forwarded to the remotes and to the clients,
+	// by open and closed connections alike
+	sent, received uint64
+	// rules - how often each rule matched, by namespace:rule
+	rules map[string]uint64
+}
+
+// statsDump - The totals so far. Safe to call while connections come and
+// go.
+func (s *server) statsDump() statsDump {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := statsDump{
+		accepted: s.accepted,
+		active:   len(s.conns),
+		sent:     s.sent,
+		received: s.received,
+		rules:    proxy.MatchCounts(),
+	}
+	if !s.started.IsZero() {
+		d.uptime = time.Since(s.started)
+	}
+	for _, p := range s.conns {
+		stats := p.Stats()
+		d.sent += stats.BytesSent
+		d.received += stats.BytesReceived
+	}
+	return d
+}
+
+func (d statsDump) write(w io.Writer) {
+	fmt.Fprintf(w, "uptime %v\n", d.uptime.Round(time.Second))
+	fmt.Fprintf(w, "connections %d total, %d active\n", d.accepted, d.active)
+	fmt.Fprintf(w, "bytes %d sent to remotes, %d received from remotes\n", d.sent, d.received)
+	rules := make([]string, 0, len(d.rules))
+	for rule := range d.rules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if d.rules[rules[i]] != d.rules[rules[j]] {
+			return d.rules[rules[i]] > d.rules[rules[j]]
+		}
+		return rules[i] < rules[j]
+	})
+	if len(rules) > topRules {
+		rules = rules[:topRules]
+	}
+	if len(rules) == 0 {
+		fmt.Fprintln(w, "no rule matches")
+		return
+	}
+	fmt.Fprintln(w, "top rule matches:")
+	for _, rule := range rules {
+		fmt.Fprintf(w, "  %s %d\n", rule, d.rules[rule])
+	}
+}
+
+// handleStats - Write the stats dump to stderr on every signal
+func handleStats(sigs <-chan os.Signal, s *server) {
+	for range sigs {
+		s.statsDump().write(os.Stderr)
+	}
+}
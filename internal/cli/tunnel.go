@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"net"
+
+	proxy "gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy"
+)
+
+// --tunnel modes
+const (
+	tunnelUDPToTCP = "udp-to-tcp"
+	tunnelTCPToUDP = "tcp-to-udp"
+	tunnelMuxToTCP = "mux-to-tcp"
+)
+
+// runTunnel - Serve one end of a UDP over TCP tunnel, or the far end of
+// --mux upstreams, instead of proxying, returning the exit code once the
+// listener fails
+func runTunnel(mode, localAddr, remoteAddr string, log proxy.Logger) int {
+	if mode == tunnelMuxToTCP {
+		l, err := net.Listen("tcp", localAddr)
+		if err != nil {
+			log.Warn("Failed to open local port to listen: %s", err)
+			return exitListen
+		}
+		log.Info("Relaying streams of mux upstreams on %v to %s", l.Addr(), remoteAddr)
+		(&proxy.MuxServer{Remote: remoteAddr, Log: log}).Serve(l)
+		return exitOK
+	}
+	t := &proxy.Tunnel{Remote: remoteAddr, Log: log}
+	if mode == tunnelUDPToTCP {
+		pc, err := net.ListenPacket("udp", localAddr)
+		if err != nil {
+			log.Warn("Failed to open local port to listen: %s", err)
+			return exitListen
+		}
+		log.Info("Tunneling datagrams from %v over TCP to %s", pc.LocalAddr(), remoteAddr)
+		t.ServeUDP(pc)
+		return exitOK
+	}
+
+	l, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		log.Warn("Failed to open local port to listen: %s", err)
+		return exitListen
+	}
+	log.Info("Tunneling datagrams framed on %v to UDP remote %s", l.Addr(), remoteAddr)
+	t.ServeTCP(l)
+	return exitOK
+}
@@ -0,0 +1,24 @@
+package proxy
+
+// Iterate - Add f to the callbacks every chunk is passed through, either
+// way, after the replacers and right before it is forwarded, for processing
+// the stream without handling the sockets. Callbacks run in the order they
+// were added, each seeing the Frame as the previous one left it, on the
+// goroutine reading the data, so the two directions run concurrently. An
+// error from f ends the connection with that error as its close reason. Call
+// before Start.
+func (p *Proxy) Iterate(f func(*Frame) error) {
+	p.iterators = append(p.iterators, f)
+}
+
+// iterate - Run the Iterate callbacks on frame, false when one of them ended
+// the connection
+func (p *Proxy) iterate(frame *Frame) bool {
+	for _, f := range p.iterators {
+		if err := f(frame); err != nil {
+			p.err("Frame callback failed", err)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIterate(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	var lock sync.Mutex
+	var frames []Frame
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.SetReplacers([]Replacer{&StringReplacer{"ping", "pong"}})
+		p.Iterate(func(f *Frame) error {
+			if f.Direction == Upstream {
+				f.Data = bytes.ToUpper(f.Data)
+			}
+			return nil
+		})
+		p.Iterate(func(f *Frame) error {
+			lock.Lock()
+			frames = append(frames, Frame{f.Direction, append([]byte(nil), f.Data...), f.Offset, f.Time})
+			lock.Unlock()
+			if bytes.Equal(f.Data, []byte("DROP")) {
+				f.Data = nil
+			}
+			return nil
+		})
+	})
+	// replaced, then upper-cased upstream, then echoed back as it is
+	if got := echoRoundTrip(t, client, "ping"); got != "PONG" {
+		t.Errorf("wanted PONG, got %q", got)
+	}
+	client.Write([]byte("drop"))
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := client.Read(make([]byte, 8)); n > 0 || err == nil {
+		t.Errorf("the dropped frame shouldn't be forwarded, got %d bytes", n)
+	}
+	client.SetReadDeadline(time.Time{})
+	if got := echoRoundTrip(t, client, "x"); got != "X" {
+		t.Errorf("wanted X, got %q", got)
+	}
+	client.Close()
+	<-done
+
+	if len(frames) != 5 {
+		t.Fatalf("wanted 5 frames, got %d", len(frames))
+	}
+	if f := frames[1]; f.Direction != Downstream || string(f.Data) != "PONG" || f.Offset != 0 || f.Time.IsZero() {
+		t.Errorf("unexpected downstream frame %+v", f)
+	}
+	last := frames[len(frames)-1]
+	if last.Direction != Downstream || string(last.Data) != "X" || last.Offset != 4 {
+		t.Errorf("offsets should count the bytes forwarded before, got %+v", last)
+	}
+}
+
+func TestIterateError(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	var p *Proxy
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(proxy *Proxy) {
+		p = proxy
+		p.Iterate(func(f *Frame) error {
+			if strings.Contains(string(f.Data), "quit") {
+				return errors.New("client asked to quit")
+			}
+			return nil
+		})
+	})
+	echoRoundTrip(t, client, "hello")
+	client.Write([]byte("quit"))
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if n, err := client.Read(make([]byte, 8)); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %d bytes and %v", n, err)
+	}
+	<-done
+	if !strings.Contains(p.CloseReason(), "client asked to quit") {
+		t.Errorf("expected the callback's error as the close reason, got %q", p.CloseReason())
+	}
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LifecycleEvents - A set of the events of a connection's life that are
+// logged at info level, see Proxy.QuietEvents
+type LifecycleEvents uint8
+
+const (
+	// LifecycleOpen - The Opened line once the remote is connected
+	LifecycleOpen LifecycleEvents = 1 << iota
+	// LifecycleTimeout - The max lifetime or idle timeout being reached
+	LifecycleTimeout
+	// LifecycleClose - The Closed line with the byte counts, and the
+	// lines following it such as the HashData digests
+	LifecycleClose
+
+	// AllLifecycleEvents - Every lifecycle event
+	AllLifecycleEvents = LifecycleOpen | LifecycleTimeout | LifecycleClose
+)
+
+var lifecycleNames = []struct {
+	name  string
+	event LifecycleEvents
+}{
+	{"open", LifecycleOpen},
+	{"timeout", LifecycleTimeout},
+	{"close", LifecycleClose},
+}
+
+// ParseLifecycleEvents - The events in a comma separated list of open,
+// timeout and close, or none for the empty set
+func ParseLifecycleEvents(s string) (LifecycleEvents, error) {
+	var events LifecycleEvents
+	if strings.TrimSpace(s) == "none" {
+		return 0, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, n := range lifecycleNames {
+			if n.name == name {
+				events |= n.event
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown lifecycle event %q, expected open, timeout, close or none", name)
+		}
+	}
+	return events, nil
+}
+
+func (e LifecycleEvents) String() string {
+	var names []string
+	for _, n := range lifecycleNames {
+		if e&n.event != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// logLifecycle - Log a lifecycle event at info level, unless it is quiet
+func (p *Proxy) logLifecycle(event LifecycleEvents, f string, args ...interface{}) {
+	quiet := p.QuietEvents
+	if p.QuietConnections {
+		quiet |= LifecycleOpen | LifecycleClose
+	}
+	if quiet&event != 0 {
+		return
+	}
+	p.Log.Info(f, args...)
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseLifecycleEvents(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want LifecycleEvents
+	}{
+		{"open,close", LifecycleOpen | LifecycleClose},
+		{"timeout", LifecycleTimeout},
+		{" close , open,timeout", AllLifecycleEvents},
+		{"none", 0},
+	} {
+		got, err := ParseLifecycleEvents(tc.spec)
+		if err != nil || got != tc.want {
+			t.Errorf("%q: wanted %v, got %v, %v", tc.spec, tc.want, got, err)
+		}
+	}
+	for _, spec := range []string{"", "opened", "open,,close"} {
+		if _, err := ParseLifecycleEvents(spec); err == nil {
+			t.Errorf("%q: wanted an error", spec)
+		}
+	}
+	if s := (LifecycleOpen | LifecycleClose).String(); s != "open,close" {
+		t.Errorf("unexpected String %q", s)
+	}
+}
+
+func TestQuietConnections(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	for _, tc := range []struct {
+		name   string
+		setup  func(*Proxy)
+		opened bool
+		closed bool
+	}{
+		{"quiet connections", func(p *Proxy) { p.QuietConnections = true }, false, false},
+		{"quiet open", func(p *Proxy) { p.QuietEvents = LifecycleOpen }, false, true},
+		{"default", func(p *Proxy) {}, true, true},
+	} {
+		var logs bytes.Buffer
+		client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+			p.Log = ColorLogger{Writer: &logs}
+			tc.setup(p)
+		})
+		echoRoundTrip(t, client, "hello")
+		// a reset shows up as a failed read, which is a warning
+		client.(*net.TCPConn).SetLinger(0)
+		client.Close()
+		<-done
+
+		out := logs.String()
+		if got := strings.Contains(out, "Opened "); got != tc.opened {
+			t.Errorf("%s: wanted the open line logged %v, got:\n%s", tc.name, tc.opened, out)
+		}
+		if got := strings.Contains(out, "Closed "); got != tc.closed {
+			t.Errorf("%s: wanted the close line logged %v, got:\n%s", tc.name, tc.closed, out)
+		}
+		if !strings.Contains(out, "Read from client failed") {
+			t.Errorf("%s: wanted warnings logged whatever is quiet, got:\n%s", tc.name, out)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import "bytes"
+
+// maxLineSize - How much of a line without a delimiter is buffered for
+// LineMatcher before it is passed on as it is
+const maxLineSize = 1 << 20
+
+// lineSplitter - Cuts one direction's chunks into the lines LineMatcher is
+// called with, holding on to a partial line until the rest of it arrives
+type lineSplitter struct {
+	delim     []byte
+	partial   []byte
+	direction Direction
+	match     func(line []byte, direction Direction)
+}
+
+func (p *Proxy) newLineSplitter(direction Direction) *lineSplitter {
+	if p.LineMatcher == nil || p.passthrough {
+		return nil
+	}
+	delim := p.LineDelimiter
+	if len(delim) == 0 {
+		delim = []byte("\n")
+	}
+	return &lineSplitter{delim: delim, direction: direction, match: p.LineMatcher}
+}
+
+// feed - Call the matcher with every line b completes
+func (s *lineSplitter) feed(b []byte) {
+	if len(s.partial) > 0 {
+		// the delimiter may straddle the chunks
+		b = append(s.partial, b...)
+		s.partial = s.partial[:0]
+	}
+	for {
+		i := bytes.Index(b, s.delim)
+		if i < 0 {
+			break
+		}
+		s.match(b[:i], s.direction)
+		b = b[i+len(s.delim):]
+	}
+	if len(b) >= maxLineSize {
+		s.match(b, s.direction)
+		return
+	}
+	s.partial = append(s.partial, b...)
+}
+
+// flush - Pass on what is left of an unterminated last line once the
+// stream ends
+func (s *lineSplitter) flush() {
+	if len(s.partial) > 0 {
+		s.match(s.partial, s.direction)
+		s.partial = nil
+	}
+}
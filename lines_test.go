@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLineMatcher(t *testing.T) {
+	client, local := net.Pipe()
+	rconn, remote := net.Pipe()
+	var lock sync.Mutex
+	lines := make(map[Direction][]string)
+	p := NewConnected(local, rconn)
+	p.LineDelimiter = []byte("\r\n")
+	p.LineMatcher = func(line []byte, direction Direction) {
+		lock.Lock()
+		lines[direction] = append(lines[direction], string(line))
+		lock.Unlock()
+	}
+	done := make(chan struct{})
+	go func() {
+		p.Start()
+		close(done)
+	}()
+	go io.Copy(ioutil.Discard, remote)
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	// each write arrives as a read of its own, splitting lines and the
+	// delimiter between them
+	for _, chunk := range []string{"USER al", "ice\r", "\nPASS x\r\nQU", "IT"} {
+		if _, err := client.Write([]byte(chunk)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	go remote.Write([]byte("+OK\r\n+OK\r\n"))
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	client.Close()
+	<-done
+
+	lock.Lock()
+	defer lock.Unlock()
+	// the unterminated last line is delivered once the client closes
+	if got := strings.Join(lines[Upstream], "|"); got != "USER alice|PASS x|QUIT" {
+		t.Errorf("unexpected upstream lines %q", got)
+	}
+	if got := strings.Join(lines[Downstream], "|"); got != "+OK|+OK" {
+		t.Errorf("unexpected downstream lines %q", got)
+	}
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// lingerOnEOF - Called when src of a pipe reached EOF. With LingerAfterEOF
+// set, the first side to finish only has its end shut down for writing, and
+// the other side keeps being relayed until it finishes too or the grace
+// period runs out. Returns false when the connection should be torn down
+// right away instead.
+func (p *Proxy) lingerOnEOF(dst io.Writer) bool {
+	if p.LingerAfterEOF <= 0 || atomic.AddInt32(&p.eofs, 1) != 1 {
+		return false
+	}
+	cw, ok := dst.(closeWriter)
+	if !ok {
+		return false
+	}
+	cw.CloseWrite()
+	expired := p.clock().After(p.LingerAfterEOF)
+	go func() {
+		select {
+		case <-expired:
+			p.err("linger after EOF expired", io.EOF)
+		case <-p.errsig:
+		}
+	}()
+	return true
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// startReplyOnClose - A remote that reads the whole request and only replies
+// once the client has finished sending
+func startReplyOnClose(t *testing.T) *net.TCPListener {
+	t.Helper()
+	l := listenLocal(t)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(2 * time.Second))
+				if _, err := ioutil.ReadAll(c); err != nil {
+					return
+				}
+				c.Write([]byte("goodbye"))
+			}()
+		}
+	}()
+	return l
+}
+
+func TestLingerAfterEOF(t *testing.T) {
+	remote := startReplyOnClose(t)
+	defer remote.Close()
+
+	client, done := startProxy(t, remote.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.LingerAfterEOF = time.Second
+	})
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte("request"))
+	client.(*net.TCPConn).CloseWrite()
+
+	reply, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(reply) != "goodbye" {
+		t.Errorf("wanted the reply sent at close, got %q", reply)
+	}
+	<-done
+}
+
+func TestLingerAfterEOFExpires(t *testing.T) {
+	// a remote that never closes its side
+	remote := listenLocal(t)
+	defer remote.Close()
+	go func() {
+		c, err := remote.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		time.Sleep(2 * time.Second)
+	}()
+
+	const linger = 100 * time.Millisecond
+	client, done := startProxy(t, remote.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.LingerAfterEOF = linger
+	})
+	defer client.Close()
+	start := time.Now()
+	client.(*net.TCPConn).CloseWrite()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection outlived its linger period")
+	}
+	if elapsed := time.Since(start); elapsed < linger {
+		t.Errorf("connection torn down after %v, before the linger period of %v", elapsed, linger)
+	}
+}
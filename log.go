@@ -2,6 +2,11 @@ package proxy
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/mgutz/ansi"
 )
@@ -29,42 +34,177 @@ func (l NullLogger) Info(f string, args ...interface{}) {}
 // Warn - no-op
 func (l NullLogger) Warn(f string, args ...interface{}) {}
 
-// ColorLogger - A Logger that logs to stdout in color
+// Palette - The colors ColorLogger uses for each level, in the
+// github.com/mgutz/ansi style (e.g. "red", "yellow+b", "white:blue"). Empty
+// entries fall back to DefaultPalette.
+type Palette struct {
+	Trace string
+	Debug string
+	Info  string
+	Warn  string
+}
+
+// DefaultPalette - The colors used when no Palette is given
+var DefaultPalette = Palette{
+	Trace: "blue",
+	Debug: "green",
+	Info:  "green",
+	Warn:  "red",
+}
+
+// ParsePalette - Parse a comma separated list of level=color pairs, e.g.
+// "warn=yellow+b,info=cyan". Levels not listed keep their default color.
+func ParsePalette(s string) (Palette, error) {
+	var p Palette
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return p, fmt.Errorf("invalid color %q, expected level=color", item)
+		}
+		switch strings.ToLower(kv[0]) {
+		case "trace":
+			p.Trace = kv[1]
+		case "debug":
+			p.Debug = kv[1]
+		case "info":
+			p.Info = kv[1]
+		case "warn":
+			p.Warn = kv[1]
+		default:
+			return p, fmt.Errorf("unknown log level %q in color scheme", kv[0])
+		}
+	}
+	return p, nil
+}
+
+func (p Palette) color(level string) string {
+	var c, def string
+	switch level {
+	case "trace":
+		c, def = p.Trace, DefaultPalette.Trace
+	case "debug":
+		c, def = p.Debug, DefaultPalette.Debug
+	case "info":
+		c, def = p.Info, DefaultPalette.Info
+	case "warn":
+		c, def = p.Warn, DefaultPalette.Warn
+	}
+	if c == "" {
+		return def
+	}
+	return c
+}
+
+// MaxLevel - The most verbose level, where trace messages are logged
+const MaxLevel = 2
+
+// LogLevel - A verbosity level that can be changed while loggers are using
+// it, from any goroutine
+type LogLevel struct {
+	level int32
+}
+
+// Get - The current level
+func (l *LogLevel) Get() int {
+	return int(atomic.LoadInt32(&l.level))
+}
+
+// Set - Change the level, clamped to 0 through MaxLevel
+func (l *LogLevel) Set(level int) {
+	if level < 0 {
+		level = 0
+	}
+	if level > MaxLevel {
+		level = MaxLevel
+	}
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// ColorLogger - A Logger that logs to stdout, optionally in color
 type ColorLogger struct {
-	Level  int
-	Prefix string
-	Color  bool
+	Level int
+	// Verbosity - When set, used instead of Level. Copies of the logger
+	// share it, so changing it affects all of them.
+	Verbosity *LogLevel
+	Prefix    string
+	// Color - Color lines by level. Ignored when the NO_COLOR environment
+	// variable is set or the Writer isn't a terminal.
+	Color bool
+	// Palette - Colors used for each level
+	Palette Palette
+	// TimeFormat - When set, each line starts with the current time
+	// rendered in this layout (e.g. time.RFC3339)
+	TimeFormat string
+	// UTC - Render timestamps in UTC instead of local time
+	UTC bool
+	// Writer - Where lines are written, defaults to stdout
+	Writer io.Writer
 }
 
 // Trace - Log a very verbose trace message
 func (l ColorLogger) Trace(f string, args ...interface{}) {
-	if !(l.Level == 2) {
+	if !(l.level() == 2) {
 		return
 	}
-	l.output("blue", f, args...)
+	l.output("trace", f, args...)
 }
 
 // Debug - Log a debug message
 func (l ColorLogger) Debug(f string, args ...interface{}) {
-	if !(l.Level == 1) {
+	if !(l.level() == 1) {
 		return
 	}
-	l.output("green", f, args...)
+	l.output("debug", f, args...)
 }
 
 // Info - Log a general message
 func (l ColorLogger) Info(f string, args ...interface{}) {
-	l.output("green", f, args...)
+	l.output("info", f, args...)
 }
 
 // Warn - Log a warning
 func (l ColorLogger) Warn(f string, args ...interface{}) {
-	l.output("red", f, args...)
+	l.output("warn", f, args...)
+}
+
+func (l ColorLogger) level() int {
+	if l.Verbosity != nil {
+		return l.Verbosity.Get()
+	}
+	return l.Level
+}
+
+func (l ColorLogger) output(level, f string, args ...interface{}) {
+	w := l.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+
+	if l.Color && os.Getenv("NO_COLOR") == "" && isTerminal(w) {
+		f = ansi.Color(f, l.Palette.color(level))
+	}
+	line := fmt.Sprintf(fmt.Sprintf("%s%s\n", l.Prefix, f), args...)
+	if l.TimeFormat != "" {
+		now := time.Now()
+		if l.UTC {
+			now = now.UTC()
+		}
+		line = now.Format(l.TimeFormat) + " " + line
+	}
+	io.WriteString(w, line)
 }
 
-func (l ColorLogger) output(color, f string, args ...interface{}) {
-	if l.Color && color != "" {
-		f = ansi.Color(f, color)
+// isTerminal - Whether w is a character device such as a terminal, so colors
+// aren't written into files and pipes
+var isTerminal = func(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
 	}
-	fmt.Printf(fmt.Sprintf("%s%s\n", l.Prefix, f), args...)
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mgutz/ansi"
+)
+
+func TestColorLoggerTimestamp(t *testing.T) {
+	var buf bytes.Buffer
+	l := ColorLogger{
+		Prefix:     "prefix ",
+		TimeFormat: time.RFC3339,
+		UTC:        true,
+		Writer:     &buf,
+	}
+	l.Info("hello %s", "world")
+
+	line := buf.String()
+	i := strings.Index(line, " ")
+	if i < 0 {
+		t.Fatalf("no timestamp separator in %q", line)
+	}
+	ts, err := time.Parse(time.RFC3339, line[:i])
+	if err != nil {
+		t.Fatalf("timestamp %q does not match layout: %v", line[:i], err)
+	}
+	if _, offset := ts.Zone(); offset != 0 || !strings.HasSuffix(line[:i], "Z") {
+		t.Errorf("timestamp should be in UTC, got %s", line[:i])
+	}
+	if rest := line[i+1:]; rest != "prefix hello world\n" {
+		t.Errorf("unexpected line after timestamp: %q", rest)
+	}
+}
+
+func TestColorLoggerCustomLayout(t *testing.T) {
+	var buf bytes.Buffer
+	l := ColorLogger{TimeFormat: "2006/01/02", Writer: &buf}
+	l.Warn("x")
+
+	want := time.Now().Format("2006/01/02") + " x\n"
+	if got := buf.String(); got != want {
+		t.Errorf("wanted %q, got %q", want, got)
+	}
+}
+
+func TestColorLoggerNoTimestamp(t *testing.T) {
+	var buf bytes.Buffer
+	l := ColorLogger{Prefix: "p ", Writer: &buf}
+	l.Info("msg")
+
+	if got := buf.String(); got != "p msg\n" {
+		t.Errorf("default format should be unchanged, got %q", got)
+	}
+}
+
+// fakeTerminal - Treat every writer as a terminal for the rest of the test
+func fakeTerminal(t *testing.T) {
+	orig := isTerminal
+	isTerminal = func(io.Writer) bool { return true }
+	t.Cleanup(func() { isTerminal = orig })
+}
+
+func TestColorLoggerPalette(t *testing.T) {
+	fakeTerminal(t)
+	t.Setenv("NO_COLOR", "")
+
+	var buf bytes.Buffer
+	l := ColorLogger{Color: true, Writer: &buf}
+	l.Warn("default")
+	if want := ansi.Color("default", "red") + "\n"; buf.String() != want {
+		t.Errorf("wanted default warn color %q, got %q", want, buf.String())
+	}
+
+	buf.Reset()
+	l.Palette = Palette{Warn: "yellow+b"}
+	l.Warn("custom")
+	if want := ansi.Color("custom", "yellow+b") + "\n"; buf.String() != want {
+		t.Errorf("wanted custom warn color %q, got %q", want, buf.String())
+	}
+}
+
+func TestColorLoggerNoColor(t *testing.T) {
+	fakeTerminal(t)
+	t.Setenv("NO_COLOR", "1")
+
+	var buf bytes.Buffer
+	l := ColorLogger{Color: true, Writer: &buf}
+	l.Warn("plain")
+	if got := buf.String(); got != "plain\n" {
+		t.Errorf("NO_COLOR should suppress colors, got %q", got)
+	}
+}
+
+func TestColorLoggerNotTerminal(t *testing.T) {
+	t.Setenv("NO_COLOR", "")
+
+	var buf bytes.Buffer
+	l := ColorLogger{Color: true, Writer: &buf}
+	l.Warn("plain")
+	if got := buf.String(); got != "plain\n" {
+		t.Errorf("colors should be suppressed when not writing to a terminal, got %q", got)
+	}
+}
+
+func TestParsePalette(t *testing.T) {
+	p, err := ParsePalette("warn=yellow+b, info=cyan")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Warn != "yellow+b" || p.Info != "cyan" || p.color("debug") != DefaultPalette.Debug {
+		t.Errorf("unexpected palette %+v", p)
+	}
+	for _, bad := range []string{"warn", "error=red", "info="} {
+		if _, err := ParsePalette(bad); err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestColorLoggerVerbosity(t *testing.T) {
+	var buf bytes.Buffer
+	level := &LogLevel{}
+	l := ColorLogger{Level: 1, Verbosity: level, Writer: &buf}
+	// a copy, as handed to each connection
+	conn := l
+	conn.Prefix = "conn "
+
+	conn.Debug("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("Verbosity should take precedence over Level, got %q", buf.String())
+	}
+
+	level.Set(1)
+	conn.Debug("shown")
+	if got := buf.String(); got != "conn shown\n" {
+		t.Errorf("raised level should apply to copies, got %q", got)
+	}
+
+	buf.Reset()
+	level.Set(5)
+	if level.Get() != MaxLevel {
+		t.Errorf("level should be clamped to %d, got %d", MaxLevel, level.Get())
+	}
+	l.Trace("trace")
+	level.Set(0)
+	l.Trace("hidden")
+	if got := buf.String(); got != "trace\n" {
+		t.Errorf("wanted only the trace logged at the max level, got %q", got)
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// peek - Read up to PeekSize initial bytes from the client, once, for the
+// Router and the LoggerFactory, waiting at most PeekTimeout. They are
+// forwarded to the remote ahead of everything else.
+func (p *Proxy) peek() error {
+	if p.peekDone || p.PeekSize <= 0 {
+		return nil
+	}
+	p.peekDone = true
+	c, timed := p.lconn.(net.Conn)
+	timed = timed && p.PeekTimeout > 0
+	if timed {
+		c.SetReadDeadline(time.Now().Add(p.PeekTimeout))
+	}
+	buf := make([]byte, p.PeekSize)
+	n, err := p.lconn.Read(buf)
+	if timed {
+		c.SetReadDeadline(time.Time{})
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if p.PeekFallback {
+			p.Log.Info("Client sent nothing within %v, going on without its initial bytes", p.PeekTimeout)
+			return nil
+		}
+		return fmt.Errorf("client sent nothing within %v", p.PeekTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read initial bytes: %w", err)
+	}
+	p.peeked = append(p.peeked, buf[:n]...)
+	return nil
+}
+
+// useLoggerFactory - Replace Log with the one LoggerFactory picks for this
+// client. Returns false when the connection should be dropped.
+func (p *Proxy) useLoggerFactory() bool {
+	if p.LoggerFactory == nil {
+		return true
+	}
+	var clientAddr net.Addr
+	if c, ok := p.lconn.(net.Conn); ok {
+		clientAddr = c.RemoteAddr()
+	}
+	if err := p.peek(); err != nil {
+		p.Log.Warn("Picking a logger failed: %s", err)
+		p.closeWith(err, "%v", err)
+		return false
+	}
+	if l := p.LoggerFactory(clientAddr, p.peeked); l != nil {
+		p.Log = withTags(l, p)
+	}
+	return true
+}
+
+// PeekServerName - The server name a TLS client asks for in its ClientHello,
+// for a LoggerFactory or Router to tell tenants apart. Empty when peek
+// doesn't start with a ClientHello, has no server name or is cut off before
+// it; a PeekSize of 1024 is usually enough.
+func PeekServerName(peek []byte) string {
+	hello, _ := parseClientHello(peek)
+	return hello.serverName
+}
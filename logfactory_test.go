@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerFactory(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	// each tenant's first byte picks its log
+	logs := map[string]*bytes.Buffer{"a": {}, "b": {}}
+	type pick struct {
+		client net.Addr
+		peek   string
+	}
+	picks := make(chan pick, 2)
+	factory := func(clientAddr net.Addr, peek []byte) Logger {
+		picks <- pick{clientAddr, string(peek)}
+		if w, ok := logs[string(peek)]; ok {
+			return ColorLogger{Writer: w}
+		}
+		return nil
+	}
+
+	for _, tenant := range []string{"a", "b"} {
+		client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+			p.PeekSize = 1
+			p.LoggerFactory = factory
+		})
+		if got := echoRoundTrip(t, client, tenant); got != tenant {
+			t.Errorf("the peeked byte should still be forwarded, got %q", got)
+		}
+		client.Close()
+		<-done
+		if got := <-picks; got.peek != tenant || got.client.String() != client.LocalAddr().String() {
+			t.Errorf("factory called with %v, %q", got.client, got.peek)
+		}
+	}
+
+	for tenant, w := range logs {
+		if got := w.String(); strings.Count(got, "Opened") != 1 || strings.Count(got, "Closed") != 1 {
+			t.Errorf("tenant %s should get the logs of its one connection, got %q", tenant, got)
+		}
+	}
+}
+
+func TestPeekServerName(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go tls.Client(c1, &tls.Config{ServerName: "tenant.example.com"}).Handshake()
+
+	c2.SetDeadline(time.Now().Add(2 * time.Second))
+	hello := make([]byte, 4096)
+	n, err := c2.Read(hello)
+	if err != nil {
+		t.Fatalf("failed to read the client hello: %v", err)
+	}
+	hello = hello[:n]
+	if got := PeekServerName(hello); got != "tenant.example.com" {
+		t.Errorf("wanted tenant.example.com, got %q", got)
+	}
+	for _, peek := range [][]byte{hello[:60], []byte("GET / HTTP/1.1\r\n"), nil} {
+		if got := PeekServerName(peek); got != "" {
+			t.Errorf("expected no server name in %q, got %q", peek, got)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Direction - Which way data is flowing through the proxy
+type Direction int
+
+const (
+	// Upstream - data read from the local client, headed to the remote
+	Upstream Direction = iota
+	// Downstream - data read from the remote, headed back to the client
+	Downstream
+)
+
+func (d Direction) String() string {
+	if d == Upstream {
+		return "upstream"
+	}
+	return "downstream"
+}
+
+// MatchContext - A chunk of proxied data along with where it came from
+type MatchContext struct {
+	// Data - the chunk as read, before any replacers ran. Only valid for the
+	// duration of the Matcher call.
+	Data      []byte
+	Direction Direction
+	// Offset - number of bytes seen in this direction before Data
+	Offset uint64
+	// Time - when Data was read
+	Time       time.Time
+	ConnID     uint64
+	ConnUUID   string
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	// Hold - Stop forwarding this direction, starting with Data, until the
+	// returned resume is called or, when d is positive, d passes. Nothing
+	// more is read from the sender meanwhile, so TCP flow control holds it
+	// back and no data is lost, e.g. while an out-of-band analysis runs.
+	// Hold can be called after the Matcher returned as well; the pipe then
+	// stops before its next read. Forwarding resumes once every hold is
+	// released. IdleTimeout and MaxLifetime still run while held.
+	Hold func(d time.Duration) (resume func())
+}
+
+// BytesMatcher - Adapt a matcher that only cares about the data to the
+// Matcher signature
+func BytesMatcher(f func([]byte)) func(MatchContext) {
+	return func(ctx MatchContext) {
+		f(ctx.Data)
+	}
+}
+
+// maxLoggedMatch - How much of each matched string is included in logs
+const maxLoggedMatch = 32
+
+const (
+	// DefaultMaxMatchStrings - How many string matches a RuleMatch keeps
+	// when MaxMatchStrings is unset
+	DefaultMaxMatchStrings = 16
+	// DefaultMaxMatchData - How many bytes of each matched string a
+	// StringMatch keeps when MaxMatchData is unset
+	DefaultMaxMatchData = 256
+)
+
+// RuleMatch - A yara rule that matched data sent upstream, or an
+// EntropyCheck that matched either direction
+type RuleMatch struct {
+	Rule      string
+	Namespace string
+	Tags      []string
+	Meta      map[string]interface{}
+	Strings   []StringMatch
+	// More - how many further string matches were left out of Strings
+	// because of MaxMatchStrings
+	More int
+}
+
+// StringMatch - Where one of a rule's strings matched
+type StringMatch struct {
+	// Name - the string's identifier, e.g. $a
+	Name string `json:"name"`
+	// Offset - position of the match in the upstream data, counted from the
+	// start of the connection
+	Offset int64 `json:"offset"`
+	// Data - the matched bytes, cut to MaxMatchData
+	Data []byte `json:"data"`
+	// Length - the size of the whole match, which is more than len(Data)
+	// when it was cut
+	Length int `json:"length"`
+}
+
+// handleMatch - Act on a match according to its tags: log and warn log it
+// and alert the Notifier, as often as AlertLimit lets them, drop blocks the
+// connection. Every match is also recorded and passed to OnRuleMatch.
+func (p *Proxy) handleMatch(match RuleMatch) {
+	p.recordMatch(match)
+	p.emitMatch(match)
+	info, warn := false, false
+	for _, tag := range match.Tags {
+		switch strings.ToLower(tag) {
+		case "log":
+			info = true
+		case "warn":
+			warn = true
+		case "drop":
+			p.block(fmt.Errorf("match on rule %s", match.Rule))
+		}
+	}
+	if info || warn {
+		if ok, suppressed := p.allowAlert(match); ok {
+			if suppressed > 0 {
+				p.Log.Info("%d alerts for rule %s suppressed by the alert rate limit", suppressed, match.Rule)
+			}
+			if info {
+				p.Log.Info("match found for rule %s", match)
+			}
+			if warn {
+				p.Log.Warn("match found for rule %s", match)
+			}
+			p.notify(match, suppressed)
+		}
+	}
+	if p.OnRuleMatch != nil {
+		p.OnRuleMatch(match)
+	}
+}
+
+// String - The match as logged, with long matched data truncated
+func (m RuleMatch) String() string {
+	var b strings.Builder
+	b.WriteString(m.Rule)
+	if len(m.Tags) > 0 {
+		fmt.Fprintf(&b, " (tags: %s)", strings.Join(m.Tags, ", "))
+	}
+	for i, s := range m.Strings {
+		if i == 0 {
+			b.WriteString(":")
+		} else {
+			b.WriteString(",")
+		}
+		data, more := s.Data, ""
+		if len(data) > maxLoggedMatch {
+			data, more = data[:maxLoggedMatch], "..."
+		} else if s.Length > len(data) {
+			more = "..."
+		}
+		fmt.Fprintf(&b, " %s at %d %q%s", s.Name, s.Offset, data, more)
+	}
+	if m.More > 0 {
+		fmt.Fprintf(&b, ", +%d more matches", m.More)
+	}
+	return b.String()
+}
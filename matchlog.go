@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	matchCountsLock sync.Mutex
+	matchCounts     = make(map[string]uint64)
+)
+
+// MatchCounts - How often each yara rule matched since the process started,
+// across all connections, keyed by namespace:rule like LoadedRules
+func MatchCounts() map[string]uint64 {
+	matchCountsLock.Lock()
+	defer matchCountsLock.Unlock()
+	counts := make(map[string]uint64, len(matchCounts))
+	for rule, n := range matchCounts {
+		counts[rule] = n
+	}
+	return counts
+}
+
+func countMatch(m RuleMatch) {
+	matchCountsLock.Lock()
+	matchCounts[m.Namespace+":"+m.Rule]++
+	matchCountsLock.Unlock()
+}
+
+// MatchRecord - One line of a MatchLog
+type MatchRecord struct {
+	Time      time.Time     `json:"time"`
+	Rule      string        `json:"rule"`
+	Namespace string        `json:"namespace"`
+	Tags      []string      `json:"tags"`
+	ID        uint64        `json:"id"`
+	UUID      string        `json:"uuid,omitempty"`
+	Client    string        `json:"client"`
+	Remote    string        `json:"remote"`
+	Strings   []StringMatch `json:"strings"`
+	More      int           `json:"more,omitempty"`
+	// ConnTags - the connection's Tags, unlike Tags which are the rule's
+	ConnTags map[string]string `json:"conn_tags,omitempty"`
+}
+
+// MatchLog - Writes a JSON MatchRecord line for every rule match, whatever
+// the rule's tags, for going through matches after the fact. One MatchLog
+// is usually shared by all connections.
+type MatchLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewMatchLog - A MatchLog writing to w
+func NewMatchLog(w io.Writer) *MatchLog {
+	return &MatchLog{w: w}
+}
+
+// OpenMatchLog - A MatchLog appending to the file at path, which is created
+// if it doesn't exist
+func OpenMatchLog(path string) (*MatchLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewMatchLog(f), nil
+}
+
+// Write - Add a record to the log
+func (l *MatchLog) Write(r MatchRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(line, '\n'))
+	return err
+}
+
+// Close - Close the underlying file, if it is one
+func (l *MatchLog) Close() error {
+	if c, ok := l.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// recordMatch - Count the match and add it to the MatchLog
+func (p *Proxy) recordMatch(m RuleMatch) {
+	countMatch(m)
+	if p.MatchLog == nil {
+		return
+	}
+	err := p.MatchLog.Write(MatchRecord{
+		Time:      p.clock().Now(),
+		Rule:      m.Rule,
+		Namespace: m.Namespace,
+		Tags:      m.Tags,
+		ID:        p.ID,
+		UUID:      p.UUID,
+		Client:    p.clientAddr(),
+		Remote:    p.remoteString(),
+		Strings:   m.Strings,
+		More:      m.More,
+		ConnTags:  p.tags(),
+	})
+	if err != nil {
+		p.Log.Warn("writing rule %s to the match log failed: %v", m.Rule, err)
+	}
+}
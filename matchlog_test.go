@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchLogAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "matches.log")
+	for i := 0; i < 2; i++ {
+		l, err := OpenMatchLog(path)
+		if err != nil {
+			t.Fatalf("failed to open match log: %v", err)
+		}
+		err = l.Write(MatchRecord{
+			Rule:    "Needle",
+			ID:      uint64(i + 1),
+			Strings: []StringMatch{{Name: "$a", Offset: 4, Data: []byte("needle")}},
+		})
+		if err != nil {
+			t.Fatalf("failed to write record: %v", err)
+		}
+		l.Close()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open match log: %v", err)
+	}
+	defer f.Close()
+	var records []MatchRecord
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		var r MatchRecord
+		if err := json.Unmarshal(lines.Bytes(), &r); err != nil {
+			t.Fatalf("bad record %q: %v", lines.Text(), err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 || records[0].ID != 1 || records[1].ID != 2 {
+		t.Fatalf("expected both records in order, got %+v", records)
+	}
+	if s := records[1].Strings; len(s) != 1 || s[0].Offset != 4 || string(s[0].Data) != "needle" {
+		t.Errorf("unexpected strings %+v", s)
+	}
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import "sync/atomic"
+
+// minSaneMSS - Segments smaller than the IPv4 default MSS hint at path MTU
+// trouble
+const minSaneMSS = 536
+
+// logMSS - Log the MSS of both connections, warning when it is suspiciously
+// small. Does nothing where the MSS can't be queried.
+func (p *Proxy) logMSS() {
+	for _, c := range []struct {
+		side string
+		conn interface{}
+	}{{"local", p.lconn}, {"remote", p.rconn}} {
+		mss, ok := tcpMSS(c.conn)
+		if !ok {
+			continue
+		}
+		if mss < minSaneMSS {
+			p.Log.Warn("%s connection has a suspiciously small MSS of %d bytes", c.side, mss)
+		} else {
+			p.Log.Info("%s connection MSS is %d bytes", c.side, mss)
+		}
+	}
+}
+
+// SmallReads - Number of reads that returned fewer than SmallReadThreshold
+// bytes
+func (p *Proxy) SmallReads() uint64 {
+	return atomic.LoadUint64(&p.smallReads)
+}
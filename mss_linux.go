@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// tcpMSS - Read the negotiated maximum segment size of a TCP connection
+func tcpMSS(conn interface{}) (int, bool) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, false
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+
+	var mss int
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		mss, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG)
+	}); err != nil || serr != nil {
+		return 0, false
+	}
+	return mss, true
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTCPMSS(t *testing.T) {
+	l := listenLocal(t)
+	defer l.Close()
+
+	c, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+
+	mss, ok := tcpMSS(c)
+	if !ok {
+		t.Fatalf("failed to read TCP_MAXSEG")
+	}
+	if mss <= 0 {
+		t.Errorf("wanted a positive MSS, got %d", mss)
+	}
+
+	if _, ok := tcpMSS(nil); ok {
+		t.Errorf("non-TCP connections should report no MSS")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+// tcpMSS - Not supported on this platform
+func tcpMSS(conn interface{}) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,615 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Frame types of the mux protocol
+const (
+	// muxOpen - a new stream, sent by the client end only
+	muxOpen = iota + 1
+	// muxData - payload for a stream
+	muxData
+	// muxClose - the sender won't write to the stream again
+	muxClose
+	// muxReset - the stream was aborted, e.g. because its remote couldn't be
+	// dialed; neither side reads or writes it anymore
+	muxReset
+)
+
+const (
+	// muxHeaderSize - Stream id, type and payload length
+	muxHeaderSize = 7
+	// maxMuxPayload - The most a single data frame carries
+	maxMuxPayload = 0xffff
+	// muxStreamBuffer - How much data a stream holds for its reader before
+	// the whole connection waits
+	muxStreamBuffer = 256 << 10
+)
+
+const (
+	defaultMuxMinBackoff = 100 * time.Millisecond
+	defaultMuxMaxBackoff = 30 * time.Second
+)
+
+// ErrMuxDown - Returned by MuxClient.Open when there is no upstream
+// connection to open a stream over
+var ErrMuxDown = errors.New("mux upstream is down")
+
+var (
+	errMuxReset  = errors.New("mux stream reset by peer")
+	errMuxClosed = errors.New("mux stream closed")
+)
+
+// muxSession - One connection between a MuxClient and a MuxServer and the
+// streams multiplexed over it.
+//
+// Every frame is a 4 byte big-endian stream id, a 1 byte type and a 2 byte
+// big-endian payload length, followed by that many bytes of payload. Only
+// data frames carry payload. The client numbers the streams it opens from 1
+// upwards; a stream is done once both sides sent a close, or either a reset.
+type muxSession struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error
+}
+
+func newMuxSession(conn net.Conn) *muxSession {
+	return &muxSession{conn: conn, streams: make(map[uint32]*muxStream)}
+}
+
+func (s *muxSession) writeFrame(id uint32, typ byte, b []byte) error {
+	frame := make([]byte, muxHeaderSize+len(b))
+	binary.BigEndian.PutUint32(frame, id)
+	frame[4] = typ
+	binary.BigEndian.PutUint16(frame[5:], uint16(len(b)))
+	copy(frame[muxHeaderSize:], b)
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.conn.Write(frame)
+	return err
+}
+
+func (s *muxSession) newStream(id uint32) *muxStream {
+	st := &muxStream{id: id, sess: s}
+	st.cond = sync.NewCond(&st.mu)
+	s.streams[id] = st
+	return st
+}
+
+// open - Start a new stream, from the client end
+func (s *muxSession) open() (*muxStream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	s.nextID++
+	st := s.newStream(s.nextID)
+	s.mu.Unlock()
+	if err := s.writeFrame(st.id, muxOpen, nil); err != nil {
+		s.fail(err)
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *muxSession) stream(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *muxSession) forget(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// fail - End the session and every stream on it with err
+func (s *muxSession) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	streams := s.streams
+	s.streams = make(map[uint32]*muxStream)
+	s.mu.Unlock()
+	s.conn.Close()
+	for _, st := range streams {
+		st.abort(err)
+	}
+}
+
+// serve - Read frames and hand them to their streams until the connection
+// fails. accept is called with every stream the other side opens; nil
+// refuses them.
+func (s *muxSession) serve(accept func(*muxStream)) error {
+	var head [muxHeaderSize]byte
+	buf := make([]byte, maxMuxPayload)
+	for {
+		if _, err := io.ReadFull(s.conn, head[:]); err != nil {
+			s.fail(err)
+			return err
+		}
+		id := binary.BigEndian.Uint32(head[:])
+		n := int(binary.BigEndian.Uint16(head[5:]))
+		if _, err := io.ReadFull(s.conn, buf[:n]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			s.fail(err)
+			return err
+		}
+		switch head[4] {
+		case muxOpen:
+			if accept == nil {
+				s.writeFrame(id, muxReset, nil)
+				continue
+			}
+			s.mu.Lock()
+			st := s.newStream(id)
+			s.mu.Unlock()
+			accept(st)
+		case muxData:
+			if st := s.stream(id); st != nil {
+				st.deliver(buf[:n])
+			}
+		case muxClose:
+			if st := s.stream(id); st != nil {
+				st.remoteClosed()
+			}
+		case muxReset:
+			if st := s.stream(id); st != nil {
+				s.forget(id)
+				st.abort(errMuxReset)
+			}
+		default:
+			err := errors.New("unknown mux frame type")
+			s.fail(err)
+			return err
+		}
+	}
+}
+
+// muxStream - One connection carried over a muxSession. Read, Write and
+// CloseWrite behave like those of a TCP connection.
+type muxStream struct {
+	id   uint32
+	sess *muxSession
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	// eof - the other side sent a close
+	eof bool
+	// wroteClose - this side sent a close
+	wroteClose bool
+	closed     bool
+	err        error
+}
+
+// deliver - Queue data from the other side, waiting while the reader is
+// muxStreamBuffer behind
+func (st *muxStream) deliver(b []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for st.buf.Len() >= muxStreamBuffer && !st.closed && st.err == nil {
+		st.cond.Wait()
+	}
+	if st.closed || st.err != nil {
+		return
+	}
+	st.buf.Write(b)
+	st.cond.Broadcast()
+}
+
+func (st *muxStream) remoteClosed() {
+	st.mu.Lock()
+	st.eof = true
+	done := st.wroteClose
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	if done {
+		st.sess.forget(st.id)
+	}
+}
+
+func (st *muxStream) abort(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *muxStream) Read(b []byte) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for st.buf.Len() == 0 && !st.eof && !st.closed && st.err == nil {
+		st.cond.Wait()
+	}
+	switch {
+	case st.buf.Len() > 0:
+		n, _ := st.buf.Read(b)
+		st.cond.Broadcast()
+		return n, nil
+	case st.closed:
+		return 0, errMuxClosed
+	case st.err != nil:
+		return 0, st.err
+	}
+	return 0, io.EOF
+}
+
+func (st *muxStream) Write(b []byte) (int, error) {
+	st.mu.Lock()
+	err := st.err
+	switch {
+	case st.closed, st.wroteClose:
+		err = errMuxClosed
+	}
+	st.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxMuxPayload {
+			chunk = chunk[:maxMuxPayload]
+		}
+		if err := st.sess.writeFrame(st.id, muxData, chunk); err != nil {
+			st.sess.fail(err)
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// CloseWrite - Tell the other side no more data follows, it reads EOF
+func (st *muxStream) CloseWrite() error {
+	st.mu.Lock()
+	if st.wroteClose || st.closed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.wroteClose = true
+	done := st.eof
+	st.mu.Unlock()
+	if done {
+		st.sess.forget(st.id)
+	}
+	return st.sess.writeFrame(st.id, muxClose, nil)
+}
+
+// Close - Finish the stream, resetting it if the other side may still send
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	finished := (st.eof && st.wroteClose) || st.err != nil
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	st.sess.forget(st.id)
+	if finished {
+		return nil
+	}
+	return st.sess.writeFrame(st.id, muxReset, nil)
+}
+
+// MuxClient - Keeps one long-lived connection to a MuxServer and opens a
+// stream over it for every connection, e.g. for a site-to-site link that
+// should only ever hold a single connection. When the upstream connection
+// drops, every stream on it fails and it is redialed with jittered
+// exponential backoff; Open waits up to QueueTimeout for it meanwhile.
+//
+// There is no flow control per stream: a stream whose reader falls
+// muxStreamBuffer behind holds up the others until it catches up.
+type MuxClient struct {
+	// Remote - The address of the MuxServer
+	Remote string
+	Log    Logger
+	// MinBackoff, MaxBackoff - The first and the longest wait between
+	// attempts to redial the upstream, doubling in between. Each wait is
+	// jittered down by up to half. Default to 100ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Rand - The source of the jitter, defaults to math/rand.Float64
+	Rand func() float64
+	// QueueTimeout - How long Open waits for the upstream while it is being
+	// redialed before failing with ErrMuxDown. Zero fails at once.
+	QueueTimeout time.Duration
+	// DialTimeout - How long each attempt to dial the upstream may take.
+	// Defaults to 10 seconds.
+	DialTimeout time.Duration
+
+	mu   sync.Mutex
+	sess *muxSession
+	// dialErr - Why the latest attempt to dial the upstream failed, nil
+	// once connected
+	dialErr error
+	ready   chan struct{}
+	closed  chan struct{}
+	started bool
+}
+
+func (c *MuxClient) log() Logger {
+	if c.Log == nil {
+		return NullLogger{}
+	}
+	return c.Log
+}
+
+func (c *MuxClient) init() {
+	if c.closed == nil {
+		c.ready = make(chan struct{})
+		c.closed = make(chan struct{})
+	}
+}
+
+// Start - Dial the upstream in the background and keep it connected until
+// Close
+func (c *MuxClient) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	if c.started {
+		return
+	}
+	c.started = true
+	go c.run()
+}
+
+// Close - Stop redialing and close the upstream and every stream on it
+func (c *MuxClient) Close() error {
+	c.mu.Lock()
+	c.init()
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	sess := c.sess
+	c.mu.Unlock()
+	if sess != nil {
+		sess.fail(errMuxClosed)
+	}
+	return nil
+}
+
+// Connected - Whether the upstream connection is currently up
+func (c *MuxClient) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sess != nil
+}
+
+// Open - Open a stream over the upstream connection. The stream supports
+// CloseWrite for half-closing like a TCP connection.
+func (c *MuxClient) Open() (io.ReadWriteCloser, error) {
+	c.mu.Lock()
+	c.init()
+	sess, ready := c.sess, c.ready
+	c.mu.Unlock()
+	if sess == nil {
+		if c.QueueTimeout <= 0 {
+			return nil, c.downError()
+		}
+		timer := time.NewTimer(c.QueueTimeout)
+		defer timer.Stop()
+		select {
+		case <-ready:
+		case <-timer.C:
+			return nil, c.downError()
+		case <-c.closed:
+			return nil, ErrMuxDown
+		}
+		c.mu.Lock()
+		sess = c.sess
+		c.mu.Unlock()
+		if sess == nil {
+			return nil, c.downError()
+		}
+	}
+	return sess.open()
+}
+
+// downError - ErrMuxDown, along with why dialing the upstream failed last
+func (c *MuxClient) downError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dialErr == nil {
+		return ErrMuxDown
+	}
+	return fmt.Errorf("%w: %v", ErrMuxDown, c.dialErr)
+}
+
+func (c *MuxClient) dialTimeout() time.Duration {
+	if c.DialTimeout <= 0 {
+		return defaultDialTimeout
+	}
+	return c.DialTimeout
+}
+
+// backoff - How long to wait before redial attempt n, counted from 0
+func (c *MuxClient) backoff(n int) time.Duration {
+	d, longest := c.MinBackoff, c.MaxBackoff
+	if d <= 0 {
+		d = defaultMuxMinBackoff
+	}
+	if longest <= 0 {
+		longest = defaultMuxMaxBackoff
+	}
+	for i := 0; i < n && d < longest; i++ {
+		d *= 2
+	}
+	if d > longest {
+		d = longest
+	}
+	random := c.Rand
+	if random == nil {
+		random = rand.Float64
+	}
+	return d - time.Duration(random()*float64(d)/2)
+}
+
+func (c *MuxClient) run() {
+	// Close gives up on a dial in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.closed
+		cancel()
+	}()
+	dialer := &net.Dialer{Timeout: c.dialTimeout()}
+	attempt := 0
+	for {
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", c.Remote)
+		if err != nil {
+			c.mu.Lock()
+			c.dialErr = err
+			c.mu.Unlock()
+			wait := c.backoff(attempt)
+			attempt++
+			c.log().Warn("Mux upstream to %s failed: %s, redialing in %v", c.Remote, err, wait)
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-c.closed:
+				timer.Stop()
+				return
+			}
+			continue
+		}
+		attempt = 0
+		sess := newMuxSession(conn)
+		c.mu.Lock()
+		select {
+		case <-c.closed:
+			c.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		c.sess = sess
+		c.dialErr = nil
+		close(c.ready)
+		c.mu.Unlock()
+		c.log().Info("Mux upstream connected %v >>> %s", conn.LocalAddr(), c.Remote)
+
+		err = sess.serve(nil)
+
+		c.mu.Lock()
+		c.sess = nil
+		c.ready = make(chan struct{})
+		c.mu.Unlock()
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+		c.log().Warn("Mux upstream to %s dropped: %s, reconnecting", c.Remote, err)
+	}
+}
+
+// MuxServer - The far end of MuxClient upstreams: connects every stream
+// opened over them to Remote and relays between the two
+type MuxServer struct {
+	// Remote - Where each stream's connection goes
+	Remote string
+	Log    Logger
+	// DialTimeout - How long connecting a stream to Remote may take.
+	// Defaults to 10 seconds.
+	DialTimeout time.Duration
+}
+
+func (m *MuxServer) log() Logger {
+	if m.Log == nil {
+		return NullLogger{}
+	}
+	return m.Log
+}
+
+// Serve - Accept MuxClient upstreams on l. Returns once l fails, e.g.
+// because it was closed.
+func (m *MuxServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go m.serveUpstream(conn)
+	}
+}
+
+func (m *MuxServer) dialTimeout() time.Duration {
+	if m.DialTimeout <= 0 {
+		return defaultDialTimeout
+	}
+	return m.DialTimeout
+}
+
+func (m *MuxServer) serveUpstream(conn net.Conn) {
+	m.log().Info("Mux upstream from %v", conn.RemoteAddr())
+	err := newMuxSession(conn).serve(func(st *muxStream) {
+		go m.serveStream(st)
+	})
+	if err != io.EOF {
+		m.log().Warn("Mux upstream from %v failed: %s", conn.RemoteAddr(), err)
+	}
+	m.log().Info("Closed mux upstream from %v", conn.RemoteAddr())
+}
+
+func (m *MuxServer) serveStream(st *muxStream) {
+	defer st.Close()
+	rconn, err := (&net.Dialer{Timeout: m.dialTimeout()}).Dial("tcp", m.Remote)
+	if err != nil {
+		m.log().Warn("Failed to connect stream %d to %s: %s", st.id, m.Remote, err)
+		return
+	}
+	defer rconn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := io.Copy(rconn, st); err != nil {
+			// reset, or the upstream dropped
+			rconn.Close()
+			return
+		}
+		if cw, ok := rconn.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+	}()
+	if _, err := io.Copy(st, rconn); err != nil {
+		st.Close()
+	} else {
+		st.CloseWrite()
+	}
+	<-done
+}
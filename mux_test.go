@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upstreamListener - Records the connections accepted, so a test can drop
+// them
+type upstreamListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *upstreamListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, c)
+		l.mu.Unlock()
+	}
+	return c, err
+}
+
+func (l *upstreamListener) accepted() []net.Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]net.Conn(nil), l.conns...)
+}
+
+// startMuxServer - A MuxServer relaying streams to remote
+func startMuxServer(t *testing.T, remote string) *upstreamListener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ul := &upstreamListener{Listener: l}
+	go (&MuxServer{Remote: remote}).Serve(ul)
+	return ul
+}
+
+func streamRoundTrip(t *testing.T, s io.ReadWriter, msg string) string {
+	t.Helper()
+	if _, err := s.Write([]byte(msg)); err != nil {
+		t.Fatalf("stream write failed: %v", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatalf("stream read failed: %v", err)
+	}
+	return string(buf)
+}
+
+func TestMuxStreams(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	server := startMuxServer(t, echo.Addr().String())
+	defer server.Close()
+
+	c := &MuxClient{Remote: server.Addr().String(), QueueTimeout: 2 * time.Second}
+	c.Start()
+	defer c.Close()
+
+	first, err := c.Open()
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	second, err := c.Open()
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	if got := streamRoundTrip(t, second, "two"); got != "two" {
+		t.Errorf("wanted two, got %q", got)
+	}
+	if got := streamRoundTrip(t, first, "one"); got != "one" {
+		t.Errorf("wanted one, got %q", got)
+	}
+	// the echo server closes once it reads EOF
+	first.(closeWriter).CloseWrite()
+	if n, err := first.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("wanted EOF after half-closing, got %d bytes and %v", n, err)
+	}
+	first.Close()
+	if got := streamRoundTrip(t, second, "still open"); got != "still open" {
+		t.Errorf("closing one stream shouldn't affect another, got %q", got)
+	}
+	second.Close()
+	if n := len(server.accepted()); n != 1 {
+		t.Errorf("wanted all streams over one upstream connection, got %d", n)
+	}
+}
+
+func TestMuxReconnect(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	server := startMuxServer(t, echo.Addr().String())
+	defer server.Close()
+
+	c := &MuxClient{
+		Remote:       server.Addr().String(),
+		MinBackoff:   10 * time.Millisecond,
+		QueueTimeout: 2 * time.Second,
+	}
+	c.Start()
+	defer c.Close()
+
+	// proxied connections run over the upstream like any other remote
+	client, done := startProxy(t, nil, func(p *Proxy) {
+		p.Mux = c
+		p.SetReplacers([]Replacer{&StringReplacer{"ping", "pong"}})
+	})
+	if got := echoRoundTrip(t, client, "ping"); got != "pong" {
+		t.Errorf("wanted pong, got %q", got)
+	}
+
+	// drop the upstream from the far end
+	for _, conn := range server.accepted() {
+		conn.Close()
+	}
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if n, err := client.Read(make([]byte, 8)); err == nil {
+		t.Errorf("the connection over the dropped upstream should have closed, got %d bytes", n)
+	}
+	client.Close()
+	<-done
+
+	// new connections wait for the redial and work again
+	client, done = startProxy(t, nil, func(p *Proxy) { p.Mux = c })
+	if got := echoRoundTrip(t, client, "again"); got != "again" {
+		t.Errorf("wanted again over the new upstream, got %q", got)
+	}
+	client.Close()
+	<-done
+	if n := len(server.accepted()); n != 2 {
+		t.Errorf("wanted the upstream to be redialed once, got %d connections", n)
+	}
+}
+
+func TestMuxDown(t *testing.T) {
+	// nothing listens here
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	c := &MuxClient{Remote: addr, MinBackoff: time.Millisecond, QueueTimeout: 20 * time.Millisecond, DialTimeout: time.Second}
+	c.Start()
+	defer c.Close()
+	_, err = c.Open()
+	if !errors.Is(err, ErrMuxDown) {
+		t.Errorf("expected ErrMuxDown, got %v", err)
+	}
+	// along with why the upstream is down
+	if err == nil || !strings.Contains(err.Error(), addr) {
+		t.Errorf("expected the dial error to be given, got %v", err)
+	}
+	c.QueueTimeout = 0
+	if _, err := c.Open(); !errors.Is(err, ErrMuxDown) {
+		t.Errorf("expected ErrMuxDown without waiting, got %v", err)
+	}
+}
+
+func TestMuxBackoff(t *testing.T) {
+	c := &MuxClient{MinBackoff: time.Second, MaxBackoff: 5 * time.Second, Rand: func() float64 { return 0 }}
+	for n, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := c.backoff(n); got != want {
+			t.Errorf("attempt %d: wanted %v, got %v", n, want, got)
+		}
+	}
+	c.Rand = func() float64 { return 1 }
+	if got := c.backoff(0); got != time.Second/2 {
+		t.Errorf("wanted the jitter to take off up to half, got %v", got)
+	}
+}
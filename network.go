@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// checkNetwork - Validate a Network setting, as given on the command line
+func checkNetwork(network string) error {
+	switch network {
+	case "", "tcp", "tcp4", "tcp6":
+		return nil
+	}
+	return fmt.Errorf("unknown network %q, expected tcp, tcp4 or tcp6", network)
+}
+
+// localStacks - Whether this host has a non-loopback IPv4 and a global IPv6
+// address, i.e. which families it can reach other hosts over
+func localStacks() (v4, v6 bool) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		// can't tell, assume both work
+		return true, true
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			v4 = true
+		} else if ipnet.IP.IsGlobalUnicast() {
+			v6 = true
+		}
+	}
+	return v4, v6
+}
+
+// ResolveRemote - Resolve a remote address for network, tcp4 or tcp6 to
+// force an address family. With tcp or an empty network the address the
+// resolver prefers is used, unless it is IPv4 on a host with only IPv6
+// connectivity (or the other way around) and the name has an address of the
+// family the host can reach.
+func ResolveRemote(network, address string) (*net.TCPAddr, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+	if network == "tcp4" || network == "tcp6" {
+		return net.ResolveTCPAddr(network, address)
+	}
+	raddr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil || raddr.IP == nil || raddr.IP.IsLoopback() {
+		return raddr, err
+	}
+	v4, v6 := localStacks()
+	other := ""
+	switch isV4 := raddr.IP.To4() != nil; {
+	case isV4 && !v4 && v6:
+		other = "tcp6"
+	case !isV4 && !v6 && v4:
+		other = "tcp4"
+	}
+	if other != "" {
+		if alt, err := net.ResolveTCPAddr(other, address); err == nil {
+			return alt, nil
+		}
+	}
+	return raddr, nil
+}
+
+// dialNetwork - The network remote connections are dialed over: Network
+// when it forces a family, otherwise the family of raddr
+func (p *Proxy) dialNetwork() string {
+	if p.Network == "tcp4" || p.Network == "tcp6" {
+		return p.Network
+	}
+	if p.raddr != nil && p.raddr.IP != nil {
+		if p.raddr.IP.To4() != nil {
+			return "tcp4"
+		}
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// noRouteError - Explain a dial that failed because this host has no route
+// over the network's address family
+func noRouteError(network, address string, err error) error {
+	if !errors.Is(err, syscall.ENETUNREACH) && !errors.Is(err, syscall.EADDRNOTAVAIL) && !errors.Is(err, syscall.EAFNOSUPPORT) {
+		return err
+	}
+	family := "IPv4 or IPv6"
+	switch network {
+	case "tcp4":
+		family = "IPv4"
+	case "tcp6":
+		family = "IPv6"
+	}
+	return fmt.Errorf("no route to %s over %s, try resolving it with another network: %w", address, family, err)
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestResolveRemoteForced(t *testing.T) {
+	for _, tc := range []struct {
+		network, address string
+		want             string
+		fails            bool
+	}{
+		{"tcp4", "127.0.0.1:80", "127.0.0.1:80", false},
+		{"tcp4", "[::1]:80", "", true},
+		{"tcp6", "[::1]:80", "[::1]:80", false},
+		{"tcp6", "127.0.0.1:80", "", true},
+		{"tcp", "127.0.0.1:80", "127.0.0.1:80", false},
+		{"", "[::1]:80", "[::1]:80", false},
+		{"udp", "127.0.0.1:80", "", true},
+	} {
+		raddr, err := ResolveRemote(tc.network, tc.address)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%s %s: expected an error, got %v", tc.network, tc.address, raddr)
+			}
+			continue
+		}
+		if err != nil || raddr.String() != tc.want {
+			t.Errorf("%s %s: expected %s, got %v %v", tc.network, tc.address, tc.want, raddr, err)
+		}
+	}
+}
+
+func TestDialNetwork(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}
+	for _, tc := range []struct {
+		network string
+		raddr   *net.TCPAddr
+		want    string
+	}{
+		{"", v4, "tcp4"},
+		{"", v6, "tcp6"},
+		{"tcp", nil, "tcp"},
+		{"tcp4", v6, "tcp4"},
+		{"tcp6", v4, "tcp6"},
+	} {
+		p := &Proxy{Network: tc.network, raddr: tc.raddr}
+		if got := p.dialNetwork(); got != tc.want {
+			t.Errorf("network %q to %v: expected %s, got %s", tc.network, tc.raddr, tc.want, got)
+		}
+	}
+}
+
+func TestForcedNetworkDial(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	raddr := echo.Addr().(*net.TCPAddr)
+
+	client, done := startProxy(t, raddr, func(p *Proxy) { p.Network = "tcp4" })
+	if got := echoRoundTrip(t, client, "over ipv4"); got != "over ipv4" {
+		t.Errorf("expected the echo over tcp4, got %q", got)
+	}
+	client.Close()
+	<-done
+
+	// an IPv6 only dial can't reach the IPv4 remote
+	var p *Proxy
+	client, done = startProxy(t, raddr, func(proxy *Proxy) {
+		p = proxy
+		p.Network = "tcp6"
+	})
+	defer client.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the tcp6 dial to fail")
+	}
+	if !strings.HasPrefix(p.CloseReason(), "remote connection failed") {
+		t.Errorf("unexpected close reason %q", p.CloseReason())
+	}
+}
+
+func TestNoRouteError(t *testing.T) {
+	unreachable := &net.OpError{Op: "dial", Net: "tcp6", Err: &net.AddrError{Err: "x"}}
+	if err := noRouteError("tcp6", "[2001:db8::1]:80", unreachable); err != unreachable {
+		t.Errorf("unrelated errors should be returned as they are, got %v", err)
+	}
+	err := noRouteError("tcp6", "[2001:db8::1]:80", &net.OpError{Op: "dial", Net: "tcp6", Err: syscall.ENETUNREACH})
+	if err == nil || !strings.Contains(err.Error(), "no route to [2001:db8::1]:80 over IPv6") || !errors.Is(err, syscall.ENETUNREACH) {
+		t.Errorf("expected a no route error, got %v", err)
+	}
+	if noRouteError("tcp", "x", nil) != nil {
+		t.Errorf("expected nil for a successful dial")
+	}
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultNotifyTimeout - How long an exec or webhook notification may take
+// when no timeout is set
+const defaultNotifyTimeout = 5 * time.Second
+
+// Alert - What a Notifier is told about a rule match
+type Alert struct {
+	Rule      string   `json:"rule"`
+	Namespace string   `json:"namespace"`
+	Tags      []string `json:"tags"`
+	ID        uint64   `json:"id"`
+	UUID      string   `json:"uuid,omitempty"`
+	Client    string   `json:"client"`
+	Local     string   `json:"local"`
+	Remote    string   `json:"remote"`
+	// Suppressed - How many alerts of the rule the AlertLimit held back
+	// since the last one
+	Suppressed uint64 `json:"suppressed,omitempty"`
+}
+
+// Notifier - Alerts someone about matches of rules tagged log or warn, e.g.
+// in headless setups where nobody watches the log
+type Notifier interface {
+	Notify(Alert) error
+}
+
+// BellNotifier - Rings the terminal bell
+type BellNotifier struct {
+	// W - Where the bell is written, defaults to stderr
+	W io.Writer
+}
+
+func (n BellNotifier) Notify(Alert) error {
+	w := n.W
+	if w == nil {
+		w = os.Stderr
+	}
+	_, err := io.WriteString(w, "\a")
+	return err
+}
+
+// ExecNotifier - Runs a command for every alert, e.g. a script calling
+// notify-send for a desktop notification. The command gets the rule, the
+// connection id and the client and remote addresses appended as arguments,
+// and the whole Alert as JSON on stdin.
+type ExecNotifier struct {
+	Command []string
+	// Timeout - How long the command may run, defaults to 5 seconds
+	Timeout time.Duration
+}
+
+func (n ExecNotifier) Notify(a Alert) error {
+	if len(n.Command) == 0 {
+		return fmt.Errorf("no notify command")
+	}
+	stdin, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutOr(n.Timeout))
+	defer cancel()
+	args := append(append([]string(nil), n.Command[1:]...), a.Rule, strconv.FormatUint(a.ID, 10), a.Client, a.Remote)
+	cmd := exec.CommandContext(ctx, n.Command[0], args...)
+	cmd.Stdin = bytes.NewReader(append(stdin, '\n'))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if output := strings.TrimSpace(string(out)); output != "" {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	}
+	return nil
+}
+
+// WebhookNotifier - POSTs every alert as JSON to a URL
+type WebhookNotifier struct {
+	URL string
+	// Timeout - How long the request may take, defaults to 5 seconds
+	Timeout time.Duration
+}
+
+func (n WebhookNotifier) Notify(a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: timeoutOr(n.Timeout)}
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func timeoutOr(d time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultNotifyTimeout
+	}
+	return d
+}
+
+// ParseNotifier - Build a Notifier from its command line form: bell,
+// exec:<command> or webhook:<url>
+func ParseNotifier(s string) (Notifier, error) {
+	kind, arg := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		kind, arg = s[:i], s[i+1:]
+	}
+	switch kind {
+	case "bell":
+		if arg == "" {
+			return BellNotifier{}, nil
+		}
+	case "exec":
+		if cmd := strings.Fields(arg); len(cmd) > 0 {
+			return ExecNotifier{Command: cmd}, nil
+		}
+	case "webhook":
+		if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
+			return WebhookNotifier{URL: arg}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid notifier %q, expected bell, exec:<command> or webhook:<url>", s)
+}
+
+// notify - Tell the Notifier about a match in the background, so a slow
+// command or webhook doesn't hold up the connection
+func (p *Proxy) notify(m RuleMatch, suppressed uint64) {
+	if p.Notifier == nil {
+		return
+	}
+	a := Alert{
+		Rule:       m.Rule,
+		Namespace:  m.Namespace,
+		Tags:       m.Tags,
+		ID:         p.ID,
+		UUID:       p.UUID,
+		Client:     p.clientAddr(),
+		Local:      p.laddr.String(),
+		Remote:     p.remoteString(),
+		Suppressed: suppressed,
+	}
+	go func() {
+		if err := p.Notifier.Notify(a); err != nil {
+			p.Log.Warn("notifying about rule %s failed: %v", a.Rule, err)
+		}
+	}()
+}
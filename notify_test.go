@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testAlert = Alert{Rule: "Needle", Tags: []string{"warn"}, ID: 9, Client: "127.0.0.1:5000", Remote: "127.0.0.1:80"}
+
+// recordingNotifier - Passes every alert on to a channel
+type recordingNotifier chan Alert
+
+func (n recordingNotifier) Notify(a Alert) error {
+	n <- a
+	return nil
+}
+
+func TestParseNotifier(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want Notifier
+	}{
+		{"bell", BellNotifier{}},
+		{"exec:notify-send tcp-proxy", ExecNotifier{Command: []string{"notify-send", "tcp-proxy"}}},
+		{"webhook:https://hooks.example/alert", WebhookNotifier{URL: "https://hooks.example/alert"}},
+	} {
+		got, err := ParseNotifier(tc.spec)
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", tc.spec, err)
+			continue
+		}
+		if gotJSON, wantJSON := mustJSON(t, got), mustJSON(t, tc.want); gotJSON != wantJSON {
+			t.Errorf("%q: expected %s, got %s", tc.spec, wantJSON, gotJSON)
+		}
+	}
+	for _, spec := range []string{"", "beep", "exec:", "webhook:hooks.example"} {
+		if _, err := ParseNotifier(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestBellNotifier(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (BellNotifier{W: &buf}).Notify(testAlert); err != nil || buf.String() != "\a" {
+		t.Errorf("expected a bell, got %q %v", buf.String(), err)
+	}
+}
+
+func TestExecNotifier(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	out := filepath.Join(t.TempDir(), "alert")
+	n := ExecNotifier{Command: []string{"sh", "-c", `printf '%s\n' "$@" > "$0"; cat >> "$0"`, out}}
+	if err := n.Notify(testAlert); err != nil {
+		t.Fatalf("notify failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 5 || strings.Join(lines[:4], " ") != "Needle 9 127.0.0.1:5000 127.0.0.1:80" {
+		t.Fatalf("expected rule, id, client and remote then json, got %q", lines)
+	}
+	var a Alert
+	if err := json.Unmarshal([]byte(lines[4]), &a); err != nil || a.Rule != "Needle" {
+		t.Errorf("bad alert on stdin %q: %v", lines[4], err)
+	}
+
+	if err := (ExecNotifier{Command: []string{"sh", "-c", "echo oops; exit 1"}}).Notify(testAlert); err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("expected the failing command's output in the error, got %v", err)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	alerts := make(chan Alert, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a Alert
+		if r.Method != http.MethodPost || r.URL.Path != "/" || json.NewDecoder(r.Body).Decode(&a) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		alerts <- a
+	}))
+	defer srv.Close()
+
+	if err := (WebhookNotifier{URL: srv.URL}).Notify(testAlert); err != nil {
+		t.Fatalf("notify failed: %v", err)
+	}
+	if a := <-alerts; a.Rule != "Needle" || a.ID != 9 || a.Client != "127.0.0.1:5000" {
+		t.Errorf("unexpected alert %+v", a)
+	}
+	if err := (WebhookNotifier{URL: srv.URL + "/missing"}).Notify(Alert{}); err == nil {
+		t.Errorf("expected an error for a rejected alert")
+	}
+}
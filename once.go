@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+// OnceReplacer - Applies Replacer to the first match on each connection and
+// passes everything after it through untouched, for rewriting e.g. only
+// the first request line. When the Replacer can, only the first match in
+// that chunk is replaced. A Proxy remembers for each connection whether it
+// fired, so connections sharing the replacer are independent; called on
+// its own, outside a Proxy, every call replaces the first match.
+type OnceReplacer struct {
+	Replacer
+}
+
+// firstReplacer - Implemented by replacers that can replace only their
+// first match in a chunk
+type firstReplacer interface {
+	ReplaceFirst(in []byte) []byte
+}
+
+// Replace - replace the first match of the wrapped replacer
+func (r *OnceReplacer) Replace(in []byte) []byte {
+	if fr, ok := r.Replacer.(firstReplacer); ok {
+		return fr.ReplaceFirst(in)
+	}
+	return r.Replacer.Replace(in)
+}
+
+// PreservesLength - whatever the wrapped replacer says
+func (r *OnceReplacer) PreservesLength() bool {
+	return !ChangesLength(r.Replacer)
+}
+
+func (r *OnceReplacer) String() string {
+	return fmt.Sprintf("once %s", r.Replacer)
+}
+
+// replaceOnce - Run r unless it already changed a chunk
+func (s *replacerState) replaceOnce(r *OnceReplacer, b []byte, direction Direction) []byte {
+	s.onceLock.Lock()
+	defer s.onceLock.Unlock()
+	if s.onceFired[r] {
+		return b
+	}
+	before := append([]byte(nil), b...)
+	var out []byte
+	if enc, ok := r.Replacer.(*EncodedReplacer); ok {
+		out = s.replaceEncoded(enc, b, direction, true)
+	} else {
+		out = r.Replace(b)
+	}
+	if out == nil || !bytes.Equal(before, out) {
+		if s.onceFired == nil {
+			s.onceFired = make(map[*OnceReplacer]bool)
+		}
+		s.onceFired[r] = true
+	}
+	return out
+}
+
+// ReplaceFirst - replace the first occurrence of In with Out
+func (r *StringReplacer) ReplaceFirst(in []byte) []byte {
+	return notDropped(bytes.Replace(in, []byte(r.In), []byte(r.Out), 1), in)
+}
+
+// ReplaceFirst - replace the first occurrence of In with Out
+func (r *BytesReplacer) ReplaceFirst(in []byte) []byte {
+	return notDropped(bytes.Replace(in, r.In, r.Out, 1), in)
+}
+
+// ReplaceFirst - replace the first match of In with Out
+func (r *RegexReplacer) ReplaceFirst(in []byte) []byte {
+	return replaceFirstMatch(in, r.In, r.Out)
+}
+
+// ReplaceFirst - remove the first occurrence of In, or match of Regex
+func (r *StripReplacer) ReplaceFirst(in []byte) []byte {
+	if r.Regex != nil {
+		return replaceFirstMatch(in, r.Regex, nil)
+	}
+	return notDropped(bytes.Replace(in, r.In, nil, 1), in)
+}
+
+// replaceFirstMatch - Like re.ReplaceAll(in, template) for only the first
+// match
+func replaceFirstMatch(in []byte, re *regexp.Regexp, template []byte) []byte {
+	match := re.FindSubmatchIndex(in)
+	if match == nil {
+		return in
+	}
+	out := make([]byte, 0, len(in))
+	out = append(out, in[:match[0]]...)
+	out = re.Expand(out, template, in, match)
+	return append(out, in[match[1]:]...)
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOnceReplacer(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	var set Proxy
+	set.Log = NullLogger{}
+	config := `
+- type: substring
+  find: "token"
+  replace: "TOKEN"
+  once: true
+`
+	if err := set.LoadConfig([]byte(config)); err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	if _, ok := set.Replacers[0].(*OnceReplacer); !ok {
+		t.Fatalf("expected a once replacer, got %s", set.Replacers[0])
+	}
+
+	// connections share the replacer but each gets its own first match
+	for i := 0; i < 2; i++ {
+		client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+			p.SetReplacers(set.Replacers)
+		})
+		if got := echoRoundTrip(t, client, "no match"); got != "no match" {
+			t.Errorf("wanted the chunk unchanged, got %q", got)
+		}
+		if got := echoRoundTrip(t, client, "token token"); got != "TOKEN token" {
+			t.Errorf("wanted only the first match replaced, got %q", got)
+		}
+		if got := echoRoundTrip(t, client, "token"); got != "token" {
+			t.Errorf("the replacer should have fired already, got %q", got)
+		}
+		client.Close()
+		<-done
+	}
+}
+
+func TestReplaceFirst(t *testing.T) {
+	var p Proxy
+	p.Log = NullLogger{}
+	config := `
+- type: regex
+  find: "id=([0-9]+)"
+  replace: "id=<$1>"
+  once: true
+- type: bytes
+  find: [0x01]
+  replace: [0x02]
+  once: true
+- type: strip
+  find: "x"
+  once: true
+`
+	if err := p.LoadConfig([]byte(config)); err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	cases := []struct {
+		in, want string
+	}{
+		{"id=1 id=2", "id=<1> id=2"},
+		{"\x01\x01", "\x02\x01"},
+		{"axbx", "abx"},
+	}
+	for i, c := range cases {
+		if got := p.Replacers[i].Replace([]byte(c.in)); string(got) != c.want {
+			t.Errorf("%s: wanted %q, got %q", p.Replacers[i], c.want, got)
+		}
+	}
+}
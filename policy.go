@@ -0,0 +1,336 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Verdict - Whether a policy admits a connection
+type Verdict string
+
+// Verdicts a Policy can give
+const (
+	Allow Verdict = "allow"
+	Deny  Verdict = "deny"
+)
+
+// ConnAttributes - What is known about a connection when it is admitted.
+// Attributes that weren't extracted are left empty, and conditions on them
+// don't match.
+type ConnAttributes struct {
+	ClientAddr net.Addr
+	// JA3, SNI - from the client's ClientHello, which the proxy only reads
+	// when a rule tests them. The JA3 of a client whose TLS is terminated
+	// locally isn't known.
+	JA3 string
+	SNI string
+	// Time - when the connection arrived, defaults to now
+	Time time.Time
+}
+
+// PolicyCondition - A set of tests on connection attributes. Every test given
+// must pass for the condition to match; all, any and not nest further
+// conditions.
+type PolicyCondition struct {
+	// CIDR - client address is in one of these networks
+	CIDR []string `yaml:"cidr"`
+	// JA3 - client TLS fingerprint is one of these
+	JA3 []string `yaml:"ja3"`
+	// SNI - server name matches one of these patterns, e.g. *.example.com
+	SNI []string `yaml:"sni"`
+	// Time - local time of day is within this range, e.g. 09:00-17:00. The
+	// range may wrap past midnight.
+	Time string `yaml:"time"`
+
+	All []PolicyCondition `yaml:"all"`
+	Any []PolicyCondition `yaml:"any"`
+	Not *PolicyCondition  `yaml:"not"`
+
+	nets       []*net.IPNet
+	start, end time.Duration
+}
+
+// PolicyRule - A condition and the verdict it gives on a match
+type PolicyRule struct {
+	Verdict Verdict `yaml:"verdict"`
+	// Tags - set on the connections the rule decides, see Proxy.Tags
+	Tags            map[string]string `yaml:"tags"`
+	PolicyCondition `yaml:",inline"`
+}
+
+// Policy - Connection admission rules, evaluated in order. The first rule
+// whose condition matches decides, connections no rule matches get Default.
+type Policy struct {
+	Default Verdict      `yaml:"default"`
+	Rules   []PolicyRule `yaml:"rules"`
+}
+
+// ParsePolicy - Parse and validate a yaml policy
+func ParsePolicy(data []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	if p.Default == "" {
+		p.Default = Allow
+	}
+	if err := checkVerdict(p.Default); err != nil {
+		return nil, fmt.Errorf("default: %w", err)
+	}
+	for i := range p.Rules {
+		if err := checkVerdict(p.Rules[i].Verdict); err != nil {
+			return nil, fmt.Errorf("policy rule %d: %w", i, err)
+		}
+		if err := p.Rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("policy rule %d: %w", i, err)
+		}
+	}
+	return &p, nil
+}
+
+// ReadPolicyFile - Read and parse a yaml policy file
+func ReadPolicyFile(filePath string) (*Policy, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+	return ParsePolicy(data)
+}
+
+func checkVerdict(v Verdict) error {
+	if v != Allow && v != Deny {
+		return fmt.Errorf("verdict must be allow or deny, got %q", v)
+	}
+	return nil
+}
+
+// Evaluate - The verdict for a connection with the given attributes
+func (p *Policy) Evaluate(attrs ConnAttributes) Verdict {
+	verdict, _ := p.decide(attrs)
+	return verdict
+}
+
+// UsesJA3 - Whether any rule has a ja3 condition
+func (p *Policy) UsesJA3() bool {
+	return p.uses(func(c *PolicyCondition) bool { return len(c.JA3) > 0 })
+}
+
+// UsesSNI - Whether any rule has an sni condition
+func (p *Policy) UsesSNI() bool {
+	return p.uses(func(c *PolicyCondition) bool { return len(c.SNI) > 0 })
+}
+
+func (p *Policy) uses(test func(*PolicyCondition) bool) bool {
+	for i := range p.Rules {
+		if p.Rules[i].uses(test) {
+			return true
+		}
+	}
+	return false
+}
+
+// uses - Whether test holds for the condition or any nested in it
+func (c *PolicyCondition) uses(test func(*PolicyCondition) bool) bool {
+	if test(c) {
+		return true
+	}
+	for _, group := range [][]PolicyCondition{c.All, c.Any} {
+		for i := range group {
+			if group[i].uses(test) {
+				return true
+			}
+		}
+	}
+	return c.Not != nil && c.Not.uses(test)
+}
+
+// decide - The verdict for a connection and the rule that gave it, nil
+// for the default
+func (p *Policy) decide(attrs ConnAttributes) (Verdict, *PolicyRule) {
+	if attrs.Time.IsZero() {
+		attrs.Time = time.Now()
+	}
+	for i := range p.Rules {
+		if p.Rules[i].Matches(attrs) {
+			return p.Rules[i].Verdict, &p.Rules[i]
+		}
+	}
+	return p.Default, nil
+}
+
+func (c *PolicyCondition) compile() error {
+	for _, s := range c.CIDR {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid cidr %q: %w", s, err)
+		}
+		c.nets = append(c.nets, n)
+	}
+	for _, s := range c.SNI {
+		if _, err := path.Match(s, ""); err != nil {
+			return fmt.Errorf("invalid sni pattern %q: %w", s, err)
+		}
+	}
+	if c.Time != "" {
+		var err error
+		if c.start, c.end, err = parseTimeRange(c.Time); err != nil {
+			return err
+		}
+	}
+	for _, group := range [][]PolicyCondition{c.All, c.Any} {
+		for i := range group {
+			if err := group[i].compile(); err != nil {
+				return err
+			}
+		}
+	}
+	if c.Not != nil {
+		return c.Not.compile()
+	}
+	return nil
+}
+
+// Matches - Whether every test in the condition passes for attrs
+func (c *PolicyCondition) Matches(attrs ConnAttributes) bool {
+	if len(c.nets) > 0 && !c.matchCIDR(attrs.ClientAddr) {
+		return false
+	}
+	if len(c.JA3) > 0 && !containsFold(c.JA3, attrs.JA3) {
+		return false
+	}
+	if len(c.SNI) > 0 && !matchSNI(c.SNI, attrs.SNI) {
+		return false
+	}
+	if c.Time != "" && !c.matchTime(attrs.Time) {
+		return false
+	}
+	for i := range c.All {
+		if !c.All[i].Matches(attrs) {
+			return false
+		}
+	}
+	if len(c.Any) > 0 {
+		any := false
+		for i := range c.Any {
+			if c.Any[i].Matches(attrs) {
+				any = true
+				break
+			}
+		}
+		if !any {
+			return false
+		}
+	}
+	if c.Not != nil && c.Not.Matches(attrs) {
+		return false
+	}
+	return true
+}
+
+func (c *PolicyCondition) matchCIDR(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *PolicyCondition) matchTime(t time.Time) bool {
+	h, m, s := t.Clock()
+	now := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	if c.start <= c.end {
+		return now >= c.start && now < c.end
+	}
+	// wraps past midnight
+	return now >= c.start || now < c.end
+}
+
+func containsFold(list []string, s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSNI(patterns []string, sni string) bool {
+	if sni == "" {
+		return false
+	}
+	sni = strings.ToLower(sni)
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), sni); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// admit - Evaluate the Policy for this connection, false if it is denied
+func (p *Proxy) admit() bool {
+	if p.Policy == nil {
+		return true
+	}
+	var attrs ConnAttributes
+	if c, ok := p.lconn.(net.Conn); ok {
+		attrs.ClientAddr = c.RemoteAddr()
+	}
+	if p.Policy.UsesJA3() || p.Policy.UsesSNI() {
+		if err := p.tlsAttributes(&attrs); err != nil {
+			p.Log.Warn("Checking the policy failed: %s", err)
+			p.closeWith(err, "%v", err)
+			return false
+		}
+	}
+	verdict, rule := p.Policy.decide(attrs)
+	if rule != nil {
+		for k, v := range rule.Tags {
+			p.SetTag(k, v)
+		}
+	}
+	if verdict == Deny {
+		p.Log.Info("Connection from %s denied by policy", p.clientAddr())
+		return false
+	}
+	return true
+}
+
+// parseTimeRange - Parse a HH:MM-HH:MM range into offsets from midnight
+func parseTimeRange(s string) (time.Duration, time.Duration, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", s)
+	}
+	var bounds [2]time.Duration
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", s)
+		}
+		bounds[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return bounds[0], bounds[1], nil
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var testPolicy = `
+default: deny
+rules:
+  - verdict: deny
+    cidr: [10.0.0.13/32]
+  - verdict: allow
+    cidr: [10.0.0.0/8]
+    not:
+      time: "09:00-17:00"
+  - verdict: allow
+    any:
+      - sni: ["*.example.com"]
+      - ja3: ["E7D705A3286E19EA42F587B344EE6865"]
+`
+
+func atHour(hour int) time.Time {
+	return time.Date(2024, 1, 1, hour, 0, 0, 0, time.Local)
+}
+
+func clientAt(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		attrs ConnAttributes
+		want  Verdict
+	}{
+		{"earlier deny wins", ConnAttributes{ClientAddr: clientAt("10.0.0.13"), Time: atHour(20)}, Deny},
+		{"cidr outside business hours", ConnAttributes{ClientAddr: clientAt("10.1.2.3"), Time: atHour(20)}, Allow},
+		{"cidr during business hours", ConnAttributes{ClientAddr: clientAt("10.1.2.3"), Time: atHour(10)}, Deny},
+		{"sni", ConnAttributes{ClientAddr: clientAt("192.0.2.1"), SNI: "api.EXAMPLE.com", Time: atHour(10)}, Allow},
+		{"ja3", ConnAttributes{ClientAddr: clientAt("192.0.2.1"), JA3: "e7d705a3286e19ea42f587b344ee6865", Time: atHour(10)}, Allow},
+		{"default", ConnAttributes{ClientAddr: clientAt("192.0.2.1"), SNI: "other.org", Time: atHour(10)}, Deny},
+		{"missing attributes don't match", ConnAttributes{Time: atHour(20)}, Deny},
+	}
+	for _, tt := range tests {
+		if got := p.Evaluate(tt.attrs); got != tt.want {
+			t.Errorf("%s: wanted %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestPolicyTimeWraps(t *testing.T) {
+	p, err := ParsePolicy([]byte("rules:\n  - verdict: deny\n    time: \"22:00-06:00\"\n"))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+	for hour, want := range map[int]Verdict{23: Deny, 3: Deny, 12: Allow} {
+		if got := p.Evaluate(ConnAttributes{Time: atHour(hour)}); got != want {
+			t.Errorf("%02d:00: wanted %s, got %s", hour, want, got)
+		}
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, bad := range []string{
+		"default: maybe\n",
+		"rules:\n  - verdict: allow\n    cidr: [nonsense]\n",
+		"rules:\n  - verdict: allow\n    time: \"9am-5pm\"\n",
+		"rules:\n  - verdict: allow\n    any:\n      - sni: [\"[\"]\n",
+		"rules:\n  - cidr: [10.0.0.0/8]\n",
+	} {
+		if _, err := ParsePolicy([]byte(bad)); err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestPolicyDeniesConnection(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	p, err := ParsePolicy([]byte("default: deny\n"))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(proxy *Proxy) {
+		proxy.Policy = p
+	})
+	defer client.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("denied connection was not closed")
+	}
+}
+
+// captureClientHello - The record holding the ClientHello a client with cfg
+// sends
+func captureClientHello(t *testing.T, cfg *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, cfg).Handshake()
+	defer client.Close()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("failed to read the record header: %v", err)
+	}
+	record := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(server, record); err != nil {
+		t.Fatalf("failed to read the ClientHello: %v", err)
+	}
+	return append(header, record...)
+}
+
+func TestPolicyTLSConditions(t *testing.T) {
+	echo, _ := startTLSEcho(t)
+	defer echo.Close()
+	clientConfig := func(name string) *tls.Config {
+		return &tls.Config{ServerName: name, InsecureSkipVerify: true}
+	}
+	ja3 := PeekJA3(captureClientHello(t, clientConfig("blocked.example.com")))
+	if ja3 == "" {
+		t.Fatal("wanted a JA3 for a complete ClientHello")
+	}
+	// a TLS 1.2 client offers other extensions, so its fingerprint differs
+	tls12 := clientConfig("allowed.example.com")
+	tls12.MaxVersion = tls.VersionTLS12
+
+	for _, tc := range []struct {
+		name    string
+		policy  string
+		config  *tls.Config
+		allowed bool
+	}{
+		{"sni denied", "rules:\n  - verdict: deny\n    sni: [blocked.*]\n", clientConfig("blocked.example.com"), false},
+		{"sni allowed", "rules:\n  - verdict: deny\n    sni: [blocked.*]\n", clientConfig("allowed.example.com"), true},
+		{"ja3 denied", fmt.Sprintf("rules:\n  - verdict: deny\n    ja3: [%s]\n", ja3), clientConfig("allowed.example.com"), false},
+		{"ja3 allowed", fmt.Sprintf("rules:\n  - verdict: deny\n    ja3: [%s]\n", ja3), tls12, true},
+	} {
+		policy, err := ParsePolicy([]byte(tc.policy))
+		if err != nil {
+			t.Fatalf("%s: failed to parse policy: %v", tc.name, err)
+		}
+		client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+			p.Policy = policy
+		})
+		conn := tls.Client(client, tc.config)
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		err = conn.Handshake()
+		if tc.allowed && err != nil {
+			t.Errorf("%s: wanted the connection admitted, handshake failed: %v", tc.name, err)
+		}
+		if !tc.allowed && err == nil {
+			t.Errorf("%s: wanted the connection denied", tc.name)
+		}
+		conn.Close()
+		<-done
+	}
+}
+
+func TestPolicyUses(t *testing.T) {
+	p, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+	if !p.UsesJA3() || !p.UsesSNI() {
+		t.Errorf("wanted the nested ja3 and sni conditions found")
+	}
+	if p, _ := ParsePolicy([]byte("rules:\n  - verdict: deny\n    cidr: [10.0.0.0/8]\n")); p.UsesJA3() || p.UsesSNI() {
+		t.Errorf("wanted no TLS conditions found")
+	}
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PortMap - The remote for each local port, for a proxy listening on
+// several ports that sends every port's connections to a backend of its own
+type PortMap map[int]string
+
+// ParsePortMap - Parse and validate a yaml mapping of local ports to
+// host:port remotes, e.g.
+//
+//	8080: backend-a:80
+//	8443: backend-b:443
+func ParsePortMap(data []byte) (PortMap, error) {
+	var m PortMap
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse port map: %w", err)
+	}
+	if len(m) == 0 {
+		return nil, fmt.Errorf("port map lists no ports")
+	}
+	for port, remote := range m {
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("port map: invalid local port %d", port)
+		}
+		if err := checkRemoteAddr(remote); err != nil {
+			return nil, fmt.Errorf("port map: local port %d: %w", port, err)
+		}
+	}
+	return m, nil
+}
+
+// ReadPortMapFile - Read and parse a yaml port map file
+func ReadPortMapFile(filePath string) (PortMap, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read port map: %w", err)
+	}
+	return ParsePortMap(data)
+}
+
+// Ports - The mapped local ports in ascending order
+func (m PortMap) Ports() []int {
+	ports := make([]int, 0, len(m))
+	for port := range m {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// Remotes - The remotes of the ports, in the order of Ports
+func (m PortMap) Remotes() []string {
+	var remotes []string
+	for _, port := range m.Ports() {
+		remotes = append(remotes, m[port])
+	}
+	return remotes
+}
+
+// Check - Make sure every one of the ports has a remote
+func (m PortMap) Check(ports ...int) error {
+	for _, port := range ports {
+		if _, ok := m[port]; !ok {
+			return fmt.Errorf("no remote mapped for local port %d", port)
+		}
+	}
+	return nil
+}
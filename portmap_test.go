@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePortMap(t *testing.T) {
+	m, err := ParsePortMap([]byte("8443: backend-b:443\n8080: backend-a:80\n"))
+	if err != nil {
+		t.Fatalf("failed to parse port map: %v", err)
+	}
+	if want := (PortMap{8080: "backend-a:80", 8443: "backend-b:443"}); !reflect.DeepEqual(m, want) {
+		t.Errorf("wanted %v, got %v", want, m)
+	}
+	if ports := m.Ports(); !reflect.DeepEqual(ports, []int{8080, 8443}) {
+		t.Errorf("wanted the ports sorted, got %v", ports)
+	}
+	if remotes := m.Remotes(); !reflect.DeepEqual(remotes, []string{"backend-a:80", "backend-b:443"}) {
+		t.Errorf("wanted the remotes in port order, got %v", remotes)
+	}
+	if err := m.Check(8080, 8443); err != nil {
+		t.Errorf("wanted both ports mapped, got %v", err)
+	}
+	if err := m.Check(8080, 9000); err == nil || !strings.Contains(err.Error(), "9000") {
+		t.Errorf("wanted an error naming the unmapped port, got %v", err)
+	}
+}
+
+func TestParsePortMapErrors(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want string
+	}{
+		{"", "no ports"},
+		{"http: backend:80\n", "failed to parse"},
+		{"0: backend:80\n", "invalid local port 0"},
+		{"70000: backend:80\n", "invalid local port 70000"},
+		{"8080: backend\n", "local port 8080"},
+		{"8080: backend:http\n", "invalid port"},
+	} {
+		if _, err := ParsePortMap([]byte(tc.data)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: wanted an error containing %q, got %v", tc.data, tc.want, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// PrefixedReplacer - Replaces a length-prefixed string field, such as a
+// Pascal string, whose value is In, with Out under a prefix recomputed for
+// Out's length. Like the other replacers it only sees one chunk at a time,
+// so a field split across reads isn't replaced.
+type PrefixedReplacer struct {
+	// Size - bytes in the length prefix: 1, 2 or 4
+	Size int
+	// Order - how the prefix is encoded, binary.BigEndian by default
+	Order binary.ByteOrder
+	In    []byte
+	Out   []byte
+}
+
+func (r *PrefixedReplacer) order() binary.ByteOrder {
+	if r.Order == nil {
+		return binary.BigEndian
+	}
+	return r.Order
+}
+
+// field - value with its length prefix
+func (r *PrefixedReplacer) field(value []byte) []byte {
+	b := make([]byte, r.Size, r.Size+len(value))
+	switch r.Size {
+	case 1:
+		b[0] = byte(len(value))
+	case 2:
+		r.order().PutUint16(b, uint16(len(value)))
+	case 4:
+		r.order().PutUint32(b, uint32(len(value)))
+	}
+	return append(b, value...)
+}
+
+// Replace - replace every In field with an Out field
+func (r *PrefixedReplacer) Replace(in []byte) []byte {
+	return notDropped(bytes.ReplaceAll(in, r.field(r.In), r.field(r.Out)), in)
+}
+
+// PreservesLength - true when In and Out are the same length
+func (r *PrefixedReplacer) PreservesLength() bool {
+	return len(r.In) == len(r.Out)
+}
+
+func (r *PrefixedReplacer) String() string {
+	order := "big endian"
+	if r.order() == binary.LittleEndian {
+		order = "little endian"
+	}
+	return fmt.Sprintf("prefixed (%d byte %s): %q -> %q", r.Size, order, r.In, r.Out)
+}
+
+// parsePrefixed - Build a prefixed replacer; find and replace are strings
+// or lists of bytes
+func (rc *ReplacerConfig) parsePrefixed() (Replacer, error) {
+	r := &PrefixedReplacer{Size: rc.PrefixSize}
+	switch r.Size {
+	case 1, 2, 4:
+	default:
+		return nil, fmt.Errorf("prefixed replacer prefix_size must be 1, 2 or 4, got %d", rc.PrefixSize)
+	}
+	switch rc.ByteOrder {
+	case "", "big":
+		r.Order = binary.BigEndian
+	case "little":
+		r.Order = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("unknown byte_order %q, expected big or little", rc.ByteOrder)
+	}
+
+	var err error
+	if r.In, err = parseStringOrBytes(rc.Find); err != nil {
+		return nil, fmt.Errorf("invalid find value: %w", err)
+	}
+	if len(r.In) == 0 {
+		return nil, fmt.Errorf("prefixed find value must not be empty")
+	}
+	if rc.Replace != nil {
+		if r.Out, err = parseStringOrBytes(rc.Replace); err != nil {
+			return nil, fmt.Errorf("invalid replace value: %w", err)
+		}
+	}
+	max := uint64(1)<<(8*uint(r.Size)) - 1
+	for _, v := range [][]byte{r.In, r.Out} {
+		if uint64(len(v)) > max {
+			return nil, fmt.Errorf("prefixed value of %d bytes doesn't fit a %d byte prefix", len(v), r.Size)
+		}
+	}
+	return r, nil
+}
+
+// parseStringOrBytes - A string's bytes, or a list of bytes
+func parseStringOrBytes(v interface{}) ([]byte, error) {
+	if s, ok := v.(string); ok {
+		return []byte(s), nil
+	}
+	return parseByteSlice(v)
+}
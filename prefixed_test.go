@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestPrefixedReplacer(t *testing.T) {
+	cases := []struct {
+		name string
+		r    *PrefixedReplacer
+		in   string
+		want string
+	}{
+		{"1 byte", &PrefixedReplacer{Size: 1, In: []byte("guest"), Out: []byte("administrator")},
+			"\x01\x05guest\x05guest", "\x01\x0dadministrator\x0dadministrator"},
+		{"2 byte big endian", &PrefixedReplacer{Size: 2, In: []byte("guest"), Out: []byte("root")},
+			"id\x00\x05guest!", "id\x00\x04root!"},
+		{"4 byte little endian", &PrefixedReplacer{Size: 4, Order: binary.LittleEndian, In: []byte("guest"), Out: []byte("nobody")},
+			"\x05\x00\x00\x00guest", "\x06\x00\x00\x00nobody"},
+		// the value alone, or under the wrong prefix, isn't a field
+		{"unprefixed", &PrefixedReplacer{Size: 1, In: []byte("guest"), Out: []byte("root")},
+			"guest \x04guest", "guest \x04guest"},
+		{"removed", &PrefixedReplacer{Size: 2, In: []byte("guest")},
+			"\x00\x05guest", "\x00\x00"},
+	}
+	for _, c := range cases {
+		if got := c.r.Replace([]byte(c.in)); string(got) != c.want {
+			t.Errorf("%s: wanted %q, got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestPrefixedReplacerConfig(t *testing.T) {
+	var p Proxy
+	p.Log = NullLogger{}
+	config := `
+- type: prefixed
+  prefix_size: 2
+  byte_order: little
+  find: "guest"
+  replace: [0x72, 0x6f, 0x6f, 0x74]
+`
+	if err := p.LoadConfig([]byte(config)); err != nil {
+		t.Fatalf("failed to parse prefixed config: %v", err)
+	}
+	if got := p.Replacers[0].Replace([]byte("\x05\x00guest")); string(got) != "\x04\x00root" {
+		t.Errorf("unexpected replacement %q", got)
+	}
+	if !ChangesLength(p.Replacers[0]) {
+		t.Error("a shorter replacement changes the length")
+	}
+
+	for _, invalid := range []string{
+		"- type: prefixed\n  find: guest\n",
+		"- type: prefixed\n  prefix_size: 3\n  find: guest\n",
+		"- type: prefixed\n  prefix_size: 2\n  byte_order: middle\n  find: guest\n",
+		"- type: prefixed\n  prefix_size: 2\n  find: \"\"\n",
+		"- type: prefixed\n  prefix_size: 1\n  find: guest\n  replace: " + strings.Repeat("x", 256) + "\n",
+	} {
+		if err := p.LoadConfig([]byte(invalid)); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
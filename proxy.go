@@ -1,40 +1,368 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
-	"os"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
-	yara "github.com/hillu/go-yara/v4"
 )
 
 // Proxy - Manages a Proxy connection, piping data between local and remote.
 type Proxy struct {
 	sentBytes     uint64
 	receivedBytes uint64
-	laddr, raddr  *net.TCPAddr
-	lconn, rconn  io.ReadWriteCloser
-	erred         bool
-	errsig        chan bool
-	tlsUnwrapp    bool
-	tlsAddress    string
+	// nanoseconds spent in yara scans and in substitutions and replacers
+	scanNanos    int64
+	replaceNanos int64
+	// eofs - pipes that have reached EOF, for LingerAfterEOF
+	eofs int32
+	// remoteSent - set once anything was read from the remote
+	remoteSent int32
+	// lastActive - when data was last read from either side, in Unix
+	// nanoseconds, for IdleTimeout
+	lastActive int64
+	// dialFailed - set by a Listener to hear about failed remote connections
+	dialFailed func(error)
+	// wsRequested, wsUpgraded - set once the client asked for a WebSocket
+	// upgrade and the remote accepted it, for DecodeWebSocket
+	wsRequested int32
+	wsUpgraded  int32
+	// passthrough - this connection wasn't picked by SampleRate
+	passthrough  bool
+	iterators    []func(*Frame) error
+	laddr, raddr *net.TCPAddr
+	lconn, rconn io.ReadWriteCloser
+	// erred - set once the connection is shutting down, when errsig is
+	// closed
+	erred    int32
+	errsig   chan struct{}
+	stopOnce sync.Once
 
 	scannerLock sync.Mutex
-	Scanner     *yara.Scanner
+	rules       *YaraRules
+	Scanner     *YaraScanner
 	Watcher     *fsnotify.Watcher
 
 	replacements []matchLocation
+	// scanned - upstream bytes scanned so far, under scannerLock
+	scanned int64
+
+	replacerLock sync.RWMutex
+	// Replacers - applied to data flowing in both directions
+	Replacers []Replacer
+	// UpstreamReplacers - applied only to data sent to the remote
+	UpstreamReplacers []Replacer
+	// DownstreamReplacers - applied only to data sent back to the client
+	DownstreamReplacers []Replacer
+	// replacing - what the replacers carry from one chunk of this connection
+	// to the next
+	replacing replacerState
+
+	tapLock    sync.Mutex
+	taps       []chan Frame
+	tapsClosed bool
+	tapDrops   uint64
+
+	// combined - chunks queued for CombinedMatcher, closed once the
+	// connection ends and combinedDone once they were all delivered
+	combinedLock   sync.Mutex
+	combined       chan MatchContext
+	combinedClosed bool
+	combinedDone   chan struct{}
+
+	smallReads uint64
+
+	dumpLock    sync.Mutex
+	dumpOffsets [2]uint64
+	dumpFailed  bool
+
+	// hashes - the digests of each direction, see HashData
+	hashes [2]*dataHash
+	// holds - the MatchContext holds on each direction
+	holds [2]holds
+
+	peeked   []byte
+	peekDone bool
+
+	started     time.Time
+	ended       time.Time
+	reasonLock  sync.Mutex
+	closeReason string
+	closeErr    error
+
+	tagsLock sync.Mutex
+	// clientWriteLock - serializes writes to the client, which come from the
+	// downstream pipe and, for a blocked connection, the upstream one
+	clientWriteLock sync.Mutex
+
+	rconnAddr net.Addr
+	// remoteTLS - what the remote connection negotiated, if it is TLS
+	remoteTLS *tls.ConnectionState
 
 	// Settings
 	Nagles    bool
 	Log       Logger
 	OutputHex bool
+	// LoggerFactory - When set, picks the Log of each connection once it
+	// starts from the client address and up to PeekSize initial bytes, e.g.
+	// to keep each tenant's logs apart by client network or PeekServerName.
+	// Returning nil keeps Log.
+	LoggerFactory func(clientAddr net.Addr, peek []byte) Logger
+	// ID - Identifies the connection in logs and to matchers
+	ID uint64
+	// UUID - When set, identifies the connection across restarts and
+	// instances, unlike ID which is usually a counter; see NewConnUUID. It is
+	// passed along with ID in summaries, alerts, hook events and matchers.
+	UUID string
+	// Tags - Key/value pairs describing the connection, e.g. tenant=acme,
+	// shown in each of its log lines and passed along in its summary, match
+	// records and events. Set them before Start; once it runs, use SetTag,
+	// e.g. from a Router. Summaries often end up as metrics, so keep tag
+	// values to a small set, a label per client address or UUID would swamp
+	// a metrics store.
+	Tags map[string]string
+	// OnRuleMatch - Called for every yara rule matching upstream data, and
+	// every EntropyCheck that matched, from the goroutine reading the data
+	OnRuleMatch func(RuleMatch)
+	// MaxMatchStrings, MaxMatchData - Bound what a RuleMatch holds, so a
+	// rule matching thousands of times in one chunk doesn't flood the logs:
+	// at most MaxMatchStrings string matches are kept, the rest only
+	// counted, each with at most MaxMatchData bytes of data. They default
+	// to DefaultMaxMatchStrings and DefaultMaxMatchData.
+	MaxMatchStrings int
+	MaxMatchData    int
+	// MatchLog - When set, every rule match is written to it
+	MatchLog *MatchLog
+	// Events - When set, an event is sent to it when the connection opens
+	// and closes and for every rule match
+	Events *EventSocket
+	// Dump - When set, every chunk forwarded either way is written to it as
+	// an annotated hexdump, whatever the log level. Writes happen on the
+	// pipes' goroutines, so a slow writer slows the connection down.
+	Dump io.Writer
+	// Notifier - When set, alerted in the background about every match of a
+	// rule tagged log or warn
+	Notifier Notifier
+	// AlertLimit - When set, bounds how often each rule is logged and
+	// alerted about, see AlertLimiter
+	AlertLimit *AlertLimiter
+	// Matcher - When set, called with every chunk read from either side. To
+	// change the data as well, see Iterate.
+	Matcher func(MatchContext)
+	// LineMatcher - When set, called with every line read from either side,
+	// without its delimiter, however the data was split into chunks. A
+	// partial line is held until the rest of it arrives or the side closes.
+	// The line is only valid during the call.
+	LineMatcher func(line []byte, direction Direction)
+	// LineDelimiter - What ends a line for LineMatcher, defaults to "\n"
+	LineDelimiter []byte
+	// CombinedMatcher - When set, called with the chunks read from both
+	// sides in the order they were read, for patterns that span directions
+	// such as a client's answer to the remote's challenge. It runs on a
+	// goroutine of its own with a copy of each chunk, so it only holds the
+	// pipes up once it falls TapBuffer chunks behind; every chunk is
+	// delivered before Start returns.
+	CombinedMatcher func(MatchContext)
+	// TapBuffer - Frames each Tap channel buffers before dropping
+	TapBuffer int
+	// OnConnectExec - Command (and args) run once the remote is connected,
+	// before any data is piped
+	OnConnectExec []string
+	// OnCloseExec - Command (and args) run after the connection closes
+	OnCloseExec []string
+	// ExecTimeout - How long hook commands may run, defaults to 5 seconds
+	ExecTimeout time.Duration
+	// LogMSS - Log the TCP maximum segment size of both connections on start
+	LogMSS bool
+	// SmallReadThreshold - Reads returning fewer bytes than this are counted
+	// as fragmented in SmallReads
+	SmallReadThreshold int
+	// BlockAction - How a connection dropped by a rule is terminated
+	BlockAction BlockAction
+	// BlockResponse - Sent to the client before closing with BlockRespond
+	BlockResponse []byte
+	// Router - When set, picks the remote for each connection from the client
+	// address and up to PeekSize initial bytes, replacing the fixed remote
+	Router func(clientAddr net.Addr, peek []byte) (network, address string, err error)
+	// PeekSize - How many initial bytes the Router and LoggerFactory get to
+	// look at, from the client's first read. Anything more the client sent
+	// isn't looked at but forwarded as usual, so a huge preamble can't take
+	// up more memory; the Router decides what a cut off one means, e.g. a
+	// default remote or an error to drop the connection.
+	PeekSize int
+	// PeekTimeout - How long to wait for the client's first bytes, so
+	// clients that never speak up don't tie up a connection forever. When
+	// it elapses the connection is dropped, or with PeekFallback the Router
+	// and LoggerFactory get no bytes at all. Zero waits as long as it takes.
+	PeekTimeout time.Duration
+	// PeekFallback - Go on without the initial bytes after PeekTimeout
+	// instead of dropping the connection, e.g. for a default remote
+	PeekFallback bool
+	// SendProxy - Send a PROXY protocol header with the client's address
+	// ahead of the data to the remote and the shadow backend
+	SendProxy ProxyProtocol
+	// Network - tcp4 or tcp6 to dial the remote over that address family
+	// only. By default the family of the remote address is used.
+	Network string
+	// UnwrapTLS - Connect to the remote with TLS and relay the decrypted
+	// data to and from the client in the clear
+	UnwrapTLS bool
+	// ServerName - With UnwrapTLS, the name sent to the remote as SNI and
+	// verified against its certificate, for remotes reached by an address
+	// other than their name, e.g. behind a load balancer. Defaults to the
+	// host of the address dialed; a ServerName in TLSConfig takes precedence.
+	ServerName string
+	// TLSConfig - Used when dialing a TLS remote, nil verifies the remote's
+	// certificate with the system roots
+	TLSConfig *tls.Config
+	// TLSNextProtos - With UnwrapTLS, the application protocols offered to
+	// the remote with ALPN, e.g. h2 for backends that only speak HTTP/2.
+	// NextProtos in TLSConfig take precedence.
+	TLSNextProtos []string
+	// Mux - When set, the remote connection is a stream opened over Mux's
+	// persistent upstream instead of a connection of its own, and the
+	// remote address is up to the MuxServer at the far end
+	Mux *MuxClient
+	// DialQueue - When set, connections the remote refuses wait in it and
+	// redial instead of failing at once, see DialQueue
+	DialQueue *DialQueue
+	// DialTimeout - How long connecting to the remote may take, and then the
+	// TLS handshake with it, defaults to 10 seconds
+	DialTimeout time.Duration
+	// QUIC - With UnwrapTLS, connect to the remote over QUIC instead of TLS
+	// over TCP and relay each connection over a stream of its own QUIC
+	// connection. Needs a QUICDialer, see RegisterQUIC.
+	QUIC bool
+	// Policy - When set, connections it denies are closed before the remote
+	// is dialed
+	Policy *Policy
+	// BindDevice - Network device (or VRF) remote connections are bound to,
+	// linux only
+	BindDevice string
+	// FWMark - Routing mark set on remote connections for policy routing,
+	// linux only
+	FWMark int
+	// ShadowAddr - When set, a copy of everything sent upstream also goes to
+	// this backend. Its responses never reach the client, they are compared
+	// with the remote's once the connection ends.
+	ShadowAddr string
+	// ShadowTimeout - How long the shadow backend has to connect, take each
+	// write and finish responding, defaults to 5s
+	ShadowTimeout time.Duration
+	// CompareShadow - Called with the responses of the remote and the shadow
+	// backend when a shadowed connection ends, each capped at 1MB. Defaults to
+	// logging where they differ.
+	CompareShadow func(primary, shadow []byte)
+	// QuietConnections - Don't log the Opened and Closed lines, which get
+	// noisy with many connections; warnings are logged as usual
+	QuietConnections bool
+	// QuietEvents - The lifecycle events not to log, for finer control
+	// than QuietConnections
+	QuietEvents LifecycleEvents
+	// HashData - Keep SHA-256 digests of the data relayed each way, before
+	// and after transforms, for checking the proxy relays faithfully. They
+	// are logged when the connection closes and added to its Summary.
+	HashData bool
+	// LingerAfterEOF - When one side closes, keep relaying the other for up
+	// to this long so a response sent right at close still arrives. Zero
+	// tears the connection down on the first EOF.
+	LingerAfterEOF time.Duration
+	// MaxLifetime - When set, connections are closed once they have been
+	// open this long, however busy they are
+	MaxLifetime time.Duration
+	// IdleTimeout - When set, connections are closed once neither side has
+	// sent anything for this long
+	IdleTimeout time.Duration
+	// Clock - Source of the time for timeouts and timestamps, defaults to
+	// the wall clock
+	Clock Clock
+	// DecodeCompressed - Look for gzip and zlib streams in the data and run
+	// the inspection on their decompressed content, re-compressing it when a
+	// replacer changed it
+	DecodeCompressed bool
+	// MaxDecodeSize - Bounds both the compressed data buffered while waiting
+	// for a stream to complete and its decompressed size, defaults to 1MB.
+	// Larger streams are inspected as they are, still compressed.
+	MaxDecodeSize int
+	// DecodeWebSocket - After an HTTP upgrade to WebSocket, run the
+	// inspection on the unmasked payload of each text and binary frame and
+	// re-frame it before forwarding. Fragmented messages, control frames and
+	// compressed frames pass through untouched.
+	DecodeWebSocket bool
+	// OnReplace - When set, called whenever a replacer or yara substitution
+	// changes a chunk, with the chunk before and after it ran (after is nil
+	// when it dropped the chunk). Both are only valid during the call. The
+	// chunk is copied ahead of every replacer to compare, so leave it unset
+	// unless the audit trail is needed.
+	OnReplace func(replacer Replacer, before, after []byte, direction Direction)
+	// CompressRemote - Compress everything sent to the remote and decompress
+	// what comes back. The remote has to be another proxy with
+	// AcceptCompressed set; the connection fails if it doesn't agree to it.
+	// Inspection runs on the uncompressed data.
+	CompressRemote bool
+	// AcceptCompressed - Let clients that are proxies with CompressRemote set
+	// compress the connection. Other clients are proxied as usual.
+	AcceptCompressed bool
+	// CompressProbe - How long AcceptCompressed waits for a client to start
+	// the compression handshake before treating it as a plain client, for
+	// protocols where the client waits for the server. Defaults to 500ms.
+	CompressProbe time.Duration
+	// ClientPrologue - Sent to the client as soon as the remote is connected,
+	// before anything the remote sends, e.g. a banner the protocol expects
+	ClientPrologue []byte
+	// RemotePrologue - Sent to the remote once it is connected, before any
+	// of the client's data, e.g. an authentication handshake
+	RemotePrologue []byte
+	// ClientCertPrologue - When set and the client connected over TLS with a
+	// verified certificate, sent to the remote ahead of RemotePrologue with
+	// the certificate's {subject}, {cn}, {issuer}, {san}, {serial} and
+	// {sha256} filled in, e.g. "X-Client-Cert: {subject}\r\n", so backends
+	// behind a proxy terminating mutual TLS still learn who the client is
+	ClientCertPrologue string
+	// SampleRate - When between 0 and 1, only this fraction of connections,
+	// picked at random, are inspected; the rest are relayed untouched without
+	// running the rules, replacers or Matcher. 0 inspects every connection.
+	SampleRate float64
+	// SampleRand - Returns the random numbers in [0, 1) SampleRate is decided
+	// by, defaults to math/rand.Float64. Called from each connection's own
+	// goroutine, see NewSampleRand for a seeded one.
+	SampleRand func() float64
+	// ScanLimit - When set, bounds the yara scans running at once across all
+	// the connections sharing it
+	ScanLimit *ScanLimiter
+	// UpstreamSkip, DownstreamSkip - Bytes at the start and end of each
+	// direction that the rules and replacers leave alone
+	UpstreamSkip   Skip
+	DownstreamSkip Skip
+	// UpstreamEntropy, DownstreamEntropy - Match each direction's data on
+	// sustained high entropy, see EntropyCheck
+	UpstreamEntropy   EntropyCheck
+	DownstreamEntropy EntropyCheck
+	// MaxReadSize - When smaller than the buffer, caps how much a single
+	// read may return, for finer grained inspection
+	MaxReadSize int
+	// BufferSize - Size of the read buffer for each direction, defaults to
+	// 64k. Each open connection holds two.
+	BufferSize int
+	// UpstreamBufferSize, DownstreamBufferSize - When set, the size of the
+	// read buffer for that direction instead of BufferSize, e.g. a small one
+	// for requests and a large one for the responses
+	UpstreamBufferSize   int
+	DownstreamBufferSize int
+	// RecvBuf, SendBuf - When set, the socket receive and send buffer sizes
+	// (SO_RCVBUF and SO_SNDBUF) of both TCP connections, e.g. larger ones
+	// for links with a high bandwidth-delay product. The OS may clamp them.
+	RecvBuf int
+	SendBuf int
 }
 
 type matchLocation struct {
@@ -50,6 +378,10 @@ func (mr *matchLocation) Replace(input []byte) []byte {
 	return data
 }
 
+func (mr *matchLocation) String() string {
+	return fmt.Sprintf("yara sub: %d bytes at %d -> %q", mr.length, mr.offset, mr.replacement)
+}
+
 // New - Create a new Proxy instance. Takes over local connection passed in,
 // and closes it when finished.
 func New(lconn *net.TCPConn, laddr, raddr *net.TCPAddr) *Proxy {
@@ -57,8 +389,7 @@ func New(lconn *net.TCPConn, laddr, raddr *net.TCPAddr) *Proxy {
 		lconn:  lconn,
 		laddr:  laddr,
 		raddr:  raddr,
-		erred:  false,
-		errsig: make(chan bool),
+		errsig: make(chan struct{}),
 		Log:    NullLogger{},
 	}
 }
@@ -66,33 +397,113 @@ func New(lconn *net.TCPConn, laddr, raddr *net.TCPAddr) *Proxy {
 // NewTLSUnwrapped - Create a new Proxy instance with a remote TLS server for
 // which we want to unwrap the TLS to be able to connect without encryption
 // locally
+//
+// Deprecated: raddr is dialed and addr only supplies the ServerName; use
+// New and set UnwrapTLS and ServerName instead.
 func NewTLSUnwrapped(lconn *net.TCPConn, laddr, raddr *net.TCPAddr, addr string) *Proxy {
 	p := New(lconn, laddr, raddr)
-	p.tlsUnwrapp = true
-	p.tlsAddress = addr
+	p.unwrapTLSTo(addr)
 	return p
 }
 
+// unwrapTLSTo - Set up UnwrapTLS for the remote the deprecated constructors
+// were given as a host:port string, as its ServerName and, when raddr is
+// missing, the address to dial
+func (p *Proxy) unwrapTLSTo(addr string) {
+	p.UnwrapTLS = true
+	if host, _, err := net.SplitHostPort(addr); err == nil && net.ParseIP(host) == nil {
+		p.ServerName = host
+	}
+	if p.raddr == nil {
+		p.raddr, _ = net.ResolveTCPAddr("tcp", addr)
+	}
+}
+
+// RemoteConnAddr - The address of the remote peer actually connected to,
+// which may differ from the configured one. Nil until the remote is dialed.
+func (p *Proxy) RemoteConnAddr() net.Addr {
+	return p.rconnAddr
+}
+
+func (p *Proxy) remoteString() string {
+	if p.rconnAddr != nil {
+		return p.rconnAddr.String()
+	}
+	return p.raddr.String()
+}
+
 type setNoDelayer interface {
 	SetNoDelay(bool) error
 }
 
+type remoteAddrer interface {
+	RemoteAddr() net.Addr
+}
+
+// Run - Start the connection and return the error it ended with once it is
+// closed, as Err reports it
+func (p *Proxy) Run() error {
+	p.Start()
+	return p.Err()
+}
+
 // Start - open connection to remote and start proxying data.
 func (p *Proxy) Start() {
+	defer p.recoverPanic("connection setup", false)
 	defer p.lconn.Close()
 
+	p.Log = withTags(p.Log, p)
+	if !p.useLoggerFactory() {
+		return
+	}
+	if !p.admit() {
+		return
+	}
+
 	var err error
+	if p.AcceptCompressed {
+		if err = p.acceptCompression(); err != nil {
+			p.Log.Warn("Compression handshake with client failed: %s", err)
+			p.closeWith(err, "compression handshake failed: %v", err)
+			return
+		}
+	}
+
 	// connect to remote
-	if p.tlsUnwrapp {
-		p.rconn, err = tls.Dial("tcp", p.tlsAddress, nil)
-	} else {
-		p.rconn, err = net.DialTCP("tcp", nil, p.raddr)
+	switch {
+	case p.rconn != nil:
+		// already connected, see NewConnected
+	case p.Mux != nil:
+		p.rconn, err = p.Mux.Open()
+	case p.Router != nil:
+		err = p.route()
+	case p.UnwrapTLS && p.QUIC:
+		p.rconn, err = p.dialQUIC(p.raddr.String())
+	case p.UnwrapTLS:
+		p.rconn, err = p.queueDial(p.dialTLS, p.dialNetwork(), p.raddr.String())
+		err = noRouteError(p.dialNetwork(), p.raddr.String(), err)
+	default:
+		p.rconn, err = p.queueDial(p.dialRemote, p.dialNetwork(), p.raddr.String())
+		err = noRouteError(p.dialNetwork(), p.raddr.String(), err)
 	}
 	if err != nil {
 		p.Log.Warn("Remote connection failed: %s", err)
+		err = &DialError{Err: err}
+		p.closeWith(err, "remote connection failed: %v", err)
+		if p.dialFailed != nil {
+			p.dialFailed(err)
+		}
 		return
 	}
 	defer p.rconn.Close()
+	if c, ok := p.rconn.(remoteAddrer); ok {
+		p.rconnAddr = c.RemoteAddr()
+	}
+	p.recordRemoteTLS()
+	if p.stopping() {
+		// Close was called while connecting
+		return
+	}
 
 	// nagles?
 	if p.Nagles {
@@ -103,26 +514,125 @@ func (p *Proxy) Start() {
 			conn.SetNoDelay(true)
 		}
 	}
+	p.setSocketBuffers()
+
+	if p.CompressRemote {
+		if err := p.compressRemote(); err != nil {
+			p.Log.Warn("Compression handshake with remote failed: %s", err)
+			p.closeWith(err, "compression handshake failed: %v", err)
+			return
+		}
+	}
+	if !p.sendPrologues() {
+		return
+	}
+	p.started = p.clock().Now()
 
 	// display both ends
-	p.Log.Info("Opened %s >>> %s", p.laddr.String(), p.raddr.String())
+	p.logLifecycle(LifecycleOpen, "Opened %s >>> %s%s", p.laddr.String(), p.remoteString(), p.tlsDescription())
+	p.emitOpen()
+	if p.LogMSS {
+		p.logMSS()
+	}
+	p.runExecHook("connect", p.OnConnectExec)
+	p.passthrough = !p.sample()
 
 	// bidirectional copy
-	if p.Scanner != nil && p.Watcher != nil {
-		go p.watchYaraFile()
+	if !p.passthrough {
+		p.useActiveRules()
+		p.startCombined()
+		if p.Scanner != nil && p.Watcher != nil {
+			go p.watchYaraFile()
+		}
+	}
+	var local io.Reader = p.lconn
+	if len(p.peeked) > 0 {
+		local = io.MultiReader(bytes.NewReader(p.peeked), p.lconn)
+	}
+	if p.ShadowAddr != "" {
+		go p.runShadow(p.Tap())
+	}
+	var lifetime, idle <-chan time.Time
+	if p.MaxLifetime > 0 {
+		timer := p.clock().NewTimer(p.MaxLifetime)
+		defer timer.Stop()
+		lifetime = timer.C()
 	}
-	go p.pipe(p.lconn, p.rconn)
-	go p.pipe(p.rconn, p.lconn)
+	if p.IdleTimeout > 0 {
+		p.touch()
+		ticker := p.clock().NewTicker(p.IdleTimeout / idleChecks)
+		defer ticker.Stop()
+		idle = ticker.C()
+	}
+	p.startHashes()
+	go p.pipe(local, p.rconn, true)
+	go p.pipe(p.rconn, p.lconn, false)
 
 	// wait for close...
-	<-p.errsig
+wait:
+	for {
+		select {
+		case <-p.errsig:
+			break wait
+		case <-lifetime:
+			p.logLifecycle(LifecycleTimeout, "max lifetime reached")
+			p.closeWith(ErrMaxLifetime, "max lifetime reached")
+			p.stop()
+			break wait
+		case <-idle:
+			if p.idleFor() < p.IdleTimeout {
+				continue
+			}
+			p.logLifecycle(LifecycleTimeout, "idle timeout reached")
+			p.closeWith(ErrIdleTimeout, "idle for %v", p.IdleTimeout)
+			p.stop()
+			break wait
+		}
+	}
+	p.ended = p.clock().Now()
+	p.closeTaps()
+	p.closeCombined()
 	if p.Watcher != nil {
 		p.Watcher.Close()
 	}
-	p.Log.Info("Closed (%d bytes sent, %d bytes recieved)", p.sentBytes, p.receivedBytes)
+	stats := p.Stats()
+	p.logLifecycle(LifecycleClose, "Closed %s (%d bytes sent, %d bytes recieved)", p.remoteString(), stats.BytesSent, stats.BytesReceived)
+	p.logHashes()
+	p.Log.Debug("Spent %v scanning and %v in replacers", stats.ScanTime, stats.ReplaceTime)
+	if small := p.SmallReads(); small > 0 {
+		p.Log.Info("%d reads were smaller than %d bytes", small, p.SmallReadThreshold)
+	}
+	p.emitClose(stats)
+	p.runExecHook("close", p.OnCloseExec)
+}
+
+// sendPrologues - Write ClientCertPrologue, RemotePrologue and
+// ClientPrologue ahead of the piped data, false if the connection failed
+func (p *Proxy) sendPrologues() bool {
+	if !p.sendClientCert() {
+		return false
+	}
+	if len(p.RemotePrologue) > 0 {
+		if _, err := p.rconn.Write(p.RemotePrologue); err != nil {
+			p.Log.Warn("Failed to send remote prologue: %s", err)
+			p.closeWith(err, "write to remote failed: %v", err)
+			return false
+		}
+		p.Log.Debug("Sent %d byte prologue to the remote", len(p.RemotePrologue))
+	}
+	if len(p.ClientPrologue) > 0 {
+		if _, err := p.lconn.Write(p.ClientPrologue); err != nil {
+			p.Log.Warn("Failed to send client prologue: %s", err)
+			p.closeWith(err, "write to client failed: %v", err)
+			return false
+		}
+		p.Log.Debug("Sent %d byte prologue to the client", len(p.ClientPrologue))
+	}
+	return true
 }
 
 func (p *Proxy) watchYaraFile() {
+	defer p.recoverPanic("yara rule watcher", false)
 	for {
 		evt := <-p.Watcher.Events
 		if !evt.Has(fsnotify.Write) {
@@ -132,111 +642,193 @@ func (p *Proxy) watchYaraFile() {
 	}
 }
 
-func (p *Proxy) rebuildScanner() {
-	p.Log.Info("rulefile updated, rebuilding scanner")
-	p.scannerLock.Lock()
-	defer p.scannerLock.Unlock()
+func (p *Proxy) err(s string, err error) {
+	p.stopOnce.Do(func() {
+		if err == io.EOF {
+			p.setCloseReason("%s: %v", strings.TrimSpace(s), err)
+		} else {
+			p.closeWith(err, "%s: %v", strings.TrimSpace(s), err)
+		}
+		if err != io.EOF {
+			p.Log.Warn(fmt.Sprintf("%s: %s", s, err.Error()))
+		}
+		p.signalStop()
+	})
+}
 
-	path := p.Watcher.WatchList()[0]
-	r, err := os.Open(path)
-	if err != nil {
-		p.Log.Warn("failed to open yara rule file %s: %v", path, err)
-		return
-	}
+// stop - Shut the connection down, if it isn't already
+func (p *Proxy) stop() {
+	p.stopOnce.Do(p.signalStop)
+}
 
-	rules, err := yara.ReadRules(r)
-	if err != nil {
-		p.Log.Warn("error reading yara rules in file %s: %v", path, err)
-		return
+func (p *Proxy) signalStop() {
+	atomic.StoreInt32(&p.erred, 1)
+	close(p.errsig)
+}
+
+// stopping - Whether the connection is shutting down
+func (p *Proxy) stopping() bool {
+	return atomic.LoadInt32(&p.erred) != 0
+}
+
+// Close - End the connection from outside, e.g. for an admin API dropping
+// a connection. Start returns once both connections are closed. Safe to
+// call more than once, from any goroutine, before or while Start runs.
+func (p *Proxy) Close() error {
+	p.setCloseReason("closed")
+	p.stop()
+	// unblocks Start when it is still dialing or handshaking; the remote
+	// connection is closed by Start itself
+	p.lconn.Close()
+	return nil
+}
+
+// setCloseReason - Record why the connection is ending, the first reason
+// recorded wins
+func (p *Proxy) setCloseReason(format string, args ...interface{}) {
+	p.closeWith(nil, format, args...)
+}
+
+// closeWith - Record why the connection is ending like setCloseReason, along
+// with the error Err reports, nil for a normal close
+func (p *Proxy) closeWith(err error, format string, args ...interface{}) {
+	p.reasonLock.Lock()
+	defer p.reasonLock.Unlock()
+	if p.closeReason == "" {
+		p.closeReason = fmt.Sprintf(format, args...)
+		p.closeErr = err
 	}
+}
 
-	scanner, err := yara.NewScanner(rules)
-	if err != nil {
-		p.Log.Warn("failed to compile yara scanner for rules from file %s: %v", path, err)
+// CloseReason - Why the connection ended, empty while it is open
+func (p *Proxy) CloseReason() string {
+	p.reasonLock.Lock()
+	defer p.reasonLock.Unlock()
+	return p.closeReason
+}
+
+// Err - The error the connection ended with, nil while it is open and when
+// it closed normally: either side closing, Close, or a linger running out.
+// Match its category with errors.Is, e.g. ErrRemoteDial, ErrRuleBlock or
+// ErrIdleTimeout, or the underlying error such as a syscall.Errno.
+func (p *Proxy) Err() error {
+	p.reasonLock.Lock()
+	defer p.reasonLock.Unlock()
+	return p.closeErr
+}
+
+// recoverPanic - Deferred at the top of every goroutine a connection runs, so
+// a panic while handling one connection ends only that connection instead of
+// the whole process. closeConn signals Start to shut the connection down, for
+// the goroutines it is waiting on.
+func (p *Proxy) recoverPanic(where string, closeConn bool) {
+	r := recover()
+	if r == nil {
 		return
 	}
-	p.Scanner = scanner
+	p.Log.Warn("Recovered from panic in %s of connection %d: %v\n%s", where, p.ID, r, debug.Stack())
+	if closeConn {
+		err := fmt.Errorf("panic: %v", r)
+		p.closeWith(err, "panic in %s: %v", where, r)
+		p.err(where, err)
+	}
 }
 
-func (p *Proxy) RuleMatching(ctx *yara.ScanContext, rule *yara.Rule) (bool, error) {
-	tags := rule.Tags()
-	for _, tag := range tags {
-		id := rule.Identifier()
-		if strings.ToLower(tag) == "log" {
-			p.Log.Info("match found for rule %s", id)
-		}
-		if strings.ToLower(tag) == "warn" {
-			p.Log.Warn("match found for rule %s", id)
-		}
-		if strings.ToLower(tag) == "drop" {
-			p.err("dropping connection", fmt.Errorf("match on rule %s", id))
-		}
+// Transform - Apply the yara substitutions and replacers to a chunk headed
+// upstream, exactly as pipe does before forwarding it
+func (p *Proxy) Transform(b []byte) []byte {
+	return p.TransformDirection(b, Upstream)
+}
+
+// TransformDirection - Apply the yara substitutions, shared replacers and the
+// replacers for the given direction to a chunk. Returns nil when a replacer
+// dropped it.
+func (p *Proxy) TransformDirection(b []byte, direction Direction) []byte {
+	for i := range p.replacements {
+		b = p.replace(&p.replacements[i], b, direction)
 	}
 
-	sub_value, ok := p.getSubstitution(rule.Metas())
-	if !ok {
-		return false, nil
+	p.replacerLock.RLock()
+	defer p.replacerLock.RUnlock()
+	if b = p.applyReplacers(b, p.Replacers, direction); b == nil {
+		return nil
 	}
-	for _, s := range rule.Strings() {
-		for _, match := range s.Matches(ctx) {
-			ofs := match.Offset()
-			l := len(match.Data())
-			p.replacements = append(p.replacements, matchLocation{
-				ofs,
-				l,
-				sub_value,
-			})
-		}
+	if direction == Upstream {
+		return p.applyReplacers(b, p.UpstreamReplacers, direction)
 	}
-	return false, nil
+	return p.applyReplacers(b, p.DownstreamReplacers, direction)
 }
 
-func (p *Proxy) getSubstitution(metas []yara.Meta) ([]byte, bool) {
-	var replacement []byte
-	var err error
-	for _, meta := range metas {
-		if strings.ToLower(meta.Identifier) != "sub" {
-			continue
-		}
-		mvs, ok := meta.Value.(string)
-		if !ok {
-			p.Log.Warn("substitution metadata value should be a string")
-			continue
-		}
-		mvs_stripped := strings.TrimSpace(mvs)
-		if strings.HasPrefix(mvs_stripped, "{ ") && strings.HasSuffix(mvs, " }") {
-			bts_raw := strings.TrimRight(strings.TrimLeft(mvs_stripped, "{"), "}")
-			bts := strings.ReplaceAll(bts_raw, " ", "")
-			replacement, err = hex.DecodeString(bts)
-			if err != nil {
-				p.Log.Warn("failed to parse substitution value as yara hex bytes")
-				continue
-			}
-			return replacement, true
-		} else {
-			return []byte(mvs), true
+// applyReplacers - ApplyReplacers, reporting changes to OnReplace
+func (p *Proxy) applyReplacers(b []byte, replacers []Replacer, direction Direction) []byte {
+	for _, r := range replacers {
+		if b = p.replace(r, b, direction); b == nil {
+			return nil
 		}
 	}
-	return nil, false
+	return b
 }
 
-func (p *Proxy) err(s string, err error) {
-	if p.erred {
-		return
+// replace - Run a single replacer, reporting a change to OnReplace
+func (p *Proxy) replace(r Replacer, b []byte, direction Direction) []byte {
+	if p.OnReplace == nil {
+		return p.runReplacer(r, b, direction)
 	}
-	if err != io.EOF {
-		p.Log.Warn(fmt.Sprintf("%s: %s", s, err.Error()))
+	before := append([]byte(nil), b...)
+	after := p.runReplacer(r, b, direction)
+	if after == nil || !bytes.Equal(before, after) {
+		p.OnReplace(r, before, after, direction)
 	}
-	p.errsig <- true
-	p.erred = true
+	return after
 }
 
-func (p *Proxy) pipe(src, dst io.ReadWriter) {
-	islocal := src == p.lconn
+// runReplacer - Replace b with r, the way ApplyReplacers does but keeping
+// what carries over between chunks for the connection
+func (p *Proxy) runReplacer(r Replacer, b []byte, direction Direction) []byte {
+	return p.replacing.run(r, b, direction, p.Log)
+}
 
+// inspect - Scan a chunk headed upstream with yara, then apply the
+// substitutions and replacers for its direction
+func (p *Proxy) inspect(b []byte, direction Direction) []byte {
+	if direction == Upstream {
+		p.scannerLock.Lock()
+		if p.Scanner != nil {
+			p.limitedScan(b)
+		}
+		p.scanned += int64(len(b))
+		p.scannerLock.Unlock()
+	}
+	start := time.Now()
+	b = p.TransformDirection(b, direction)
+	atomic.AddInt64(&p.replaceNanos, int64(time.Since(start)))
+	return b
+}
+
+// limitedScan - Scan b once ScanLimit has a slot for it, or not at all if
+// the limiter skips
+func (p *Proxy) limitedScan(b []byte) {
+	if p.ScanLimit != nil {
+		if !p.ScanLimit.acquire() {
+			p.Log.Debug("Too many scans running, forwarding %d bytes unscanned", len(b))
+			return
+		}
+		defer p.ScanLimit.release()
+	}
+	start := time.Now()
+	p.scanMem(b)
+	atomic.AddInt64(&p.scanNanos, int64(time.Since(start)))
+}
+
+func (p *Proxy) pipe(src io.Reader, dst io.Writer, islocal bool) {
+	defer p.recoverPanic("pipe", true)
 	var dataDirection string
+	direction := Downstream
+	srcName, dstName := "remote", "client"
 	if islocal {
 		dataDirection = ">>> %d bytes sent%s"
+		direction = Upstream
+		srcName, dstName = dstName, srcName
 	} else {
 		dataDirection = "<<< %d bytes recieved%s"
 	}
@@ -248,72 +840,286 @@ func (p *Proxy) pipe(src, dst io.ReadWriter) {
 		byteFormat = "%s"
 	}
 
-	// directional copy (64k buffer)
-	buff := make([]byte, 0xffff)
+	// directional copy (64k buffer by default)
+	pooled := buffers.get(p.bufferSize(direction))
+	defer buffers.put(pooled)
+	buff := pooled.B
+	if p.MaxReadSize > 0 && p.MaxReadSize < len(buff) {
+		buff = buff[:p.MaxReadSize]
+	}
+	var offset uint64
+	inspect := func(b []byte) []byte {
+		return p.inspect(b, direction)
+	}
+	var dec *decoder
+	if p.DecodeCompressed {
+		dec = newDecoder(p.MaxDecodeSize)
+		inspect = func(b []byte) []byte {
+			return dec.feed(b, func(b []byte) []byte {
+				return p.inspect(b, direction)
+			})
+		}
+	}
+	var ws *wsFramer
+	if p.DecodeWebSocket {
+		ws = p.newWSFramer(direction, p.MaxDecodeSize)
+	}
+	if p.passthrough {
+		dec, ws = nil, nil
+		inspect = func(b []byte) []byte { return b }
+	}
+	skip := p.newSkipper(direction)
+	lines := p.newLineSplitter(direction)
+	hashes := p.hashes[direction]
+	entropy := p.newEntropyMeter(direction)
+	if lines != nil {
+		defer lines.flush()
+	}
+
+	// forward - log and write out a chunk
+	var forwarded uint64
+	forward := func(b []byte) bool {
+		p.Log.Debug(dataDirection, len(b), "")
+		p.Log.Trace(byteFormat, b)
+		p.sendTaps(direction, forwarded, b)
+		p.dump(direction, b)
+
+		if !islocal {
+			p.clientWriteLock.Lock()
+		}
+		n, err := dst.Write(b)
+		if !islocal {
+			p.clientWriteLock.Unlock()
+		}
+		if err != nil && islocal && p.closedWithoutData(err) {
+			return false
+		}
+		if err != nil {
+			p.closeWith(err, "write to %s failed: %v", dstName, err)
+			p.err(fmt.Sprintf("Write to %s failed", dstName), err)
+			return false
+		}
+		hashes.add(true, b[:n])
+		forwarded += uint64(n)
+		if islocal {
+			atomic.AddUint64(&p.sentBytes, uint64(n))
+		} else {
+			atomic.AddUint64(&p.receivedBytes, uint64(n))
+		}
+		return true
+	}
+
 	for {
+		if !p.waitHolds(direction) {
+			return
+		}
 		n, err := src.Read(buff)
+		if n > 0 && !islocal {
+			atomic.StoreInt32(&p.remoteSent, 1)
+		}
+		if err != nil && !islocal && p.closedWithoutData(err) {
+			return
+		}
+		if err == io.EOF && ws != nil {
+			// an incomplete frame goes out as it came in
+			if tail := ws.flush(); len(tail) > 0 && !forward(tail) {
+				return
+			}
+		} else if err == io.EOF && dec != nil {
+			// so does an incomplete compressed stream; with DecodeWebSocket
+			// the decoder only sees frame payloads
+			if tail := dec.flush(); len(tail) > 0 && !forward(tail) {
+				return
+			}
+		}
+		if err == io.EOF && skip != nil {
+			// the held back tail is the end of the stream after all
+			if tail := skip.flush(); len(tail) > 0 && !forward(tail) {
+				return
+			}
+		}
+		if err == io.EOF && lines != nil {
+			lines.flush()
+		}
+		if err == io.EOF {
+			p.setCloseReason("%s closed", srcName)
+			if p.lingerOnEOF(dst) {
+				return
+			}
+		}
 		if err != nil {
-			p.err("Read failed '%s'\n", err)
+			p.closeWith(err, "read from %s failed: %v", srcName, err)
+			p.err(fmt.Sprintf("Read from %s failed", srcName), err)
 			return
 		}
 		b := buff[:n]
-
-		if p.Scanner != nil && islocal {
-			p.scannerLock.Lock()
-			p.Scanner.ScanMem(b)
-			p.scannerLock.Unlock()
+		if n < p.SmallReadThreshold {
+			atomic.AddUint64(&p.smallReads, 1)
 		}
+		p.touch()
+		hashes.add(false, b)
 
-		for _, rep := range p.replacements {
-			b = rep.Replace(b)
+		if (p.Matcher != nil || p.CombinedMatcher != nil) && !p.passthrough {
+			ctx := MatchContext{
+				Data:       b,
+				Direction:  direction,
+				Offset:     offset,
+				Time:       p.clock().Now(),
+				ConnID:     p.ID,
+				ConnUUID:   p.UUID,
+				LocalAddr:  p.laddr,
+				RemoteAddr: p.raddr,
+				Hold:       p.holdFunc(direction),
+			}
+			if p.Matcher != nil {
+				p.Matcher(ctx)
+			}
+			p.sendCombined(ctx)
+			if !p.waitHolds(direction) {
+				return
+			}
 		}
-
-		if p.erred {
-			return
+		if lines != nil {
+			lines.feed(b)
+		}
+		if entropy != nil {
+			p.checkEntropy(entropy, b)
 		}
+		offset += uint64(n)
 
-		// show output
-		p.Log.Debug(dataDirection, n, "")
-		p.Log.Trace(byteFormat, b)
+		var head []byte
+		if skip != nil {
+			head, b = skip.split(b)
+			p.skipScan(direction, len(head))
+		}
+		switch {
+		case skip != nil && len(b) == 0:
+			// all head or held back tail
+		case ws != nil:
+			b = ws.feed(b, inspect)
+		default:
+			b = inspect(b)
+		}
 
-		// write out result
-		n, err = dst.Write(b)
-		if err != nil {
-			p.err("Write failed '%s'\n", err)
+		if p.stopping() {
 			return
 		}
-		if islocal {
-			p.sentBytes += uint64(n)
-		} else {
-			p.receivedBytes += uint64(n)
+		if len(head) > 0 {
+			if !forward(head) {
+				return
+			}
+			if len(b) == 0 {
+				continue
+			}
+		}
+		if (dec != nil || ws != nil || skip != nil) && len(b) == 0 {
+			// still buffering a compressed member, frame or the tail
+			continue
+		}
+		if b == nil {
+			p.Log.Debug("Dropped a %d byte chunk, a replacer returned nil", n)
+			continue
 		}
+		if len(p.iterators) > 0 && !p.passthrough {
+			frame := Frame{Direction: direction, Data: b, Offset: forwarded, Time: p.clock().Now()}
+			if !p.iterate(&frame) {
+				return
+			}
+			if len(frame.Data) == 0 {
+				continue
+			}
+			b = frame.Data
+		}
+		if !forward(b) {
+			return
+		}
+	}
+}
+
+// SetReplacers - Swap the replacers used by the proxy in both directions.
+// Safe to call while the proxy is running; the new set applies from the next
+// chunk onwards.
+func (p *Proxy) SetReplacers(replacers []Replacer) {
+	p.replacerLock.Lock()
+	p.Replacers = replacers
+	p.replacerLock.Unlock()
+}
+
+// SetReplacerSet - Swap all of the proxy's replacers, shared and per
+// direction, in one go. Safe to call while the proxy is running.
+func (p *Proxy) SetReplacerSet(set ReplacerSet) {
+	p.replacerLock.Lock()
+	p.Replacers = set.Both
+	p.UpstreamReplacers = set.Upstream
+	p.DownstreamReplacers = set.Downstream
+	p.replacerLock.Unlock()
+}
+
+// LoadedRules - The namespace:identifier of every yara rule the proxy is
+// scanning with
+func (p *Proxy) LoadedRules() []string {
+	p.scannerLock.Lock()
+	defer p.scannerLock.Unlock()
+	if p.rules == nil {
+		return nil
 	}
+	return RuleNames(p.rules)
 }
 
+// compileYaraRules - CompileYaraRules, swapped out by tests for a slow one
+var compileYaraRules = CompileYaraRules
+
+// LoadYaraConfig - Compile the yara rules in filePath, scan with them and
+// watch the file for changes
 func (p *Proxy) LoadYaraConfig(filePath string) error {
-	cmp, err := yara.NewCompiler()
-	if err != nil {
-		return fmt.Errorf("error creating yara compiler: %v", err)
+	return p.LoadYaraConfigContext(context.Background(), filePath)
+}
+
+// CompileYaraRulesContext - CompileYaraRules, giving up once ctx is done,
+// e.g. when shutting down while a huge ruleset is still compiling. Yara
+// can't interrupt a compilation, so it finishes in the background and the
+// rules it produces are destroyed.
+func CompileYaraRulesContext(ctx context.Context, filePath string) (*YaraRules, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
 	}
-	f, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to open yara config file: %v", err)
+	type compiled struct {
+		rules    *YaraRules
+		warnings []string
+		err      error
+	}
+	done := make(chan compiled, 1)
+	compile := compileYaraRules
+	go func() {
+		rules, warnings, err := compile(filePath)
+		done <- compiled{rules, warnings, err}
+	}()
+	select {
+	case c := <-done:
+		return c.rules, c.warnings, c.err
+	case <-ctx.Done():
+		go func() {
+			if c := <-done; c.rules != nil {
+				c.rules.Destroy()
+			}
+		}()
+		return nil, nil, fmt.Errorf("loading yara rules from %s: %w", filePath, ctx.Err())
 	}
-	defer f.Close()
+}
 
-	if err := cmp.AddFile(f, "proxy"); err != nil {
-		return fmt.Errorf("error adding file to compiler: %v", err)
+// LoadYaraConfigContext - LoadYaraConfig, giving up once ctx is done like
+// CompileYaraRulesContext; the proxy is then left as it was
+func (p *Proxy) LoadYaraConfigContext(ctx context.Context, filePath string) error {
+	rules, warnings, err := CompileYaraRulesContext(ctx, filePath)
+	for _, w := range warnings {
+		p.Log.Warn("yara compiler warning: %s", w)
 	}
-	rules, err := cmp.GetRules()
 	if err != nil {
-		return fmt.Errorf("failed to get yara rules: %w", err)
+		return err
 	}
-	p.Scanner, err = yara.NewScanner(rules)
-	if err != nil {
-		p.Scanner = nil
-		return fmt.Errorf("failed to create new yara scanner: %w", err)
+	if err := p.SetYaraRules(rules); err != nil {
+		return err
 	}
-	p.Scanner.SetCallback(p)
 
 	p.Watcher, err = fsnotify.NewWatcher()
 	if err != nil {
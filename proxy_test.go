@@ -1,6 +1,648 @@
 package proxy
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestReplaceBytes(t *testing.T) {
 }
+
+func listenLocal(t *testing.T) *net.TCPListener {
+	t.Helper()
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	return l
+}
+
+// startEcho - A remote that writes everything it reads straight back
+func startEcho(t *testing.T) *net.TCPListener {
+	t.Helper()
+	l := listenLocal(t)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 0xffff)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					if _, err := c.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+// startProxy - Open a client connection proxied to raddr. setup configures the
+// Proxy before it starts; done is closed once Start returns.
+func startProxy(t *testing.T, raddr *net.TCPAddr, setup func(*Proxy)) (client net.Conn, done chan struct{}) {
+	t.Helper()
+	l := listenLocal(t)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial proxy listener: %v", err)
+	}
+	lconn, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+
+	p := New(lconn, l.Addr().(*net.TCPAddr), raddr)
+	if setup != nil {
+		setup(p)
+	}
+	done = make(chan struct{})
+	go func() {
+		p.Start()
+		close(done)
+	}()
+	return client, done
+}
+
+func echoRoundTrip(t *testing.T, c net.Conn, msg string) string {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	buf := make([]byte, len(msg)*2)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestMatcherContext(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	raddr := echo.Addr().(*net.TCPAddr)
+
+	var mu sync.Mutex
+	var seen []MatchContext
+	var laddr net.Addr
+	client, done := startProxy(t, raddr, func(p *Proxy) {
+		p.ID = 42
+		laddr = p.laddr
+		p.Matcher = func(ctx MatchContext) {
+			ctx.Data = append([]byte(nil), ctx.Data...)
+			mu.Lock()
+			seen = append(seen, ctx)
+			mu.Unlock()
+		}
+	})
+
+	echoRoundTrip(t, client, "hello")
+	echoRoundTrip(t, client, "world!")
+	client.Close()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[Direction][]struct {
+		data   string
+		offset uint64
+	}{
+		Upstream:   {{"hello", 0}, {"world!", 5}},
+		Downstream: {{"hello", 0}, {"world!", 5}},
+	}
+	got := map[Direction]int{}
+	for _, ctx := range seen {
+		i := got[ctx.Direction]
+		got[ctx.Direction]++
+		if i >= len(want[ctx.Direction]) {
+			t.Errorf("unexpected extra %s chunk %q", ctx.Direction, ctx.Data)
+			continue
+		}
+		w := want[ctx.Direction][i]
+		if string(ctx.Data) != w.data || ctx.Offset != w.offset {
+			t.Errorf("%s chunk %d: wanted %q at %d, got %q at %d",
+				ctx.Direction, i, w.data, w.offset, ctx.Data, ctx.Offset)
+		}
+		if ctx.ConnID != 42 {
+			t.Errorf("wanted connection id 42, got %d", ctx.ConnID)
+		}
+		if ctx.LocalAddr.String() != laddr.String() || ctx.RemoteAddr.String() != raddr.String() {
+			t.Errorf("unexpected addresses %v -> %v", ctx.LocalAddr, ctx.RemoteAddr)
+		}
+	}
+	for d, chunks := range want {
+		if got[d] != len(chunks) {
+			t.Errorf("wanted %d %s chunks, got %d", len(chunks), d, got[d])
+		}
+	}
+}
+
+func TestCloseWhileFlowing(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	var p *Proxy
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(proxy *Proxy) {
+		p = proxy
+	})
+	defer client.Close()
+	echoRoundTrip(t, client, "warm up")
+
+	// keep data flowing both ways while Close races the pipes
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go io.Copy(ioutil.Discard, client)
+	go func() {
+		chunk := bytes.Repeat([]byte("x"), 4096)
+		for {
+			if _, err := client.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Close()
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start didn't return after Close")
+	}
+	if reason := p.CloseReason(); reason != "closed" {
+		t.Errorf("expected close reason closed, got %q", reason)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("closing again should be harmless, got %v", err)
+	}
+}
+
+func TestCloseBeforeStart(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.Close()
+	})
+	defer client.Close()
+	<-done
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected the client connection to be closed")
+	}
+}
+
+func TestCloseReasonSide(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	// the client resets its connection
+	var p *Proxy
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(proxy *Proxy) { p = proxy })
+	echoRoundTrip(t, client, "hello")
+	client.(*net.TCPConn).SetLinger(0)
+	client.Close()
+	<-done
+	if reason := p.CloseReason(); !strings.HasPrefix(reason, "read from client failed") {
+		t.Errorf("expected a client side read failure, got %q", reason)
+	}
+
+	// the remote resets its connection after answering the first chunk
+	remote := listenLocal(t)
+	defer remote.Close()
+	answered := make(chan struct{})
+	go func() {
+		c, err := remote.AcceptTCP()
+		if err != nil {
+			return
+		}
+		c.Read(make([]byte, 16))
+		c.Write([]byte("hi"))
+		<-answered
+		c.SetLinger(0)
+		c.Close()
+	}()
+	client, done = startProxy(t, remote.Addr().(*net.TCPAddr), func(proxy *Proxy) { p = proxy })
+	defer client.Close()
+	echoRoundTrip(t, client, "hello")
+	close(answered)
+	<-done
+	if reason := p.CloseReason(); !strings.HasPrefix(reason, "read from remote failed") {
+		t.Errorf("expected a remote side read failure, got %q", reason)
+	}
+}
+
+func TestBytesMatcher(t *testing.T) {
+	var got []byte
+	m := BytesMatcher(func(b []byte) { got = b })
+	m(MatchContext{Data: []byte("abc")})
+	if string(got) != "abc" {
+		t.Errorf("adapter should pass the data through, got %q", got)
+	}
+}
+
+func TestCombinedMatcher(t *testing.T) {
+	// a remote that challenges first and answers the client's response
+	remote := listenLocal(t)
+	defer remote.Close()
+	go func() {
+		c, err := remote.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("challenge"))
+		buf := make([]byte, 16)
+		if _, err := c.Read(buf); err == nil {
+			c.Write([]byte("ok"))
+		}
+	}()
+
+	var seen []MatchContext
+	client, done := startProxy(t, remote.Addr().(*net.TCPAddr), func(p *Proxy) {
+		// called from a single goroutine, no lock needed
+		p.CombinedMatcher = func(ctx MatchContext) {
+			seen = append(seen, ctx)
+		}
+	})
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "challenge" {
+		t.Fatalf("expected the challenge, got %q %v", buf[:n], err)
+	}
+	client.Write([]byte("response"))
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "ok" {
+		t.Fatalf("expected ok, got %q %v", buf[:n], err)
+	}
+	client.Close()
+	<-done
+
+	want := []struct {
+		direction Direction
+		data      string
+	}{
+		{Downstream, "challenge"},
+		{Upstream, "response"},
+		{Downstream, "ok"},
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("expected %d chunks, got %d", len(want), len(seen))
+	}
+	for i, w := range want {
+		if seen[i].Direction != w.direction || string(seen[i].Data) != w.data {
+			t.Errorf("chunk %d: expected %s %q, got %s %q", i, w.direction, w.data, seen[i].Direction, seen[i].Data)
+		}
+		if i > 0 && seen[i].Time.Before(seen[i-1].Time) {
+			t.Errorf("chunk %d was read before the one ahead of it", i)
+		}
+	}
+}
+
+func TestMaxReadSize(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	const maxRead = 10
+	var mu sync.Mutex
+	sizes := map[Direction][]int{}
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.MaxReadSize = maxRead
+		p.Matcher = func(ctx MatchContext) {
+			mu.Lock()
+			sizes[ctx.Direction] = append(sizes[ctx.Direction], len(ctx.Data))
+			mu.Unlock()
+		}
+	})
+
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 8)
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Write(msg); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	client.Close()
+	<-done
+
+	if !bytes.Equal(got, msg) {
+		t.Errorf("data corrupted by small reads: %q", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for d, chunks := range sizes {
+		total := 0
+		for _, n := range chunks {
+			if n > maxRead {
+				t.Errorf("%s read of %d bytes exceeds MaxReadSize %d", d, n, maxRead)
+			}
+			total += n
+		}
+		if total != len(msg) {
+			t.Errorf("%s: wanted %d bytes in total, got %d", d, len(msg), total)
+		}
+	}
+}
+
+func TestSmallReads(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	var proxy *Proxy
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.SmallReadThreshold = 4
+		proxy = p
+	})
+	echoRoundTrip(t, client, "ab")
+	echoRoundTrip(t, client, "abcdef")
+	client.Close()
+	<-done
+
+	// "ab" once in each direction
+	if got := proxy.SmallReads(); got != 2 {
+		t.Errorf("wanted 2 small reads, got %d", got)
+	}
+}
+
+func TestRemoteConnAddr(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	// configure the remote by name, the connection should report the
+	// concrete address it ended up on
+	var proxy *Proxy
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		proxy = p
+		p.Router = func(net.Addr, []byte) (string, string, error) {
+			_, port, _ := net.SplitHostPort(echo.Addr().String())
+			return "tcp4", net.JoinHostPort("localhost", port), nil
+		}
+		if p.RemoteConnAddr() != nil {
+			t.Errorf("remote address should be unset before dialing")
+		}
+	})
+	echoRoundTrip(t, client, "x")
+	client.Close()
+	<-done
+
+	if got := proxy.RemoteConnAddr(); got == nil || got.String() != echo.Addr().String() {
+		t.Errorf("wanted remote %v, got %v", echo.Addr(), got)
+	}
+}
+
+func TestPanicIsolation(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	raddr := echo.Addr().(*net.TCPAddr)
+
+	client, done := startProxy(t, raddr, func(p *Proxy) {
+		p.Matcher = func(ctx MatchContext) {
+			if string(ctx.Data) == "boom" {
+				panic("matcher blew up")
+			}
+		}
+	})
+	echoRoundTrip(t, client, "fine")
+	client.Write([]byte("boom"))
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("panicking connection was not closed")
+	}
+	client.Close()
+
+	// a panic before the pipes start is contained too
+	client, done = startProxy(t, raddr, func(p *Proxy) {
+		p.Router = func(net.Addr, []byte) (string, string, error) {
+			panic("router blew up")
+		}
+	})
+	client.Write([]byte("x"))
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection with a panicking router was not closed")
+	}
+	client.Close()
+
+	// and other connections carry on
+	client, done = startProxy(t, raddr, nil)
+	if got := echoRoundTrip(t, client, "still alive"); got != "still alive" {
+		t.Errorf("wanted echo, got %q", got)
+	}
+	client.Close()
+	<-done
+}
+
+func TestMaxLifetime(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	const lifetime = 200 * time.Millisecond
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.MaxLifetime = lifetime
+	})
+	defer client.Close()
+	start := time.Now()
+
+	// keep the connection busy past its lifetime
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			client.SetDeadline(time.Now().Add(time.Second))
+			if _, err := client.Write([]byte("ping")); err != nil {
+				return
+			}
+			if _, err := client.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection outlived its max lifetime")
+	}
+	if elapsed := time.Since(start); elapsed < lifetime {
+		t.Errorf("connection closed after %v, before its lifetime of %v", elapsed, lifetime)
+	}
+}
+
+func TestReplacerDropsChunk(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	var frames <-chan Frame
+	read := make(chan struct{}, 4)
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.UpstreamReplacers = []Replacer{dropReplacer{"secret"}}
+		p.Matcher = func(MatchContext) {
+			select {
+			case read <- struct{}{}:
+			default:
+			}
+		}
+		frames = p.Tap()
+	})
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte("secret"))
+	// make sure the chunks are read separately
+	<-read
+	// the echo only ever sees the chunk that wasn't dropped
+	if got := echoRoundTrip(t, client, "public"); got != "public" {
+		t.Errorf("wanted only the other chunk echoed, got %q", got)
+	}
+	client.Close()
+	<-done
+
+	for f := range frames {
+		if bytes.Contains(f.Data, []byte("secret")) {
+			t.Errorf("dropped chunk was forwarded %s", f.Direction)
+		}
+	}
+}
+
+func TestPrologues(t *testing.T) {
+	l := listenLocal(t)
+	defer l.Close()
+	const clientData = "client data"
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, len("AUTH\n")+len(clientData))
+		_, err = io.ReadFull(c, buf)
+		received <- string(buf)
+		if err == nil {
+			c.Write([]byte("reply"))
+		}
+	}()
+
+	client, done := startProxy(t, l.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.ClientPrologue = []byte("BANNER\n")
+		p.RemotePrologue = []byte("AUTH\n")
+	})
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Write([]byte(clientData)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	got := make([]byte, len("BANNER\nreply"))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	client.Close()
+	<-done
+
+	if string(got) != "BANNER\nreply" {
+		t.Errorf("expected the client prologue ahead of the remote's data, got %q", got)
+	}
+	if r := <-received; r != "AUTH\n"+clientData {
+		t.Errorf("expected the remote prologue ahead of the client's data, got %q", r)
+	}
+}
+
+func TestOnReplace(t *testing.T) {
+	type change struct {
+		replacer      Replacer
+		before, after string
+		dropped       bool
+		direction     Direction
+	}
+	var changes []change
+	up := &StringReplacer{"foo", "bar"}
+	unused := &StringReplacer{"missing", "found"}
+	down := dropReplacer{"secret"}
+	p := &Proxy{
+		Log:                 NullLogger{},
+		Replacers:           []Replacer{unused},
+		UpstreamReplacers:   []Replacer{up},
+		DownstreamReplacers: []Replacer{down},
+		OnReplace: func(r Replacer, before, after []byte, direction Direction) {
+			changes = append(changes, change{r, string(before), string(after), after == nil, direction})
+		},
+	}
+
+	p.TransformDirection([]byte("no match"), Upstream)
+	if len(changes) != 0 {
+		t.Fatalf("expected no callback when nothing changed, got %v", changes)
+	}
+
+	if got := p.TransformDirection([]byte("a foo"), Upstream); string(got) != "a bar" {
+		t.Fatalf("expected replaced chunk, got %q", got)
+	}
+	p.TransformDirection([]byte("a secret"), Downstream)
+	want := []change{
+		{up, "a foo", "a bar", false, Upstream},
+		{down, "a secret", "", true, Downstream},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("expected %d callbacks, got %v", len(want), changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("callback %d: expected %+v, got %+v", i, want[i], changes[i])
+		}
+	}
+}
+
+func TestLoadYaraConfigContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	compileYaraRules = func(string) (*YaraRules, []string, error) {
+		// a huge ruleset
+		<-release
+		return nil, nil, errors.New("should have been given up on")
+	}
+	defer func() { compileYaraRules = CompileYaraRules }()
+
+	p := New(nil, nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	errs := make(chan error, 1)
+	go func() { errs <- p.LoadYaraConfigContext(ctx, "huge.yar") }()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the load to be cancelled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("LoadYaraConfigContext didn't return once cancelled")
+	}
+	if p.Scanner != nil || p.Watcher != nil {
+		t.Errorf("a cancelled load should leave the proxy alone")
+	}
+
+	if err := p.LoadYaraConfigContext(ctx, "huge.yar"); !errors.Is(err, context.Canceled) {
+		t.Errorf("a done context shouldn't start compiling, got %v", err)
+	}
+}
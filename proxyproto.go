@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ProxyProtocol - Which version of the haproxy PROXY protocol header, if
+// any, is sent ahead of the data on connections to the remote and to the
+// shadow backend, so they see the original client's address instead of the
+// proxy's
+type ProxyProtocol int
+
+const (
+	// ProxyProtocolOff - Send no header
+	ProxyProtocolOff ProxyProtocol = iota
+	// ProxyProtocolV1 - The human readable text header
+	ProxyProtocolV1
+	// ProxyProtocolV2 - The binary header
+	ProxyProtocolV2
+)
+
+// proxyV2Signature - Starts every version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ParseProxyProtocol - Parse a header version: v1, v2, or off or empty for
+// none
+func ParseProxyProtocol(s string) (ProxyProtocol, error) {
+	switch s {
+	case "", "off":
+		return ProxyProtocolOff, nil
+	case "v1":
+		return ProxyProtocolV1, nil
+	case "v2":
+		return ProxyProtocolV2, nil
+	}
+	return ProxyProtocolOff, fmt.Errorf("unknown PROXY protocol version %q, expected v1 or v2", s)
+}
+
+// proxyHeader - The header announcing a connection from src to dst. Unless
+// both are TCP addresses the header says the source is unknown, which
+// receivers treat as a connection from the proxy itself.
+func proxyHeader(version ProxyProtocol, src, dst net.Addr) []byte {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	known := sok && dok && s.IP != nil && d.IP != nil
+	var sip, dip net.IP
+	if known {
+		sip, dip = s.IP.To4(), d.IP.To4()
+		if sip == nil || dip == nil {
+			// mixed families are sent as IPv6, with v4-mapped addresses
+			sip, dip = s.IP.To16(), d.IP.To16()
+		}
+	}
+
+	if version == ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP4"
+		if len(sip) == net.IPv6len {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, sip, dip, s.Port, d.Port))
+	}
+
+	h := append([]byte(nil), proxyV2Signature...)
+	if !known {
+		// LOCAL command, no addresses
+		return append(h, 0x20, 0x00, 0, 0)
+	}
+	family := byte(0x11) // TCP over IPv4
+	if len(sip) == net.IPv6len {
+		family = 0x21 // TCP over IPv6
+	}
+	h = append(h, 0x21, family)
+	h = append(h, 0, 0)
+	binary.BigEndian.PutUint16(h[len(h)-2:], uint16(2*len(sip)+4))
+	h = append(h, sip...)
+	h = append(h, dip...)
+	h = append(h, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(h[len(h)-4:], uint16(s.Port))
+	binary.BigEndian.PutUint16(h[len(h)-2:], uint16(d.Port))
+	return h
+}
+
+// sendProxyHeader - Announce the client to a connection just dialed for it,
+// when SendProxy is set
+func (p *Proxy) sendProxyHeader(conn net.Conn) error {
+	if p.SendProxy == ProxyProtocolOff {
+		return nil
+	}
+	var src, dst net.Addr
+	if c, ok := p.lconn.(net.Conn); ok {
+		src, dst = c.RemoteAddr(), c.LocalAddr()
+	}
+	if _, err := conn.Write(proxyHeader(p.SendProxy, src, dst)); err != nil {
+		return fmt.Errorf("sending PROXY protocol header failed: %w", err)
+	}
+	return nil
+}
+
+// dialRemote - Connect to a remote, sending the PROXY protocol header
+func (p *Proxy) dialRemote(network, address string) (net.Conn, error) {
+	conn, err := p.dialer().Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.sendProxyHeader(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// String - The version as ParseProxyProtocol takes it
+func (v ProxyProtocol) String() string {
+	switch v {
+	case ProxyProtocolOff:
+		return "off"
+	case ProxyProtocolV1:
+		return "v1"
+	case ProxyProtocolV2:
+		return "v2"
+	}
+	return "ProxyProtocol(" + strconv.Itoa(int(v)) + ")"
+}
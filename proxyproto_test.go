@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v4 := func(s string, port int) *net.TCPAddr { return &net.TCPAddr{IP: net.ParseIP(s), Port: port} }
+	tests := []struct {
+		name    string
+		version ProxyProtocol
+		src     net.Addr
+		dst     net.Addr
+		want    []byte
+	}{
+		{"v1 ipv4", ProxyProtocolV1, v4("192.0.2.1", 5000), v4("198.51.100.2", 443),
+			[]byte("PROXY TCP4 192.0.2.1 198.51.100.2 5000 443\r\n")},
+		{"v1 ipv6", ProxyProtocolV1, v4("2001:db8::1", 5000), v4("2001:db8::2", 443),
+			[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 5000 443\r\n")},
+		{"v1 unknown", ProxyProtocolV1, nil, nil, []byte("PROXY UNKNOWN\r\n")},
+		{"v2 ipv4", ProxyProtocolV2, v4("192.0.2.1", 5000), v4("198.51.100.2", 443),
+			append(append([]byte(nil), proxyV2Signature...),
+				0x21, 0x11, 0, 12,
+				192, 0, 2, 1, 198, 51, 100, 2,
+				0x13, 0x88, 0x01, 0xbb)},
+		{"v2 unknown", ProxyProtocolV2, nil, nil,
+			append(append([]byte(nil), proxyV2Signature...), 0x20, 0x00, 0, 0)},
+	}
+	for _, tt := range tests {
+		if got := proxyHeader(tt.version, tt.src, tt.dst); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: wanted %q, got %q", tt.name, tt.want, got)
+		}
+	}
+
+	// mixed families are sent as IPv6
+	h := proxyHeader(ProxyProtocolV2, v4("192.0.2.1", 5000), v4("2001:db8::2", 443))
+	if len(h) != 16+36 || h[13] != 0x21 || binary.BigEndian.Uint16(h[14:]) != 36 {
+		t.Errorf("unexpected mixed family header %x", h)
+	}
+}
+
+func TestParseProxyProtocol(t *testing.T) {
+	for _, s := range []string{"", "off", "v1", "v2"} {
+		v, err := ParseProxyProtocol(s)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", s, err)
+		}
+		if s != "" && v.String() != s {
+			t.Errorf("%q parsed as %s", s, v)
+		}
+	}
+	if _, err := ParseProxyProtocol("v3"); err == nil {
+		t.Error("expected an error for v3")
+	}
+}
+
+// startProxyHeaderEcho - A remote that reads a v2 PROXY protocol header for
+// an IPv4 client, reports it, and then echoes everything else
+func startProxyHeaderEcho(t *testing.T) (*net.TCPListener, <-chan []byte) {
+	t.Helper()
+	l := listenLocal(t)
+	headers := make(chan []byte, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		h := make([]byte, 16+12)
+		if _, err := io.ReadFull(c, h); err != nil {
+			return
+		}
+		headers <- h
+		io.Copy(c, c)
+	}()
+	return l, headers
+}
+
+func TestSendProxyToRemoteAndShadow(t *testing.T) {
+	remote, remoteHeaders := startProxyHeaderEcho(t)
+	defer remote.Close()
+	shadow, shadowHeaders := startProxyHeaderEcho(t)
+	defer shadow.Close()
+
+	results := make(chan shadowResult, 1)
+	client, done := startProxy(t, remote.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.SendProxy = ProxyProtocolV2
+		p.ShadowAddr = shadow.Addr().String()
+		p.CompareShadow = func(primary, shadow []byte) {
+			results <- shadowResult{string(primary), string(shadow)}
+		}
+	})
+	if got := echoRoundTrip(t, client, "hello"); got != "hello" {
+		t.Errorf("header should not reach the client, got %q", got)
+	}
+	want := proxyHeader(ProxyProtocolV2, client.LocalAddr(), client.RemoteAddr())
+	client.Close()
+	<-done
+
+	for name, headers := range map[string]<-chan []byte{"remote": remoteHeaders, "shadow": shadowHeaders} {
+		select {
+		case h := <-headers:
+			if !bytes.Equal(h, want) {
+				t.Errorf("%s got header %x, wanted %x", name, h, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s never got a header", name)
+		}
+	}
+	if r := <-results; r.shadow != "hello" {
+		t.Errorf("shadow should see the data after its header, got %q", r.shadow)
+	}
+}
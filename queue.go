@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// queueRetryMin, queueRetryMax - How long a queued connection waits before
+// redialing the remote, doubling from the first to the second
+const (
+	queueRetryMin = 50 * time.Millisecond
+	queueRetryMax = time.Second
+)
+
+// ErrQueueFull - Returned for a connection the remote refused while its
+// DialQueue was full
+var ErrQueueFull = errors.New("dial queue full")
+
+// DialQueue - Holds on to connections whose remote refused them, redialing
+// it with backoff until it accepts or Timeout passes, so a backend that is
+// briefly at capacity doesn't turn clients away. At most Size connections
+// wait at once; beyond that the remote's refusal is passed straight on. One
+// DialQueue is usually shared by all connections to a backend.
+type DialQueue struct {
+	Size    int
+	Timeout time.Duration
+
+	waiting int32
+}
+
+// NewDialQueue - A DialQueue holding up to size connections for up to
+// timeout each
+func NewDialQueue(size int, timeout time.Duration) *DialQueue {
+	return &DialQueue{Size: size, Timeout: timeout}
+}
+
+// Waiting - How many connections are waiting in the queue
+func (q *DialQueue) Waiting() int {
+	return int(atomic.LoadInt32(&q.waiting))
+}
+
+// join - Take a place in the queue, false when it is full
+func (q *DialQueue) join() bool {
+	for {
+		n := atomic.LoadInt32(&q.waiting)
+		if int(n) >= q.Size {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&q.waiting, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (q *DialQueue) leave() {
+	atomic.AddInt32(&q.waiting, -1)
+}
+
+// wsaeConnRefused - The errno Windows dials fail with when refused, which
+// isn't syscall.ECONNREFUSED there
+const wsaeConnRefused = syscall.Errno(10061)
+
+// refused - Whether a dial failed because nothing accepted the connection
+func refused(err error) bool {
+	var errno syscall.Errno
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.As(err, &errno) && errno == wsaeConnRefused
+}
+
+// queueDial - dial, and while the remote refuses the connection wait in the
+// DialQueue and dial again
+func (p *Proxy) queueDial(dial func(network, address string) (net.Conn, error), network, address string) (net.Conn, error) {
+	conn, err := dial(network, address)
+	q := p.DialQueue
+	if q == nil || !refused(err) {
+		return conn, err
+	}
+	if !q.join() {
+		return nil, fmt.Errorf("%w: %v", ErrQueueFull, err)
+	}
+	defer q.leave()
+
+	clock := p.clock()
+	start := clock.Now()
+	p.Log.Info("Remote refused the connection, queued for up to %v", q.Timeout)
+	deadline := clock.NewTimer(q.Timeout)
+	defer deadline.Stop()
+	for wait := queueRetryMin; ; {
+		select {
+		case <-deadline.C():
+			return nil, fmt.Errorf("remote still refusing after %v in the queue: %w", q.Timeout, err)
+		case <-p.errsig:
+			return nil, err
+		case <-clock.After(wait):
+		}
+		if conn, err = dial(network, address); !refused(err) {
+			if err == nil {
+				p.Log.Info("Remote accepted the connection after %v in the queue", clock.Now().Sub(start))
+			}
+			return conn, err
+		}
+		if wait *= 2; wait > queueRetryMax {
+			wait = queueRetryMax
+		}
+	}
+}
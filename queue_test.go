@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// refusingAddr - An address on which nothing listens, so dials are refused
+func refusingAddr(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	l := listenLocal(t)
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+	return addr
+}
+
+func TestDialQueue(t *testing.T) {
+	addr := refusingAddr(t)
+	q := NewDialQueue(1, 5*time.Second)
+	client, done := startProxy(t, addr, func(p *Proxy) { p.DialQueue = q })
+	defer func() {
+		client.Close()
+		<-done
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for q.Waiting() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if q.Waiting() != 1 {
+		t.Fatalf("wanted the refused connection in the queue")
+	}
+
+	// the backend frees up
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen on %v again: %v", addr, err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+	if got := echoRoundTrip(t, client, "queued"); got != "queued" {
+		t.Errorf("wanted the queued connection relayed, got %q", got)
+	}
+	if n := q.Waiting(); n != 0 {
+		t.Errorf("wanted the connection to leave the queue, %d still waiting", n)
+	}
+}
+
+func TestDialQueueLimits(t *testing.T) {
+	addr := refusingAddr(t)
+	for _, tc := range []struct {
+		name   string
+		queue  *DialQueue
+		reason string
+	}{
+		{"full", NewDialQueue(0, time.Minute), ErrQueueFull.Error()},
+		{"timeout", NewDialQueue(1, 100*time.Millisecond), "still refusing after 100ms"},
+	} {
+		var proxy *Proxy
+		client, done := startProxy(t, addr, func(p *Proxy) {
+			proxy = p
+			p.DialQueue = tc.queue
+		})
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: the connection wasn't given up on", tc.name)
+		}
+		client.Close()
+		if reason := proxy.CloseReason(); !strings.Contains(reason, tc.reason) {
+			t.Errorf("%s: wanted a close reason containing %q, got %q", tc.name, tc.reason, reason)
+		}
+	}
+}
+
+func TestDialQueueOnlyRefusals(t *testing.T) {
+	p := &Proxy{DialQueue: NewDialQueue(1, time.Minute), Log: NullLogger{}}
+	dials := 0
+	failing := errors.New("no such host")
+	_, err := p.queueDial(func(network, address string) (net.Conn, error) {
+		dials++
+		return nil, failing
+	}, "tcp", "backend:80")
+	if err != failing || dials != 1 {
+		t.Errorf("wanted errors other than refusals returned at once, got %v after %d dials", err, dials)
+	}
+}
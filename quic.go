@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"sync"
+)
+
+// QUICDialer - Connects to a QUIC remote with cfg and opens the stream a
+// connection is relayed over. ctx bounds the handshake. The stream should
+// provide CloseWrite, ConnectionState and RemoteAddr like a *tls.Conn, see
+// RemoteTLS.
+type QUICDialer func(ctx context.Context, address string, cfg *tls.Config) (io.ReadWriteCloser, error)
+
+var (
+	quicDialerLock sync.RWMutex
+	quicDialer     QUICDialer
+)
+
+// ErrQUICDisabled - Returned when dialing a QUIC remote while no QUICDialer
+// is registered
+var ErrQUICDisabled = errors.New("QUIC disabled in this build")
+
+// defaultQUICProtos - Offered with ALPN when neither TLSConfig nor
+// TLSNextProtos name any, as a QUIC handshake needs an application protocol
+var defaultQUICProtos = []string{"h3"}
+
+// RegisterQUIC - Set the dialer used for QUIC remotes. quic-go needs a far
+// newer Go than the rest of the proxy, so it lives in a module of its own,
+// gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy/quic, which registers it when
+// imported. nil unregisters it.
+func RegisterQUIC(d QUICDialer) {
+	quicDialerLock.Lock()
+	quicDialer = d
+	quicDialerLock.Unlock()
+}
+
+// QUICEnabled - Whether a QUICDialer is registered, so proxies can connect
+// to remotes over QUIC
+func QUICEnabled() bool {
+	quicDialerLock.RLock()
+	defer quicDialerLock.RUnlock()
+	return quicDialer != nil
+}
+
+// dialQUIC - Connect to a QUIC remote with TLSConfig like dialTLS and open
+// the stream to relay over. BindDevice, FWMark and SendProxy don't apply.
+func (p *Proxy) dialQUIC(address string) (io.ReadWriteCloser, error) {
+	quicDialerLock.RLock()
+	dial := quicDialer
+	quicDialerLock.RUnlock()
+	if dial == nil {
+		return nil, ErrQUICDisabled
+	}
+	cfg := p.remoteTLSConfig(address)
+	if len(cfg.NextProtos) == 0 {
+		cfg = cfg.Clone()
+		cfg.NextProtos = defaultQUICProtos
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.dialTimeout())
+	defer cancel()
+	return dial(ctx, address, cfg)
+}
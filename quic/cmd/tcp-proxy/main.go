@@ -0,0 +1,16 @@
+// tcp-proxy with QUIC remotes, see --quic
+package main
+
+import (
+	"os"
+
+	"gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy/internal/cli"
+	_ "gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy/quic"
+)
+
+// version - Set when building a release, like the tcp-proxy without QUIC
+var version = "0.0.0-src"
+
+func main() {
+	cli.Main(version, os.Args[1:])
+}
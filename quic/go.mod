@@ -0,0 +1,26 @@
+module gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy/quic
+
+go 1.26.0
+
+require (
+	github.com/quic-go/quic-go v0.63.0
+	gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/fsnotify/fsnotify v1.6.0 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
+	github.com/hillu/go-yara/v4 v4.2.3 // indirect
+	github.com/mattn/go-colorable v0.1.4 // indirect
+	github.com/mattn/go-isatty v0.0.8 // indirect
+	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/crypto v0.54.0 // indirect
+	golang.org/x/net v0.56.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy => ../
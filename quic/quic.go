@@ -0,0 +1,68 @@
+// Package quic - Lets go-tcp-proxy connect to remotes over QUIC, see
+// Proxy.QUIC. Importing it registers its Dial with proxy.RegisterQUIC. It is
+// a module of its own because quic-go needs a much newer Go than the rest of
+// the proxy.
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+
+	"github.com/quic-go/quic-go"
+	proxy "gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy"
+)
+
+func init() {
+	proxy.RegisterQUIC(Dial)
+}
+
+// stream - The stream a connection is relayed over. Its QUIC connection
+// carries nothing else, so closing the stream closes that too.
+type stream struct {
+	io.ReadWriteCloser
+	state     tls.ConnectionState
+	addr      net.Addr
+	closeConn func() error
+}
+
+// CloseWrite - End the stream's sending side, the remote reads EOF
+func (s *stream) CloseWrite() error {
+	return s.ReadWriteCloser.Close()
+}
+
+func (s *stream) Close() error {
+	s.ReadWriteCloser.Close()
+	return s.closeConn()
+}
+
+func (s *stream) ConnectionState() tls.ConnectionState {
+	return s.state
+}
+
+func (s *stream) RemoteAddr() net.Addr {
+	return s.addr
+}
+
+// Dial - Connect to the QUIC remote at address with cfg and open a stream
+// on a connection of its own, a proxy.QUICDialer
+func Dial(ctx context.Context, address string, cfg *tls.Config) (io.ReadWriteCloser, error) {
+	conn, err := quic.DialAddr(ctx, address, cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	str, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return &stream{
+		ReadWriteCloser: str,
+		state:           conn.ConnectionState().TLS,
+		addr:            conn.RemoteAddr(),
+		closeConn: func() error {
+			return conn.CloseWithError(0, "")
+		},
+	}, nil
+}
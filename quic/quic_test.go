@@ -0,0 +1,114 @@
+package quic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	proxy "gitlab.cs.uno.edu/dgmcdona/go-tcp-proxy"
+)
+
+// startQUICEcho - A QUIC server echoing every stream, with a self-signed
+// certificate for 127.0.0.1 offering the h3 protocol
+func startQUICEcho(t *testing.T) *quic.Listener {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h3"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				io.Copy(stream, stream)
+				stream.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestQUICRemote(t *testing.T) {
+	if !proxy.QUICEnabled() {
+		t.Fatal("importing the quic module should register its dialer")
+	}
+	remote := startQUICEcho(t)
+	defer remote.Close()
+	addr := remote.Addr().(*net.UDPAddr)
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	lconn, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := proxy.New(lconn, l.Addr().(*net.TCPAddr), &net.TCPAddr{IP: addr.IP, Port: addr.Port})
+	p.UnwrapTLS = true
+	p.QUIC = true
+	p.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	done := make(chan struct{})
+	go func() {
+		p.Start()
+		close(done)
+	}()
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("wanted echo over QUIC, got %q, %v", buf, err)
+	}
+	client.Close()
+	<-done
+
+	state := p.RemoteTLS()
+	if state == nil || state.Version != tls.VersionTLS13 || state.NegotiatedProtocol != "h3" {
+		t.Errorf("unexpected remote TLS state %+v", state)
+	}
+}
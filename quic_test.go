@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQUICDisabled(t *testing.T) {
+	if QUICEnabled() {
+		t.Fatal("QUICEnabled should be false without a registered QUICDialer")
+	}
+	echo := startEcho(t)
+	defer echo.Close()
+
+	var p *Proxy
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(proxy *Proxy) {
+		p = proxy
+		p.UnwrapTLS = true
+		p.QUIC = true
+	})
+	<-done
+	client.Close()
+	if !strings.Contains(p.CloseReason(), ErrQUICDisabled.Error()) {
+		t.Errorf("expected the remote connection to fail with %v, got %q", ErrQUICDisabled, p.CloseReason())
+	}
+}
+
+func TestQUICDialer(t *testing.T) {
+	remote, _ := startTLSEcho(t)
+	defer remote.Close()
+	var protos []string
+	var bounded bool
+	// TLS over TCP stands in for the QUIC stream
+	RegisterQUIC(func(ctx context.Context, address string, cfg *tls.Config) (io.ReadWriteCloser, error) {
+		protos = cfg.NextProtos
+		_, bounded = ctx.Deadline()
+		return tls.Dial("tcp", address, cfg)
+	})
+	defer RegisterQUIC(nil)
+	if !QUICEnabled() {
+		t.Fatal("QUICEnabled should be true with a registered QUICDialer")
+	}
+
+	var p *Proxy
+	client, done := startProxy(t, remote.Addr().(*net.TCPAddr), func(proxy *Proxy) {
+		p = proxy
+		p.UnwrapTLS = true
+		p.QUIC = true
+		p.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	})
+	if got := echoRoundTrip(t, client, "hello"); got != "hello" {
+		t.Fatalf("wanted echo over the QUIC dialer's stream, got %q", got)
+	}
+	client.Close()
+	<-done
+
+	if !reflect.DeepEqual(protos, []string{"h3"}) || !bounded {
+		t.Errorf("wanted h3 offered and the handshake bounded, got %v and %v", protos, bounded)
+	}
+	if p.RemoteTLS() == nil {
+		t.Errorf("wanted the stream's TLS state recorded")
+	}
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"syscall"
+)
+
+// closedWithoutData - Whether err means the remote hung up before sending
+// anything, as backends that are restarting often do right after accepting.
+// If so the connection is shut down quietly with its own close reason,
+// instead of warning about a failed read or write.
+func (p *Proxy) closedWithoutData(err error) bool {
+	if atomic.LoadInt32(&p.remoteSent) != 0 {
+		return false
+	}
+	switch {
+	case err == io.EOF && p.LingerAfterEOF <= 0:
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+	default:
+		return false
+	}
+	p.stopOnce.Do(func() {
+		p.setCloseReason("remote closed without data")
+		p.Log.Debug("Remote closed without sending any data: %v", err)
+		p.signalStop()
+	})
+	return true
+}
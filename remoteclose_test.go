@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteClosedWithoutData(t *testing.T) {
+	for _, reset := range []bool{false, true} {
+		remote := listenLocal(t)
+		defer remote.Close()
+		go func(reset bool) {
+			for {
+				c, err := remote.AcceptTCP()
+				if err != nil {
+					return
+				}
+				if reset {
+					c.SetLinger(0)
+				}
+				c.Close()
+			}
+		}(reset)
+
+		var logs bytes.Buffer
+		var p *Proxy
+		client, done := startProxy(t, remote.Addr().(*net.TCPAddr), func(proxy *Proxy) {
+			proxy.Log = ColorLogger{Writer: &logs}
+			p = proxy
+		})
+		defer client.Close()
+		client.Write([]byte("hello"))
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("connection wasn't closed")
+		}
+		if reason := p.CloseReason(); reason != "remote closed without data" {
+			t.Errorf("reset %v: unexpected close reason %q", reset, reason)
+		}
+		if strings.Contains(logs.String(), "failed") {
+			t.Errorf("reset %v: a remote closing early shouldn't be logged as a failure:\n%s", reset, logs.String())
+		}
+	}
+}
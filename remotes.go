@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// errNoRemotes - Returned by RemoteFile.Route while the file lists no usable
+// addresses
+var errNoRemotes = errors.New("no remotes listed in remote file")
+
+// RemoteFile - Backend addresses read from a file, one host:port per line,
+// that new connections are spread over in turn. Blank lines and lines
+// starting with # are ignored. The file is watched and re-read whenever it
+// changes; its Route method is meant to be used as a Proxy's Router.
+type RemoteFile struct {
+	Log     Logger
+	path    string
+	watcher *fsnotify.Watcher
+
+	mu    sync.Mutex
+	addrs []string
+	next  int
+}
+
+// OpenRemoteFile - Read the remotes in path and start watching it for
+// changes. Fails only when the file can't be read or watched; a file that
+// lists no valid addresses is loaded, and rejects connections until it does.
+func OpenRemoteFile(path string, log Logger) (*RemoteFile, error) {
+	if log == nil {
+		log = NullLogger{}
+	}
+	r := &RemoteFile{Log: log, path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	// watch the directory rather than the file, so editors that replace the
+	// file instead of writing it are noticed too
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher for remote file: %w", err)
+	}
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("failed to watch remote file %s: %w", path, err)
+	}
+	r.watcher = w
+	go r.watch()
+	return r, nil
+}
+
+func (r *RemoteFile) watch() {
+	name := filepath.Clean(r.path)
+	for evt := range r.watcher.Events {
+		if filepath.Clean(evt.Name) != name || !(evt.Has(fsnotify.Write) || evt.Has(fsnotify.Create)) {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			r.Log.Warn("error reloading remote file, keeping previous remotes: %v", err)
+		}
+	}
+}
+
+// Reload - Re-read the file. When it can't be read the previous addresses
+// stay in use.
+func (r *RemoteFile) Reload() error {
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return fmt.Errorf("failed to read remote file: %w", err)
+	}
+	addrs := r.parse(data)
+	if len(addrs) == 0 {
+		r.Log.Warn("remote file %s lists no remotes, new connections will be rejected", r.path)
+	} else {
+		r.Log.Info("Loaded %d remotes from %s: %s", len(addrs), r.path, strings.Join(addrs, ", "))
+	}
+
+	r.mu.Lock()
+	r.addrs = addrs
+	r.next = 0
+	r.mu.Unlock()
+	return nil
+}
+
+// parse - The valid addresses in data, warning about the others
+func (r *RemoteFile) parse(data []byte) []string {
+	var addrs []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := checkRemoteAddr(line); err != nil {
+			r.Log.Warn("skipping line %d of remote file %s: %v", n, r.path, err)
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	return addrs
+}
+
+func checkRemoteAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("address %q has no host", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("address %q has an invalid port", addr)
+	}
+	return nil
+}
+
+// Addresses - The remotes currently listed
+func (r *RemoteFile) Addresses() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.addrs...)
+}
+
+// Route - Pick the next remote in turn, for use as a Proxy's Router
+func (r *RemoteFile) Route(clientAddr net.Addr, peek []byte) (string, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.addrs) == 0 {
+		return "", "", errNoRemotes
+	}
+	addr := r.addrs[r.next%len(r.addrs)]
+	r.next++
+	return "tcp", addr, nil
+}
+
+// Close - Stop watching the file
+func (r *RemoteFile) Close() error {
+	if r.watcher == nil {
+		return nil
+	}
+	return r.watcher.Close()
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func routeAll(t *testing.T, r *RemoteFile, n int) []string {
+	t.Helper()
+	var got []string
+	for i := 0; i < n; i++ {
+		_, addr, err := r.Route(nil, nil)
+		if err != nil {
+			t.Fatalf("route failed: %v", err)
+		}
+		got = append(got, addr)
+	}
+	return got
+}
+
+func TestRemoteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "remotes")
+	write := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# backends\n10.0.0.1:80\n\nnot an address\n10.0.0.2:80\nhost:99999\n")
+
+	r, err := OpenRemoteFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	got := routeAll(t, r, 4)
+	want := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.1:80", "10.0.0.2:80"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected round robin over valid lines %v, got %v", want, got)
+		}
+	}
+
+	write("10.0.0.3:8080\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if addrs := r.Addresses(); len(addrs) == 1 && addrs[0] == "10.0.0.3:8080" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("edited file not picked up, remotes are %v", r.Addresses())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := routeAll(t, r, 2); got[0] != "10.0.0.3:8080" || got[1] != "10.0.0.3:8080" {
+		t.Errorf("expected new remote after edit, got %v", got)
+	}
+
+	write("")
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Route(nil, nil); err == nil {
+		t.Error("expected an empty remote file to reject connections")
+	}
+}
+
+func TestOpenRemoteFileMissing(t *testing.T) {
+	if _, err := OpenRemoteFile(filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Error("expected an error for a missing remote file")
+	}
+}
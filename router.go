@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// route - Peek at the start of the client's data, ask the Router where the
+// connection should go and dial it. The peeked bytes are forwarded to the
+// remote ahead of everything else.
+func (p *Proxy) route() error {
+	var clientAddr net.Addr
+	if c, ok := p.lconn.(net.Conn); ok {
+		clientAddr = c.RemoteAddr()
+	}
+
+	if err := p.peek(); err != nil {
+		return fmt.Errorf("routing: %w", err)
+	}
+
+	network, address, err := p.Router(clientAddr, p.peeked)
+	if err != nil {
+		return fmt.Errorf("router rejected connection: %w", err)
+	}
+
+	var conn net.Conn
+	if p.UnwrapTLS {
+		conn, err = p.queueDial(p.dialTLS, network, address)
+	} else {
+		conn, err = p.queueDial(p.dialRemote, network, address)
+	}
+	if err != nil {
+		return err
+	}
+	if raddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		p.raddr = raddr
+	}
+	p.rconn = conn
+	return nil
+}
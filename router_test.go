@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTagged - A remote that answers every read with its tag followed by
+// what it read
+func startTagged(t *testing.T, tag string) *net.TCPListener {
+	t.Helper()
+	l := listenLocal(t)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					c.Write(append([]byte(tag), buf[:n]...))
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestRouter(t *testing.T) {
+	a := startTagged(t, "A:")
+	defer a.Close()
+	b := startTagged(t, "B:")
+	defer b.Close()
+
+	router := func(clientAddr net.Addr, peek []byte) (string, string, error) {
+		if clientAddr == nil {
+			return "", "", errors.New("no client address")
+		}
+		switch {
+		case len(peek) == 0:
+			return "", "", errors.New("nothing to route on")
+		case peek[0] == 'a':
+			return "tcp", a.Addr().String(), nil
+		case peek[0] == 'b':
+			return "tcp", b.Addr().String(), nil
+		}
+		return "", "", errors.New("unknown protocol")
+	}
+
+	for _, tt := range []struct{ msg, want string }{
+		{"abc", "A:abc"},
+		{"bcd", "B:bcd"},
+	} {
+		// the fixed remote is unreachable, so only the router can get us there
+		client, done := startProxy(t, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, func(p *Proxy) {
+			p.Router = router
+			p.PeekSize = 1
+		})
+		if got := echoRoundTrip(t, client, tt.msg); got != tt.want {
+			t.Errorf("wanted %q, got %q", tt.want, got)
+		}
+		client.Close()
+		<-done
+	}
+}
+
+func TestRouterReject(t *testing.T) {
+	client, done := startProxy(t, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, func(p *Proxy) {
+		p.PeekSize = 4
+		p.Router = func(net.Addr, []byte) (string, string, error) {
+			return "", "", errors.New("go away")
+		}
+	})
+	defer client.Close()
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte("hi"))
+	<-done
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("rejected client should be closed, got %v", err)
+	}
+}
+
+func TestPeekTimeout(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	router := func(_ net.Addr, peek []byte) (string, string, error) {
+		if len(peek) == 0 {
+			return "tcp", echo.Addr().String(), nil
+		}
+		return "", "", errors.New("expected a silent client")
+	}
+
+	// a client that never speaks up is dropped
+	var p *Proxy
+	client, done := startProxy(t, nil, func(proxy *Proxy) {
+		p = proxy
+		p.Router = router
+		p.PeekSize = 16
+		p.PeekTimeout = 20 * time.Millisecond
+	})
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("a silent client should be dropped after PeekTimeout")
+	}
+	client.Close()
+	if want := "client sent nothing within 20ms"; !strings.Contains(p.CloseReason(), want) {
+		t.Errorf("wanted close reason %q, got %q", want, p.CloseReason())
+	}
+
+	// or routed without any initial bytes
+	client, done = startProxy(t, nil, func(p *Proxy) {
+		p.Router = router
+		p.PeekSize = 16
+		p.PeekTimeout = 20 * time.Millisecond
+		p.PeekFallback = true
+	})
+	time.Sleep(50 * time.Millisecond)
+	if got := echoRoundTrip(t, client, "late"); got != "late" {
+		t.Errorf("wanted the silent client routed to the default remote, got %q", got)
+	}
+	client.Close()
+	<-done
+}
+
+func TestPeekSizeLimit(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	peeked := make(chan string, 1)
+	client, done := startProxy(t, nil, func(p *Proxy) {
+		p.PeekSize = 4
+		p.PeekTimeout = time.Second
+		p.Router = func(_ net.Addr, peek []byte) (string, string, error) {
+			peeked <- string(peek)
+			return "tcp", echo.Addr().String(), nil
+		}
+	})
+	preamble := strings.Repeat("x", 1000)
+	if got := echoRoundTrip(t, client, preamble); got != preamble {
+		t.Errorf("the whole preamble should be forwarded, got %d bytes", len(got))
+	}
+	client.Close()
+	<-done
+	if got := <-peeked; got != "xxxx" {
+		t.Errorf("the router should only see PeekSize bytes, got %q", got)
+	}
+}
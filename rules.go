@@ -0,0 +1,41 @@
+package proxy
+
+import "sync"
+
+var (
+	activeRulesLock sync.RWMutex
+	activeRules     *YaraRules
+)
+
+// SetActiveRules - Set the compiled yara rules that every proxy started from
+// now on scans with, unless it was given rules of its own. Proxies that are
+// already running keep the rules they started with.
+func SetActiveRules(rules *YaraRules) {
+	activeRulesLock.Lock()
+	activeRules = rules
+	activeRulesLock.Unlock()
+}
+
+// ActiveRules - The rules set with SetActiveRules, or nil
+func ActiveRules() *YaraRules {
+	activeRulesLock.RLock()
+	defer activeRulesLock.RUnlock()
+	return activeRules
+}
+
+// useActiveRules - Give the proxy its own scanner for the active rules if it
+// doesn't have one yet
+func (p *Proxy) useActiveRules() {
+	p.scannerLock.Lock()
+	hasScanner := p.Scanner != nil
+	p.scannerLock.Unlock()
+	if hasScanner {
+		return
+	}
+
+	if rules := ActiveRules(); rules != nil {
+		if err := p.SetYaraRules(rules); err != nil {
+			p.Log.Warn("failed to use active yara rules: %v", err)
+		}
+	}
+}
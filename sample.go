@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// sample - Decide whether this connection is inspected, logging the choice
+// when SampleRate is in use
+func (p *Proxy) sample() bool {
+	if p.SampleRate <= 0 || p.SampleRate >= 1 {
+		return true
+	}
+	random := p.SampleRand
+	if random == nil {
+		random = rand.Float64
+	}
+	if random() < p.SampleRate {
+		p.Log.Info("Inspecting connection, sampled at rate %g", p.SampleRate)
+		return true
+	}
+	p.Log.Info("Passing connection through uninspected, not sampled at rate %g", p.SampleRate)
+	return false
+}
+
+// NewSampleRand - A seeded source for SampleRand, safe to share between
+// connections, so the same seed picks the same connections
+func NewSampleRand(seed int64) func() float64 {
+	var mu sync.Mutex
+	r := rand.New(rand.NewSource(seed))
+	return func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return r.Float64()
+	}
+}
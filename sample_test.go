@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// sampledRoundTrip - Send ping through a fresh connection and return what
+// came back, pong when the replacer ran
+func sampledRoundTrip(t *testing.T, configure func(*Proxy)) string {
+	t.Helper()
+	client, local := net.Pipe()
+	rconn, remote := net.Pipe()
+	p := NewConnected(local, rconn)
+	p.SetReplacers([]Replacer{&StringReplacer{"ping", "pong"}})
+	configure(p)
+	done := make(chan struct{})
+	go func() {
+		p.Start()
+		close(done)
+	}()
+	go io.Copy(remote, remote)
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	client.Close()
+	<-done
+	return string(buf)
+}
+
+func TestSampleRate(t *testing.T) {
+	const conns, rate = 400, 0.25
+	random := NewSampleRand(1)
+	inspected := 0
+	for i := 0; i < conns; i++ {
+		got := sampledRoundTrip(t, func(p *Proxy) {
+			p.SampleRate = rate
+			p.SampleRand = random
+		})
+		switch got {
+		case "pong":
+			inspected++
+		case "ping":
+		default:
+			t.Fatalf("unexpected response %q", got)
+		}
+	}
+	if frac := float64(inspected) / conns; frac < 0.18 || frac > 0.32 {
+		t.Errorf("expected about %g of connections inspected, got %g", rate, frac)
+	}
+}
+
+func TestSampleRandSeeded(t *testing.T) {
+	a, b := NewSampleRand(7), NewSampleRand(7)
+	for i := 0; i < 10; i++ {
+		if x, y := a(), b(); x != y {
+			t.Fatalf("same seed gave %g and %g", x, y)
+		}
+	}
+}
+
+func TestSampleRateUnset(t *testing.T) {
+	never := func() float64 { return 0.99 }
+	for _, rate := range []float64{0, 1} {
+		got := sampledRoundTrip(t, func(p *Proxy) {
+			p.SampleRate = rate
+			p.SampleRand = never
+		})
+		if got != "pong" {
+			t.Errorf("rate %g: expected every connection inspected, got %q", rate, got)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import "sync/atomic"
+
+// ScanLimiter - Bounds how many yara scans run at once across all the
+// connections sharing it, so that scanning under heavy load can't take every
+// core away from relaying data. A scan that finds the limiter full either
+// waits for a slot or, when the limiter skips, doesn't run at all and the
+// chunk is forwarded unscanned.
+type ScanLimiter struct {
+	slots   chan struct{}
+	skip    bool
+	skipped uint64
+}
+
+// NewScanLimiter - A limiter allowing max concurrent scans. With skip set,
+// scans are skipped instead of queued while max are running.
+func NewScanLimiter(max int, skip bool) *ScanLimiter {
+	if max < 1 {
+		max = 1
+	}
+	return &ScanLimiter{slots: make(chan struct{}, max), skip: skip}
+}
+
+// acquire - Take a slot for a scan, false if the scan should be skipped
+func (l *ScanLimiter) acquire() bool {
+	if l.skip {
+		select {
+		case l.slots <- struct{}{}:
+			return true
+		default:
+			atomic.AddUint64(&l.skipped, 1)
+			return false
+		}
+	}
+	l.slots <- struct{}{}
+	return true
+}
+
+func (l *ScanLimiter) release() {
+	<-l.slots
+}
+
+// Running - How many scans hold a slot right now
+func (l *ScanLimiter) Running() int {
+	return len(l.slots)
+}
+
+// Skipped - How many scans were skipped because the limiter was full
+func (l *ScanLimiter) Skipped() uint64 {
+	return atomic.LoadUint64(&l.skipped)
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runScans - Run n scans of d each through l at once, returning the most
+// that ran together and how many ran at all
+func runScans(l *ScanLimiter, n int, d time.Duration) (peak, ran int32) {
+	var running int32
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !l.acquire() {
+				return
+			}
+			defer l.release()
+			atomic.AddInt32(&ran, 1)
+			cur := atomic.AddInt32(&running, 1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if cur <= old || atomic.CompareAndSwapInt32(&peak, old, cur) {
+					break
+				}
+			}
+			time.Sleep(d)
+			atomic.AddInt32(&running, -1)
+		}()
+	}
+	wg.Wait()
+	return peak, ran
+}
+
+func TestScanLimiterQueues(t *testing.T) {
+	l := NewScanLimiter(3, false)
+	peak, ran := runScans(l, 32, 5*time.Millisecond)
+	if peak > 3 {
+		t.Errorf("expected at most 3 scans at once, saw %d", peak)
+	}
+	if ran != 32 || l.Skipped() != 0 {
+		t.Errorf("expected every scan to wait its turn, %d ran and %d skipped", ran, l.Skipped())
+	}
+	if l.Running() != 0 {
+		t.Errorf("expected all slots released, %d held", l.Running())
+	}
+}
+
+func TestScanLimiterSkips(t *testing.T) {
+	l := NewScanLimiter(2, true)
+	peak, ran := runScans(l, 32, 20*time.Millisecond)
+	if peak > 2 {
+		t.Errorf("expected at most 2 scans at once, saw %d", peak)
+	}
+	if ran == 32 || uint64(ran)+l.Skipped() != 32 {
+		t.Errorf("expected the scans over the limit to be skipped, %d ran and %d skipped", ran, l.Skipped())
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// NewFromConn - Create a new Proxy for a local connection of any kind, not
+// just TCP. Takes over the connection and closes it when finished.
+func NewFromConn(lconn net.Conn, raddr *net.TCPAddr) *Proxy {
+	laddr, _ := lconn.LocalAddr().(*net.TCPAddr)
+	return &Proxy{
+		lconn:  lconn,
+		laddr:  laddr,
+		raddr:  raddr,
+		errsig: make(chan struct{}),
+		Log:    NullLogger{},
+	}
+}
+
+// NewTLSUnwrappedFromConn - Like NewFromConn, for a remote TLS server whose
+// TLS is unwrapped as in NewTLSUnwrapped
+//
+// Deprecated: use NewFromConn and set UnwrapTLS and ServerName instead.
+func NewTLSUnwrappedFromConn(lconn net.Conn, raddr *net.TCPAddr, addr string) *Proxy {
+	p := NewFromConn(lconn, raddr)
+	p.unwrapTLSTo(addr)
+	return p
+}
+
+// NewConnected - Create a Proxy between a local connection and a remote one
+// that is already open, such as in-memory pipes. Start relays between them
+// without dialing anything.
+func NewConnected(lconn, rconn net.Conn) *Proxy {
+	p := NewFromConn(lconn, nil)
+	p.rconn = rconn
+	return p
+}
+
+// NewStream - Create a Proxy between two streams that need not be network
+// connections at all, such as SSH channels or pipes. Start runs the same
+// inspection and replacing as for sockets without dialing anything; steps
+// that need a socket, like Nagles and logging the MSS, are skipped.
+func NewStream(local, remote io.ReadWriteCloser) *Proxy {
+	return &Proxy{
+		lconn:  local,
+		rconn:  remote,
+		errsig: make(chan struct{}),
+		Log:    NullLogger{},
+	}
+}
+
+// Serve - Accept connections on an already open listener, such as one handed
+// over by systemd, and start the Proxy newProxy builds for each of them.
+// newProxy may return nil to turn a connection away. Returns once the
+// listener fails with a permanent error, e.g. because it was closed.
+func Serve(l net.Listener, newProxy func(net.Conn) *Proxy) error {
+	return NewListener(l, newProxy).Serve()
+}
+
+// errorBacklog - How many errors a Listener holds for a reader of Errors
+// before dropping new ones
+const errorBacklog = 64
+
+// ServeError - An error a Listener ran into. Fatal errors end Serve: the
+// listener failed for good and nothing more will be accepted. All others are
+// transient, the connection concerned is dropped and serving carries on.
+type ServeError struct {
+	// Op - "accept" for errors accepting a connection, "dial" for failures
+	// connecting an accepted one to its remote
+	Op string
+	// Client - The client whose remote connection failed, nil for accept
+	// errors
+	Client net.Addr
+	Err    error
+	Fatal  bool
+}
+
+func (e *ServeError) Error() string {
+	if e.Client != nil {
+		return fmt.Sprintf("%s for %v: %v", e.Op, e.Client, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *ServeError) Unwrap() error {
+	return e.Err
+}
+
+// Listener - Runs the accept loop of Serve and reports what goes wrong on its
+// Errors channel, for supervisors that want to restart or alert rather than
+// read logs
+type Listener struct {
+	l        net.Listener
+	newProxy func(net.Conn) *Proxy
+	errs     chan error
+	dropped  uint64
+}
+
+// NewListener - Create a Listener accepting on l, with newProxy as in Serve
+func NewListener(l net.Listener, newProxy func(net.Conn) *Proxy) *Listener {
+	return &Listener{l: l, newProxy: newProxy, errs: make(chan error, errorBacklog)}
+}
+
+// Errors - The errors Serve runs into, as *ServeError: temporary accept
+// errors and failed remote connections, which are transient, and finally the
+// fatal accept error Serve returns. The channel holds a bounded backlog and
+// is never closed; errors that arrive while it is full are dropped rather
+// than holding up connections, see Dropped.
+func (l *Listener) Errors() <-chan error {
+	return l.errs
+}
+
+// Dropped - How many errors were dropped because Errors was full
+func (l *Listener) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+func (l *Listener) report(err *ServeError) {
+	select {
+	case l.errs <- err:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+// Serve - Accept connections until the listener fails, as Serve does
+func (l *Listener) Serve() error {
+	var delay time.Duration
+	for {
+		conn, err := l.l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				l.report(&ServeError{Op: "accept", Err: err})
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			l.report(&ServeError{Op: "accept", Err: err, Fatal: true})
+			return err
+		}
+		delay = 0
+
+		p := l.newProxy(conn)
+		if p == nil {
+			conn.Close()
+			continue
+		}
+		client := conn.RemoteAddr()
+		p.dialFailed = func(err error) {
+			l.report(&ServeError{Op: "dial", Client: client, Err: err})
+		}
+		go p.Start()
+	}
+}
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeListener - An in-memory listener handing out net.Pipe connections
+type pipeListener struct {
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+func (l *pipeListener) Dial() net.Conn {
+	client, server := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestServe(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	raddr := echo.Addr().(*net.TCPAddr)
+
+	l := newPipeListener()
+	served := make(chan error, 1)
+	var mu sync.Mutex
+	count := 0
+	go func() {
+		served <- Serve(l, func(c net.Conn) *Proxy {
+			mu.Lock()
+			defer mu.Unlock()
+			count++
+			if count == 2 {
+				return nil
+			}
+			return NewFromConn(c, raddr)
+		})
+	}()
+
+	c := l.Dial()
+	if got := echoRoundTrip(t, c, "over a pipe"); got != "over a pipe" {
+		t.Errorf("wanted echo over the pipe, got %q", got)
+	}
+	c.Close()
+
+	rejected := l.Dial()
+	if _, err := rejected.Read(make([]byte, 1)); err == nil {
+		t.Errorf("connection turned away by newProxy should be closed")
+	}
+
+	l.Close()
+	if err := <-served; err == nil {
+		t.Errorf("Serve should return the listener's error")
+	}
+}
+
+func TestNewConnected(t *testing.T) {
+	client, local := net.Pipe()
+	rconn, remote := net.Pipe()
+	p := NewConnected(local, rconn)
+	p.SetReplacers([]Replacer{&StringReplacer{"ping", "pong"}})
+	done := make(chan struct{})
+	go func() {
+		p.Start()
+		close(done)
+	}()
+	go io.Copy(remote, remote)
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(buf) != "pong" {
+		t.Errorf("wanted pong, got %q", buf)
+	}
+	client.Close()
+	<-done
+}
+
+// stream - Hides everything about a net.Conn but reading, writing and
+// closing
+type stream struct {
+	io.ReadWriteCloser
+}
+
+func TestNewStream(t *testing.T) {
+	client, local := net.Pipe()
+	rconn, remote := net.Pipe()
+	p := NewStream(stream{local}, stream{rconn})
+	p.Nagles = true
+	p.SetReplacers([]Replacer{&StringReplacer{"ping", "pong"}})
+	done := make(chan struct{})
+	go func() {
+		p.Start()
+		close(done)
+	}()
+	go func() {
+		// answer each message with what the remote got
+		buf := make([]byte, 64)
+		for {
+			n, err := remote.Read(buf)
+			if err != nil {
+				remote.Close()
+				return
+			}
+			remote.Write(append([]byte("got "), buf[:n]...))
+		}
+	}()
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte("ping"))
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(buf) != "got pong" {
+		t.Errorf("wanted got pong, got %q", buf)
+	}
+	// a pipe's write returns once read, so the count may trail the data
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Stats().BytesReceived != 8 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	client.Close()
+	<-done
+	if stats := p.Stats(); stats.BytesSent != 4 || stats.BytesReceived != 8 {
+		t.Errorf("unexpected byte counts %+v", stats)
+	}
+}
+
+// tempError - A transient accept error, like running out of file descriptors
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// failingListener - Hands out its conns, after failing with each of errs in
+// turn
+type failingListener struct {
+	*pipeListener
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		l.mu.Unlock()
+		return nil, err
+	}
+	l.mu.Unlock()
+	return l.pipeListener.Accept()
+}
+
+func nextServeError(t *testing.T, errs <-chan error) *ServeError {
+	t.Helper()
+	select {
+	case err := <-errs:
+		return err.(*ServeError)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected an error on the channel")
+	}
+	return nil
+}
+
+func TestListenerErrors(t *testing.T) {
+	// a port nothing listens on
+	closed := listenLocal(t)
+	raddr := closed.Addr().(*net.TCPAddr)
+	closed.Close()
+
+	pl := &failingListener{pipeListener: newPipeListener(), errs: []error{tempError{}, tempError{}}}
+	l := NewListener(pl, func(c net.Conn) *Proxy {
+		return NewFromConn(c, raddr)
+	})
+	served := make(chan error, 1)
+	go func() { served <- l.Serve() }()
+
+	for i := 0; i < 2; i++ {
+		err := nextServeError(t, l.Errors())
+		if err.Op != "accept" || err.Fatal || !errors.Is(err, tempError{}) {
+			t.Errorf("expected a transient accept error, got %+v", err)
+		}
+	}
+
+	c := pl.Dial()
+	defer c.Close()
+	if err := nextServeError(t, l.Errors()); err.Op != "dial" || err.Fatal || err.Client == nil || !errors.Is(err, ErrRemoteDial) {
+		t.Errorf("expected a transient dial error, got %+v", err)
+	}
+
+	pl.Close()
+	if err := nextServeError(t, l.Errors()); err.Op != "accept" || !err.Fatal {
+		t.Errorf("expected a fatal accept error, got %+v", err)
+	}
+	if err := <-served; err == nil {
+		t.Errorf("Serve should return the listener's error")
+	}
+}
+
+func TestListenerErrorsBounded(t *testing.T) {
+	l := NewListener(newPipeListener(), nil)
+	for i := 0; i < errorBacklog+3; i++ {
+		l.report(&ServeError{Op: "accept", Err: tempError{}})
+	}
+	if len(l.Errors()) != errorBacklog || l.Dropped() != 3 {
+		t.Errorf("expected %d queued and 3 dropped, got %d and %d", errorBacklog, len(l.Errors()), l.Dropped())
+	}
+}
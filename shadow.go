@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"time"
+)
+
+const (
+	// defaultShadowTimeout - How long the shadow backend gets to connect,
+	// accept each write and finish responding once the connection closes
+	defaultShadowTimeout = 5 * time.Second
+	// maxShadowCapture - How much of each backend's response is kept for
+	// comparison
+	maxShadowCapture = 1 << 20
+)
+
+// cappedBuffer - A buffer that silently discards writes past max bytes
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room < len(p) {
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// runShadow - Send a copy of everything forwarded upstream to ShadowAddr and
+// compare what it sends back with the primary remote's response once the
+// connection ends. Frames come from a tap, so a slow or failed shadow never
+// holds up the connection; frames it can't keep up with are dropped.
+func (p *Proxy) runShadow(frames <-chan Frame) {
+	defer p.recoverPanic("shadow", false)
+
+	timeout := p.ShadowTimeout
+	if timeout <= 0 {
+		timeout = defaultShadowTimeout
+	}
+	primary := &cappedBuffer{max: maxShadowCapture}
+	shadow := &cappedBuffer{max: maxShadowCapture}
+
+	conn, err := net.DialTimeout("tcp", p.ShadowAddr, timeout)
+	if err == nil {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		if err = p.sendProxyHeader(conn); err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+	if err != nil {
+		p.Log.Warn("Shadow connection to %s failed: %s", p.ShadowAddr, err)
+	}
+	var readDone chan struct{}
+	if conn != nil {
+		defer conn.Close()
+		readDone = make(chan struct{})
+		go func() {
+			defer close(readDone)
+			buf := make([]byte, 0xffff)
+			for {
+				n, err := conn.Read(buf)
+				shadow.Write(buf[:n])
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	for f := range frames {
+		if f.Direction == Downstream {
+			primary.Write(f.Data)
+			continue
+		}
+		if conn == nil {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write(f.Data); err != nil {
+			p.Log.Warn("Shadow write to %s failed: %s", p.ShadowAddr, err)
+			conn.Close()
+			<-readDone
+			conn = nil
+		}
+	}
+
+	if conn != nil {
+		// let the shadow see the end of the request and finish responding
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		<-readDone
+	}
+
+	if p.CompareShadow != nil {
+		p.CompareShadow(primary.Bytes(), shadow.Bytes())
+	} else {
+		p.logShadowDiff(primary.Bytes(), shadow.Bytes())
+	}
+}
+
+// logShadowDiff - The default comparison, logging where the responses of the
+// two backends diverge
+func (p *Proxy) logShadowDiff(primary, shadow []byte) {
+	if bytes.Equal(primary, shadow) {
+		p.Log.Debug("Shadow response matches the primary response (%d bytes)", len(primary))
+		return
+	}
+	i := 0
+	for i < len(primary) && i < len(shadow) && primary[i] == shadow[i] {
+		i++
+	}
+	p.Log.Warn("Shadow response differs from the primary response at byte %d (%d bytes from primary, %d from shadow)",
+		i, len(primary), len(shadow))
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUpper - A remote that writes back everything it reads in upper case
+func startUpper(t *testing.T) *net.TCPListener {
+	t.Helper()
+	l := listenLocal(t)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 0xffff)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					c.Write(bytes.ToUpper(buf[:n]))
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+type shadowResult struct {
+	primary, shadow string
+}
+
+func TestShadow(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	upper := startUpper(t)
+	defer upper.Close()
+
+	results := make(chan shadowResult, 1)
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.ShadowAddr = upper.Addr().String()
+		p.CompareShadow = func(primary, shadow []byte) {
+			results <- shadowResult{string(primary), string(shadow)}
+		}
+	})
+	if got := echoRoundTrip(t, client, "hello"); got != "hello" {
+		t.Errorf("client should only see the primary response, got %q", got)
+	}
+	client.Close()
+	<-done
+
+	select {
+	case r := <-results:
+		if r.primary != "hello" || r.shadow != "HELLO" {
+			t.Errorf("wanted primary %q and shadow %q, got %q and %q", "hello", "HELLO", r.primary, r.shadow)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("comparison was never called")
+	}
+}
+
+func TestShadowUnreachable(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	dead := listenLocal(t)
+	dead.Close()
+
+	results := make(chan shadowResult, 1)
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.ShadowAddr = dead.Addr().String()
+		p.CompareShadow = func(primary, shadow []byte) {
+			results <- shadowResult{string(primary), string(shadow)}
+		}
+	})
+	if got := echoRoundTrip(t, client, "hello"); got != "hello" {
+		t.Errorf("a failed shadow should not affect the primary, got %q", got)
+	}
+	client.Close()
+	<-done
+
+	r := <-results
+	if r.primary != "hello" || r.shadow != "" {
+		t.Errorf("wanted only the primary response, got %q and %q", r.primary, r.shadow)
+	}
+}
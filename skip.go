@@ -0,0 +1,78 @@
+package proxy
+
+// Skip - How many bytes at the start and at the end of one direction's
+// stream are forwarded without being scanned or replaced, e.g. a protocol
+// header and a trailing checksum that must stay intact
+type Skip struct {
+	// Head - bytes at the start of the stream that pass uninspected
+	Head int
+	// Tail - bytes at the end of the stream that pass uninspected. Since
+	// the end isn't known until the sender closes, the last Tail bytes read
+	// are held back until more data follows or the stream ends, so a
+	// protocol that waits for a reply before sending more stalls. A stream
+	// shorter than Head and Tail together isn't inspected at all.
+	Tail int
+}
+
+// skipper - Splits one direction's chunks into the parts Skip leaves alone
+// and the part in between that is inspected
+type skipper struct {
+	Skip
+	headDone int
+	held     []byte
+}
+
+func (p *Proxy) newSkipper(direction Direction) *skipper {
+	skip := p.UpstreamSkip
+	if direction == Downstream {
+		skip = p.DownstreamSkip
+	}
+	if p.passthrough || (skip.Head <= 0 && skip.Tail <= 0) {
+		return nil
+	}
+	return &skipper{Skip: skip}
+}
+
+// split - Take in the next chunk and return the head bytes it contains,
+// which pass uninspected, and the bytes that are known not to be in the
+// tail, which are inspected. The rest is held back.
+func (s *skipper) split(b []byte) (head, body []byte) {
+	if len(s.held) > 0 {
+		b = append(s.held, b...)
+		s.held = nil
+	}
+	if n := s.Head - s.headDone; n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		head, b = b[:n], b[n:]
+		s.headDone += n
+	}
+	if s.Tail > 0 {
+		keep := s.Tail
+		if keep > len(b) {
+			keep = len(b)
+		}
+		s.held = append([]byte(nil), b[len(b)-keep:]...)
+		b = b[:len(b)-keep]
+	}
+	return head, b
+}
+
+// flush - The held back tail, once the stream has ended
+func (s *skipper) flush() []byte {
+	held := s.held
+	s.held = nil
+	return held
+}
+
+// skipScan - Count upstream bytes that bypassed the scanner, so offsets of
+// later rule matches still count from the start of the connection
+func (p *Proxy) skipScan(direction Direction, n int) {
+	if direction != Upstream || n == 0 {
+		return
+	}
+	p.scannerLock.Lock()
+	p.scanned += int64(n)
+	p.scannerLock.Unlock()
+}
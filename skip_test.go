@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSkipperSplit(t *testing.T) {
+	s := &skipper{Skip: Skip{Head: 3, Tail: 2}}
+	var heads, bodies string
+	for _, chunk := range []string{"ab", "cdef", "g", "hij"} {
+		head, body := s.split([]byte(chunk))
+		heads += string(head)
+		bodies += string(body)
+	}
+	if heads != "abc" {
+		t.Errorf("wanted head abc, got %q", heads)
+	}
+	if bodies != "defgh" {
+		t.Errorf("wanted body defgh, got %q", bodies)
+	}
+	if tail := string(s.flush()); tail != "ij" {
+		t.Errorf("wanted tail ij, got %q", tail)
+	}
+	if tail := s.flush(); len(tail) != 0 {
+		t.Errorf("tail should only be flushed once, got %q", tail)
+	}
+}
+
+// startSink - A remote that reads until the client closes and reports what
+// it got
+func startSink(t *testing.T) (*net.TCPListener, <-chan string) {
+	t.Helper()
+	l := listenLocal(t)
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		b, _ := ioutil.ReadAll(c)
+		received <- string(b)
+	}()
+	return l, received
+}
+
+func TestSkipHeadAndTail(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		skip Skip
+		sent string
+		want string
+	}{
+		{"head and tail", Skip{Head: 4, Tail: 4}, "CRC!body CRC! bodyCRC!", "CRC!body XXXX bodyCRC!"},
+		{"tail only", Skip{Tail: 4}, "CRC!CRC!", "XXXXCRC!"},
+		{"shorter than tail", Skip{Tail: 8}, "CRC!", "CRC!"},
+		{"shorter than head and tail", Skip{Head: 3, Tail: 3}, "CRC!", "CRC!"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sink, received := startSink(t)
+			defer sink.Close()
+			client, done := startProxy(t, sink.Addr().(*net.TCPAddr), func(p *Proxy) {
+				p.UpstreamReplacers = []Replacer{&StringReplacer{"CRC!", "XXXX"}}
+				p.UpstreamSkip = tc.skip
+			})
+			if _, err := client.Write([]byte(tc.sent)); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+			client.(*net.TCPConn).CloseWrite()
+			select {
+			case got := <-received:
+				if got != tc.want {
+					t.Errorf("wanted %q, got %q", tc.want, got)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("remote never got the stream")
+			}
+			client.Close()
+			<-done
+		})
+	}
+}
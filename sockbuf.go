@@ -0,0 +1,38 @@
+package proxy
+
+// readBufferSetter, writeBufferSetter - Connections whose socket buffers
+// can be sized, like *net.TCPConn
+type readBufferSetter interface {
+	SetReadBuffer(bytes int) error
+}
+
+type writeBufferSetter interface {
+	SetWriteBuffer(bytes int) error
+}
+
+// setSocketBuffers - Apply RecvBuf and SendBuf to both connections and log
+// the sizes the OS settled on, which may differ from the ones asked for.
+// Connections that aren't sockets are left alone.
+func (p *Proxy) setSocketBuffers() {
+	if p.RecvBuf <= 0 && p.SendBuf <= 0 {
+		return
+	}
+	for _, c := range []struct {
+		side string
+		conn interface{}
+	}{{"local", p.lconn}, {"remote", p.rconn}} {
+		if s, ok := c.conn.(readBufferSetter); ok && p.RecvBuf > 0 {
+			if err := s.SetReadBuffer(p.RecvBuf); err != nil {
+				p.Log.Warn("Failed to set the %s receive buffer to %d bytes: %v", c.side, p.RecvBuf, err)
+			}
+		}
+		if s, ok := c.conn.(writeBufferSetter); ok && p.SendBuf > 0 {
+			if err := s.SetWriteBuffer(p.SendBuf); err != nil {
+				p.Log.Warn("Failed to set the %s send buffer to %d bytes: %v", c.side, p.SendBuf, err)
+			}
+		}
+		if recv, send, ok := socketBuffers(c.conn); ok {
+			p.Log.Info("%s connection buffers are %d bytes to receive and %d to send", c.side, recv, send)
+		}
+	}
+}
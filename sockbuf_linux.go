@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// socketBuffers - Read the receive and send buffer sizes of a TCP
+// connection. Linux reports twice the size set, to account for its
+// bookkeeping overhead.
+func socketBuffers(conn interface{}) (recv, send int, ok bool) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, 0, false
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var rerr, serr error
+	if err := raw.Control(func(fd uintptr) {
+		recv, rerr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		send, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	}); err != nil || rerr != nil || serr != nil {
+		return 0, 0, false
+	}
+	return recv, send, true
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSocketBuffers(t *testing.T) {
+	l := listenLocal(t)
+	defer l.Close()
+	c, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+	accepted, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer accepted.Close()
+
+	_, before, ok := socketBuffers(c)
+	if !ok {
+		t.Fatalf("failed to read the socket buffers")
+	}
+	p := NewConnected(accepted, c)
+	// well below the default, linux doubles it to account for overhead
+	p.SendBuf = 4096
+	p.setSocketBuffers()
+	if _, after, _ := socketBuffers(c); after == before {
+		t.Errorf("the send buffer should have changed from %d bytes", before)
+	}
+
+	if _, _, ok := socketBuffers(nil); ok {
+		t.Errorf("non-TCP connections should report no buffers")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+// socketBuffers - Not supported on this platform
+func socketBuffers(conn interface{}) (recv, send int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// bufferedStream - A stream that records the socket buffer sizes set on it
+type bufferedStream struct {
+	io.ReadWriteCloser
+	read, write int
+}
+
+func (s *bufferedStream) SetReadBuffer(n int) error  { s.read = n; return nil }
+func (s *bufferedStream) SetWriteBuffer(n int) error { s.write = n; return nil }
+
+func TestSetSocketBuffers(t *testing.T) {
+	_, local := net.Pipe()
+	_, remote := net.Pipe()
+	l, r := &bufferedStream{ReadWriteCloser: local}, &bufferedStream{ReadWriteCloser: remote}
+	p := NewStream(l, r)
+	p.RecvBuf = 1 << 20
+	p.SendBuf = 1 << 19
+	p.setSocketBuffers()
+	for _, s := range []*bufferedStream{l, r} {
+		if s.read != 1<<20 || s.write != 1<<19 {
+			t.Errorf("wanted buffers of %d and %d bytes, got %d and %d", 1<<20, 1<<19, s.read, s.write)
+		}
+	}
+
+	// plain streams are skipped, without failing
+	p = NewStream(local, remote)
+	p.RecvBuf = 1 << 20
+	p.setSocketBuffers()
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats - A snapshot of a connection's counters
+type Stats struct {
+	BytesSent     uint64
+	BytesReceived uint64
+	SmallReads    uint64
+	TapDrops      uint64
+	// ScanTime - Time spent in yara scans
+	ScanTime time.Duration
+	// ReplaceTime - Time spent applying yara substitutions and replacers
+	ReplaceTime time.Duration
+}
+
+// Stats - Current counters for the connection. Safe to call while it runs.
+func (p *Proxy) Stats() Stats {
+	return Stats{
+		BytesSent:     atomic.LoadUint64(&p.sentBytes),
+		BytesReceived: atomic.LoadUint64(&p.receivedBytes),
+		SmallReads:    p.SmallReads(),
+		TapDrops:      p.TapDrops(),
+		ScanTime:      time.Duration(atomic.LoadInt64(&p.scanNanos)),
+		ReplaceTime:   time.Duration(atomic.LoadInt64(&p.replaceNanos)),
+	}
+}
+
+// Summary - The end of connection statistics, as written by the CLI's
+// --stats-output
+type Summary struct {
+	ID       uint64  `json:"id"`
+	UUID     string  `json:"uuid,omitempty"`
+	Client   string  `json:"client"`
+	Local    string  `json:"local"`
+	Remote   string  `json:"remote"`
+	Sent     uint64  `json:"sent"`
+	Received uint64  `json:"received"`
+	Duration float64 `json:"duration_seconds"`
+	Reason   string  `json:"reason"`
+	// Tags - the connection's Tags
+	Tags map[string]string `json:"tags,omitempty"`
+	// TLS - what the connections negotiated, when either is TLS
+	TLS *SummaryTLS `json:"tls,omitempty"`
+	// Hashes - the digests of the relayed data, with HashData
+	Hashes *DataHashes `json:"hashes,omitempty"`
+}
+
+// SummaryTLS - The TLS parameters of a connection's two sides
+type SummaryTLS struct {
+	Client *TLSInfo `json:"client,omitempty"`
+	Remote *TLSInfo `json:"remote,omitempty"`
+}
+
+// Summary - Describe the connection, meant to be called once Start has
+// returned. The duration covers the time from the remote connecting until
+// the connection closed.
+func (p *Proxy) Summary() Summary {
+	var duration time.Duration
+	if !p.started.IsZero() && !p.ended.IsZero() {
+		duration = p.ended.Sub(p.started)
+	}
+	stats := p.Stats()
+	var tlsInfo *SummaryTLS
+	client, remote := newTLSInfo(p.ClientTLS()), newTLSInfo(p.remoteTLS)
+	if client != nil || remote != nil {
+		tlsInfo = &SummaryTLS{Client: client, Remote: remote}
+	}
+	return Summary{
+		ID:       p.ID,
+		UUID:     p.UUID,
+		Client:   p.clientAddr(),
+		Local:    p.laddr.String(),
+		Remote:   p.remoteString(),
+		Sent:     stats.BytesSent,
+		Received: stats.BytesReceived,
+		Duration: duration.Seconds(),
+		Reason:   p.CloseReason(),
+		Tags:     p.tags(),
+		TLS:      tlsInfo,
+		Hashes:   p.Hashes(),
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// slowReplacer - Passes data through after a delay
+type slowReplacer struct{ delay time.Duration }
+
+func (r slowReplacer) Replace(in []byte) []byte {
+	time.Sleep(r.delay)
+	return in
+}
+
+func (r slowReplacer) String() string { return "slow" }
+
+func TestStatsReplaceTime(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	const delay = 20 * time.Millisecond
+	var proxy *Proxy
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.UpstreamReplacers = []Replacer{slowReplacer{delay}}
+		proxy = p
+	})
+	echoRoundTrip(t, client, "hello")
+	client.Close()
+	<-done
+
+	stats := proxy.Stats()
+	if stats.ReplaceTime < delay {
+		t.Errorf("wanted at least %v of replacer time, got %v", delay, stats.ReplaceTime)
+	}
+	if stats.ScanTime != 0 {
+		t.Errorf("no scanner was set, but got %v of scan time", stats.ScanTime)
+	}
+	if stats.BytesSent != 5 || stats.BytesReceived != 5 {
+		t.Errorf("wanted 5 bytes each way, got %d sent and %d received", stats.BytesSent, stats.BytesReceived)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	var proxy *Proxy
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.ID = 7
+		proxy = p
+	})
+	echoRoundTrip(t, client, "hello")
+	time.Sleep(10 * time.Millisecond)
+	clientAddr := client.LocalAddr().String()
+	client.Close()
+	<-done
+
+	s := proxy.Summary()
+	if s.ID != 7 || s.Client != clientAddr || s.Remote != echo.Addr().String() {
+		t.Errorf("unexpected connection details %+v", s)
+	}
+	if s.Sent != 5 || s.Received != 5 {
+		t.Errorf("wanted 5 bytes each way, got %d sent and %d received", s.Sent, s.Received)
+	}
+	if s.Duration < 0.01 {
+		t.Errorf("wanted a duration of at least 10ms, got %vs", s.Duration)
+	}
+	if s.Reason != "client closed" {
+		t.Errorf("wanted reason %q, got %q", "client closed", s.Reason)
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"sort"
+	"strings"
+)
+
+// SetTag - Tag the connection with key=value, replacing any value key had.
+// Safe to call while the connection runs.
+func (p *Proxy) SetTag(key, value string) {
+	p.tagsLock.Lock()
+	defer p.tagsLock.Unlock()
+	if p.Tags == nil {
+		p.Tags = make(map[string]string)
+	}
+	p.Tags[key] = value
+}
+
+// tags - A copy of Tags, nil when there are none
+func (p *Proxy) tags() map[string]string {
+	p.tagsLock.Lock()
+	defer p.tagsLock.Unlock()
+	if len(p.Tags) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(p.Tags))
+	for k, v := range p.Tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// tagString - Tags as key=value pairs sorted by key, e.g.
+// "[region=eu tenant=acme] ", or empty when there are none
+func (p *Proxy) tagString() string {
+	tags := p.tags()
+	if len(tags) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return "[" + strings.Join(pairs, " ") + "] "
+}
+
+// tagLogger - Starts each line with the connection's tags, as they are when
+// the line is logged
+type tagLogger struct {
+	Logger
+	p *Proxy
+}
+
+// withTags - l, logging the tags of p
+func withTags(l Logger, p *Proxy) Logger {
+	if l == nil {
+		l = NullLogger{}
+	}
+	if t, ok := l.(tagLogger); ok && t.p == p {
+		return l
+	}
+	return tagLogger{Logger: l, p: p}
+}
+
+// tagPrefix - Formats as the tagString of p, so the tags are only gathered
+// for lines the logger doesn't filter out
+type tagPrefix struct {
+	p *Proxy
+}
+
+func (t tagPrefix) String() string {
+	return t.p.tagString()
+}
+
+func (l tagLogger) Trace(f string, args ...interface{}) {
+	l.Logger.Trace("%s"+f, append([]interface{}{tagPrefix{l.p}}, args...)...)
+}
+
+func (l tagLogger) Debug(f string, args ...interface{}) {
+	l.Logger.Debug("%s"+f, append([]interface{}{tagPrefix{l.p}}, args...)...)
+}
+
+func (l tagLogger) Info(f string, args ...interface{}) {
+	l.Logger.Info("%s"+f, append([]interface{}{tagPrefix{l.p}}, args...)...)
+}
+
+func (l tagLogger) Warn(f string, args ...interface{}) {
+	l.Logger.Warn("%s"+f, append([]interface{}{tagPrefix{l.p}}, args...)...)
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	events, stop := readEvents(t, l)
+	defer stop()
+	sock := NewEventSocket("unix", path, nil)
+	defer sock.Close()
+
+	policy, err := ParsePolicy([]byte("rules:\n  - verdict: allow\n    cidr: [127.0.0.0/8]\n    tags: {zone: internal}\n"))
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+	echo := startEcho(t)
+	defer echo.Close()
+	var logs bytes.Buffer
+	var proxy *Proxy
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		proxy = p
+		p.Log = ColorLogger{Writer: &logs}
+		p.Tags = map[string]string{"tenant": "acme"}
+		p.Policy = policy
+		p.Events = sock
+	})
+	echoRoundTrip(t, client, "ping")
+	client.Close()
+	<-done
+
+	want := map[string]string{"tenant": "acme", "zone": "internal"}
+	for _, kind := range []string{"open", "close"} {
+		if e := nextEvent(t, events); e.Event != kind || !reflect.DeepEqual(e.ConnTags, want) {
+			t.Errorf("wanted a %s event tagged %v, got %+v", kind, want, e)
+		}
+	}
+	if got := proxy.Summary().Tags; !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted the summary tagged %v, got %v", want, got)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if !strings.HasPrefix(line, "[tenant=acme zone=internal] ") {
+			t.Errorf("log line without the tags: %q", line)
+		}
+	}
+}
+
+func TestSetTag(t *testing.T) {
+	var logs bytes.Buffer
+	p := &Proxy{}
+	p.Log = withTags(ColorLogger{Writer: &logs}, p)
+	p.Log.Info("untagged %d", 1)
+	p.SetTag("tenant", "acme")
+	p.SetTag("tenant", "globex")
+	p.Log.Info("tagged %d%%", 2)
+	if want := "untagged 1\n[tenant=globex] tagged 2%\n"; logs.String() != want {
+		t.Errorf("wanted %q, got %q", want, logs.String())
+	}
+	if withTags(p.Log, p) != p.Log {
+		t.Errorf("tags shouldn't be logged twice")
+	}
+}
+
+func TestTagsOnlyGatheredWhenLogged(t *testing.T) {
+	var logs bytes.Buffer
+	p := &Proxy{}
+	p.Log = withTags(ColorLogger{Writer: &logs}, p)
+	p.SetTag("tenant", "acme")
+	// gathering the tags would wait for the lock
+	p.tagsLock.Lock()
+	done := make(chan struct{})
+	go func() {
+		p.Log.Debug("filtered out")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a debug line below the log level gathered the tags")
+	}
+	p.tagsLock.Unlock()
+	if logs.Len() != 0 {
+		t.Errorf("wanted nothing logged, got %q", logs.String())
+	}
+}
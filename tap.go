@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// defaultTapBuffer - Frames a tap holds before new ones are dropped
+const defaultTapBuffer = 64
+
+// Frame - A chunk forwarded by the proxy, as copied to taps and handed to
+// the callbacks added with Iterate
+type Frame struct {
+	Direction Direction
+	// Data - the chunk as forwarded, after the replacers ran. An Iterate
+	// callback may change it in place or replace it; an empty Data forwards
+	// nothing.
+	Data []byte
+	// Offset - number of bytes forwarded in this direction before Data
+	Offset uint64
+	Time   time.Time
+}
+
+// Tap - Get a channel receiving a copy of every chunk the proxy forwards.
+// The proxy never waits on a tap: when its buffer (TapBuffer frames) is full
+// the frame is dropped and counted in TapDrops. The channel is closed once the
+// connection ends.
+func (p *Proxy) Tap() <-chan Frame {
+	size := p.TapBuffer
+	if size <= 0 {
+		size = defaultTapBuffer
+	}
+	ch := make(chan Frame, size)
+
+	p.tapLock.Lock()
+	defer p.tapLock.Unlock()
+	if p.tapsClosed {
+		close(ch)
+		return ch
+	}
+	p.taps = append(p.taps, ch)
+	return ch
+}
+
+// TapDrops - Number of frames dropped because a tap's buffer was full
+func (p *Proxy) TapDrops() uint64 {
+	return atomic.LoadUint64(&p.tapDrops)
+}
+
+func (p *Proxy) sendTaps(direction Direction, offset uint64, b []byte) {
+	p.tapLock.Lock()
+	defer p.tapLock.Unlock()
+	if len(p.taps) == 0 {
+		return
+	}
+
+	f := Frame{
+		Direction: direction,
+		Data:      append([]byte(nil), b...),
+		Offset:    offset,
+		Time:      p.clock().Now(),
+	}
+	for _, ch := range p.taps {
+		select {
+		case ch <- f:
+		default:
+			atomic.AddUint64(&p.tapDrops, 1)
+		}
+	}
+}
+
+func (p *Proxy) closeTaps() {
+	p.tapLock.Lock()
+	defer p.tapLock.Unlock()
+	for _, ch := range p.taps {
+		close(ch)
+	}
+	p.taps = nil
+	p.tapsClosed = true
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTapFrames(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	var frames <-chan Frame
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.SetReplacers([]Replacer{&StringReplacer{"ping", "pong"}})
+		frames = p.Tap()
+	})
+
+	echoRoundTrip(t, client, "ping")
+	client.Close()
+	<-done
+
+	want := []Frame{
+		{Direction: Upstream, Data: []byte("pong")},
+		{Direction: Downstream, Data: []byte("pong")},
+	}
+	var got []Frame
+	for f := range frames {
+		got = append(got, f)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("wanted %d frames, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].Direction != want[i].Direction || string(got[i].Data) != string(want[i].Data) {
+			t.Errorf("frame %d: wanted %s %q, got %s %q", i,
+				want[i].Direction, want[i].Data, got[i].Direction, got[i].Data)
+		}
+		if got[i].Offset != 0 {
+			t.Errorf("frame %d: wanted offset 0, got %d", i, got[i].Offset)
+		}
+		if got[i].Time.IsZero() {
+			t.Errorf("frame %d has no timestamp", i)
+		}
+	}
+}
+
+func TestTapDrops(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	var proxy *Proxy
+	var frames <-chan Frame
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.TapBuffer = 1
+		proxy = p
+		frames = p.Tap()
+	})
+
+	for _, msg := range []string{"one", "two", "three"} {
+		echoRoundTrip(t, client, msg)
+	}
+	client.Close()
+	<-done
+
+	if drops := proxy.TapDrops(); drops != 5 {
+		t.Errorf("wanted 5 dropped frames, got %d", drops)
+	}
+	f, ok := <-frames
+	if !ok || string(f.Data) != "one" {
+		t.Errorf("the first frame should have been kept, got %q", f.Data)
+	}
+	if _, ok := <-frames; ok {
+		t.Errorf("tap should be closed after the connection ends")
+	}
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// TextEncoding - A character encoding a backend may send text in, which
+// replacers can match in by way of UTF-8, see EncodedReplacer
+type TextEncoding interface {
+	// Decode - b as UTF-8, along with the bytes at the end of b that don't
+	// make up a whole character yet
+	Decode(b []byte) (text, rest []byte, err error)
+	// Encode - UTF-8 text in this encoding
+	Encode(text []byte) ([]byte, error)
+	String() string
+}
+
+// ParseTextEncoding - The TextEncoding by name: latin1 (or iso-8859-1),
+// utf-16le or utf-16be
+func ParseTextEncoding(name string) (TextEncoding, error) {
+	switch strings.ToLower(name) {
+	case "latin1", "latin-1", "iso-8859-1":
+		return xtextEncoding{charmap.ISO8859_1, "latin1"}, nil
+	case "utf-16le":
+		return xtextEncoding{unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), "utf-16le"}, nil
+	case "utf-16be":
+		return xtextEncoding{unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), "utf-16be"}, nil
+	default:
+		return nil, fmt.Errorf("unknown encoding %q, expected latin1, utf-16le or utf-16be", name)
+	}
+}
+
+// errInvalidUTF8 - Returned by Encode for text that isn't UTF-8
+var errInvalidUTF8 = errors.New("text is not valid UTF-8")
+
+// xtextEncoding - A TextEncoding from golang.org/x/text. UTF-16 is read and
+// written without a byte order mark.
+type xtextEncoding struct {
+	encoding.Encoding
+	name string
+}
+
+func (e xtextEncoding) Decode(b []byte) ([]byte, []byte, error) {
+	dec := e.NewDecoder()
+	text := make([]byte, 2*len(b)+utf8.UTFMax)
+	for {
+		// not at EOF, so a character cut off at the end of b is left
+		// undecoded, as is the high half of a surrogate pair
+		n, read, err := dec.Transform(text, b, false)
+		if err == transform.ErrShortDst {
+			text = make([]byte, 2*len(text))
+			dec.Reset()
+			continue
+		}
+		if err != nil && err != transform.ErrShortSrc {
+			return nil, nil, err
+		}
+		text = text[:n]
+		// the decoder puts U+FFFD in place of what isn't valid, such as
+		// an unpaired surrogate, which encodes back differently
+		if bytes.ContainsRune(text, utf8.RuneError) {
+			if again, err := e.Encode(text); err != nil || !bytes.Equal(again, b[:read]) {
+				return nil, nil, fmt.Errorf("invalid %s", e.name)
+			}
+		}
+		return text, b[read:], nil
+	}
+}
+
+func (e xtextEncoding) Encode(text []byte) ([]byte, error) {
+	// the encoder would put U+FFFD in place of invalid UTF-8
+	if !utf8.Valid(text) {
+		return nil, errInvalidUTF8
+	}
+	return e.NewEncoder().Bytes(text)
+}
+
+func (e xtextEncoding) String() string {
+	return e.name
+}
+
+// EncodedReplacer - Runs Replacer on chunks decoded from Encoding to UTF-8,
+// and encodes what it returns back, so UTF-8 patterns match text a backend
+// sends in e.g. UTF-16. A character split between two chunks is passed on
+// as it is and isn't matched, nor is a chunk that isn't valid in Encoding,
+// say one starting halfway into a UTF-16 character. A Proxy remembers where
+// the last chunk of each direction cut off a character and matches the next
+// one from the first character that starts in it, so odd-length reads of
+// UTF-16 don't misalign the rest of the stream.
+type EncodedReplacer struct {
+	Replacer
+	Encoding TextEncoding
+}
+
+// Replace - replace in the decoded text
+func (r *EncodedReplacer) Replace(in []byte) []byte {
+	out, _ := r.apply(in, r.textReplace(false))
+	return out
+}
+
+// ReplaceFirst - replace the first match in the decoded text, when the
+// wrapped replacer can
+func (r *EncodedReplacer) ReplaceFirst(in []byte) []byte {
+	out, _ := r.apply(in, r.textReplace(true))
+	return out
+}
+
+// textReplace - The wrapped replacer's Replace, or its ReplaceFirst when
+// first is set and it has one
+func (r *EncodedReplacer) textReplace(first bool) func([]byte) []byte {
+	if fr, ok := r.Replacer.(firstReplacer); ok && first {
+		return fr.ReplaceFirst
+	}
+	return r.Replacer.Replace
+}
+
+// apply - Run replace on in as decoded text, along with the bytes at the
+// end of in that don't make up a whole character
+func (r *EncodedReplacer) apply(in []byte, replace func([]byte) []byte) (out, rest []byte) {
+	text, rest, err := r.Encoding.Decode(in)
+	if err != nil {
+		return in, nil
+	}
+	out = replace(text)
+	if out == nil {
+		return nil, nil
+	}
+	if bytes.Equal(out, text) {
+		return in, rest
+	}
+	encoded, err := r.Encoding.Encode(out)
+	if err != nil {
+		return in, rest
+	}
+	return append(encoded, rest...), rest
+}
+
+// applyAfter - apply to in, which follows carry, the bytes the previous
+// chunk ended with that didn't make up a whole character. The bytes
+// finishing that character pass through as they are. rest is a copy, for
+// the next chunk's carry.
+func (r *EncodedReplacer) applyAfter(carry, in []byte, replace func([]byte) []byte) (out, rest []byte) {
+	skip := 0
+	if len(carry) > 0 {
+		var err error
+		skip, err = r.completion(carry, in)
+		switch {
+		case err != nil:
+			// not a character after all, start over with in
+			skip = 0
+		case skip < 0:
+			// in is still part of the same character
+			return in, append(append([]byte(nil), carry...), in...)
+		}
+	}
+	out, rest = r.apply(in[skip:], replace)
+	rest = append([]byte(nil), rest...)
+	if out == nil || skip == 0 {
+		return out, rest
+	}
+	return append(in[:skip:skip], out...), rest
+}
+
+// completion - How many bytes at the start of in finish the character
+// carry starts, -1 when in doesn't finish it
+func (r *EncodedReplacer) completion(carry, in []byte) (int, error) {
+	// no character is longer than a UTF-8 one
+	if len(in) > utf8.UTFMax {
+		in = in[:utf8.UTFMax]
+	}
+	text, _, err := r.Encoding.Decode(append(append([]byte(nil), carry...), in...))
+	if err != nil {
+		return 0, err
+	}
+	if len(text) == 0 {
+		return -1, nil
+	}
+	_, size := utf8.DecodeRune(text)
+	first, err := r.Encoding.Encode(text[:size])
+	if err != nil {
+		return 0, err
+	}
+	if len(first) < len(carry) {
+		return 0, errors.New("carry is more than one character")
+	}
+	return len(first) - len(carry), nil
+}
+
+// replaceEncoded - Run r on b, picking up from the characters the previous
+// chunk in this direction cut off. With first, only the first match is
+// replaced, as for an OnceReplacer.
+func (s *replacerState) replaceEncoded(r *EncodedReplacer, b []byte, direction Direction, first bool) []byte {
+	s.encodedLock.Lock()
+	carry := s.encodedRest[direction][r]
+	s.encodedLock.Unlock()
+	out, rest := r.applyAfter(carry, b, r.textReplace(first))
+	s.encodedLock.Lock()
+	defer s.encodedLock.Unlock()
+	if len(rest) == 0 {
+		delete(s.encodedRest[direction], r)
+		return out
+	}
+	if s.encodedRest[direction] == nil {
+		s.encodedRest[direction] = make(map[*EncodedReplacer][]byte)
+	}
+	s.encodedRest[direction][r] = rest
+	return out
+}
+
+// PreservesLength - true for substrings whose find and replace values are
+// the same length once encoded
+func (r *EncodedReplacer) PreservesLength() bool {
+	s, ok := r.Replacer.(*StringReplacer)
+	if !ok {
+		return false
+	}
+	in, inErr := r.Encoding.Encode([]byte(s.In))
+	out, outErr := r.Encoding.Encode([]byte(s.Out))
+	return inErr == nil && outErr == nil && len(in) == len(out)
+}
+
+func (r *EncodedReplacer) String() string {
+	return fmt.Sprintf("%s in %s", r.Replacer, r.Encoding)
+}
+
+// withEncoding - Wrap a substring or regex replacer in an EncodedReplacer
+// for rc.Encoding, checking that what it can put in the text is encodable
+func (rc *ReplacerConfig) withEncoding(r Replacer) (Replacer, error) {
+	if rc.Encoding == "" {
+		return r, nil
+	}
+	enc, err := ParseTextEncoding(rc.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	switch r := r.(type) {
+	case *StringReplacer:
+		values = []string{r.In, r.Out}
+	case *RegexReplacer:
+		values = []string{string(r.Out)}
+	}
+	for _, v := range values {
+		if _, err := enc.Encode([]byte(v)); err != nil {
+			return nil, fmt.Errorf("%q can't be encoded in %s: %w", v, enc, err)
+		}
+	}
+	return &EncodedReplacer{Replacer: r, Encoding: enc}, nil
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func encodeUTF16LE(s string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(u), byte(u>>8))
+	}
+	return b
+}
+
+func parseReplacer(t *testing.T, config string) Replacer {
+	t.Helper()
+	set, err := readConfigData([]byte(config))
+	if err != nil || len(set.Both) != 1 {
+		t.Fatalf("failed to parse %q: %v", config, err)
+	}
+	return set.Both[0]
+}
+
+func TestEncodedReplacer(t *testing.T) {
+	r := parseReplacer(t, "- type: substring\n  find: password=hunter2\n  replace: password=*******\n  encoding: utf-16le\n")
+	if ChangesLength(r) {
+		t.Errorf("%s should preserve length", r)
+	}
+	in := encodeUTF16LE("user=bob&password=hunter2 \U0001F600")
+	want := encodeUTF16LE("user=bob&password=******* \U0001F600")
+	if got := r.Replace(in); !bytes.Equal(got, want) {
+		t.Errorf("wanted %x, got %x", want, got)
+	}
+	// the plain UTF-8 bytes don't match
+	if got := r.Replace([]byte("password=hunter2")); string(got) != "password=hunter2" {
+		t.Errorf("UTF-8 text shouldn't match a utf-16le replacer, got %q", got)
+	}
+
+	r = parseReplacer(t, "- type: regex\n  find: \"caf(é|e)\"\n  replace: \"thé\"\n  encoding: latin1\n")
+	if got := r.Replace([]byte("un caf\xe9 noir")); string(got) != "un th\xe9 noir" {
+		t.Errorf("wanted the latin1 text replaced, got %q", got)
+	}
+}
+
+func TestEncodedReplacerSplitCharacters(t *testing.T) {
+	r := parseReplacer(t, "- type: substring\n  find: a\n  replace: b\n  encoding: utf-16le\n")
+	stream := encodeUTF16LE("a\U0001F600a")
+	// cut after the high half of the surrogate pair, and in the middle of
+	// the last character
+	for _, chunks := range [][][]byte{
+		{stream[:4], stream[4:]},
+		{stream[:7], stream[7:]},
+	} {
+		var out []byte
+		for _, chunk := range chunks {
+			out = append(out, r.Replace(append([]byte{}, chunk...))...)
+		}
+		// the character after the cut goes through unchanged either way
+		if len(out) != len(stream) || !bytes.Equal(out[:2], encodeUTF16LE("b")) {
+			t.Errorf("cut at %d: got %x", len(chunks[0]), out)
+		}
+		if !bytes.Equal(out[2:6], stream[2:6]) {
+			t.Errorf("cut at %d: the split character was corrupted, got %x", len(chunks[0]), out)
+		}
+	}
+	// a chunk starting in the middle of a character isn't valid UTF-16 and
+	// passes through
+	if got := r.Replace(stream[3:]); !bytes.Equal(got, stream[3:]) {
+		t.Errorf("wanted a misaligned chunk passed through, got %x", got)
+	}
+}
+
+func TestEncodedReplacerOddReads(t *testing.T) {
+	r := parseReplacer(t, "- type: substring\n  find: needle\n  replace: pin\n  encoding: utf-16le\n")
+	for _, tc := range []struct {
+		text string
+		cut  []int
+	}{
+		// halfway into the character before the match
+		{"xa needle", []int{3}},
+		// into a surrogate pair, each of its bytes on its own
+		{"\U0001F600needle", []int{1, 2, 3}},
+		{"\U0001F600needle", []int{3}},
+		// the match itself starting on an odd byte of a chunk
+		{"a needle and a needle", []int{1, 17}},
+	} {
+		p := New(nil, nil, nil)
+		p.Replacers = []Replacer{r}
+		stream := encodeUTF16LE(tc.text)
+		var out []byte
+		last := 0
+		for _, cut := range append(tc.cut, len(stream)) {
+			out = append(out, p.TransformDirection(append([]byte{}, stream[last:cut]...), Downstream)...)
+			last = cut
+		}
+		want := encodeUTF16LE(strings.ReplaceAll(tc.text, "needle", "pin"))
+		if !bytes.Equal(out, want) {
+			t.Errorf("%q cut at %v: wanted %x, got %x", tc.text, tc.cut, want, out)
+		}
+	}
+}
+
+func TestEncodedReplacerProxied(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.Log = NullLogger{}
+		if err := p.LoadConfig([]byte("- type: substring\n  find: ping\n  replace: pong\n  encoding: utf-16le\n  once: true\n")); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer func() {
+		client.Close()
+		<-done
+	}()
+	if got := echoRoundTrip(t, client, string(encodeUTF16LE("ping ping"))); got != string(encodeUTF16LE("pong ping")) {
+		t.Errorf("wanted the first ping replaced, got %x", got)
+	}
+}
+
+func TestEncodingConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		"- type: substring\n  find: a\n  encoding: ebcdic\n",
+		"- type: bytes\n  find: [0x61]\n  encoding: utf-16le\n",
+		"- type: substring\n  find: a\n  replace: \"€\"\n  encoding: latin1\n",
+	} {
+		if _, err := readConfigData([]byte(config)); err == nil || !strings.Contains(err.Error(), "encod") {
+			t.Errorf("wanted an encoding error for %q, got %v", config, err)
+		}
+	}
+}
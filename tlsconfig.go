@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// SPKIHash - SHA-256 hash of a certificate's SubjectPublicKeyInfo, as used
+// for pinning
+func SPKIHash(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// ParseSPKIPin - Parse a SHA-256 SPKI pin given in hex or base64
+func ParseSPKIPin(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "sha256/")
+	if b, err := hex.DecodeString(strings.ReplaceAll(s, ":", "")); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	return nil, fmt.Errorf("invalid sha256 pin %q, expected 32 bytes in hex or base64", s)
+}
+
+// RemoteTLSConfig - Build the config for TLS connections to the remote.
+// insecureSkipVerify accepts any certificate chain, pins additionally
+// requires the remote's leaf certificate to have one of the given SPKI
+// hashes. Returns nil, the default verification, when neither is set.
+func RemoteTLSConfig(insecureSkipVerify bool, pins [][]byte) *tls.Config {
+	if !insecureSkipVerify && len(pins) == 0 {
+		return nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if len(pins) > 0 {
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("remote sent no certificate")
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return fmt.Errorf("failed to parse remote certificate: %w", err)
+			}
+			hash := SPKIHash(leaf)
+			for _, pin := range pins {
+				if bytes.Equal(hash, pin) {
+					return nil
+				}
+			}
+			return fmt.Errorf("remote certificate public key %s matches no pin", base64.StdEncoding.EncodeToString(hash))
+		}
+	}
+	return cfg
+}
+
+// remoteTLSConfig - TLSConfig completed for a handshake with the remote at
+// address: a copy of it with ServerName, or else the host, and the
+// TLSNextProtos when it names no server or protocols of its own
+func (p *Proxy) remoteTLSConfig(address string) *tls.Config {
+	cfg := p.TLSConfig
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" || (len(cfg.NextProtos) == 0 && len(p.TLSNextProtos) > 0) {
+		cfg = cfg.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = p.ServerName
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		if len(cfg.NextProtos) == 0 {
+			cfg.NextProtos = p.TLSNextProtos
+		}
+	}
+	return cfg
+}
+
+// dialTLS - Connect to a TLS remote with TLSConfig, sending ServerName or
+// else the host dialed. With SendProxy the PROXY protocol header goes ahead
+// of the handshake, in the clear.
+func (p *Proxy) dialTLS(network, address string) (net.Conn, error) {
+	cfg := p.remoteTLSConfig(address)
+	conn, err := p.dialRemote(network, address)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(conn, cfg)
+	// a remote that accepts but never answers mustn't hold the connection
+	conn.SetDeadline(time.Now().Add(p.dialTimeout()))
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if len(cfg.NextProtos) > 0 && tc.ConnectionState().NegotiatedProtocol == "" {
+		p.Log.Info("Remote agreed on none of the protocols %s offered with ALPN", strings.Join(cfg.NextProtos, ", "))
+	}
+	return tc, nil
+}
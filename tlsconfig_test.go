@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTLSEcho - An echo server with a freshly generated self-signed
+// certificate, which is returned along with it
+func startTLSEcho(t *testing.T) (net.Listener, *x509.Certificate) {
+	t.Helper()
+	return startNamedTLSEcho(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, nil)
+}
+
+// startNamedTLSEcho - Like startTLSEcho, for a certificate made from tmpl,
+// reporting the server name of every handshake on snis when it is set
+func startNamedTLSEcho(t *testing.T, tmpl *x509.Certificate, snis chan<- string) (net.Listener, *x509.Certificate) {
+	t.Helper()
+	return startTLSEchoConfig(t, tmpl, func(cfg *tls.Config) {
+		if snis != nil {
+			cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				snis <- hello.ServerName
+				return nil, nil
+			}
+		}
+	})
+}
+
+// startTLSEchoConfig - Like startTLSEcho, for a certificate made from tmpl,
+// with setup changing the server's config before it listens
+func startTLSEchoConfig(t *testing.T, tmpl *x509.Certificate, setup func(*tls.Config)) (net.Listener, *x509.Certificate) {
+	t.Helper()
+	pair, cert := selfSigned(t, tmpl)
+	cfg := &tls.Config{Certificates: []tls.Certificate{pair}}
+	setup(cfg)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := c.Read(buf)
+					if err != nil {
+						return
+					}
+					c.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+	return l, cert
+}
+
+// selfSigned - A self-signed certificate made from tmpl, as served and as
+// parsed
+func selfSigned(t *testing.T, tmpl *x509.Certificate) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(1)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+// tlsRoundTrip - Proxy a message to the TLS remote with the given config,
+// returning whether it came back
+func tlsRoundTrip(t *testing.T, remote net.Listener, cfg *tls.Config) bool {
+	t.Helper()
+	client, done := startProxy(t, remote.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.UnwrapTLS = true
+		p.TLSConfig = cfg
+	})
+	defer func() {
+		client.Close()
+		<-done
+	}()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	n, _ := client.Read(buf)
+	return string(buf[:n]) == "hello"
+}
+
+func TestRemoteTLSVerification(t *testing.T) {
+	remote, cert := startTLSEcho(t)
+	defer remote.Close()
+	pin := SPKIHash(cert)
+	wrong := sha256.Sum256([]byte("not the key"))
+
+	if tlsRoundTrip(t, remote, RemoteTLSConfig(false, nil)) {
+		t.Errorf("self-signed remote should fail the default verification")
+	}
+	if !tlsRoundTrip(t, remote, RemoteTLSConfig(true, nil)) {
+		t.Errorf("insecure-skip-verify should accept the self-signed remote")
+	}
+	if !tlsRoundTrip(t, remote, RemoteTLSConfig(true, [][]byte{wrong[:], pin})) {
+		t.Errorf("matching pin should accept the remote")
+	}
+	if tlsRoundTrip(t, remote, RemoteTLSConfig(true, [][]byte{wrong[:]})) {
+		t.Errorf("mismatched pin should fail the handshake")
+	}
+	if tlsRoundTrip(t, remote, RemoteTLSConfig(false, [][]byte{pin})) {
+		t.Errorf("a pin alone should not skip chain verification")
+	}
+}
+
+func TestRemoteTLSHandshakeTimeout(t *testing.T) {
+	// a remote that accepts and then never says a word
+	silent := listenLocal(t)
+	defer silent.Close()
+	go func() {
+		for {
+			c, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	p := New(nil, nil, nil)
+	p.TLSConfig = RemoteTLSConfig(true, nil)
+	p.DialTimeout = 100 * time.Millisecond
+	start := time.Now()
+	_, err := p.dialTLS("tcp", silent.Addr().String())
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("wanted the handshake to time out, got %v", err)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("handshake took %v with a 100ms dial timeout", took)
+	}
+}
+
+func TestRemoteServerName(t *testing.T) {
+	snis := make(chan string, 4)
+	remote, cert := startNamedTLSEcho(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "backend.example"},
+		DNSNames: []string{"backend.example"},
+	}, snis)
+	defer remote.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	cfg := &tls.Config{RootCAs: roots}
+
+	// dialed by IP, verified by name
+	client, done := startProxy(t, remote.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.UnwrapTLS = true
+		p.ServerName = "backend.example"
+		p.TLSConfig = cfg
+	})
+	if got := echoRoundTrip(t, client, "hello"); got != "hello" {
+		t.Errorf("expected the remote to verify as backend.example, got %q", got)
+	}
+	client.Close()
+	<-done
+	if sni := <-snis; sni != "backend.example" {
+		t.Errorf("expected SNI backend.example, got %q", sni)
+	}
+	if cfg.ServerName != "" {
+		t.Errorf("the shared TLSConfig should be left untouched")
+	}
+
+	// without it the certificate doesn't match the IP dialed
+	if tlsRoundTrip(t, remote, cfg) {
+		t.Errorf("expected verification against the IP address to fail")
+	}
+}
+
+func TestNewTLSUnwrappedShim(t *testing.T) {
+	raddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}
+	p := NewTLSUnwrapped(nil, nil, raddr, "backend.example:443")
+	if !p.UnwrapTLS || p.ServerName != "backend.example" || p.raddr != raddr {
+		t.Errorf("expected TLS to raddr named backend.example, got %v %q %v", p.UnwrapTLS, p.ServerName, p.raddr)
+	}
+	p = NewTLSUnwrapped(nil, nil, nil, "127.0.0.1:443")
+	if p.ServerName != "" || p.raddr.String() != "127.0.0.1:443" {
+		t.Errorf("expected the address to be dialed with no server name, got %q %v", p.ServerName, p.raddr)
+	}
+}
+
+func TestParseSPKIPin(t *testing.T) {
+	sum := sha256.Sum256([]byte("key"))
+	for _, s := range []string{
+		hex.EncodeToString(sum[:]),
+		"sha256/" + base64.StdEncoding.EncodeToString(sum[:]),
+	} {
+		pin, err := ParseSPKIPin(s)
+		if err != nil || string(pin) != string(sum[:]) {
+			t.Errorf("failed to parse pin %q: %v", s, err)
+		}
+	}
+	if _, err := ParseSPKIPin("abcd"); err == nil {
+		t.Errorf("expected an error for a short pin")
+	}
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// TLSInfo - The parameters a TLS connection negotiated, as logged and
+// included in summaries
+type TLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	// ALPN - the negotiated application protocol, if any
+	ALPN string `json:"alpn,omitempty"`
+}
+
+// tlsVersions - Names of the TLS versions crypto/tls speaks
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// newTLSInfo - Describe state, nil if the handshake hasn't completed
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	if state == nil || !state.HandshakeComplete {
+		return nil
+	}
+	version, ok := tlsVersions[state.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04x", state.Version)
+	}
+	return &TLSInfo{
+		Version:     version,
+		CipherSuite: cipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+	}
+}
+
+func (i *TLSInfo) String() string {
+	s := fmt.Sprintf("%s, %s", i.Version, i.CipherSuite)
+	if i.ALPN != "" {
+		s += ", ALPN " + i.ALPN
+	}
+	return s
+}
+
+// RemoteTLS - What the TLS connection to the remote negotiated, with
+// UnwrapTLS. Nil until the remote is connected, or when it isn't TLS.
+func (p *Proxy) RemoteTLS() *tls.ConnectionState {
+	return p.remoteTLS
+}
+
+// ClientTLS - What the TLS connection with the client negotiated, when the
+// local connection is TLS, e.g. served from a CertStore. Nil for plain
+// clients and until the handshake completed, which happens with the
+// client's first data.
+func (p *Proxy) ClientTLS() *tls.ConnectionState {
+	tc, ok := p.lconn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	if !state.HandshakeComplete {
+		return nil
+	}
+	return &state
+}
+
+// connectionStater - A remote connection secured by TLS, such as a *tls.Conn
+// or a QUIC stream
+type connectionStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// recordRemoteTLS - Keep what the remote connection negotiated, if it is TLS
+func (p *Proxy) recordRemoteTLS() {
+	tc, ok := p.rconn.(connectionStater)
+	if !ok {
+		return
+	}
+	state := tc.ConnectionState()
+	p.remoteTLS = &state
+}
+
+// tlsDescription - The TLS parameters of both connections for the open log
+func (p *Proxy) tlsDescription() string {
+	var s string
+	if info := newTLSInfo(p.ClientTLS()); info != nil {
+		s += fmt.Sprintf(" (client TLS: %s)", info)
+	}
+	if info := newTLSInfo(p.remoteTLS); info != nil {
+		s += fmt.Sprintf(" (remote TLS: %s)", info)
+	}
+	return s
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteTLSState(t *testing.T) {
+	remote, _ := startTLSEcho(t)
+	defer remote.Close()
+
+	var p *Proxy
+	var logs bytes.Buffer
+	client, done := startProxy(t, remote.Addr().(*net.TCPAddr), func(proxy *Proxy) {
+		p = proxy
+		p.Log = ColorLogger{Writer: &logs}
+		p.UnwrapTLS = true
+		p.TLSConfig = &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         tls.VersionTLS12,
+			CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}
+	})
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if got := echoRoundTrip(t, client, "hello"); got != "hello" {
+		t.Fatalf("wanted echo, got %q", got)
+	}
+	client.Close()
+	<-done
+
+	state := p.RemoteTLS()
+	if state == nil || state.Version != tls.VersionTLS12 || state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("unexpected remote TLS state %+v", state)
+	}
+	if p.ClientTLS() != nil {
+		t.Errorf("the client connection isn't TLS")
+	}
+	want := "TLS 1.2, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"
+	summary := p.Summary()
+	if summary.TLS == nil || summary.TLS.Client != nil || summary.TLS.Remote.String() != want {
+		t.Errorf("wanted the summary to have remote TLS %s, got %+v", want, summary.TLS)
+	}
+	if !strings.Contains(logs.String(), "(remote TLS: "+want+")") {
+		t.Errorf("the open log should describe the remote TLS, got %s", logs.String())
+	}
+}
+
+func TestTLSInfo(t *testing.T) {
+	info := newTLSInfo(&tls.ConnectionState{
+		HandshakeComplete:  true,
+		Version:            tls.VersionTLS13,
+		CipherSuite:        tls.TLS_AES_128_GCM_SHA256,
+		NegotiatedProtocol: "h2",
+	})
+	if got := info.String(); got != "TLS 1.3, TLS_AES_128_GCM_SHA256, ALPN h2" {
+		t.Errorf("unexpected description %q", got)
+	}
+	if newTLSInfo(&tls.ConnectionState{}) != nil {
+		t.Errorf("an incomplete handshake has nothing to describe")
+	}
+}
+
+func TestTLSNextProtos(t *testing.T) {
+	offered := make(chan []string, 1)
+	remote, _ := startTLSEchoConfig(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, func(cfg *tls.Config) {
+		cfg.NextProtos = []string{"h2"}
+		cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			offered <- hello.SupportedProtos
+			return nil, nil
+		}
+	})
+	defer remote.Close()
+
+	var p *Proxy
+	client, done := startProxy(t, remote.Addr().(*net.TCPAddr), func(proxy *Proxy) {
+		p = proxy
+		p.UnwrapTLS = true
+		p.TLSConfig = RemoteTLSConfig(true, nil)
+		p.TLSNextProtos = []string{"h2", "http/1.1"}
+	})
+	if got := echoRoundTrip(t, client, "hello"); got != "hello" {
+		t.Fatalf("wanted echo, got %q", got)
+	}
+	client.Close()
+	<-done
+
+	if got := strings.Join(<-offered, ","); got != "h2,http/1.1" {
+		t.Errorf("wanted h2 and http/1.1 offered, got %q", got)
+	}
+	if got := p.RemoteTLS().NegotiatedProtocol; got != "h2" {
+		t.Errorf("wanted h2 negotiated, got %q", got)
+	}
+	if p.TLSConfig.NextProtos != nil {
+		t.Errorf("the shared TLSConfig shouldn't be changed")
+	}
+}
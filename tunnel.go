@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxDatagram - The largest datagram a tunnel frame can carry
+const maxDatagram = 0xffff
+
+// defaultTunnelIdle - How long a UDP client may go quiet before its tunnel
+// connection is closed, when IdleTimeout is unset
+const defaultTunnelIdle = time.Minute
+
+// defaultTunnelDial - How long opening a UDP client's tunnel connection may
+// take, when DialTimeout is unset
+const defaultTunnelDial = 10 * time.Second
+
+// maxQueuedDatagrams - How many datagrams a UDP client's session holds while
+// its tunnel connection is being opened or is behind; more are dropped
+const maxQueuedDatagrams = 64
+
+// Tunnel - Converts between UDP and TCP, so datagrams can cross networks
+// that only let TCP through. One end serves UDP and carries each datagram
+// over a TCP connection to the other end, which serves TCP and sends them on
+// to a UDP remote; replies travel back the same way.
+//
+// On the TCP side every datagram is framed as a 2 byte big-endian length
+// followed by that many bytes of payload, in order, so the far end gets
+// exactly the datagrams that were sent, however the stream was segmented.
+type Tunnel struct {
+	// Remote - The address datagrams are tunneled to: the TCP address of the
+	// other end for ServeUDP, the UDP remote for ServeTCP
+	Remote string
+	Log    Logger
+	// IdleTimeout - For ServeUDP, how long a client may send and receive
+	// nothing, or its TCP connection take to accept a datagram, before the
+	// connection is closed. Defaults to a minute.
+	IdleTimeout time.Duration
+	// DialTimeout - For ServeUDP, how long connecting a new client's TCP
+	// connection may take. Defaults to 10 seconds.
+	DialTimeout time.Duration
+}
+
+// writeFrame - Write one datagram to a tunnel stream
+func writeFrame(w io.Writer, b []byte) error {
+	if len(b) > maxDatagram {
+		return errors.New("datagram too large for a tunnel frame")
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame - Read one datagram from a tunnel stream into buf, which must
+// hold maxDatagram bytes
+func readFrame(r io.Reader, buf []byte) ([]byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(head[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (t *Tunnel) log() Logger {
+	if t.Log == nil {
+		return NullLogger{}
+	}
+	return t.Log
+}
+
+// udpSession - The TCP connection carrying one UDP client's datagrams
+type udpSession struct {
+	// last - unix nanoseconds of the latest datagram either way, first for
+	// 64-bit alignment of the atomic accesses
+	last int64
+	// frames - datagrams waiting to be written to the connection, along
+	// with those that arrived while it was being dialed
+	frames chan []byte
+	// done - closed once the connection has ended
+	done chan struct{}
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
+}
+
+// ServeUDP - Read datagrams from pc and tunnel them over TCP to Remote, with
+// a connection per client address. Each connection is written to on its own,
+// so a client whose connection falls behind has its datagrams dropped rather
+// than holding up the others. Returns once pc fails, e.g. because it was
+// closed.
+func (t *Tunnel) ServeUDP(pc net.PacketConn) error {
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	closed := false
+	stop := make(chan struct{})
+	defer func() {
+		mu.Lock()
+		closed = true
+		close(stop)
+		mu.Unlock()
+	}()
+
+	// open - Dial a new client's connection without holding up the
+	// datagrams of others, then write it what the client sends, in order
+	open := func(client net.Addr, s *udpSession) {
+		conn, err := (&net.Dialer{Timeout: t.dialTimeout()}).Dial("tcp", t.Remote)
+		mu.Lock()
+		if err == nil && (closed || sessions[client.String()] != s) {
+			// ServeUDP returned while dialing
+			conn.Close()
+			err = errors.New("tunnel closed")
+		}
+		if err != nil {
+			if sessions[client.String()] == s {
+				delete(sessions, client.String())
+			}
+			mu.Unlock()
+			t.log().Warn("Tunnel to %s failed for %v: %s", t.Remote, client, err)
+			return
+		}
+		mu.Unlock()
+
+		t.log().Info("Tunneling datagrams from %v over %v >>> %s", client, conn.LocalAddr(), t.Remote)
+		go func() {
+			t.returnDatagrams(pc, client, s, conn)
+			mu.Lock()
+			delete(sessions, client.String())
+			mu.Unlock()
+			close(s.done)
+		}()
+		for {
+			select {
+			case b := <-s.frames:
+				// a connection that takes this long won't catch up
+				conn.SetWriteDeadline(time.Now().Add(t.idleTimeout()))
+				if err := writeFrame(conn, b); err != nil {
+					// returnDatagrams ends and removes the session
+					t.log().Warn("Tunnel write for %v failed: %s", client, err)
+					conn.Close()
+					return
+				}
+			case <-s.done:
+				return
+			case <-stop:
+				conn.Close()
+				return
+			}
+		}
+	}
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		s, ok := sessions[client.String()]
+		if !ok {
+			s = &udpSession{
+				frames: make(chan []byte, maxQueuedDatagrams),
+				done:   make(chan struct{}),
+			}
+			sessions[client.String()] = s
+			go open(client, s)
+		}
+		mu.Unlock()
+
+		s.touch()
+		select {
+		case s.frames <- append([]byte(nil), buf[:n]...):
+		default:
+			t.log().Debug("Tunnel for %v is behind, dropped a datagram", client)
+		}
+	}
+}
+
+func (t *Tunnel) dialTimeout() time.Duration {
+	if t.DialTimeout <= 0 {
+		return defaultTunnelDial
+	}
+	return t.DialTimeout
+}
+
+func (t *Tunnel) idleTimeout() time.Duration {
+	if t.IdleTimeout <= 0 {
+		return defaultTunnelIdle
+	}
+	return t.IdleTimeout
+}
+
+// returnDatagrams - Send the frames coming back over a client's tunnel
+// connection to it as datagrams, until the connection ends or goes idle
+func (t *Tunnel) returnDatagrams(pc net.PacketConn, client net.Addr, s *udpSession, conn net.Conn) {
+	defer conn.Close()
+	idle := t.idleTimeout()
+	buf := make([]byte, maxDatagram)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idle))
+		b, err := readFrame(conn, buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if time.Since(time.Unix(0, atomic.LoadInt64(&s.last))) < idle {
+				// still sending, just not getting replies
+				continue
+			}
+			t.log().Info("Closed idle tunnel for %v", client)
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				t.log().Warn("Tunnel read for %v failed: %s", client, err)
+			}
+			return
+		}
+		s.touch()
+		if _, err := pc.WriteTo(b, client); err != nil {
+			t.log().Warn("Failed to return datagram to %v: %s", client, err)
+		}
+	}
+}
+
+// ServeTCP - Accept tunnel connections on l and send the datagrams framed
+// on each of them to Remote over UDP, from a socket of the connection's own,
+// framing the replies back. Returns once l fails, e.g. because it was closed.
+func (t *Tunnel) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go t.serveTunnelConn(conn)
+	}
+}
+
+func (t *Tunnel) serveTunnelConn(conn net.Conn) {
+	defer conn.Close()
+	udp, err := net.Dial("udp", t.Remote)
+	if err != nil {
+		t.log().Warn("Failed to open UDP socket to %s: %s", t.Remote, err)
+		return
+	}
+	defer udp.Close()
+	t.log().Info("Tunneling datagrams from %v >>> %s", conn.RemoteAddr(), t.Remote)
+
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				// closed once the tunnel connection ends
+				return
+			}
+			if err := writeFrame(conn, buf[:n]); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, maxDatagram)
+	for {
+		b, err := readFrame(conn, buf)
+		if err != nil {
+			if err != io.EOF {
+				t.log().Warn("Tunnel read from %v failed: %s", conn.RemoteAddr(), err)
+			}
+			t.log().Info("Closed tunnel from %v", conn.RemoteAddr())
+			return
+		}
+		if _, err := udp.Write(b); err != nil {
+			t.log().Warn("Failed to send datagram to %s: %s", t.Remote, err)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestTunnelFrames(t *testing.T) {
+	datagrams := []string{"one", "", strings.Repeat("x", 1500), "last"}
+	var stream bytes.Buffer
+	for _, d := range datagrams {
+		if err := writeFrame(&stream, []byte(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// however the stream is split up, the datagrams come out whole
+	r := iotest.OneByteReader(&stream)
+	buf := make([]byte, maxDatagram)
+	for _, want := range datagrams {
+		got, err := readFrame(r, buf)
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("expected datagram %q, got %q", want, got)
+		}
+	}
+	if err := writeFrame(&stream, make([]byte, maxDatagram+1)); err == nil {
+		t.Error("expected an error for a datagram too large to frame")
+	}
+}
+
+// startUDPEcho - A UDP server that sends every datagram back upper cased
+func startUDPEcho(t *testing.T) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(bytes.ToUpper(buf[:n]), addr)
+		}
+	}()
+	return pc
+}
+
+func TestTunnelTCPToUDP(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+
+	l := listenLocal(t)
+	defer l.Close()
+	tun := &Tunnel{Remote: echo.LocalAddr().String()}
+	go tun.ServeTCP(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, maxDatagram)
+	for _, msg := range []string{"hello", "world"} {
+		if err := writeFrame(c, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readFrame(c, buf)
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if string(got) != strings.ToUpper(msg) {
+			t.Errorf("expected %q back, got %q", strings.ToUpper(msg), got)
+		}
+	}
+}
+
+func TestTunnelUDPOverTCP(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+
+	// the far end: TCP in, UDP out
+	l := listenLocal(t)
+	defer l.Close()
+	go (&Tunnel{Remote: echo.LocalAddr().String()}).ServeTCP(l)
+
+	// the near end: UDP in, TCP out
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go (&Tunnel{Remote: l.Addr().String()}).ServeUDP(pc)
+
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, maxDatagram)
+	for _, msg := range []string{"first datagram", "second", strings.Repeat("y", 4000)} {
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if got := string(buf[:n]); got != strings.ToUpper(msg) {
+			t.Errorf("expected %q back through both conversions, got %q", strings.ToUpper(msg), got)
+		}
+	}
+}
+
+func TestTunnelQueuesWhileDialing(t *testing.T) {
+	// the far end reports the datagrams framed on each connection
+	l := listenLocal(t)
+	defer l.Close()
+	frames := make(chan string, 16)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, maxDatagram)
+				for {
+					b, err := readFrame(c, buf)
+					if err != nil {
+						return
+					}
+					frames <- string(b)
+				}
+			}()
+		}
+	}()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go (&Tunnel{Remote: l.Addr().String()}).ServeUDP(pc)
+
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// sent back to back, most arrive before the tunnel connection is up
+	want := []string{"one", "two", "three", "four", "five"}
+	for _, msg := range want {
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, msg := range want {
+		select {
+		case got := <-frames:
+			if got != msg {
+				t.Errorf("expected datagram %q, got %q", msg, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("datagram %q never arrived", msg)
+		}
+	}
+}
+
+func TestTunnelStalledClient(t *testing.T) {
+	// the far end never reads the first connection and echoes the others
+	l := listenLocal(t)
+	defer l.Close()
+	stalled := make(chan net.Conn, 1)
+	go func() {
+		for first := true; ; first = false {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if first {
+				stalled <- c
+				continue
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, maxDatagram)
+				for {
+					b, err := readFrame(c, buf)
+					if err != nil || writeFrame(c, b) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go (&Tunnel{Remote: l.Addr().String()}).ServeUDP(pc)
+
+	slow, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	if _, err := slow.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-stalled:
+		defer c.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("the tunnel connection was never opened")
+	}
+	// far more than the socket buffers take, paced so that pc doesn't drop
+	// most of it
+	big := make([]byte, 60000)
+	for i := 0; i < 1000; i++ {
+		slow.Write(big)
+		if i%4 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	buf := make([]byte, maxDatagram)
+	// datagrams may be lost to the flood, so keep asking for a while
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := c.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if n, err := c.Read(buf); err == nil {
+			if got := string(buf[:n]); got != "hello" {
+				t.Errorf("expected %q back, got %q", "hello", got)
+			}
+			return
+		}
+	}
+	t.Fatal("another client's datagrams were held up by the stalled one")
+}
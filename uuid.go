@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// uuidFallback - Counter making fallback ids unique within the process
+var uuidFallback uint64
+
+// NewConnUUID - A random (version 4) UUID for a connection's UUID, unique
+// across restarts and instances. Should the system's random source fail, the
+// current time and a counter take its place.
+func NewConnUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint64(b[8:], atomic.AddUint64(&uuidFallback, 1))
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
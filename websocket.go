@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// maxHTTPHeader - How much of an HTTP message is kept while looking for the
+// end of its headers
+const maxHTTPHeader = 8 << 10
+
+// WebSocket opcodes, from RFC 6455
+const (
+	wsText   = 0x1
+	wsBinary = 0x2
+)
+
+// wsFramer - Tracks one direction of a connection for DecodeWebSocket. Until
+// the upgrade the data is HTTP and inspected as is; the client side records
+// that an upgrade was asked for and the remote side that it was accepted.
+// Afterwards the data is parsed into frames, buffering frames split over
+// several reads.
+type wsFramer struct {
+	p        *Proxy
+	upstream bool
+	max      int
+	framed   bool
+	head     []byte
+	pending  []byte
+	// raw - bytes of an oversized frame still to be passed through
+	raw uint64
+}
+
+func (p *Proxy) newWSFramer(direction Direction, max int) *wsFramer {
+	if max <= 0 {
+		max = defaultMaxDecodeSize
+	}
+	return &wsFramer{p: p, upstream: direction == Upstream, max: max}
+}
+
+// feed - Process a chunk, returning the bytes to forward. Returns nothing
+// while a frame is incomplete.
+func (w *wsFramer) feed(b []byte, inspect func([]byte) []byte) []byte {
+	// the client only sends frames once it has seen the remote accept the
+	// upgrade, which the remote side notes before forwarding it
+	if !w.framed && w.upstream && atomic.LoadInt32(&w.p.wsUpgraded) == 1 {
+		w.framed = true
+	}
+	if w.framed {
+		return w.frames(b, inspect)
+	}
+
+	end := w.headersEnd(b)
+	if end < 0 {
+		return inspect(b)
+	}
+	head := w.head
+	w.head = nil
+	if w.upstream {
+		if isUpgradeRequest(head) {
+			atomic.StoreInt32(&w.p.wsRequested, 1)
+		}
+		return inspect(b)
+	}
+	if !isUpgradeResponse(head) || atomic.LoadInt32(&w.p.wsRequested) == 0 {
+		return inspect(b)
+	}
+
+	w.p.Log.Debug("WebSocket upgrade accepted, inspecting frames")
+	atomic.StoreInt32(&w.p.wsUpgraded, 1)
+	w.framed = true
+	out := inspect(b[:end])
+	if out == nil {
+		out = []byte{}
+	}
+	return append(out, w.frames(b[end:], inspect)...)
+}
+
+// headersEnd - Collect b into the current HTTP message's headers, returning
+// the offset in b just past them once they are complete, or -1
+func (w *wsFramer) headersEnd(b []byte) int {
+	prev := len(w.head)
+	w.head = append(w.head, b...)
+	i := bytes.Index(w.head, []byte("\r\n\r\n"))
+	if i < 0 {
+		if len(w.head) > maxHTTPHeader {
+			// a body or something other than HTTP, start looking afresh
+			w.head = nil
+		}
+		return -1
+	}
+	end := i + 4 - prev
+	w.head = w.head[:i+4]
+	return end
+}
+
+func isUpgradeRequest(head []byte) bool {
+	return headerHasToken(head, "upgrade", "websocket")
+}
+
+func isUpgradeResponse(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("HTTP/1.1 101")) && headerHasToken(head, "upgrade", "websocket")
+}
+
+// headerHasToken - Whether an HTTP header field lists token, ignoring case
+func headerHasToken(head []byte, field, token string) bool {
+	for _, line := range bytes.Split(head, []byte("\r\n")) {
+		kv := bytes.SplitN(line, []byte(":"), 2)
+		if len(kv) != 2 || !bytes.EqualFold(bytes.TrimSpace(kv[0]), []byte(field)) {
+			continue
+		}
+		for _, v := range bytes.Split(kv[1], []byte(",")) {
+			if bytes.EqualFold(bytes.TrimSpace(v), []byte(token)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// frames - Inspect the complete frames in the buffered data followed by b
+func (w *wsFramer) frames(b []byte, inspect func([]byte) []byte) []byte {
+	out := []byte{}
+	if w.raw > 0 {
+		n := uint64(len(b))
+		if n > w.raw {
+			n = w.raw
+		}
+		out = append(out, b[:n]...)
+		w.raw -= n
+		b = b[n:]
+	}
+
+	data := b
+	if len(w.pending) > 0 {
+		data = append(w.pending, b...)
+		w.pending = nil
+	}
+	for len(data) > 0 {
+		f, ok := parseWSFrame(data)
+		if !ok {
+			w.pending = append([]byte(nil), data...)
+			break
+		}
+		if f.length > uint64(w.max) {
+			// too big to buffer, pass it through as it arrives
+			rest := uint64(len(data) - f.headerLen)
+			if rest < f.length {
+				out = append(out, data...)
+				w.raw = f.length - rest
+				break
+			}
+			n := f.headerLen + int(f.length)
+			out = append(out, data[:n]...)
+			data = data[n:]
+			continue
+		}
+		n := f.headerLen + int(f.length)
+		if len(data) < n {
+			w.pending = append([]byte(nil), data...)
+			break
+		}
+		out = append(out, w.inspectFrame(f, data[:n], inspect)...)
+		data = data[n:]
+	}
+	return out
+}
+
+// flush - The bytes of a frame still incomplete once the connection ends,
+// to be forwarded as they are
+func (w *wsFramer) flush() []byte {
+	pending := w.pending
+	w.pending = nil
+	return pending
+}
+
+// wsFrame - The header of a WebSocket frame
+type wsFrame struct {
+	fin       bool
+	rsv       byte
+	opcode    byte
+	masked    bool
+	mask      [4]byte
+	length    uint64
+	headerLen int
+}
+
+// parseWSFrame - Parse the frame header at the start of b, false if b
+// doesn't hold all of it yet
+func parseWSFrame(b []byte) (wsFrame, bool) {
+	var f wsFrame
+	if len(b) < 2 {
+		return f, false
+	}
+	f.fin = b[0]&0x80 != 0
+	f.rsv = b[0] & 0x70
+	f.opcode = b[0] & 0x0f
+	f.masked = b[1]&0x80 != 0
+	f.length = uint64(b[1] & 0x7f)
+	f.headerLen = 2
+	switch f.length {
+	case 126:
+		if len(b) < 4 {
+			return f, false
+		}
+		f.length = uint64(binary.BigEndian.Uint16(b[2:]))
+		f.headerLen = 4
+	case 127:
+		if len(b) < 10 {
+			return f, false
+		}
+		f.length = binary.BigEndian.Uint64(b[2:])
+		f.headerLen = 10
+	}
+	if f.masked {
+		if len(b) < f.headerLen+4 {
+			return f, false
+		}
+		copy(f.mask[:], b[f.headerLen:])
+		f.headerLen += 4
+	}
+	return f, true
+}
+
+// inspectFrame - Run a complete frame's payload through inspect, returning
+// the frame to forward. Only whole, uncompressed text and binary messages
+// are inspected.
+func (w *wsFramer) inspectFrame(f wsFrame, frame []byte, inspect func([]byte) []byte) []byte {
+	if !f.fin || f.rsv != 0 || (f.opcode != wsText && f.opcode != wsBinary) {
+		return frame
+	}
+	payload := append([]byte(nil), frame[f.headerLen:]...)
+	if f.masked {
+		maskWS(payload, f.mask)
+	}
+	inspected := inspect(append([]byte(nil), payload...))
+	switch {
+	case inspected == nil:
+		w.p.Log.Debug("Dropped a %d byte WebSocket frame, a replacer returned nil", len(payload))
+		return nil
+	case bytes.Equal(inspected, payload):
+		return frame
+	}
+	return encodeWSFrame(f, inspected)
+}
+
+// encodeWSFrame - Frame payload with f's flags and mask
+func encodeWSFrame(f wsFrame, payload []byte) []byte {
+	out := []byte{frameFlags(f), 0}
+	n := len(payload)
+	switch {
+	case n < 126:
+		out[1] = byte(n)
+	case n <= 0xffff:
+		out[1] = 126
+		out = append(out, byte(n>>8), byte(n))
+	default:
+		out[1] = 127
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		out = append(out, ext[:]...)
+	}
+	start := len(out)
+	if f.masked {
+		out[1] |= 0x80
+		out = append(out, f.mask[:]...)
+		start += 4
+	}
+	out = append(out, payload...)
+	if f.masked {
+		maskWS(out[start:], f.mask)
+	}
+	return out
+}
+
+func frameFlags(f wsFrame) byte {
+	b := f.rsv | f.opcode
+	if f.fin {
+		b |= 0x80
+	}
+	return b
+}
+
+// maskWS - Mask or unmask b in place
+func maskWS(b []byte, mask [4]byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const (
+	wsRequest  = "GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	wsResponse = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n"
+)
+
+var testMask = []byte{0x37, 0xfa, 0x21, 0x3d}
+
+// wsFrameBytes - A single frame with the given first byte (FIN, RSV and
+// opcode), masked when mask is set
+func wsFrameBytes(first byte, mask []byte, payload string) []byte {
+	b := []byte{first, byte(len(payload))}
+	if mask != nil {
+		b[1] |= 0x80
+		b = append(b, mask...)
+	}
+	start := len(b)
+	b = append(b, payload...)
+	if mask != nil {
+		for i := start; i < len(b); i++ {
+			b[i] ^= mask[(i-start)%4]
+		}
+	}
+	return b
+}
+
+// readWSPayload - Read one short frame from r and return its opcode byte and
+// unmasked payload
+func readWSPayload(r io.Reader) (byte, string, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, "", err
+	}
+	if head[1]&0x7f >= 126 {
+		return 0, "", errors.New("unexpected extended length frame")
+	}
+	var mask []byte
+	if head[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return 0, "", err
+		}
+	}
+	payload := make([]byte, head[1]&0x7f)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, "", err
+	}
+	for i := range payload {
+		if mask != nil {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return head[0], string(payload), nil
+}
+
+func replaceFoo(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte("foo"), []byte("foobar"))
+}
+
+// upgradedFramers - A client and remote framer pair past the upgrade
+func upgradedFramers(t *testing.T) (up, down *wsFramer) {
+	t.Helper()
+	p := &Proxy{Log: NullLogger{}}
+	up = p.newWSFramer(Upstream, 0)
+	down = p.newWSFramer(Downstream, 0)
+	up.feed([]byte(wsRequest), replaceFoo)
+	// the remote's first frame arrives in the same read as the response
+	serverFrame := wsFrameBytes(0x81, nil, "hi foo")
+	out := down.feed(append([]byte(wsResponse), serverFrame...), replaceFoo)
+	want := append([]byte(wsResponse), wsFrameBytes(0x81, nil, "hi foobar")...)
+	if !bytes.Equal(out, want) {
+		t.Fatalf("expected response and re-framed frame, got %q", out)
+	}
+	return up, down
+}
+
+func TestWebSocketMaskedText(t *testing.T) {
+	up, _ := upgradedFramers(t)
+
+	frame := wsFrameBytes(0x81, testMask, "say foo")
+	// split inside the mask key and inside the payload
+	var out []byte
+	for _, part := range [][]byte{frame[:4], frame[4:9], frame[9:]} {
+		out = append(out, up.feed(part, replaceFoo)...)
+	}
+	want := wsFrameBytes(0x81, testMask, "say foobar")
+	if !bytes.Equal(out, want) {
+		t.Errorf("expected re-masked frame %x, got %x", want, out)
+	}
+}
+
+func TestWebSocketPassthrough(t *testing.T) {
+	up, _ := upgradedFramers(t)
+
+	frames := [][]byte{
+		wsFrameBytes(0x89, testMask, "ping foo"),    // ping
+		wsFrameBytes(0x01, testMask, "first foo"),   // unfinished text
+		wsFrameBytes(0x80, testMask, "last foo"),    // continuation
+		wsFrameBytes(0xc1, testMask, "deflate foo"), // compressed
+		wsFrameBytes(0x82, testMask, "plain"),       // unchanged binary
+	}
+	var in []byte
+	for _, f := range frames {
+		in = append(in, f...)
+	}
+	if out := up.feed(in, replaceFoo); !bytes.Equal(out, in) {
+		t.Errorf("expected frames to pass through untouched, got %x", out)
+	}
+}
+
+func TestWebSocketDropFrame(t *testing.T) {
+	up, _ := upgradedFramers(t)
+	drop := func(b []byte) []byte {
+		if bytes.Contains(b, []byte("drop")) {
+			return nil
+		}
+		return b
+	}
+	keep := wsFrameBytes(0x81, testMask, "keep")
+	in := append(wsFrameBytes(0x81, testMask, "drop me"), keep...)
+	if out := up.feed(in, drop); !bytes.Equal(out, keep) {
+		t.Errorf("expected only the kept frame, got %x", out)
+	}
+}
+
+func TestWebSocketWithoutUpgrade(t *testing.T) {
+	p := &Proxy{Log: NullLogger{}}
+	up := p.newWSFramer(Upstream, 0)
+	down := p.newWSFramer(Downstream, 0)
+	up.feed([]byte(wsRequest), replaceFoo)
+	down.feed([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"), replaceFoo)
+
+	// the remote refused, so later data is still plain HTTP
+	in := []byte("GET /foo HTTP/1.1\r\n\r\n")
+	if out := up.feed(in, replaceFoo); string(out) != "GET /foobar HTTP/1.1\r\n\r\n" {
+		t.Errorf("expected plain inspection, got %q", out)
+	}
+}
+
+// startWSEcho - A server that accepts a WebSocket upgrade and then echoes
+// the payload of every frame back unmasked
+func startWSEcho(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				if _, err := http.ReadRequest(r); err != nil {
+					return
+				}
+				io.WriteString(c, wsResponse)
+				for {
+					op, payload, err := readWSPayload(r)
+					if err != nil {
+						return
+					}
+					c.Write(wsFrameBytes(op, nil, payload))
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	remote := startWSEcho(t)
+	defer remote.Close()
+
+	client, done := startProxy(t, remote.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.DecodeWebSocket = true
+		p.UpstreamReplacers = []Replacer{&StringReplacer{"secret", "public"}}
+	})
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(client)
+
+	io.WriteString(client, wsRequest)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade failed: %v %v", resp, err)
+	}
+	client.Write(wsFrameBytes(0x81, testMask, "my secret"))
+	_, got, err := readWSPayload(r)
+	if err != nil {
+		t.Fatalf("failed to read echoed frame: %v", err)
+	}
+	if got != "my public" {
+		t.Errorf("expected replaced payload, got %q", got)
+	}
+	client.Close()
+	<-done
+}
+
+func TestWebSocketFlushAtEOF(t *testing.T) {
+	// a remote that accepts the upgrade and reports everything after it
+	remote := listenLocal(t)
+	defer remote.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := remote.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		r := bufio.NewReader(c)
+		if _, err := http.ReadRequest(r); err != nil {
+			return
+		}
+		io.WriteString(c, wsResponse)
+		b, _ := ioutil.ReadAll(r)
+		received <- b
+	}()
+
+	client, done := startProxy(t, remote.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.DecodeWebSocket = true
+	})
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(client, wsRequest)
+	if _, err := http.ReadResponse(bufio.NewReader(client), nil); err != nil {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+	whole := wsFrameBytes(0x81, testMask, "first")
+	cut := wsFrameBytes(0x81, testMask, "second")[:5]
+	client.Write(append(append([]byte(nil), whole...), cut...))
+	client.(*net.TCPConn).CloseWrite()
+
+	select {
+	case got := <-received:
+		if want := append(whole, cut...); !bytes.Equal(got, want) {
+			t.Errorf("wanted every byte forwarded, %x, got %x", want, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("remote never got the frames")
+	}
+	client.Close()
+	<-done
+}
@@ -0,0 +1,207 @@
+//go:build !noyara
+// +build !noyara
+
+package proxy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	yara "github.com/hillu/go-yara/v4"
+)
+
+// YaraEnabled - Whether this build can scan with yara rules. Builds made
+// with the noyara tag leave out yara and its native library.
+const YaraEnabled = true
+
+// YaraRules, YaraScanner - The compiled rules and scanner types of this build
+type (
+	YaraRules   = yara.Rules
+	YaraScanner = yara.Scanner
+)
+
+// scanMem - Scan b with the proxy's scanner, with the scanner lock held
+func (p *Proxy) scanMem(b []byte) {
+	p.Scanner.ScanMem(b)
+}
+
+func (p *Proxy) rebuildScanner() {
+	p.Log.Info("rulefile updated, rebuilding scanner")
+	p.scannerLock.Lock()
+	defer p.scannerLock.Unlock()
+
+	path := p.Watcher.WatchList()[0]
+	r, err := os.Open(path)
+	if err != nil {
+		p.Log.Warn("failed to open yara rule file %s: %v", path, err)
+		return
+	}
+
+	rules, err := yara.ReadRules(r)
+	if err != nil {
+		p.Log.Warn("error reading yara rules in file %s: %v", path, err)
+		return
+	}
+
+	scanner, err := yara.NewScanner(rules)
+	if err != nil {
+		p.Log.Warn("failed to compile yara scanner for rules from file %s: %v", path, err)
+		return
+	}
+	p.Scanner = scanner
+}
+
+// RuleMatching - The yara scanner callback, run for every rule that matched
+// the chunk being scanned
+func (p *Proxy) RuleMatching(ctx *yara.ScanContext, rule *yara.Rule) (bool, error) {
+	p.handleMatch(p.ruleMatch(ctx, rule))
+
+	sub_value, ok := p.getSubstitution(rule.Metas())
+	if !ok {
+		return false, nil
+	}
+	for _, s := range rule.Strings() {
+		for _, match := range s.Matches(ctx) {
+			ofs := match.Offset()
+			l := len(match.Data())
+			p.replacements = append(p.replacements, matchLocation{
+				ofs,
+				l,
+				sub_value,
+			})
+		}
+	}
+	return false, nil
+}
+
+// ruleMatch - Describe a rule that matched the chunk being scanned
+func (p *Proxy) ruleMatch(ctx *yara.ScanContext, rule *yara.Rule) RuleMatch {
+	m := RuleMatch{
+		Rule:      rule.Identifier(),
+		Namespace: rule.Namespace(),
+		Tags:      rule.Tags(),
+		Meta:      make(map[string]interface{}),
+	}
+	for _, meta := range rule.Metas() {
+		m.Meta[meta.Identifier] = meta.Value
+	}
+	maxStrings, maxData := p.matchLimits()
+	for _, s := range rule.Strings() {
+		for _, match := range s.Matches(ctx) {
+			if len(m.Strings) >= maxStrings {
+				m.More++
+				continue
+			}
+			data := match.Data()
+			length := len(data)
+			if len(data) > maxData {
+				data = data[:maxData]
+			}
+			m.Strings = append(m.Strings, StringMatch{
+				Name:   s.Identifier(),
+				Offset: p.scanned + match.Offset(),
+				Data:   append([]byte(nil), data...),
+				Length: length,
+			})
+		}
+	}
+	return m
+}
+
+// matchLimits - How many string matches a RuleMatch keeps and how much of
+// each one's data
+func (p *Proxy) matchLimits() (n, size int) {
+	n, size = p.MaxMatchStrings, p.MaxMatchData
+	if n <= 0 {
+		n = DefaultMaxMatchStrings
+	}
+	if size <= 0 {
+		size = DefaultMaxMatchData
+	}
+	return n, size
+}
+
+func (p *Proxy) getSubstitution(metas []yara.Meta) ([]byte, bool) {
+	var replacement []byte
+	var err error
+	for _, meta := range metas {
+		if strings.ToLower(meta.Identifier) != "sub" {
+			continue
+		}
+		mvs, ok := meta.Value.(string)
+		if !ok {
+			p.Log.Warn("substitution metadata value should be a string")
+			continue
+		}
+		mvs_stripped := strings.TrimSpace(mvs)
+		if strings.HasPrefix(mvs_stripped, "{ ") && strings.HasSuffix(mvs, " }") {
+			bts_raw := strings.TrimRight(strings.TrimLeft(mvs_stripped, "{"), "}")
+			bts := strings.ReplaceAll(bts_raw, " ", "")
+			replacement, err = hex.DecodeString(bts)
+			if err != nil {
+				p.Log.Warn("failed to parse substitution value as yara hex bytes")
+				continue
+			}
+			return replacement, true
+		} else {
+			return []byte(mvs), true
+		}
+	}
+	return nil, false
+}
+
+// CompileYaraRules - Compile the yara rules in the given file. Any compiler
+// warnings are returned alongside the rules.
+func CompileYaraRules(filePath string) (*YaraRules, []string, error) {
+	cmp, err := yara.NewCompiler()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating yara compiler: %v", err)
+	}
+	// the rules outlive it
+	defer cmp.Destroy()
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open yara config file: %v", err)
+	}
+	defer f.Close()
+
+	if err := cmp.AddFile(f, "proxy"); err != nil {
+		return nil, nil, fmt.Errorf("error adding file to compiler: %v", err)
+	}
+	var warnings []string
+	for _, w := range cmp.Warnings {
+		warnings = append(warnings, fmt.Sprintf("%s:%d: %s", w.Filename, w.Line, w.Text))
+	}
+	rules, err := cmp.GetRules()
+	if err != nil {
+		return nil, warnings, fmt.Errorf("failed to get yara rules: %w", err)
+	}
+	return rules, warnings, nil
+}
+
+// SetYaraRules - Scan local data with the given compiled rules. Safe to call
+// while the proxy is running.
+func (p *Proxy) SetYaraRules(rules *YaraRules) error {
+	scanner, err := yara.NewScanner(rules)
+	if err != nil {
+		return fmt.Errorf("failed to create new yara scanner: %w", err)
+	}
+	scanner.SetCallback(p)
+
+	p.scannerLock.Lock()
+	p.Scanner = scanner
+	p.rules = rules
+	p.scannerLock.Unlock()
+	return nil
+}
+
+// RuleNames - The namespace:identifier of every rule in a compiled set
+func RuleNames(rules *YaraRules) []string {
+	var names []string
+	for _, r := range rules.GetRules() {
+		names = append(names, r.Namespace()+":"+r.Identifier())
+	}
+	return names
+}
@@ -0,0 +1,44 @@
+//go:build noyara
+// +build noyara
+
+package proxy
+
+import "errors"
+
+// YaraEnabled - Whether this build can scan with yara rules. Builds made
+// with the noyara tag leave out yara and its native library.
+const YaraEnabled = false
+
+// ErrYaraDisabled - Returned when yara rules are used in a noyara build
+var ErrYaraDisabled = errors.New("yara disabled in this build")
+
+// YaraRules, YaraScanner - Placeholders in noyara builds, where no rules can
+// be compiled and the scanner is always nil
+type (
+	YaraRules   struct{}
+	YaraScanner struct{}
+)
+
+// Destroy - Nothing to free in noyara builds
+func (r *YaraRules) Destroy() {}
+
+func (p *Proxy) scanMem(b []byte) {}
+
+func (p *Proxy) rebuildScanner() {
+	p.Log.Warn("rulefile updated, but %v", ErrYaraDisabled)
+}
+
+// CompileYaraRules - Always fails with ErrYaraDisabled
+func CompileYaraRules(filePath string) (*YaraRules, []string, error) {
+	return nil, nil, ErrYaraDisabled
+}
+
+// SetYaraRules - Always fails with ErrYaraDisabled
+func (p *Proxy) SetYaraRules(rules *YaraRules) error {
+	return ErrYaraDisabled
+}
+
+// RuleNames - Always empty
+func RuleNames(rules *YaraRules) []string {
+	return nil
+}
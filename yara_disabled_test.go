@@ -0,0 +1,45 @@
+//go:build noyara
+// +build noyara
+
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestYaraDisabled(t *testing.T) {
+	if YaraEnabled {
+		t.Fatal("YaraEnabled should be false in a noyara build")
+	}
+	path := filepath.Join(t.TempDir(), "rules.yar")
+	if err := ioutil.WriteFile(path, []byte("rule Foo\n{\n    condition:\n        true\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CompileYaraRules(path); !errors.Is(err, ErrYaraDisabled) {
+		t.Errorf("expected ErrYaraDisabled compiling rules, got %v", err)
+	}
+	p := &Proxy{Log: NullLogger{}}
+	if err := p.LoadYaraConfig(path); !errors.Is(err, ErrYaraDisabled) {
+		t.Errorf("expected ErrYaraDisabled loading rules, got %v", err)
+	}
+	if err := p.SetYaraRules(&YaraRules{}); !errors.Is(err, ErrYaraDisabled) {
+		t.Errorf("expected ErrYaraDisabled setting rules, got %v", err)
+	}
+}
+
+func TestProxyWithoutYara(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.SetReplacers([]Replacer{&StringReplacer{"foo", "bar"}})
+	})
+	if got := echoRoundTrip(t, client, "foo"); got != "bar" {
+		t.Errorf("expected replacers to work without yara, got %q", got)
+	}
+	client.Close()
+	<-done
+}
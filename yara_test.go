@@ -0,0 +1,368 @@
+//go:build !noyara
+// +build !noyara
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	yara "github.com/hillu/go-yara/v4"
+)
+
+var warningRules = `
+rule Slow
+{
+    strings:
+        $a = "a"
+
+    condition:
+        $a
+}
+
+rule Fine
+{
+    strings:
+        $b = "something longer"
+
+    condition:
+        $b
+}
+`
+
+// singleStringRule - A rule named name matching s
+func singleStringRule(name, s string) string {
+	return fmt.Sprintf(`
+rule %s
+{
+    strings:
+        $a = %q
+
+    condition:
+        $a
+}
+`, name, s)
+}
+
+func writeRules(t *testing.T, rules string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.yar")
+	if err := ioutil.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+	return path
+}
+
+func TestCompileYaraRulesWarnings(t *testing.T) {
+	path := writeRules(t, warningRules)
+
+	rules, warnings, err := CompileYaraRules(path)
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+	if len(warnings) == 0 {
+		t.Errorf("expected a compiler warning for a single byte string")
+	}
+	for _, w := range warnings {
+		if !strings.Contains(w, "$a") {
+			t.Errorf("unexpected warning %q", w)
+		}
+	}
+
+	var p Proxy
+	p.Log = NullLogger{}
+	if got := p.LoadedRules(); got != nil {
+		t.Errorf("no rules should be loaded yet, got %v", got)
+	}
+	if err := p.SetYaraRules(rules); err != nil {
+		t.Fatalf("failed to set rules: %v", err)
+	}
+	got := strings.Join(p.LoadedRules(), ",")
+	if got != "proxy:Slow,proxy:Fine" {
+		t.Errorf("unexpected loaded rules %s", got)
+	}
+}
+
+func TestActiveRulesSwap(t *testing.T) {
+	defer SetActiveRules(nil)
+	echo := startEcho(t)
+	defer echo.Close()
+	raddr := echo.Addr().(*net.TCPAddr)
+
+	oldRules, err := yara.Compile(singleStringRule("Old", "old"), nil)
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+	newRules, err := yara.Compile(singleStringRule("New", "new"), nil)
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+
+	SetActiveRules(oldRules)
+	if ActiveRules() != oldRules {
+		t.Fatalf("ActiveRules should return what was set")
+	}
+	var first, second *Proxy
+	client1, done1 := startProxy(t, raddr, func(p *Proxy) { first = p })
+	echoRoundTrip(t, client1, "x")
+
+	SetActiveRules(newRules)
+	client2, done2 := startProxy(t, raddr, func(p *Proxy) { second = p })
+	echoRoundTrip(t, client2, "x")
+
+	// the first connection is still open and keeps the rules it started with
+	echoRoundTrip(t, client1, "y")
+	if got := strings.Join(first.LoadedRules(), ","); got != "default:Old" {
+		t.Errorf("existing connection should keep the old rules, got %s", got)
+	}
+	if got := strings.Join(second.LoadedRules(), ","); got != "default:New" {
+		t.Errorf("new connection should use the new rules, got %s", got)
+	}
+
+	client1.Close()
+	client2.Close()
+	<-done1
+	<-done2
+}
+
+func TestRuleMatchOffsets(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	rules, err := yara.Compile(`
+rule Needle : log alert
+{
+    meta:
+        author = "tester"
+
+    strings:
+        $a = "needle"
+
+    condition:
+        $a
+}
+`, nil)
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+
+	matches := make(chan RuleMatch, 4)
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		if err := p.SetYaraRules(rules); err != nil {
+			t.Fatalf("failed to set rules: %v", err)
+		}
+		p.OnRuleMatch = func(m RuleMatch) { matches <- m }
+	})
+	echoRoundTrip(t, client, "0123456789")
+	echoRoundTrip(t, client, "hay needle hay")
+	client.Close()
+	<-done
+
+	var m RuleMatch
+	select {
+	case m = <-matches:
+	default:
+		t.Fatal("no rule match reported")
+	}
+	if m.Rule != "Needle" || strings.Join(m.Tags, ",") != "log,alert" {
+		t.Errorf("unexpected rule %s with tags %v", m.Rule, m.Tags)
+	}
+	if m.Meta["author"] != "tester" {
+		t.Errorf("wanted author meta, got %v", m.Meta)
+	}
+	if len(m.Strings) != 1 {
+		t.Fatalf("wanted one string match, got %d", len(m.Strings))
+	}
+	// offsets count from the start of the connection, not the chunk
+	if s := m.Strings[0]; s.Name != "$a" || s.Offset != 14 || string(s.Data) != "needle" {
+		t.Errorf("unexpected string match %+v", s)
+	}
+}
+
+func TestRuleMatchString(t *testing.T) {
+	m := RuleMatch{
+		Rule: "Big",
+		Tags: []string{"warn"},
+		Strings: []StringMatch{
+			{Name: "$a", Offset: 3, Data: []byte(strings.Repeat("x", 100))},
+		},
+	}
+	want := `Big (tags: warn): $a at 3 "` + strings.Repeat("x", maxLoggedMatch) + `"...`
+	if got := m.String(); got != want {
+		t.Errorf("wanted %s, got %s", want, got)
+	}
+}
+
+func TestRuleMatchLimits(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	rules, err := yara.Compile(singleStringRule("Many", "ab"), nil)
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+
+	matches := make(chan RuleMatch, 4)
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.MaxMatchStrings = 5
+		p.MaxMatchData = 1
+		if err := p.SetYaraRules(rules); err != nil {
+			t.Fatalf("failed to set rules: %v", err)
+		}
+		p.OnRuleMatch = func(m RuleMatch) { matches <- m }
+	})
+	echoRoundTrip(t, client, strings.Repeat("ab", 50))
+	client.Close()
+	<-done
+
+	var m RuleMatch
+	select {
+	case m = <-matches:
+	default:
+		t.Fatal("no rule match reported")
+	}
+	if len(m.Strings) != 5 || m.More != 45 {
+		t.Fatalf("wanted 5 string matches and 45 more, got %d and %d", len(m.Strings), m.More)
+	}
+	if s := m.Strings[4]; s.Offset != 8 || string(s.Data) != "a" || s.Length != 2 {
+		t.Errorf("unexpected string match %+v", s)
+	}
+	want := `Many: $a at 0 "a"..., $a at 2 "a"..., $a at 4 "a"..., $a at 6 "a"..., $a at 8 "a"..., +45 more matches`
+	if got := m.String(); got != want {
+		t.Errorf("wanted %s, got %s", want, got)
+	}
+}
+
+func init() {
+	benchConfigs = append(benchConfigs, benchConfig{"yara", func(b *testing.B, p *Proxy) {
+		rules, err := yara.Compile(singleStringRule("Needle", "needle"), nil)
+		if err != nil {
+			b.Fatalf("failed to compile rules: %v", err)
+		}
+		if err := p.SetYaraRules(rules); err != nil {
+			b.Fatalf("failed to set rules: %v", err)
+		}
+	}})
+}
+
+func TestScanLimitSkipsScan(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	rules, err := yara.Compile(dropRule, nil)
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+
+	// another connection holds the only slot
+	limit := NewScanLimiter(1, true)
+	limit.acquire()
+	defer limit.release()
+
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.ScanLimit = limit
+		if err := p.SetYaraRules(rules); err != nil {
+			t.Fatalf("failed to set rules: %v", err)
+		}
+	})
+	if got := echoRoundTrip(t, client, "something evil"); got != "something evil" {
+		t.Errorf("expected the unscanned chunk to be forwarded, got %q", got)
+	}
+	if limit.Skipped() != 1 {
+		t.Errorf("expected one skipped scan, got %d", limit.Skipped())
+	}
+	client.Close()
+	<-done
+}
+
+func TestNotifierOnMatch(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	rules, err := yara.Compile(`
+rule Logged: log
+{
+    strings:
+        $a = "needle"
+
+    condition:
+        $a
+}
+
+rule Quiet
+{
+    strings:
+        $a = "hay"
+
+    condition:
+        $a
+}
+`, nil)
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+
+	alerts := make(recordingNotifier, 4)
+	client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+		p.ID = 3
+		p.Notifier = alerts
+		if err := p.SetYaraRules(rules); err != nil {
+			t.Fatalf("failed to set rules: %v", err)
+		}
+	})
+	echoRoundTrip(t, client, "hay needle hay")
+	client.Close()
+	<-done
+
+	select {
+	case a := <-alerts:
+		if a.Rule != "Logged" || a.ID != 3 || a.Client == "" {
+			t.Errorf("unexpected alert %+v", a)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("notifier wasn't called")
+	}
+	select {
+	case a := <-alerts:
+		t.Errorf("only the rule tagged log should alert, got %+v", a)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMatchCounts(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	rules, err := yara.Compile(singleStringRule("Counted", "needle")+singleStringRule("Rare", "thread"), nil)
+	if err != nil {
+		t.Fatalf("failed to compile rules: %v", err)
+	}
+	before := MatchCounts()
+
+	var log bytes.Buffer
+	for i := 0; i < 2; i++ {
+		client, done := startProxy(t, echo.Addr().(*net.TCPAddr), func(p *Proxy) {
+			p.MatchLog = NewMatchLog(&log)
+			if err := p.SetYaraRules(rules); err != nil {
+				t.Fatalf("failed to set rules: %v", err)
+			}
+		})
+		echoRoundTrip(t, client, "needle")
+		echoRoundTrip(t, client, "hay needle")
+		client.Close()
+		<-done
+	}
+
+	after := MatchCounts()
+	if n := after["default:Counted"] - before["default:Counted"]; n != 4 {
+		t.Errorf("expected 4 matches of Counted across connections, got %d", n)
+	}
+	if n := after["default:Rare"] - before["default:Rare"]; n != 0 {
+		t.Errorf("Rare never matched, got %d", n)
+	}
+	if lines := strings.Count(log.String(), "\n"); lines != 4 {
+		t.Errorf("expected a match log line per match, got %d", lines)
+	}
+}